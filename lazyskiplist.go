@@ -3,285 +3,8505 @@ import "math/rand"
 import "fmt"
 import "time"
 import "sync"
-import "reflect"
+import "io"
+import "strings"
+import "flag"
+import "runtime"
+import "bytes"
+import "strconv"
+import "os"
+import "encoding/json"
+import "encoding/csv"
+import "math"
+import "math/bits"
+import "sync/atomic"
+import "context"
+import "cmp"
+import "math/big"
+import "unicode"
+import "unicode/utf8"
+import "encoding/binary"
+import "hash/maphash"
+import "hash/crc32"
+import "sort"
+import "bufio"
+import "regexp"
+import "path/filepath"
+import "text/tabwriter"
+import "runtime/pprof"
+import "unsafe"
+import "net/http"
+import "errors"
+import _ "net/http/pprof"
 
 const MAX_LEVEL int = 32
 const Prob float32 = 0.5
 
-func randomLevel() int {
-    level := 0
+// set with -debug, checks the locking protocol on every splice
+var debug = false
+
+/**
+called at the points where a badly timed interleaving does the most damage:
+between validation and splice, before fully_linked is set and between the
+logical and the physical delete. also called on every retry and lock wait,
+so a test scheduler can always switch goroutines there. nil outside of
+-chaos runs and tests
+**/
+var chaos func(point string)
+
+// tests replace this to pin tower heights
+var level_source = randomLevel
+
+func chaosDelay(point string) {
+    switch n := rand.Intn(100); {
+    case n < 20:
+        runtime.Gosched()
+    case n < 22:
+        time.Sleep(time.Duration(rand.Intn(50)) * time.Microsecond)
+    }
+}
+
+func randomLevel(max_level int, prob float32) int {
+    level := 1
     rand.Seed(time.Now().UnixNano())
-    for i := 0; i < MAX_LEVEL; i++ {
-        if rand.Float32() <= Prob {
+    for level < max_level {
+        if rand.Float32() <= prob {
             level++
         } else {
             return level
         }
     }
-    return level
+    return level
+}
+
+type Node[K any] struct {
+    key K
+    // read and overwritten atomically under withOnDuplicate(OVERWRITE)
+    item int64
+    // orders KEEP_BOTH duplicates by insertion, 0 otherwise
+    seq uint64
+    // 1 once the key was deleted with tombstone(), changed under lock
+    tombstoned int32
+    // the height the node was added with, and whether it was hit since the
+    // last maintain(), under withPromotion() only
+    base_level int
+    hot int32
+    top_level int
+    next []*Node[K]
+    marked bool
+    fully_linked bool
+    // nothing takes a node lock shared, so a plain mutex
+    lock sync.Mutex
+    // the lock word of spinLocker
+    spin int32
+    // set while moveRange() moves the node out of its list, or a copy of
+    // it in, the only writes to a node from another list
+    moving atomic.Pointer[moveRecord]
+    incoming bool
+    // a []V of appendValue() or a SyncMap's *syncValue, read and written under lock
+    values interface{}
+    // the list's change sequence at the last put() or tombstone() of the
+    // key, under withChangeTracking() only
+    changed uint64
+}
+
+func newNode[K any](key K, item, height int) *Node[K] {
+    new_node := Node[K]{
+        key: key, 
+        item: int64(item),
+        top_level: height,
+        marked: false,
+        fully_linked: false,
+        next: make([]*Node[K], height)}
+    return &new_node
+}
+
+/**
+a node for this list: out of the slab while it lasts, with room for
+max_level pointers under withPromotion()
+**/
+func (this *LazySkipList[K]) newNode(key K, item, height int) *Node[K] {
+    tower := height
+    if this.promote_every > 0 {
+        tower = this.max_level
+    }
+    if this.slab == nil {
+        node := newNode(key, item, height)
+        if tower > height {
+            node.next = make([]*Node[K], tower)
+        }
+        return node
+    }
+    node := this.slab.node()
+    node.key, node.item, node.top_level = key, int64(item), height
+    node.next = this.slab.tower(tower)
+    return node
+}
+
+/**
+nodes and tower pointers allocated up front by withCapacityHint(), handed
+out by bumping an index. a slab is one allocation to the garbage collector,
+freed only when none of its nodes is reachable any more, so removed nodes
+keep their slab alive while others from it are linked
+**/
+type nodeSlab[K any] struct {
+    nodes []Node[K]
+    towers []*Node[K]
+    used_nodes int64
+    used_towers int64
+}
+
+func newNodeSlab[K any](capacity int, prob float32) *nodeSlab[K] {
+    // a node has 1 / (1 - prob) pointers on average
+    return &nodeSlab[K]{
+        nodes: make([]Node[K], capacity),
+        towers: make([]*Node[K], int(float64(capacity) / (1 - float64(prob))))}
+}
+
+func (this *nodeSlab[K]) node() *Node[K] {
+    if i := atomic.AddInt64(&this.used_nodes, 1); i <= int64(len(this.nodes)) {
+        return &this.nodes[i - 1]
+    }
+    return &Node[K]{}
+}
+
+func (this *nodeSlab[K]) tower(height int) []*Node[K] {
+    if end := atomic.AddInt64(&this.used_towers, int64(height)); end <= int64(len(this.towers)) {
+        return this.towers[end - int64(height):end:end]
+    }
+    return make([]*Node[K], height)
+}
+
+// what is left of the slab, in bytes
+func (this *nodeSlab[K]) reserve() int64 {
+    nodes := max(int64(len(this.nodes)) - atomic.LoadInt64(&this.used_nodes), 0)
+    towers := max(int64(len(this.towers)) - atomic.LoadInt64(&this.used_towers), 0)
+    return nodes * int64(unsafe.Sizeof(Node[K]{})) + towers * int64(unsafe.Sizeof((*Node[K])(nil)))
+}
+
+func (this *Node[K]) loadItem() int {
+    return int(atomic.LoadInt64(&this.item))
+}
+
+func (this *Node[K]) isTombstone() bool {
+    return atomic.LoadInt32(&this.tombstoned) == 1
+}
+
+// fully linked, not marked, not a tombstone and not hidden by a move
+func (this *Node[K]) isLive() bool {
+    return this.fully_linked && !this.marked && !this.isTombstone() && !this.isHidden()
+}
+
+// on the side of a moveRange() commit where the node does not count yet, or any more
+func (this *Node[K]) isHidden() bool {
+    move := this.moving.Load()
+    return move != nil && (atomic.LoadInt32(&move.committed) == 1) != this.incoming
+}
+
+// what add() and put() do with a key that is already present
+type duplicatePolicy int
+
+const (
+    // set semantics, the existing entry is kept
+    REJECT duplicatePolicy = iota
+    // map semantics, the existing entry takes the new item
+    OVERWRITE
+    // multiset semantics, a new entry is linked after the equal ones
+    KEEP_BOTH
+)
+
+// what lookup() found
+type lookupResult int
+
+const (
+    // the key was never added, or was removed outright
+    ABSENT lookupResult = iota
+    FOUND
+    // a tombstone: the key was deleted here and older layers must not be consulted
+    DELETED
+)
+
+// which path put() took
+type putResult int
+
+const (
+    PUT_REJECTED putResult = iota
+    PUT_INSERTED
+    PUT_OVERWRITTEN
+    // inserted next to at least one entry with the same key
+    PUT_DUPLICATED
+    // nothing changed, the list was frozen
+    PUT_FROZEN
+    // nothing changed, withBackpressure() turned the write away
+    PUT_OVER_CAPACITY
+)
+
+func (this putResult) String() string {
+    return [...]string{"rejected", "inserted", "overwritten", "duplicated", "frozen", "over capacity"}[this]
+}
+
+// what add() reports: whether the put went in, as a new key or over an old one
+func (this putResult) added() bool {
+    return this != PUT_REJECTED && this != PUT_FROZEN && this != PUT_OVER_CAPACITY
+}
+
+// what put() does while the list is over withBackpressure()'s high-water mark
+type overflowPolicy int
+
+const (
+    // waits until removals bring the list down to the low-water mark
+    OVERFLOW_BLOCK overflowPolicy = iota
+    // returns PUT_OVER_CAPACITY until then
+    OVERFLOW_REJECT
+    // calls the shedding callback, which is to make room, and goes ahead
+    OVERFLOW_SHED
+)
+
+/**
+compare returns a negative number, zero or a positive number as a sorts
+before, equals or sorts after b. head and tail are told apart by identity,
+not by key, so they never compare against user keys
+**/
+type LazySkipList[K any] struct {
+    head  *Node[K]
+    tail *Node[K]
+    compare func(a, b K) int
+    // one past the highest level in use, where lookups start, see compact()
+    level int32
+    count shardedCounter
+    seq uint64
+    // nil unless withBloomFilter()
+    bloom *bloomState[K]
+    // nil unless withJumpTable()
+    jump *jumpState[K]
+    // 1 once freeze() was called
+    frozen int32
+    // odd while drain() or moveRange() has writes paused, see waitUnpaused()
+    pause_epoch uint32
+    // bumped by every drain() and rebuild()
+    drains uint32
+    // nil unless withMiddleware(), outermost first
+    chain []middleware[K]
+    // nil unless withSeed()
+    levels *seededLevels
+    // nil unless withCapacityHint()
+    slab *nodeSlab[K]
+    // nil unless withSlowOpThreshold()
+    slow *slowLog
+    // nil unless withWriteLimit()
+    limiter *tokenBucket
+    // nil unless withLocker(), then every node lock goes through it
+    locker nodeLocker[K]
+    // the last change stamped by touch()
+    changes uint64
+    // tombstones left since the last compactDeleted(), and 1 while one runs
+    new_tombstones int64
+    compacting int32
+    // tombstones unlinked by help() and by compactDeleted(), see repairs()
+    helped int64
+    compacted int64
+    // 1 from reaching the high-water mark until back under the low one
+    overloaded int32
+    // PRIORITY_HIGH operations in flight, see lane()
+    foreground int32
+    listOptions
+}
+
+type listOptions struct {
+    max_level int
+    prob float32
+    on_duplicate duplicatePolicy
+    decay_every int
+    promote_every int
+    eliminate bool
+    jump_level int
+    bloom_bits int
+    // a func(K) uint64, checked when the list is built
+    bloom_hash interface{}
+    // middleware[K]s, checked likewise
+    middleware []interface{}
+    // a func(a, b K) int, for newList()
+    order interface{}
+    seed int64
+    seeded bool
+    // a nodeLocker[K], checked when the list is built
+    locker interface{}
+    track_changes bool
+    compact_after int
+    capacity_hint int
+    slow_after time.Duration
+    slow_log io.Writer
+    no_read_help bool
+    high_water int
+    low_water int
+    overflow overflowPolicy
+    shed func(size int)
+    write_rate float64
+    write_burst int
+}
+
+type option func(*listOptions)
+
+// number of levels, defaults to MAX_LEVEL
+func withMaxLevel(max_level int) option {
+    return func(list *listOptions) {
+        list.max_level = max_level
+    }
+}
+
+// defaults to REJECT
+func withOnDuplicate(policy duplicatePolicy) option {
+    return func(list *listOptions) {
+        list.on_duplicate = policy
+    }
+}
+
+/**
+raise a node by one level on one in every successful contains(), and let
+maintain() lower nodes that were not hit since its last run by one level,
+down to their original height. every node then carries room for max_level
+pointers
+**/
+func withPromotion(every int) option {
+    return func(list *listOptions) {
+        list.promote_every = every
+    }
+}
+
+/**
+keep a Bloom filter over the keys with about bits_per_key bits per key, so
+lookups of absent keys mostly return before the descent. hash must agree
+with the list's order: keys that compare equal hash equal. the filter is
+rebuilt from level 0 once the list outgrows it or once removes reach half
+of what it was sized for
+**/
+func withBloomFilter[K any](bits_per_key int, hash func(K) uint64) option {
+    return func(list *listOptions) {
+        list.bloom_bits = bits_per_key
+        list.bloom_hash = hash
+    }
+}
+
+// a hash for withBloomFilter() on keys whose == matches their order
+func comparableHash[K comparable]() func(K) uint64 {
+    seed := maphash.MakeSeed()
+    return func(key K) uint64 {
+        return maphash.Comparable(seed, key)
+    }
+}
+
+/**
+keep a sorted array of the nodes linked at level (counted from 0), so that
+contains(), get() and ascend() binary search it and start descending there
+instead of walking the top levels from head. meant for lists of millions
+of keys, with level chosen to sample a few thousand of them. add() and
+remove() still descend from head, they need predecessors at every level
+**/
+func withJumpTable(level int) option {
+    return func(list *listOptions) {
+        list.jump_level = level
+    }
+}
+
+// let a FlatCombiningList cancel a put() against a remove() of the same key
+func withElimination() option {
+    return func(list *listOptions) {
+        list.eliminate = true
+    }
+}
+
+// chance of a node reaching the next level, defaults to Prob
+func withProbability(prob float32) option {
+    return func(list *listOptions) {
+        list.prob = prob
+    }
+}
+
+/**
+stamp every change to an item or tombstone with a list-wide sequence
+number, so backupSince() can write only what changed since the last
+backup. one shared counter bumped by every write, so not for lists that
+are written to hard by many goroutines
+**/
+func withChangeTracking() option {
+    return func(list *listOptions) {
+        list.track_changes = true
+    }
+}
+
+/**
+allocate nodes and their towers for about n entries when the list is built,
+so a burst of adds up to that many does not wait on the allocator. what is
+not handed out yet shows as memoryUsage().reserve
+**/
+func withCapacityHint(n int) option {
+    return func(list *listOptions) {
+        list.capacity_hint = n
+    }
+}
+
+/**
+log every put(), tombstone(), remove() and ascend() that takes longer than
+after to w, one line each with the key, the retries and the time taken.
+the writes are timed with putStats() and removeStats(), so bypass any
+middleware; an ascend() is timed with its callbacks
+**/
+func withSlowOpThreshold(after time.Duration, w io.Writer) option {
+    return func(list *listOptions) {
+        list.slow_after = after
+        list.slow_log = w
+    }
+}
+
+/**
+run compactDeleted() from the tombstone() call that leaves the after-th
+tombstone since the last run. for a list whose tombstones nothing reads:
+lookup() reports a purged key ABSENT rather than DELETED, so a memtable
+must keep its own until older layers are compacted. reads purge the
+tombstones they come across as well, see help()
+**/
+func withTombstoneCompaction(after int) option {
+    return func(list *listOptions) {
+        list.compact_after = after
+    }
+}
+
+/**
+backpressure for a list buffering a producer: once size() reaches high,
+put(), add() and the new entries of SyncMap and BTree apply policy until
+the list is down to low again, a low of 0 meaning empty. shed gets
+size() under OVERFLOW_SHED, is nil otherwise, and must not put() itself.
+counts keys rather than bytes, memoryUsage() walks the whole list. an
+overwrite is held back like an insert, tombstone() and bulk loads are not
+**/
+func withBackpressure(high, low int, policy overflowPolicy, shed func(size int)) option {
+    return func(list *listOptions) {
+        list.high_water = high
+        list.low_water = low
+        list.overflow = policy
+        list.shed = shed
+    }
+}
+
+/**
+lets writes through at per_second on average and up to burst at once,
+e.g. so a bulk loader sharing the list cannot crowd out reads. put(),
+tombstone(), remove() and every entry of insertSortedBatch() take a token
+and sleep until it is due
+**/
+func withWriteLimit(per_second float64, burst int) option {
+    return func(list *listOptions) {
+        list.write_rate = per_second
+        list.write_burst = burst
+    }
+}
+
+/**
+keeps reads from unlinking the tombstones they come across, so their
+latency stays flat, and runs compactDeleted() on a goroutine of its own
+instead of in the tombstone() call that triggers it
+**/
+func withoutReadHelping() option {
+    return func(list *listOptions) {
+        list.no_read_help = true
+    }
+}
+
+// the key order for newList(), needed unless K is a built-in ordered type
+func withCompare[K any](compare func(a, b K) int) option {
+    return func(list *listOptions) {
+        list.order = compare
+    }
+}
+
+/**
+draw tower heights from the list's own generator seeded with seed instead
+of level_source, so a list built from the same keys in the same order
+gets the same shape every time
+**/
+func withSeed(seed int64) option {
+    return func(list *listOptions) {
+        list.seed = seed
+        list.seeded = true
+    }
+}
+
+/**
+how a list locks and unlocks its nodes, state kept in the node. the
+default is the node's mutex without going through an interface; a
+spinLocker trades parking for spinning on short critical sections, an
+adaptiveLocker picks between the two as contention goes, and a test double can check every acquisition against the protocol. there is no
+reader-writer choice: nothing takes a node lock shared
+**/
+type nodeLocker[K any] interface {
+    lock(node *Node[K])
+    tryLock(node *Node[K]) bool
+    unlock(node *Node[K])
+}
+
+func withLocker[K any](locker nodeLocker[K]) option {
+    return func(list *listOptions) {
+        list.locker = locker
+    }
+}
+
+// the node's mutex, what a list does without withLocker()
+type mutexLocker[K any] struct{}
+
+func (mutexLocker[K]) lock(node *Node[K]) {
+    node.lock.Lock()
+}
+
+func (mutexLocker[K]) tryLock(node *Node[K]) bool {
+    return node.lock.TryLock()
+}
+
+func (mutexLocker[K]) unlock(node *Node[K]) {
+    node.lock.Unlock()
+}
+
+// a test-and-test-and-set lock on the node's spin word, yielding between attempts
+type spinLocker[K any] struct{}
+
+func (this spinLocker[K]) lock(node *Node[K]) {
+    for !this.tryLock(node) {
+        for atomic.LoadInt32(&node.spin) != 0 {
+            runtime.Gosched()
+        }
+    }
+}
+
+func (spinLocker[K]) tryLock(node *Node[K]) bool {
+    return atomic.CompareAndSwapInt32(&node.spin, 0, 1)
+}
+
+func (spinLocker[K]) unlock(node *Node[K]) {
+    if atomic.SwapInt32(&node.spin, 0) == 0 {
+        panic("unlock of unlocked node")
+    }
+}
+
+/**
+spins on the node's mutex for up to an adaptive number of attempts before
+parking on it. the budget doubles whenever spinning got the lock and
+halves whenever it had to park, so it settles high where writers hold
+locks briefly and low where they collide on long holds. the read/write
+mix does not come into it: reads take no node lock, so there is no shared
+mode to move hot nodes to, only the writers' contention to adapt to
+**/
+type adaptiveLocker[K any] struct {
+    budget int32
+}
+
+const ADAPTIVE_SPIN_MIN int32 = 1
+const ADAPTIVE_SPIN_MAX int32 = 1024
+
+func newAdaptiveLocker[K any]() *adaptiveLocker[K] {
+    return &adaptiveLocker[K]{budget: 16}
+}
+
+func (this *adaptiveLocker[K]) lock(node *Node[K]) {
+    // an uncontended lock says nothing about the budget
+    if node.lock.TryLock() {
+        return
+    }
+    budget := atomic.LoadInt32(&this.budget)
+    for i := int32(0); i < budget; i++ {
+        runtime.Gosched()
+        if node.lock.TryLock() {
+            if budget < ADAPTIVE_SPIN_MAX {
+                atomic.CompareAndSwapInt32(&this.budget, budget, budget * 2)
+            }
+            return
+        }
+    }
+    node.lock.Lock()
+    if budget > ADAPTIVE_SPIN_MIN {
+        atomic.CompareAndSwapInt32(&this.budget, budget, budget / 2)
+    }
+}
+
+func (*adaptiveLocker[K]) tryLock(node *Node[K]) bool {
+    return node.lock.TryLock()
+}
+
+func (*adaptiveLocker[K]) unlock(node *Node[K]) {
+    node.lock.Unlock()
+}
+
+// the attempts a contended lock() spins for now
+func (this *adaptiveLocker[K]) spinBudget() int {
+    return int(atomic.LoadInt32(&this.budget))
+}
+
+type seededLevels struct {
+    lock sync.Mutex
+    rng *rand.Rand
+}
+
+func (this *seededLevels) level(max_level int, prob float32) int {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    level := 1
+    for level < max_level && this.rng.Float32() <= prob {
+        level++
+    }
+    return level
+}
+
+// a tower height from level_source, or from the generator of withSeed()
+func (this *LazySkipList[K]) randomHeight() int {
+    if this.levels != nil {
+        return this.levels.level(this.max_level, this.prob)
+    }
+    return level_source(this.max_level, this.prob)
+}
+
+/**
+sees every get(), put(), remove() and contains() of the list as op
+(OP_GET, OP_ADD for put(), OP_REMOVE, OP_CONTAINS) with its key and, for
+put(), its item. it goes on by calling next, with the same arguments or
+others, or refuses the operation by returning without calling it. the
+caller gets whatever it returns. add() comes through as the put() it is
+**/
+type middleware[K any] func(op uint8, key K, item int, next func(key K, item int) opResult) opResult
+
+// an operation's result as middleware sees it: put() sets result, the others item and ok
+type opResult struct {
+    item int
+    ok bool
+    result putResult
+}
+
+/**
+runs every operation through mw, the first one outermost. repeated uses
+append, so each layer of a setup can add its own, e.g. audit logging
+around rejection rules around a shadow write to a second list
+**/
+func withMiddleware[K any](mw ...middleware[K]) option {
+    return func(list *listOptions) {
+        for _, m := range mw {
+            list.middleware = append(list.middleware, m)
+        }
+    }
+}
+
+// int keys, as used by the benchmarks
+func newLazySkipList(opts ...option) LazySkipList[int] {
+    return newListFunc(cmp.Compare[int], opts...)
+}
+
+// keys with a natural order: integers, floats and strings
+func newOrderedList[K cmp.Ordered](opts ...option) LazySkipList[K] {
+    return newListFunc(cmp.Compare[K], opts...)
+}
+
+// newOrderedList() with newList()'s checks on the options
+func newCheckedOrderedList[K cmp.Ordered](opts ...option) (LazySkipList[K], error) {
+    return newList[K](append(append([]option{}, opts...), withCompare(cmp.Compare[K]))...)
+}
+
+// keys that order themselves, e.g. netip.Addr
+type comparer[K any] interface {
+    Compare(other K) int
+}
+
+func newComparerList[K comparer[K]](opts ...option) LazySkipList[K] {
+    return newListFunc(func(a, b K) int { return a.Compare(b) }, opts...)
+}
+
+// the checks of newList() that do not depend on the key type, shared with the other list types
+func (this listOptions) validate() error {
+    switch {
+    case this.max_level < 1 || this.max_level > 64:
+        return fmt.Errorf("max level %d is not in [1, 64]", this.max_level)
+    case !(this.prob > 0 && this.prob < 1):
+        return fmt.Errorf("probability %v is not in (0, 1)", this.prob)
+    case this.bloom_bits < 0 || this.jump_level < 0 || this.promote_every < 0 || this.compact_after < 0 || this.capacity_hint < 0:
+        return fmt.Errorf("negative bloom bits, jump level, promotion rate, compaction threshold or capacity hint")
+    case this.slow_after > 0 && this.slow_log == nil:
+        return fmt.Errorf("withSlowOpThreshold() has no writer to log to")
+    case this.high_water > 0 && (this.low_water < 0 || this.low_water >= this.high_water):
+        return fmt.Errorf("low-water mark %d is not in [0, %d)", this.low_water, this.high_water)
+    case this.high_water > 0 && (this.overflow == OVERFLOW_SHED) != (this.shed != nil):
+        return fmt.Errorf("withBackpressure() takes a shedding callback with OVERFLOW_SHED and only then")
+    case this.write_rate < 0 || (this.write_rate > 0 && this.write_burst < 1):
+        return fmt.Errorf("write limit %v per second with a burst of %d", this.write_rate, this.write_burst)
+    case this.no_read_help && this.compact_after == 0:
+        return fmt.Errorf("withoutReadHelping() without withTombstoneCompaction(), reads never help")
+    case this.jump_level >= this.max_level:
+        return fmt.Errorf("jump level %d is not below max level %d", this.jump_level, this.max_level)
+    }
+    return nil
+}
+
+/**
+every setting as an option, the order included: withCompare(), or the
+natural order of the built-in integer, float and string types. unlike the
+other constructors it checks the options and returns an error for one out
+of range or of the wrong key type instead of panicking. there is no
+reclamation scheme to choose, nodes are reclaimed by the garbage collector
+**/
+func newList[K any](opts ...option) (LazySkipList[K], error) {
+    config := listOptions{max_level: MAX_LEVEL, prob: Prob}
+    for _, opt := range opts {
+        opt(&config)
+    }
+    compare := naturalOrder[K]()
+    if config.order != nil {
+        var ok bool
+        if compare, ok = config.order.(func(a, b K) int); !ok {
+            return LazySkipList[K]{}, fmt.Errorf("withCompare() takes a %T, not a %T", compare, config.order)
+        }
+    }
+    if compare == nil {
+        var zero K
+        return LazySkipList[K]{}, fmt.Errorf("%T keys have no natural order, use withCompare()", zero)
+    }
+    if err := config.validate(); err != nil {
+        return LazySkipList[K]{}, err
+    }
+    if _, ok := config.bloom_hash.(func(K) uint64); config.bloom_bits > 0 && !ok {
+        return LazySkipList[K]{}, fmt.Errorf("withBloomFilter() hash is a %T, not a func(%T) uint64", config.bloom_hash, *new(K))
+    }
+    for _, m := range config.middleware {
+        if _, ok := m.(middleware[K]); !ok {
+            return LazySkipList[K]{}, fmt.Errorf("withMiddleware() takes a middleware[%T], not a %T", *new(K), m)
+        }
+    }
+    if _, ok := config.locker.(nodeLocker[K]); config.locker != nil && !ok {
+        return LazySkipList[K]{}, fmt.Errorf("withLocker() takes a nodeLocker[%T], not a %T", *new(K), config.locker)
+    }
+    return newListFunc(compare, opts...), nil
+}
+
+// cmp.Compare for the built-in ordered key types, nil for any other
+func naturalOrder[K any]() func(a, b K) int {
+    var compare interface{}
+    switch any(*new(K)).(type) {
+    case int:
+        compare = cmp.Compare[int]
+    case int64:
+        compare = cmp.Compare[int64]
+    case int32:
+        compare = cmp.Compare[int32]
+    case uint:
+        compare = cmp.Compare[uint]
+    case uint64:
+        compare = cmp.Compare[uint64]
+    case uint32:
+        compare = cmp.Compare[uint32]
+    case float64:
+        compare = cmp.Compare[float64]
+    case float32:
+        compare = cmp.Compare[float32]
+    case string:
+        compare = cmp.Compare[string]
+    default:
+        return nil
+    }
+    return compare.(func(a, b K) int)
+}
+
+/**
+time.Time keys ordered by instant, whatever their location. the monotonic
+clock reading is stripped before comparing: it is not persisted, and two
+keys must not change order once read back without it
+**/
+func newTimeList(opts ...option) LazySkipList[time.Time] {
+    return newListFunc(compareTime, opts...)
+}
+
+func compareTime(a, b time.Time) int {
+    return a.Round(0).Compare(b.Round(0))
+}
+
+/**
+float64 score keys in a total order: -Inf < finite values < +Inf < NaN.
+-0 and +0 are the same key, and so are all NaNs
+**/
+func newFloatList(opts ...option) LazySkipList[float64] {
+    return newListFunc(compareFloat, opts...)
+}
+
+func compareFloat(a, b float64) int {
+    switch a_nan, b_nan := math.IsNaN(a), math.IsNaN(b); {
+    case a_nan && b_nan:
+        return 0
+    case a_nan:
+        return 1
+    case b_nan:
+        return -1
+    case a < b:
+        return -1
+    case a > b:
+        return 1
+    }
+    return 0
+}
+
+/**
+arbitrary-precision keys, e.g. 256-bit hashes. the list keeps the pointers
+it is given, so a key must not be modified once added, and nil is not a key
+**/
+func newBigIntList(opts ...option) LazySkipList[*big.Int] {
+    return newListFunc((*big.Int).Cmp, opts...)
+}
+
+/**
+string keys in case-insensitive order, so iteration matches what a user
+sees rather than byte order ("apple" < "Banana" < "cherry"). strings that
+differ only in case stay distinct keys, ordered by bytes. for locale rules
+and diacritics pass collate.New(tag).CompareString from golang.org/x/text
+to newListFunc instead
+**/
+func newFoldedList(opts ...option) LazySkipList[string] {
+    return newListFunc(compareFolded, opts...)
+}
+
+func compareFolded(a, b string) int {
+    for i, j := 0, 0; i < len(a) || j < len(b); {
+        if i == len(a) {
+            return -1
+        }
+        if j == len(b) {
+            return 1
+        }
+        r_a, n_a := utf8.DecodeRuneInString(a[i:])
+        r_b, n_b := utf8.DecodeRuneInString(b[j:])
+        if c := cmp.Compare(unicode.ToLower(r_a), unicode.ToLower(r_b)); c != 0 {
+            return c
+        }
+        i += n_a
+        j += n_b
+    }
+    return strings.Compare(a, b)
+}
+
+/**
+comparators over several fields of a composite key, e.g. ORDER BY score
+DESC, name ASC:
+
+    newListFunc(orderBy(
+        desc(func(r row) float64 { return r.score }),
+        asc(func(r row) string { return r.name })))
+
+later terms only break ties left by earlier ones
+**/
+func orderBy[K any](terms ...func(a, b K) int) func(a, b K) int {
+    return func(a, b K) int {
+        for _, term := range terms {
+            if c := term(a, b); c != 0 {
+                return c
+            }
+        }
+        return 0
+    }
+}
+
+func asc[K any, F cmp.Ordered](field func(K) F) func(a, b K) int {
+    return func(a, b K) int {
+        return cmp.Compare(field(a), field(b))
+    }
+}
+
+func desc[K any, F cmp.Ordered](field func(K) F) func(a, b K) int {
+    return func(a, b K) int {
+        return cmp.Compare(field(b), field(a))
+    }
+}
+
+// keys built with keyEncoder, ordered bytewise
+func newBytesList(opts ...option) LazySkipList[[]byte] {
+    return newListFunc(bytes.Compare, opts...)
+}
+
+type direction bool
+
+const (
+    ASCENDING direction = false
+    DESCENDING direction = true
+)
+
+/**
+serializes tuples into []byte keys whose bytewise order is the order of the
+tuples, so keys of different shapes can share one newBytesList and still be
+range-scanned by prefix. integers are big-endian with the sign bit flipped,
+floats also invert negative values (-0 sorts before +0), strings escape 0x00
+as 0x00 0xff and end in 0x00 0x01 so that no encoding is a prefix of
+another, and DESCENDING fields are stored with every byte inverted
+**/
+type keyEncoder struct {
+    buf []byte
+}
+
+func (this *keyEncoder) put(field []byte, dir direction) *keyEncoder {
+    if dir == DESCENDING {
+        for i := range field {
+            field[i] = ^field[i]
+        }
+    }
+    this.buf = append(this.buf, field...)
+    return this
+}
+
+func (this *keyEncoder) putUint64(v uint64, dir direction) *keyEncoder {
+    return this.put(binary.BigEndian.AppendUint64(nil, v), dir)
+}
+
+func (this *keyEncoder) putInt64(v int64, dir direction) *keyEncoder {
+    return this.putUint64(uint64(v) ^ 1 << 63, dir)
+}
+
+func (this *keyEncoder) putFloat64(v float64, dir direction) *keyEncoder {
+    b := math.Float64bits(v)
+    if b & (1 << 63) != 0 {
+        b = ^b
+    } else {
+        b |= 1 << 63
+    }
+    return this.putUint64(b, dir)
+}
+
+func (this *keyEncoder) putString(v string, dir direction) *keyEncoder {
+    field := make([]byte, 0, len(v) + 2)
+    for i := 0; i < len(v); i++ {
+        field = append(field, v[i])
+        if v[i] == 0 {
+            field = append(field, 0xff)
+        }
+    }
+    return this.put(append(field, 0, 1), dir)
+}
+
+func (this *keyEncoder) bytes() []byte {
+    return this.buf
+}
+
+// reads back the fields of a keyEncoder key, in order and with the same directions
+type keyDecoder struct {
+    buf []byte
+}
+
+func (this *keyDecoder) byteAt(i int, dir direction) byte {
+    if dir == DESCENDING {
+        return ^this.buf[i]
+    }
+    return this.buf[i]
+}
+
+func (this *keyDecoder) getUint64(dir direction) (uint64, error) {
+    if len(this.buf) < 8 {
+        return 0, fmt.Errorf("key truncated: %d bytes left for an 8 byte field", len(this.buf))
+    }
+    v := binary.BigEndian.Uint64(this.buf)
+    if dir == DESCENDING {
+        v = ^v
+    }
+    this.buf = this.buf[8:]
+    return v, nil
+}
+
+func (this *keyDecoder) getInt64(dir direction) (int64, error) {
+    v, err := this.getUint64(dir)
+    return int64(v ^ 1 << 63), err
+}
+
+func (this *keyDecoder) getFloat64(dir direction) (float64, error) {
+    b, err := this.getUint64(dir)
+    if b & (1 << 63) != 0 {
+        b &^= 1 << 63
+    } else {
+        b = ^b
+    }
+    return math.Float64frombits(b), err
+}
+
+func (this *keyDecoder) getString(dir direction) (string, error) {
+    field := []byte{}
+    for i := 0; i + 1 < len(this.buf); i++ {
+        b := this.byteAt(i, dir)
+        if b != 0 {
+            field = append(field, b)
+            continue
+        }
+        switch this.byteAt(i + 1, dir) {
+        case 0x01:
+            this.buf = this.buf[i + 2:]
+            return string(field), nil
+        case 0xff:
+            field = append(field, 0)
+            i++
+        default:
+            return "", fmt.Errorf("bad escape 0x00 0x%02x in string field", this.byteAt(i + 1, dir))
+        }
+    }
+    return "", fmt.Errorf("unterminated string field")
+}
+
+/**
+a counter spread over COUNTER_SHARDS cache lines, each add() going to a
+random one, so writers on different cores rarely touch the same line
+**/
+type shardedCounter struct {
+    shards []paddedCount
+    // the last sum() and when it was taken, for approx()
+    total int64
+    summed_at int64
+}
+
+// how stale approx() may be
+const SIZE_REFRESH time.Duration = time.Millisecond
+
+const COUNTER_SHARDS int = 32
+
+type paddedCount struct {
+    n int64
+    _ [56]byte
+}
+
+func newShardedCounter() shardedCounter {
+    return shardedCounter{shards: make([]paddedCount, COUNTER_SHARDS)}
+}
+
+func (this *shardedCounter) add(delta int64) {
+    atomic.AddInt64(&this.shards[rand.Intn(len(this.shards))].n, delta)
+}
+
+/**
+exact when no add() runs alongside, and otherwise off by at most the adds
+that overlap the sum: an add() that returned before sum() was called is
+always counted. never negative
+**/
+func (this *shardedCounter) sum() int64 {
+    total := int64(0)
+    for i := range this.shards {
+        total += atomic.LoadInt64(&this.shards[i].n)
+    }
+    total = max(total, 0)
+    atomic.StoreInt64(&this.total, total)
+    atomic.StoreInt64(&this.summed_at, time.Now().UnixNano())
+    return total
+}
+
+// the last sum() if it is younger than SIZE_REFRESH, a new one otherwise
+func (this *shardedCounter) approx() int64 {
+    if time.Now().UnixNano() - atomic.LoadInt64(&this.summed_at) < int64(SIZE_REFRESH) {
+        return atomic.LoadInt64(&this.total)
+    }
+    return this.sum()
+}
+
+func newListFunc[K any](compare func(a, b K) int, opts ...option) LazySkipList[K] {
+    var zero K
+    newList := LazySkipList[K]{
+        compare: compare,
+        level: 1,
+        count: newShardedCounter(),
+        listOptions: listOptions{
+            max_level: MAX_LEVEL,
+            prob: Prob}}
+    for _, opt := range opts {
+        opt(&newList.listOptions)
+    }
+    if newList.bloom_bits > 0 {
+        newList.bloom = &bloomState[K]{
+            hash: newList.bloom_hash.(func(K) uint64),
+            bits_per_key: newList.bloom_bits}
+        newList.bloom.current.Store(newBloomFilter(BLOOM_MIN_KEYS, newList.bloom_bits))
+    }
+    if newList.jump_level > 0 {
+        newList.jump = &jumpState[K]{level: newList.jump_level}
+        newList.jump.table.Store(&jumpTable[K]{})
+    }
+    for _, m := range newList.middleware {
+        newList.chain = append(newList.chain, m.(middleware[K]))
+    }
+    if newList.seeded {
+        newList.levels = &seededLevels{rng: rand.New(rand.NewSource(newList.seed))}
+    }
+    if newList.listOptions.locker != nil {
+        newList.locker = newList.listOptions.locker.(nodeLocker[K])
+    }
+    if newList.capacity_hint > 0 {
+        newList.slab = newNodeSlab[K](newList.capacity_hint, newList.prob)
+    }
+    if newList.slow_after > 0 {
+        newList.slow = &slowLog{after: newList.slow_after, w: newList.slow_log}
+    }
+    if newList.write_rate > 0 {
+        newList.limiter = &tokenBucket{rate: newList.write_rate, burst: float64(newList.write_burst), tokens: float64(newList.write_burst), last: time.Now()}
+    }
+    newList.head = newNode(zero, 0, newList.max_level)
+    newList.tail = newNode(zero, 0, newList.max_level)
+    
+    for i := 0; i < newList.max_level; i++ {
+        newList.head.next[i] = newList.tail
+    }
+    
+    return newList
+}
+
+// nodes are ordered by key, then by seq among equal keys
+func (this *LazySkipList[K]) before(node *Node[K], key K, seq uint64) bool {
+    if node == this.head {
+        return true
+    }
+    if node == this.tail {
+        return false
+    }
+    c := this.compare(node.key, key)
+    return c < 0 || (c == 0 && node.seq < seq)
+}
+
+func (this *LazySkipList[K]) hasKey(node *Node[K], key K) bool {
+    return node != this.head && node != this.tail && this.compare(node.key, key) == 0
+}
+
+func (this *LazySkipList[K]) label(node *Node[K]) string {
+    switch node {
+    case this.head:
+        return "head"
+    case this.tail:
+        return "tail"
+    }
+    return fmt.Sprint(node.key)
+}
+
+func (this *LazySkipList[K]) find(key K, seq uint64) (int, []*Node[K], []*Node[K]) {
+    return this.findFrom(key, seq, nil)
+}
+
+/**
+find() that may start each level at hint[l], the preds of an earlier
+search for a smaller key, instead of where the level above left off.
+a hint that is marked, was lowered out of the level or lies past key is
+ignored, so any hint gives the same answer, just not as fast
+**/
+func (this *LazySkipList[K]) findFrom(key K, seq uint64, hint []*Node[K]) (int, []*Node[K], []*Node[K]) {
+    return this.findCounted(key, seq, hint, nil)
+}
+
+// findFrom() counting the levels it searched and the nodes it stepped over into stats unless nil
+func (this *LazySkipList[K]) findCounted(key K, seq uint64, hint []*Node[K], stats *opStats) (int, []*Node[K], []*Node[K]) {
+    layer_found := -1
+    preds := make([]*Node[K], this.max_level + 1)
+    succs := make([]*Node[K], this.max_level + 1)
+    pred := this.head
+    // the levels above the active one hold head and tail only
+    level := this.activeLevel()
+    for l := this.max_level - 1; l >= level; l-- {
+        preds[l] = this.head
+        succs[l] = this.tail
+    }
+    for l := level - 1; l >= 0; l-- {
+        if hint != nil && hint[l] != nil && !hint[l].marked && l < hint[l].top_level && this.sortsBefore(pred, hint[l]) && this.before(hint[l], key, seq) {
+            pred = hint[l]
+        }
+        curr := pred.next[l]
+        for this.before(curr, key, seq) {
+            pred = curr
+            curr = pred.next[l]
+            if stats != nil {
+                stats.steps++
+            }
+        }
+        if stats != nil {
+            stats.levels++
+        }
+        if layer_found == -1 && this.hasKey(curr, key) && seq == curr.seq {
+            layer_found = l
+        }
+        preds[l] = pred
+        succs[l] = curr
+    }
+    return layer_found, preds, succs
+}
+
+/**
+the first node at or after key on level 0, like succs[0] of find(key, 0),
+for searches that need no other level. pred.next[0] is not read again:
+a node with a smaller key may have been linked after pred since
+**/
+func (this *LazySkipList[K]) descend(key K) *Node[K] {
+    pred, level := this.head, this.activeLevel() - 1
+    if this.jump != nil {
+        if start := this.jump.start(this, key); start != nil {
+            pred, level = start, this.jump.level
+        }
+    }
+    var curr *Node[K]
+    for l := level; l >= 0; l-- {
+        curr = pred.next[l]
+        for this.before(curr, key, 0) {
+            pred = curr
+            curr = pred.next[l]
+        }
+    }
+    return curr
+}
+
+// the first unmarked, fully linked, unhidden node with the key, nil if there is none
+func (this *LazySkipList[K]) firstLive(key K) *Node[K] {
+    if this.bloom != nil && !this.bloom.mayContain(key) {
+        return nil
+    }
+    for curr := this.descend(key); this.hasKey(curr, key); curr = curr.next[0] {
+        if curr.fully_linked && !curr.marked && !curr.isHidden() {
+            return curr
+        }
+    }
+    return nil
+}
+
+func (this *LazySkipList[K]) contains(x K) bool {
+    if this.chain != nil {
+        return this.through(0, OP_CONTAINS, x, 0).ok
+    }
+    return this.containsKey(x)
+}
+
+func (this *LazySkipList[K]) containsKey(x K) bool {
+    node := this.firstLive(x)
+    if node == nil {
+        return false
+    }
+    if node.isTombstone() {
+        this.help(node)
+        return false
+    }
+    if this.promote_every > 0 && rand.Intn(this.promote_every) == 0 {
+        atomic.StoreInt32(&node.hot, 1)
+        this.raise(node)
+    }
+    return true
+}
+
+/**
+links node into the level above its top under the same protocol as add():
+the node is locked like a victim, then the predecessor, and both are
+validated. gives up instead of retrying, promotion is only a hint
+**/
+func (this *LazySkipList[K]) raise(node *Node[K]) bool {
+    level := node.top_level
+    if level >= this.max_level {
+        return false
+    }
+    epoch := this.pauseEpoch()
+    _, preds, succs := this.find(node.key, node.seq)
+    pred := preds[level]
+    this.lockNode(node)
+    defer this.unlockNode(node)
+    // a node drained or rebuilt away before find() is not found by it
+    if succs[0] != node || node.marked || !node.fully_linked || node.top_level != level || this.isFrozen() || epoch % 2 == 1 || this.pauseEpoch() != epoch {
+        return false
+    }
+    this.lockNode(pred)
+    defer this.unlockNode(pred)
+    if pred.marked || level >= pred.top_level || pred.next[level] != succs[level] {
+        return false
+    }
+    this.grow(level + 1)
+    node.next[level] = succs[level]
+    pred.next[level] = node
+    node.top_level = level + 1
+    this.grow(level + 1)
+    return true
+}
+
+/**
+lookups start from the highest level a node was linked at rather than
+max_level, so a list that shrank from millions of entries to thousands
+stops walking the levels its tall nodes left behind. adds raise it before
+they link, and compact() lowers it again, which remove() calls when it
+unlinks a node as tall as the level. any level is correct to start from,
+every node is on all the levels below its top, so the level is only a
+hint and racing a lowering to a raise costs speed at worst. that holds
+for walks, not for find(), which takes head and tail as the preds and
+succs above the level: a taller add grows the level before it links and
+again after, and compact() looks for a link above a level it lowered to
+and grows back, so no linked node is left above it. head and tail
+keep their max_level towers: searches read them without locks, and at 16
+bytes a level they are not worth resizing under readers
+**/
+func (this *LazySkipList[K]) activeLevel() int {
+    return int(atomic.LoadInt32(&this.level))
+}
+
+func (this *LazySkipList[K]) grow(height int) {
+    for {
+        level := atomic.LoadInt32(&this.level)
+        if int32(height) <= level || atomic.CompareAndSwapInt32(&this.level, level, int32(height)) {
+            return
+        }
+    }
+}
+
+// lowers the active level to the highest one in use and returns it
+func (this *LazySkipList[K]) compact() int {
+    level := atomic.LoadInt32(&this.level)
+    used := int32(1)
+    for l := this.max_level - 1; l > 0; l-- {
+        if this.head.next[l] != this.tail {
+            used = int32(l + 1)
+            break
+        }
+    }
+    switch {
+    case used > level:
+        this.grow(int(used))
+    case used < level:
+        // an add that raised the level meanwhile wins
+        if !atomic.CompareAndSwapInt32(&this.level, level, used) {
+            break
+        }
+        // one that grew before the load and linked after the scan does too
+        for l := level - 1; l >= used; l-- {
+            if this.head.next[l] != this.tail {
+                this.grow(int(l) + 1)
+                break
+            }
+        }
+    }
+    return this.activeLevel()
+}
+
+// unlinks node from its top level, the reverse of raise()
+func (this *LazySkipList[K]) lower(node *Node[K]) bool {
+    level := node.top_level - 1
+    if level < node.base_level {
+        return false
+    }
+    epoch := this.pauseEpoch()
+    _, preds, _ := this.find(node.key, node.seq)
+    pred := preds[level]
+    this.lockNode(node)
+    defer this.unlockNode(node)
+    if node.marked || node.top_level != level + 1 || this.isFrozen() || epoch % 2 == 1 || this.pauseEpoch() != epoch {
+        return false
+    }
+    this.lockNode(pred)
+    defer this.unlockNode(pred)
+    if pred.marked || level >= pred.top_level || pred.next[level] != node {
+        return false
+    }
+    // readers already on node at this level still find their way on through node.next
+    pred.next[level] = node.next[level]
+    node.top_level = level
+    return true
+}
+
+/**
+lowers by one level every promoted node that was not hit since the last
+call and returns how many were lowered. safe to run alongside other
+operations, e.g. from a ticker
+**/
+func (this *LazySkipList[K]) maintain() int {
+    cold := []*Node[K]{}
+    for curr := this.head.next[0]; curr != this.tail; curr = curr.next[0] {
+        if atomic.SwapInt32(&curr.hot, 0) == 0 && curr.top_level > curr.base_level {
+            cold = append(cold, curr)
+        }
+    }
+    lowered := 0
+    for _, node := range cold {
+        if this.lower(node) {
+            lowered++
+        }
+    }
+    if lowered > 0 {
+        this.compact()
+    }
+    return lowered
+}
+
+// the item stored with key, the oldest one under KEEP_BOTH
+func (this *LazySkipList[K]) get(key K) (int, bool) {
+    if this.chain != nil {
+        r := this.through(0, OP_GET, key, 0)
+        return r.item, r.ok
+    }
+    item, result := this.lookup(key)
+    return item, result == FOUND
+}
+
+/**
+like get(), but tells a tombstone apart from a key that is not there, so a
+memtable reader knows whether to go on to older layers
+**/
+func (this *LazySkipList[K]) lookup(key K) (int, lookupResult) {
+    node := this.firstLive(key)
+    switch {
+    case node == nil:
+        return 0, ABSENT
+    case node.isTombstone():
+        this.help(node)
+        return 0, DELETED
+    }
+    return node.loadItem(), FOUND
+}
+
+func (this *LazySkipList[K]) add(x K) bool {
+    return this.put(x, 0).added()
+}
+
+func (this *LazySkipList[K]) put(x K, item int) putResult {
+    if this.chain != nil {
+        return this.through(0, OP_ADD, x, item).result
+    }
+    return this.store(x, item, false)
+}
+
+// op with the middleware from chain[i] inwards, the list itself after the last one
+func (this *LazySkipList[K]) through(i int, op uint8, key K, item int) opResult {
+    if i < len(this.chain) {
+        return this.chain[i](op, key, item, func(key K, item int) opResult {
+            return this.through(i + 1, op, key, item)
+        })
+    }
+    switch op {
+    case OP_GET:
+        item, result := this.lookup(key)
+        return opResult{item: item, ok: result == FOUND}
+    case OP_ADD:
+        return opResult{result: this.store(key, item, false)}
+    case OP_REMOVE:
+        return opResult{ok: this.removeKey(key)}
+    }
+    return opResult{ok: this.containsKey(key)}
+}
+
+/**
+deletes key by leaving a tombstone for lookup() to find, inserting one if
+the key is not there. returns whether a present key was deleted. meant for
+REJECT and OVERWRITE lists; under KEEP_BOTH the tombstone is one more entry
+**/
+func (this *LazySkipList[K]) tombstone(key K) bool {
+    result := this.store(key, 0, true)
+    if (result == PUT_OVERWRITTEN || result == PUT_INSERTED) && this.compact_after > 0 && atomic.AddInt64(&this.new_tombstones, 1) >= int64(this.compact_after) {
+        if this.no_read_help {
+            go this.compactDeleted()
+        } else {
+            this.compactDeleted()
+        }
+    }
+    return result == PUT_OVERWRITTEN
+}
+
+/**
+unlinks the tombstones through the usual remove path, each only if it is
+still one when its lock is taken, and returns how many went. marked nodes
+need no sweep: whoever marks a node holds its lock until it has unlinked
+it, so every marked node is on its way out already. one run at a time,
+a call while another runs returns 0
+**/
+func (this *LazySkipList[K]) compactDeleted() int {
+    if !atomic.CompareAndSwapInt32(&this.compacting, 0, 1) {
+        return 0
+    }
+    defer atomic.StoreInt32(&this.compacting, 0)
+    atomic.StoreInt64(&this.new_tombstones, 0)
+    still_tombstone := func(victim *Node[K]) bool {
+        return victim.isTombstone()
+    }
+    reclaimed := 0
+    for curr := this.head.next[0]; curr != this.tail; curr = curr.next[0] {
+        if curr.fully_linked && !curr.marked && !curr.isHidden() && curr.isTombstone() && this.unlink(curr.key, true, still_tombstone) {
+            reclaimed++
+        }
+    }
+    atomic.AddInt64(&this.compacted, int64(reclaimed))
+    return reclaimed
+}
+
+/**
+helping: a read that comes across a tombstone in a list that purges them
+unlinks it there and then, so tombstones on a hot search path go on the
+next read instead of lengthening every search until compactDeleted().
+skipped while writes are paused, for a read not to wait out a drain().
+marked nodes get no help: their remover holds the lock until it has
+unlinked them, so a snip from here would race with its splice, and no
+marked node outlives the remove() that marked it. tombstones are the
+logically deleted nodes that do stay on the search path
+**/
+func (this *LazySkipList[K]) help(node *Node[K]) {
+    if this.compact_after == 0 || this.no_read_help || !node.fully_linked || node.marked || node.isHidden() || !node.isTombstone() || this.pauseEpoch() % 2 == 1 {
+        return
+    }
+    if this.unlink(node.key, true, func(victim *Node[K]) bool {
+        return victim == node && victim.isTombstone()
+    }) {
+        atomic.AddInt64(&this.helped, 1)
+    }
+}
+
+// where the tombstones of a list with tombstone compaction went
+type repairStats struct {
+    // unlinked by reads, see help()
+    helped int64
+    // unlinked by compactDeleted()
+    compacted int64
+}
+
+func (this *LazySkipList[K]) repairs() repairStats {
+    return repairStats{atomic.LoadInt64(&this.helped), atomic.LoadInt64(&this.compacted)}
+}
+
+/**
+put() and tombstone(). a tombstone can always be overwritten, which brings
+the key back as PUT_INSERTED; tombstoning a present key reports
+PUT_OVERWRITTEN and tombstoning a tombstone PUT_REJECTED
+**/
+func (this *LazySkipList[K]) store(x K, item int, tombstone bool) putResult {
+    if this.high_water > 0 && !tombstone && !this.admit() {
+        return PUT_OVER_CAPACITY
+    }
+    if this.limiter != nil {
+        this.limiter.take()
+    }
+    if this.slow != nil {
+        start, stats := time.Now(), opStats{}
+        result, _ := this.storeCounted(x, item, tombstone, false, nil, &stats)
+        op := "put"
+        if tombstone {
+            op = "tombstone"
+        }
+        this.slow.check(op, x, stats.retries, start)
+        return result
+    }
+    result, _ := this.storeFrom(x, item, tombstone, false, nil)
+    return result
+}
+
+// how long a put() held back by OVERFLOW_BLOCK sleeps between looks at size()
+const BACKPRESSURE_POLL time.Duration = time.Millisecond
+
+/**
+whether a put() may go ahead under withBackpressure(), after waiting under
+OVERFLOW_BLOCK. a list that reached the high-water mark stays overloaded
+until it is down to the low one, so writers are not let back in one removal
+at a time. a frozen list lets the put() through to report PUT_FROZEN
+**/
+func (this *LazySkipList[K]) admit() bool {
+    if atomic.LoadInt32(&this.overloaded) == 0 {
+        if this.size() < this.high_water {
+            return true
+        }
+        atomic.StoreInt32(&this.overloaded, 1)
+    }
+    for size := this.size(); size > this.low_water && !this.isFrozen(); size = this.size() {
+        switch this.overflow {
+        case OVERFLOW_REJECT:
+            return false
+        case OVERFLOW_SHED:
+            this.shed(size)
+            if this.size() > this.low_water {
+                return true
+            }
+        default:
+            time.Sleep(BACKPRESSURE_POLL)
+        }
+    }
+    atomic.StoreInt32(&this.overloaded, 0)
+    return true
+}
+
+/**
+store() searching from hint, see findFrom(), returns the preds it found for
+the next hint. only_new rejects a present key whatever the policy
+**/
+func (this *LazySkipList[K]) storeFrom(x K, item int, tombstone, only_new bool, hint []*Node[K]) (putResult, []*Node[K]) {
+    return this.storeCounted(x, item, tombstone, only_new, hint, nil)
+}
+
+// storeFrom() adding up its work in stats unless nil
+func (this *LazySkipList[K]) storeCounted(x K, item int, tombstone, only_new bool, hint []*Node[K], stats *opStats) (putResult, []*Node[K]) {
+    if this.isFrozen() {
+        return PUT_FROZEN, hint
+    }
+    // the user's hash runs before any lock is taken, a panic in it leaves none held
+    var bloom_hash uint64
+    if this.bloom != nil {
+        bloom_hash = this.bloom.hash(x)
+    }
+    preds := make([]*Node[K], this.max_level)
+    succs := make([]*Node[K], this.max_level)
+    if stats != nil {
+        stats.retries = -1
+    }
+    for {
+        if stats != nil {
+            stats.retries++
+        }
+        epoch := this.waitUnpaused()
+        layer_found := -1
+        seq := uint64(0)
+        if this.on_duplicate == KEEP_BOTH {
+            seq = atomic.AddUint64(&this.seq, 1)
+        }
+        layer_found, preds, succs = this.findCounted(x, seq, hint, stats)
+        // a retry starts from head again, the hint may be what went stale
+        hint = nil
+        if layer_found != -1 {
+            node_found := succs[layer_found]
+            if !node_found.marked {
+                for !node_found.fully_linked {
+                    if chaos != nil {
+                        chaos("add:wait-linked")
+                    }
+                    runtime.Gosched()
+                }
+                if (this.on_duplicate == REJECT || only_new) && !tombstone && !node_found.isTombstone() {
+                    return PUT_REJECTED, preds
+                }
+                // a remover marks under the node lock, so an unmarked node stays in the list until we are done
+                this.lockCounted(node_found, stats)
+                if node_found.marked {
+                    this.unlockNode(node_found)
+                    continue
+                }
+                if this.isFrozen() {
+                    this.unlockNode(node_found)
+                    return PUT_FROZEN, preds
+                }
+                if this.pauseEpoch() != epoch {
+                    this.unlockNode(node_found)
+                    hint = nil
+                    continue
+                }
+                was_tombstone := node_found.isTombstone()
+                result := PUT_OVERWRITTEN
+                switch {
+                case tombstone && was_tombstone:
+                    result = PUT_REJECTED
+                case tombstone:
+                    atomic.StoreInt32(&node_found.tombstoned, 1)
+                    this.count.add(-1)
+                case was_tombstone:
+                    // the item goes in before the key reappears
+                    atomic.StoreInt64(&node_found.item, int64(item))
+                    atomic.StoreInt32(&node_found.tombstoned, 0)
+                    this.count.add(1)
+                    result = PUT_INSERTED
+                case this.on_duplicate == REJECT || only_new:
+                    result = PUT_REJECTED
+                default:
+                    atomic.StoreInt64(&node_found.item, int64(item))
+                }
+                if result != PUT_REJECTED {
+                    this.touch(node_found)
+                }
+                this.unlockNode(node_found)
+                return result, preds
+            }
+            if chaos != nil {
+                chaos("add:retry")
+            }
+            continue
+        }
+        locked := []*Node[K]{}
+        top_level := this.randomHeight()
+        var pred, succ, prev_pred *Node[K]
+        valid := true
+        for level := 0; valid && (level <= top_level - 1); level++ {
+            pred = preds[level]
+            succ = succs[level]
+            if pred != prev_pred {
+                this.lockCounted(pred, stats)
+                locked = append(locked, pred)
+                prev_pred = pred
+            }
+            
+            // pred may have been lowered out of this level since find()
+            valid = !pred.marked && !succ.marked && level < pred.top_level && pred.next[level] == succ
+        }
+        if !valid {
+            this.unlockAll(locked)
+            if chaos != nil {
+                chaos("add:retry")
+            }
+            continue
+        }
+        if this.isFrozen() {
+            this.unlockAll(locked)
+            return PUT_FROZEN, preds
+        }
+        // the preds may have been drained since find()
+        if this.pauseEpoch() != epoch {
+            this.unlockAll(locked)
+            continue
+        }
+        if debug {
+            this.checkSplice(x, seq, preds, succs, top_level)
+        }
+        if chaos != nil {
+            chaos("add:validated")
+        }
+        // the key goes into the filter before it can be found, see rebuildBloom()
+        if this.bloom != nil {
+            this.bloom.lock.RLock()
+            this.bloom.insertHash(bloom_hash)
+        }
+        new_node := this.newNode(x, item, top_level)
+        new_node.seq = seq
+        new_node.base_level = top_level
+        if tombstone {
+            new_node.tombstoned = 1
+        }
+        this.touch(new_node)
+        this.grow(top_level)
+        for level := 0; level <= top_level - 1; level++ {
+            new_node.next[level] = succs[level]
+        }  
+        for level := 0; level <= top_level - 1; level++ {
+            preds[level].next[level] = new_node
+        }
+        // a compact() may have lowered the level in between
+        this.grow(top_level)
+        if chaos != nil {
+            chaos("add:linked")
+        }
+        new_node.fully_linked = true
+        if this.bloom != nil {
+            this.bloom.lock.RUnlock()
+        }
+        if !tombstone {
+            this.count.add(1)
+        }
+        this.unlockAll(locked)
+        // size() reads every counter shard, so only a sample of adds checks it
+        if this.bloom != nil && rand.Intn(64) == 0 && int64(this.size()) > this.bloom.current.Load().capacity {
+            this.rebuildBloom()
+        }
+        if this.jump != nil {
+            this.jump.changed(this)
+        }
+        if this.hasKey(preds[0], x) {
+            return PUT_DUPLICATED, preds
+        }
+        return PUT_INSERTED, preds
+    }
+}
+
+func (this *LazySkipList[K]) remove(x K) bool {
+    if this.limiter != nil {
+        this.limiter.take()
+    }
+    if this.chain != nil {
+        return this.through(0, OP_REMOVE, x, 0).ok
+    }
+    return this.removeKey(x)
+}
+
+// remove() past the middleware, timed for withSlowOpThreshold() as store() is
+func (this *LazySkipList[K]) removeKey(x K) bool {
+    if this.slow != nil {
+        start := time.Now()
+        ok, stats := this.removeStats(x)
+        this.slow.check("remove", x, stats.retries, start)
+        return ok
+    }
+    return this.unlink(x, false, nil)
+}
+
+/**
+the work one write did, for finding the keys that writers fight over:
+returned by putStats() and removeStats(), which are put() and remove()
+without the middleware
+**/
+type opStats struct {
+    // times it started over, after a failed validation or a pause
+    retries int
+    // levels searched and nodes stepped over, over every search it made
+    levels int
+    steps int
+    // time spent taking node locks, waits for other writers included
+    lock_wait time.Duration
+}
+
+func (this *LazySkipList[K]) putStats(x K, item int) (putResult, opStats) {
+    stats := opStats{}
+    result, _ := this.storeCounted(x, item, false, false, nil, &stats)
+    return result, stats
+}
+
+func (this *LazySkipList[K]) removeStats(x K) (bool, opStats) {
+    stats := opStats{}
+    ok := this.unlinkCounted(x, false, nil, &stats)
+    return ok, stats
+}
+
+// where withSlowOpThreshold() writes
+type slowLog struct {
+    after time.Duration
+    w io.Writer
+    lock sync.Mutex
+}
+
+func (this *slowLog) check(op string, key interface{}, retries int, start time.Time) {
+    took := time.Since(start)
+    if took <= this.after {
+        return
+    }
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    fmt.Fprintf(this.w, "slow %s %v: %d retries, %v\n", op, key, retries, took)
+}
+
+// the writes' token bucket, see withWriteLimit()
+type tokenBucket struct {
+    lock sync.Mutex
+    rate float64
+    burst float64
+    tokens float64
+    last time.Time
+}
+
+/**
+takes a token and sleeps until it is due. writers queue up: taking a token
+ahead of time leaves the bucket in debt, which the next one waits out too
+**/
+func (this *tokenBucket) take() {
+    this.lock.Lock()
+    now := time.Now()
+    this.tokens = math.Min(this.burst, this.tokens + now.Sub(this.last).Seconds() * this.rate)
+    this.last = now
+    this.tokens--
+    wait := time.Duration(-this.tokens / this.rate * float64(time.Second))
+    this.lock.Unlock()
+    if wait > 0 {
+        time.Sleep(wait)
+    }
+}
+
+// lockNode() timed into stats unless nil
+func (this *LazySkipList[K]) lockCounted(node *Node[K], stats *opStats) {
+    if stats == nil {
+        this.lockNode(node)
+        return
+    }
+    start := time.Now()
+    this.lockNode(node)
+    stats.lock_wait += time.Since(start)
+}
+
+// why insert() and delete() did nothing, to test with errors.Is()
+var err_exists = errors.New("key exists")
+var err_not_found = errors.New("key not found")
+var err_frozen = errors.New("list is frozen")
+var err_timeout = errors.New("timed out waiting out a pause")
+var err_over_capacity = errors.New("list over capacity")
+
+// put() reporting a key REJECT kept as err_exists, nil for any other change
+func (this *LazySkipList[K]) insert(x K, item int) error {
+    switch this.put(x, item) {
+    case PUT_REJECTED:
+        return err_exists
+    case PUT_FROZEN:
+        return err_frozen
+    case PUT_OVER_CAPACITY:
+        return err_over_capacity
+    }
+    return nil
+}
+
+// remove() telling an absent key from a frozen list
+func (this *LazySkipList[K]) delete(x K) error {
+    if this.remove(x) {
+        return nil
+    }
+    if this.isFrozen() {
+        return err_frozen
+    }
+    return err_not_found
+}
+
+/**
+waits out a drain(), moveRange() or rename() in progress, err_timeout if ctx
+ends first. writes wait for pauses on their own; this only bounds the wait
+**/
+func (this *LazySkipList[K]) awaitUnpaused(ctx context.Context) error {
+    for this.pauseEpoch() % 2 == 1 {
+        if err := ctx.Err(); err != nil {
+            return fmt.Errorf("%w: %v", err_timeout, err)
+        }
+        runtime.Gosched()
+    }
+    return nil
+}
+
+/**
+insert() giving up with err_timeout if ctx ends while writes are paused,
+and with err_starved if it ends while a PRIORITY_LOW insert is yielding
+**/
+func (this *LazySkipList[K]) insertContext(ctx context.Context, x K, item int) error {
+    done, err := this.lane(ctx)
+    if err != nil {
+        return err
+    }
+    defer done()
+    if err := this.awaitUnpaused(ctx); err != nil {
+        return err
+    }
+    return this.insert(x, item)
+}
+
+func (this *LazySkipList[K]) deleteContext(ctx context.Context, x K) error {
+    done, err := this.lane(ctx)
+    if err != nil {
+        return err
+    }
+    defer done()
+    if err := this.awaitUnpaused(ctx); err != nil {
+        return err
+    }
+    return this.delete(x)
+}
+
+// which lane an operation given a context takes, see prioritized()
+type priority int
+
+const (
+    // neither waits nor is waited for, what a context without a priority gets
+    PRIORITY_NORMAL priority = iota
+    // latency-sensitive: PRIORITY_LOW operations back off while one is in flight
+    PRIORITY_HIGH
+    // bulk work that yields to PRIORITY_HIGH operations
+    PRIORITY_LOW
+)
+
+type priorityKey struct{}
+
+// ctx tagging the operations it is passed to with p
+func prioritized(ctx context.Context, p priority) context.Context {
+    return context.WithValue(ctx, priorityKey{}, p)
+}
+
+func priorityOf(ctx context.Context) priority {
+    p, _ := ctx.Value(priorityKey{}).(priority)
+    return p
+}
+
+// how long a PRIORITY_LOW operation first backs off, doubling up to LOW_BACKOFF_MAX
+const LOW_BACKOFF_MIN time.Duration = 50 * time.Microsecond
+const LOW_BACKOFF_MAX time.Duration = 5 * time.Millisecond
+
+var err_starved = errors.New("timed out yielding to high-priority operations")
+
+/**
+enters ctx's lane: a PRIORITY_HIGH operation is counted in flight until
+done() is called, a PRIORITY_LOW one first backs off for as long as any
+is, err_starved if ctx ends first. a steady stream of high-priority
+operations starves the low ones, so give those a deadline
+**/
+func (this *LazySkipList[K]) lane(ctx context.Context) (done func(), err error) {
+    switch priorityOf(ctx) {
+    case PRIORITY_HIGH:
+        atomic.AddInt32(&this.foreground, 1)
+        return func() { atomic.AddInt32(&this.foreground, -1) }, nil
+    case PRIORITY_LOW:
+        if err := this.yield(ctx); err != nil {
+            return nil, err
+        }
+    }
+    return func() {}, nil
+}
+
+func (this *LazySkipList[K]) yield(ctx context.Context) error {
+    for backoff := LOW_BACKOFF_MIN; atomic.LoadInt32(&this.foreground) > 0; backoff = min(backoff * 2, LOW_BACKOFF_MAX) {
+        select {
+        case <-ctx.Done():
+            return fmt.Errorf("%w: %v", err_starved, ctx.Err())
+        case <-time.After(backoff):
+        }
+    }
+    return nil
+}
+
+/**
+makes the list read-only: from then on put() returns PUT_FROZEN, add(),
+remove() and tombstone() return false and nodes are no longer promoted.
+writers check the flag under the locks they splice with, so once every
+node was locked and released here no write is still in flight, and
+every reader sees the final list
+**/
+func (this *LazySkipList[K]) freeze() {
+    atomic.StoreInt32(&this.frozen, 1)
+    this.lockNode(this.head)
+    this.unlockNode(this.head)
+    for curr := this.head.next[0]; curr != this.tail; curr = curr.next[0] {
+        this.lockNode(curr)
+        this.unlockNode(curr)
+    }
+}
+
+func (this *LazySkipList[K]) isFrozen() bool {
+    return atomic.LoadInt32(&this.frozen) == 1
+}
+
+func (this *LazySkipList[K]) pauseEpoch() uint32 {
+    return atomic.LoadUint32(&this.pause_epoch)
+}
+
+/**
+waits out a pause in progress and returns the epoch to check, under the
+locks a write splices with, that no pause started since
+**/
+func (this *LazySkipList[K]) waitUnpaused() uint32 {
+    for {
+        if epoch := this.pauseEpoch(); epoch % 2 == 0 {
+            return epoch
+        }
+        runtime.Gosched()
+    }
+}
+
+// true if this call paused writes, undone with resume()
+func (this *LazySkipList[K]) tryPause() bool {
+    epoch := this.pauseEpoch()
+    return epoch % 2 == 0 && atomic.CompareAndSwapUint32(&this.pause_epoch, epoch, epoch + 1)
+}
+
+func (this *LazySkipList[K]) resume() {
+    atomic.AddUint32(&this.pause_epoch, 1)
+}
+
+/**
+writes check the epoch under the locks they splice with, so once every node
+was locked and released after a pause none is still in flight
+**/
+func (this *LazySkipList[K]) flushWriters() {
+    this.lockNode(this.head)
+    this.unlockNode(this.head)
+    for curr := this.head.next[0]; curr != this.tail; curr = curr.next[0] {
+        this.lockNode(curr)
+        this.unlockNode(curr)
+    }
+}
+
+// the entries detached by drain(), handed out in key order
+type drained[K any] struct {
+    curr *Node[K]
+    tail *Node[K]
+}
+
+func (this *drained[K]) next() (K, int, bool) {
+    for ; this.curr != this.tail; this.curr = this.curr.next[0] {
+        if node := this.curr; !node.marked && !node.isTombstone() {
+            this.curr = node.next[0]
+            return node.key, node.loadItem(), true
+        }
+    }
+    var zero K
+    return zero, 0, false
+}
+
+/**
+detaches every node at once and returns them to iterate, leaving the list
+empty for new writes, e.g. to rotate a memtable. with writes paused and
+flushed, head is pointed at tail with nothing able to splice. a write is
+in the drained nodes or in the list afterwards, never both or neither.
+a frozen list is not drained, its iterator is empty
+**/
+func (this *LazySkipList[K]) drain() *drained[K] {
+    for !this.tryPause() {
+        runtime.Gosched()
+    }
+    defer this.resume()
+    if this.isFrozen() {
+        return &drained[K]{curr: this.tail, tail: this.tail}
+    }
+    this.flushWriters()
+    // no rebuild may publish a table of drained nodes once the empty one is in
+    if this.jump != nil {
+        for !atomic.CompareAndSwapInt32(&this.jump.rebuilding, 0, 1) {
+            runtime.Gosched()
+        }
+        this.jump.table.Store(&jumpTable[K]{})
+        atomic.StoreInt64(&this.jump.changes, 0)
+    }
+    first := this.head.next[0]
+    for l := range this.head.next {
+        this.head.next[l] = this.tail
+    }
+    this.compact()
+    if this.jump != nil {
+        atomic.StoreInt32(&this.jump.rebuilding, 0)
+    }
+    live := 0
+    for curr := first; curr != this.tail; curr = curr.next[0] {
+        if !curr.marked && !curr.isTombstone() {
+            live++
+        }
+    }
+    this.count.add(int64(-live))
+    if this.bloom != nil {
+        this.rebuildBloom()
+    }
+    // before resume(), for removers that find their victim drained
+    atomic.AddUint32(&this.drains, 1)
+    return &drained[K]{curr: first, tail: this.tail}
+}
+
+/**
+removes every entry, tombstones included, one at a time through the
+usual remove path, so readers and iterators never see a half-spliced
+list. not atomic: keys added while it runs may survive it. returns the
+number of entries it removed
+**/
+func (this *LazySkipList[K]) clear() int {
+    removed := 0
+    for curr := this.head.next[0]; curr != this.tail; curr = curr.next[0] {
+        if curr.fully_linked && !curr.marked && this.unlink(curr.key, true, nil) {
+            removed++
+        }
+    }
+    return removed
+}
+
+/**
+replaces every node with a fresh one, towers leveled as evenly as a skip
+list can be: with prob 1/2 every 2nd entry reaches level 2, every 4th level
+3 and so on. the entries are snapshotted and their nodes allocated without
+stopping anyone, writes going on against the old nodes meanwhile. they are
+merged in with writes paused: each new node takes its entry's current
+item, tombstone and values, entries removed since the snapshot are left
+out and ones added since get a node of random height. the new nodes are
+linked among themselves and head is pointed at them top level first, so a
+reader is wholly in the old nodes or in the new ones, and finds the same
+entries in either. false if a drain() came in between, leaving nothing to
+merge into
+**/
+func (this *LazySkipList[K]) rebuild() bool {
+    drains := atomic.LoadUint32(&this.drains)
+    base := max(int(math.Round(float64(1 / this.prob))), 2)
+    fresh := map[*Node[K]]*Node[K]{}
+    i := 0
+    for curr := this.head.next[0]; curr != this.tail; curr = curr.next[0] {
+        if !curr.fully_linked || curr.marked || curr.isHidden() {
+            continue
+        }
+        i++
+        height := 1
+        for n := i; n % base == 0 && height < this.max_level; n /= base {
+            height++
+        }
+        fresh[curr] = this.freshNode(curr, height)
+    }
+    for !this.tryPause() {
+        runtime.Gosched()
+    }
+    defer this.resume()
+    this.flushWriters()
+    if atomic.LoadUint32(&this.drains) != drains {
+        return false
+    }
+    firsts := make([]*Node[K], this.max_level)
+    lasts := make([]*Node[K], this.max_level)
+    for curr := this.head.next[0]; curr != this.tail; curr = curr.next[0] {
+        if !curr.fully_linked || curr.marked || curr.isHidden() {
+            continue
+        }
+        node := fresh[curr]
+        if node == nil {
+            node = this.freshNode(curr, this.randomHeight())
+        }
+        // what writes since the snapshot left, settled by the pause
+        node.item, node.tombstoned = atomic.LoadInt64(&curr.item), curr.tombstoned
+        node.values, node.changed = curr.values, curr.changed
+        for l := 0; l < node.top_level; l++ {
+            if lasts[l] == nil {
+                firsts[l] = node
+            } else {
+                lasts[l].next[l] = node
+            }
+            lasts[l] = node
+        }
+    }
+    // no table rebuild may publish old nodes once the new ones are in
+    if this.jump != nil {
+        for !atomic.CompareAndSwapInt32(&this.jump.rebuilding, 0, 1) {
+            runtime.Gosched()
+        }
+    }
+    for l := this.max_level - 1; l >= 0; l-- {
+        if lasts[l] == nil {
+            this.head.next[l] = this.tail
+            continue
+        }
+        lasts[l].next[l] = this.tail
+        this.head.next[l] = firsts[l]
+    }
+    this.compact()
+    if this.jump != nil {
+        atomic.StoreInt32(&this.jump.rebuilding, 0)
+        this.jump.rebuild(this)
+    }
+    // a remover that marked an old node gives up on it, as after a drain
+    atomic.AddUint32(&this.drains, 1)
+    return true
+}
+
+// an unlinked node for rebuild() to put in place of node
+func (this *LazySkipList[K]) freshNode(node *Node[K], height int) *Node[K] {
+    fresh := this.newNode(node.key, 0, height)
+    fresh.seq = node.seq
+    fresh.base_level = height
+    fresh.fully_linked = true
+    return fresh
+}
+
+/**
+adds delta to the key's item under its node lock and returns the new item,
+putting delta if the key is absent or a tombstone. two incrBy() calls that
+both find the key absent are settled like two add() calls, so neither
+increment is lost. under KEEP_BOTH the first duplicate is the counter, and
+racing creators can each add one. false if the list is frozen
+**/
+func (this *LazySkipList[K]) incrBy(key K, delta int) (int, bool) {
+    for {
+        epoch := this.waitUnpaused()
+        node := this.firstLive(key)
+        if node == nil {
+            switch result, _ := this.storeFrom(key, delta, false, true, nil); result {
+            case PUT_INSERTED, PUT_DUPLICATED:
+                return delta, true
+            case PUT_FROZEN:
+                return 0, false
+            }
+            // added since firstLive(), increment that one instead
+            continue
+        }
+        this.lockNode(node)
+        if node.marked || this.pauseEpoch() != epoch {
+            this.unlockNode(node)
+            continue
+        }
+        if this.isFrozen() {
+            this.unlockNode(node)
+            return 0, false
+        }
+        item := delta
+        if node.isTombstone() {
+            // the item goes in before the key reappears, as in put()
+            atomic.StoreInt64(&node.item, int64(item))
+            atomic.StoreInt32(&node.tombstoned, 0)
+            this.count.add(1)
+        } else {
+            item += node.loadItem()
+            atomic.StoreInt64(&node.item, int64(item))
+        }
+        this.touch(node)
+        this.unlockNode(node)
+        return item, true
+    }
+}
+
+/**
+appends v to the key's values under its node lock, creating the entry if it
+is absent or a tombstone, so concurrent collectors need no mutex of their
+own. the values live beside the item, which stays as it was; a list must
+hold values of one type. false if the list is frozen
+**/
+func appendValue[K, V any](list *LazySkipList[K], key K, v V) bool {
+    for {
+        epoch := list.waitUnpaused()
+        node := list.firstLive(key)
+        if node == nil {
+            if result, _ := list.storeFrom(key, 0, false, true, nil); result == PUT_FROZEN {
+                return false
+            }
+            // the entry exists now, ours or a racing collector's
+            continue
+        }
+        list.lockNode(node)
+        if node.marked || list.pauseEpoch() != epoch {
+            list.unlockNode(node)
+            continue
+        }
+        if list.isFrozen() {
+            list.unlockNode(node)
+            return false
+        }
+        if node.isTombstone() {
+            node.values = nil
+            atomic.StoreInt32(&node.tombstoned, 0)
+            list.count.add(1)
+        }
+        values, _ := node.values.([]V)
+        node.values = append(values, v)
+        list.touch(node)
+        list.unlockNode(node)
+        return true
+    }
+}
+
+// a copy of the values appendValue() collected for the key
+func valuesOf[K, V any](list *LazySkipList[K], key K) ([]V, bool) {
+    for {
+        node := list.firstLive(key)
+        if node == nil || node.isTombstone() {
+            return nil, false
+        }
+        list.lockNode(node)
+        if node.marked {
+            list.unlockNode(node)
+            continue
+        }
+        values, _ := node.values.([]V)
+        values = append([]V{}, values...)
+        list.unlockNode(node)
+        return values, true
+    }
+}
+
+/**
+reference counting on the items: inc() adds the key with a count of 1 or
+increments it, dec() decrements it and removes the key in the same step the
+count reaches 0, so a key is present exactly while its count is positive.
+a counting list holds nothing but counts, and should not be KEEP_BOTH
+**/
+func (this *LazySkipList[K]) inc(key K) (int, bool) {
+    return this.incrBy(key, 1)
+}
+
+// the count left, false if the key was absent or the list is frozen
+func (this *LazySkipList[K]) dec(key K) (int, bool) {
+    for {
+        epoch := this.waitUnpaused()
+        node := this.firstLive(key)
+        if node == nil || node.isTombstone() {
+            return 0, false
+        }
+        this.lockNode(node)
+        if node.marked || this.pauseEpoch() != epoch {
+            this.unlockNode(node)
+            continue
+        }
+        if this.isFrozen() {
+            this.unlockNode(node)
+            return 0, false
+        }
+        if count := node.loadItem() - 1; count > 0 {
+            atomic.StoreInt64(&node.item, int64(count))
+            this.touch(node)
+            this.unlockNode(node)
+            return count, true
+        }
+        this.unlockNode(node)
+        // the last reference: removed only if no inc() got in since
+        if this.unlink(key, false, func(victim *Node[K]) bool {
+            return victim == node && victim.loadItem() <= 1
+        }) {
+            return 0, true
+        }
+    }
+}
+
+// locks two distinct nodes, the later one first like every writer, in the order unlockAll() takes
+func (this *LazySkipList[K]) lockPair(a, b *Node[K]) []*Node[K] {
+    if this.sortsBefore(a, b) {
+        a, b = b, a
+    }
+    this.lockNode(a)
+    this.lockNode(b)
+    return []*Node[K]{a, b}
+}
+
+/**
+exchanges the items of two keys under both node locks. a reader of one key
+sees its old item or its new one; getPair() reads both under the same locks
+and so never sees one key swapped and the other not. false if either key is
+absent or the list is frozen
+**/
+func (this *LazySkipList[K]) swapValues(k1, k2 K) bool {
+    for {
+        epoch := this.waitUnpaused()
+        a, b := this.firstLive(k1), this.firstLive(k2)
+        if a == nil || b == nil || a.isTombstone() || b.isTombstone() {
+            return false
+        }
+        if a == b {
+            return true
+        }
+        locked := this.lockPair(a, b)
+        // a remove or a pause since firstLive() sends us back to look again
+        if a.marked || b.marked || this.pauseEpoch() != epoch {
+            this.unlockAll(locked)
+            continue
+        }
+        swapped := !this.isFrozen() && !a.isTombstone() && !b.isTombstone()
+        if swapped {
+            item := a.loadItem()
+            atomic.StoreInt64(&a.item, int64(b.loadItem()))
+            atomic.StoreInt64(&b.item, int64(item))
+            this.touch(a)
+            this.touch(b)
+        }
+        this.unlockAll(locked)
+        return swapped
+    }
+}
+
+// the items of two keys as of one instant, read under both node locks
+func (this *LazySkipList[K]) getPair(k1, k2 K) (int, int, bool) {
+    for {
+        a, b := this.firstLive(k1), this.firstLive(k2)
+        if a == nil || b == nil || a.isTombstone() || b.isTombstone() {
+            return 0, 0, false
+        }
+        if a == b {
+            return a.loadItem(), a.loadItem(), true
+        }
+        locked := this.lockPair(a, b)
+        if a.marked || b.marked {
+            this.unlockAll(locked)
+            continue
+        }
+        item1, item2 := a.loadItem(), b.loadItem()
+        this.unlockAll(locked)
+        return item1, item2, true
+    }
+}
+
+// shared by the nodes of one moveRange(), committed flips them all at once
+type moveRecord struct {
+    committed int32
+}
+
+/**
+moves the entries with lo <= key < hi to dst so that every reader sees
+each key in exactly one of the two lists: the entries are linked into dst
+hidden, and one store to the move's record shows them there and hides them
+here, before they are unlinked. writes to both lists are paused and
+flushed for the duration. a key dst already holds keeps dst's entry and
+this one is dropped; a key dst holds a tombstone for, or is removing,
+stays behind. tombstones are not moved. returns the number of entries
+that left this list, 0 if either list is frozen
+**/
+func (this *LazySkipList[K]) moveRange(dst *LazySkipList[K], lo, hi K) int {
+    if dst == this {
+        return 0
+    }
+    // never wait for one list while holding the other paused
+    for {
+        if this.tryPause() {
+            if dst.tryPause() {
+                break
+            }
+            this.resume()
+        }
+        runtime.Gosched()
+    }
+    defer this.resume()
+    defer dst.resume()
+    if this.isFrozen() || dst.isFrozen() {
+        return 0
+    }
+    this.flushWriters()
+    dst.flushWriters()
+    move := &moveRecord{}
+    leaving, inserted := 0, []*Node[K]{}
+    // until the commit a panicking compare or hash undoes the move: the
+    // hidden entries come out of dst and the ones here stay as they were
+    left := []*Node[K]{}
+    committed := false
+    defer func() {
+        if committed {
+            return
+        }
+        dst.unlinkMoved(move)
+        for _, node := range left {
+            node.moving.Store(nil)
+        }
+    }()
+    var hint []*Node[K]
+    for curr := this.descend(lo); this.before(curr, hi, 0); curr = curr.next[0] {
+        if !curr.isLive() {
+            continue
+        }
+        seq := uint64(0)
+        if dst.on_duplicate == KEEP_BOTH {
+            seq = atomic.AddUint64(&dst.seq, 1)
+        }
+        layer_found, preds, succs := dst.findFrom(curr.key, seq, hint)
+        hint = preds
+        if layer_found != -1 {
+            if !succs[layer_found].isLive() {
+                continue
+            }
+            // dropped, dst's entry was visible all along
+            curr.moving.Store(move)
+            left = append(left, curr)
+            leaving++
+            continue
+        }
+        top_level := dst.randomHeight()
+        new_node := dst.newNode(curr.key, curr.loadItem(), top_level)
+        new_node.values = curr.values
+        new_node.seq = seq
+        new_node.base_level = top_level
+        new_node.incoming = true
+        new_node.moving.Store(move)
+        new_node.fully_linked = true
+        dst.touch(new_node)
+        // the key goes into the filter before it can be found, see rebuildBloom()
+        if dst.bloom != nil {
+            h := dst.bloom.hash(curr.key)
+            dst.bloom.lock.RLock()
+            dst.bloom.insertHash(h)
+        }
+        dst.grow(top_level)
+        for level := 0; level < top_level; level++ {
+            new_node.next[level] = succs[level]
+            preds[level].next[level] = new_node
+        }
+        dst.grow(top_level)
+        if dst.bloom != nil {
+            dst.bloom.lock.RUnlock()
+        }
+        curr.moving.Store(move)
+        left = append(left, curr)
+        leaving++
+        inserted = append(inserted, new_node)
+    }
+    // where the range starts and ends on every level, so that nothing after
+    // the commit calls compare
+    _, preds, _ := this.find(lo, 0)
+    ends := make([]*Node[K], this.max_level)
+    for l := 0; l < this.max_level; l++ {
+        ends[l] = preds[l].next[l]
+        for this.before(ends[l], hi, 0) {
+            ends[l] = ends[l].next[l]
+        }
+    }
+    atomic.StoreInt32(&move.committed, 1)
+    committed = true
+    dst.count.add(int64(len(inserted)))
+    this.count.add(int64(-leaving))
+    for _, node := range inserted {
+        node.moving.Store(nil)
+    }
+    // unlink what left, on every level, stepping over nodes that stay
+    for l := 0; l < this.max_level; l++ {
+        pred := preds[l]
+        for curr := pred.next[l]; curr != ends[l]; curr = curr.next[l] {
+            if curr.moving.Load() == move {
+                curr.marked = true
+                pred.next[l] = curr.next[l]
+            } else {
+                pred = curr
+            }
+        }
+    }
+    if this.jump != nil {
+        this.jump.rebuild(this)
+    }
+    if dst.jump != nil {
+        dst.jump.rebuild(dst)
+    }
+    return leaving
+}
+
+// takes the nodes a moveRange() that never committed linked here back out, by identity
+func (this *LazySkipList[K]) unlinkMoved(move *moveRecord) {
+    for l := 0; l < this.max_level; l++ {
+        pred := this.head
+        for curr := pred.next[l]; curr != this.tail; curr = curr.next[l] {
+            if curr.moving.Load() == move {
+                curr.marked = true
+                pred.next[l] = curr.next[l]
+            } else {
+                pred = curr
+            }
+        }
+    }
+}
+
+/**
+moves the entry of old_key to new_key so that readers see exactly one of
+the two at every instant: the new node is linked hidden and the same kind
+of commit as moveRange() shows it and hides the old one. writes are
+paused and flushed meanwhile, a walk of the list, so this is for the
+occasional rename. false if old_key is absent, new_key has any entry,
+tombstones included, or the list is frozen
+**/
+func (this *LazySkipList[K]) rename(old_key, new_key K) bool {
+    for !this.tryPause() {
+        runtime.Gosched()
+    }
+    defer this.resume()
+    if this.isFrozen() {
+        return false
+    }
+    this.flushWriters()
+    old := this.firstLive(old_key)
+    if old == nil || old.isTombstone() {
+        return false
+    }
+    if this.compare(old_key, new_key) == 0 {
+        return true
+    }
+    if this.hasKey(this.descend(new_key), new_key) {
+        return false
+    }
+    seq := uint64(0)
+    if this.on_duplicate == KEEP_BOTH {
+        seq = atomic.AddUint64(&this.seq, 1)
+    }
+    _, preds, succs := this.find(new_key, seq)
+    // the old node's preds are found before anything changes, nothing after the commit calls compare
+    _, old_preds, _ := this.find(old.key, old.seq)
+    var h uint64
+    if this.bloom != nil {
+        h = this.bloom.hash(new_key)
+    }
+    move := &moveRecord{}
+    top_level := this.randomHeight()
+    new_node := this.newNode(new_key, old.loadItem(), top_level)
+    new_node.values = old.values
+    new_node.seq = seq
+    new_node.base_level = top_level
+    new_node.incoming = true
+    new_node.moving.Store(move)
+    new_node.fully_linked = true
+    this.touch(new_node)
+    if this.bloom != nil {
+        this.bloom.lock.RLock()
+        this.bloom.insertHash(h)
+    }
+    this.grow(top_level)
+    for level := 0; level < top_level; level++ {
+        new_node.next[level] = succs[level]
+        preds[level].next[level] = new_node
+    }
+    this.grow(top_level)
+    if this.bloom != nil {
+        this.bloom.lock.RUnlock()
+    }
+    old.moving.Store(move)
+    atomic.StoreInt32(&move.committed, 1)
+    new_node.moving.Store(nil)
+    old.marked = true
+    for level := 0; level < old.top_level; level++ {
+        // the new node may have gone in between
+        pred := old_preds[level]
+        for pred.next[level] != old {
+            pred = pred.next[level]
+        }
+        pred.next[level] = old.next[level]
+    }
+    if this.jump != nil {
+        this.jump.changed(this)
+    }
+    return true
+}
+
+/**
+remove(), and with tombstones also the tombstone of x. a non-nil when is
+asked under the victim's lock, before marking, whether to go ahead
+**/
+func (this *LazySkipList[K]) unlink(x K, tombstones bool, when func(victim *Node[K]) bool) bool {
+    return this.unlinkCounted(x, tombstones, when, nil)
+}
+
+// unlink() adding up its work in stats unless nil
+func (this *LazySkipList[K]) unlinkCounted(x K, tombstones bool, when func(victim *Node[K]) bool, stats *opStats) bool {
+    var victim *Node[K]
+    is_marked := false
+    // the epoch the victim's lock has been held in since marking it
+    victim_epoch := uint32(0)
+    drains := uint32(0)
+    top_level := -1
+    preds := make([]*Node[K], this.max_level)
+    succs := make([]*Node[K], this.max_level)
+    if this.bloom != nil && !this.bloom.mayContain(x) {
+        return false
+    }
+    if stats != nil {
+        stats.retries = -1
+    }
+    for {
+        if stats != nil {
+            stats.retries++
+        }
+        // a remover that marked holds the victim's lock, which flushWriters() waits for
+        epoch := victim_epoch
+        if !is_marked {
+            epoch = this.waitUnpaused()
+        }
+        layer_found := -1
+        seq := uint64(0)
+        if is_marked {
+            seq = victim.seq
+        } else if this.on_duplicate == KEEP_BOTH {
+            // pick one of the duplicates, then look for exactly that node
+            first := this.firstLive(x)
+            if first == nil {
+                return false
+            }
+            seq = first.seq
+        }
+        layer_found, preds, succs = this.findCounted(x, seq, nil, stats)
+        if layer_found != -1 {
+            victim = succs[layer_found]
+        }
+        if is_marked == true || (layer_found != -1 && victim.fully_linked && victim.top_level - 1 == layer_found && !victim.marked) {
+            if !is_marked {
+                this.lockCounted(victim, stats)
+                // raise() and lower() change top_level under the victim's lock
+                top_level = victim.top_level
+                if this.isFrozen() {
+                    this.unlockNode(victim)
+                    return false
+                }
+                if this.pauseEpoch() != epoch {
+                    this.unlockNode(victim)
+                    continue
+                }
+                tombstoned := victim.isTombstone()
+                if tombstoned && !tombstones {
+                    // already deleted, the tombstone stays for lookup()
+                    this.unlockNode(victim)
+                    return false
+                }
+                if (victim.marked) {
+                    this.unlockNode(victim)
+                    if this.on_duplicate == KEEP_BOTH {
+                        continue
+                    }
+                    return false
+                }
+                if when != nil && !when(victim) {
+                    this.unlockNode(victim)
+                    return false
+                }
+                victim.marked = true
+                is_marked = true
+                victim_epoch = epoch
+                drains = atomic.LoadUint32(&this.drains)
+                if !tombstoned {
+                    this.count.add(-1)
+                }
+                if chaos != nil {
+                    chaos("remove:marked")
+                }
+            }
+            locked := []*Node[K]{}
+            var pred, succ, prev_pred *Node[K]
+            valid := true
+            for level := 0; valid && (level <= top_level - 1); level++ {
+                pred = preds[level]
+                succ = succs[level]
+                if pred != prev_pred {
+                    this.lockCounted(pred, stats)
+                    locked = append(locked, pred)
+                    prev_pred = pred
+                }
+                valid = !pred.marked && level < pred.top_level && pred.next[level] == succ
+            }
+            if !valid {
+                this.unlockAll(locked)
+                if chaos != nil {
+                    chaos("remove:retry")
+                }
+                continue
+            }
+            // paused while marked: the pause waits for the victim's lock
+            if this.pauseEpoch() != victim_epoch {
+                this.unlockNode(victim)
+                this.unlockAll(locked)
+                victim_epoch = this.waitUnpaused()
+                // drained: the victim went with the others, and preds
+                // found from now on belong to the new list
+                if atomic.LoadUint32(&this.drains) != drains {
+                    return true
+                }
+                this.lockCounted(victim, stats)
+                continue
+            }
+            if debug {
+                this.checkUnlink(victim, preds, top_level)
+            }
+            if chaos != nil {
+                chaos("remove:validated")
+            }
+            for level := top_level - 1; level >= 0; level-- {
+                preds[level].next[level] = victim.next[level]
+            }
+            this.unlockNode(victim)
+            this.unlockAll(locked)
+            if top_level >= this.activeLevel() {
+                this.compact()
+            }
+            if this.bloom != nil {
+                filter := this.bloom.current.Load()
+                // sized for twice the keys it was built with, so half its capacity may never be removed
+                if atomic.AddInt64(&filter.removed, 1) > filter.capacity / 4 {
+                    this.rebuildBloom()
+                }
+            }
+            if this.jump != nil {
+                this.jump.changed(this)
+            }
+            return true
+        } else if this.on_duplicate == KEEP_BOTH && layer_found != -1 {
+            // the picked duplicate went away, another one may still be there
+            continue
+        } else if layer_found != -1 && victim.fully_linked && !victim.marked && victim.top_level - 1 != layer_found {
+            // raised or lowered since find()
+            continue
+        } else {
+            return false
+        }
+    }
+}
+
+/**
+the number of keys, read from every counter shard. exact once writes
+stop; with writes in flight it may miss the ones still running
+**/
+func (this *LazySkipList[K]) size() int {
+    return int(this.count.sum())
+}
+
+/**
+size() as of at most SIZE_REFRESH ago, usually a single load. for metrics
+and dashboards that poll often and do not need the latest write
+**/
+func (this *LazySkipList[K]) approxSize() int {
+    return int(this.count.approx())
+}
+
+// bytes held by a list, see memoryUsage()
+type memoryStats struct {
+    // linked nodes, tombstones and those being removed included, head and tail not
+    nodes int
+    // those nodes and their towers; keys and values pointing elsewhere are not counted
+    bytes int64
+    // allocated by withCapacityHint() and not handed out yet
+    reserve int64
+}
+
+// walks level 0, so a snapshot that writes in flight may or may not be in
+func (this *LazySkipList[K]) memoryUsage() memoryStats {
+    stats := memoryStats{}
+    node_size, pointer_size := int64(unsafe.Sizeof(Node[K]{})), int64(unsafe.Sizeof((*Node[K])(nil)))
+    for curr := this.head.next[0]; curr != this.tail; curr = curr.next[0] {
+        stats.nodes++
+        stats.bytes += node_size + int64(cap(curr.next)) * pointer_size
+    }
+    if this.slab != nil {
+        stats.reserve = this.slab.reserve()
+    }
+    return stats
+}
+
+// calls fn in key order for every present key in [lo, hi) until fn returns false
+func (this *LazySkipList[K]) ascend(lo, hi K, fn func(key K, item int) bool) {
+    if this.slow != nil {
+        defer this.slow.check("ascend", fmt.Sprintf("[%v, %v)", lo, hi), 0, time.Now())
+    }
+    this.ascendContext(context.Background(), lo, hi, fn)
+}
+
+// how many nodes a scan walks between looks at its context
+const SCAN_CHECK_EVERY int = 256
+
+var err_cancelled = errors.New("scan cancelled")
+
+/**
+ascend() that stops with err_cancelled once ctx ends, so a range over tens
+of millions of keys can be called off midway. ctx is looked at every
+SCAN_CHECK_EVERY nodes walked, dead ones included, so a stretch of
+tombstones cannot hold the caller either. fn itself is not interrupted.
+a PRIORITY_LOW scan also yields there to PRIORITY_HIGH operations, and a
+PRIORITY_HIGH one counts as in flight until it returns
+**/
+func (this *LazySkipList[K]) ascendContext(ctx context.Context, lo, hi K, fn func(key K, item int) bool) error {
+    done, err := this.lane(ctx)
+    if err != nil {
+        return err
+    }
+    defer done()
+    low := priorityOf(ctx) == PRIORITY_LOW
+    walked := 0
+    for curr := this.descend(lo); curr != this.tail && this.compare(curr.key, hi) < 0; curr = curr.next[0] {
+        if walked++; walked % SCAN_CHECK_EVERY == 0 {
+            if err := ctx.Err(); err != nil {
+                return fmt.Errorf("%w at %v: %v", err_cancelled, curr.key, err)
+            }
+            if low {
+                if err := this.yield(ctx); err != nil {
+                    return err
+                }
+            }
+        }
+        if curr.isLive() {
+            if !fn(curr.key, curr.loadItem()) {
+                return nil
+            }
+        } else {
+            // an unlinked node keeps its next, the walk goes on from it
+            this.help(curr)
+        }
+    }
+    return nil
+}
+
+/**
+how far a long scan got, to be saved, e.g. with encoding/json, and handed
+back to pick up after a restart instead of from the start. the scan
+resumes after Last, so with KEEP_BOTH the remaining duplicates of Last are
+skipped. Version is the persistentVersion read, 0 for a lazy list
+**/
+type scanCheckpoint[K any] struct {
+    Last K `json:"last"`
+    // false until the first key was delivered
+    Started bool `json:"started"`
+    Done bool `json:"done"`
+    Version uint64 `json:"version,omitempty"`
+}
+
+/**
+calls fn in key order from where cp left off until fn returns false or the
+keys run out, then Done is set. cp.Last is the key fn was called with by
+the time fn runs, so fn may save cp itself every so often
+**/
+func (this *LazySkipList[K]) resumeScan(cp *scanCheckpoint[K], fn func(key K, item int) bool) {
+    if cp.Done {
+        return
+    }
+    curr := this.head.next[0]
+    if cp.Started {
+        curr = this.descend(cp.Last)
+        for this.hasKey(curr, cp.Last) {
+            curr = curr.next[0]
+        }
+    }
+    for ; curr != this.tail; curr = curr.next[0] {
+        if !curr.isLive() {
+            continue
+        }
+        cp.Last, cp.Started = curr.key, true
+        if !fn(curr.key, curr.loadItem()) {
+            return
+        }
+    }
+    cp.Done = true
+}
+
+// stamps a change to node under its lock, or before it is linked, see withChangeTracking()
+func (this *LazySkipList[K]) touch(node *Node[K]) {
+    if this.track_changes {
+        atomic.StoreUint64(&node.changed, atomic.AddUint64(&this.changes, 1))
+    }
+}
+
+/**
+writes the entries put() or tombstone()d after change since as CSV, all of
+them for since 0, and returns the change the backup goes up to, the since
+of the next one. writes are paused just long enough to flush the ones in
+flight, so every change up to the returned one is in this backup or an
+earlier one; later ones may be too, applying them twice does no harm.
+remove() leaves nothing behind to back up: a list backed up this way
+deletes with tombstone(). format turns a key into its CSV field
+**/
+func (this *LazySkipList[K]) backupSince(since uint64, w io.Writer, format func(key K) string) (uint64, error) {
+    if !this.track_changes {
+        return 0, fmt.Errorf("backupSince() needs withChangeTracking()")
+    }
+    for !this.tryPause() {
+        runtime.Gosched()
+    }
+    this.flushWriters()
+    upto := atomic.LoadUint64(&this.changes)
+    this.resume()
+    out := csv.NewWriter(w)
+    out.Write([]string{"backup", strconv.FormatUint(since, 10), strconv.FormatUint(upto, 10)})
+    for curr := this.head.next[0]; curr != this.tail; curr = curr.next[0] {
+        if !curr.fully_linked || curr.marked || curr.isHidden() {
+            continue
+        }
+        if since > 0 && atomic.LoadUint64(&curr.changed) <= since {
+            continue
+        }
+        if curr.isTombstone() {
+            out.Write([]string{"tombstone", format(curr.key), ""})
+        } else {
+            out.Write([]string{"put", format(curr.key), strconv.Itoa(curr.loadItem())})
+        }
+    }
+    out.Flush()
+    return upto, out.Error()
+}
+
+/**
+applies a backup written by backupSince(), a full one and then each
+incremental one in order, and returns the change it went up to. parse
+turns a CSV field back into a key. under REJECT a put replaces the key by
+way of a tombstone, so this is for a list being restored rather than one
+being read; KEEP_BOTH lists would gain a duplicate per put
+**/
+func (this *LazySkipList[K]) applyBackup(r io.Reader, parse func(field string) (K, error)) (uint64, error) {
+    in := csv.NewReader(r)
+    in.FieldsPerRecord = 3
+    header, err := in.Read()
+    if err != nil {
+        return 0, err
+    }
+    if header[0] != "backup" {
+        return 0, fmt.Errorf("not a backup, starts with %q", header[0])
+    }
+    upto, err := strconv.ParseUint(header[2], 10, 64)
+    if err != nil {
+        return 0, fmt.Errorf("header: %v", err)
+    }
+    for {
+        record, err := in.Read()
+        if err == io.EOF {
+            return upto, nil
+        }
+        if err != nil {
+            return 0, err
+        }
+        key, err := parse(record[1])
+        if err != nil {
+            line, _ := in.FieldPos(1)
+            return 0, fmt.Errorf("line %d: %v", line, err)
+        }
+        switch record[0] {
+        case "put":
+            item, err := strconv.Atoi(record[2])
+            if err != nil {
+                return 0, fmt.Errorf("key %s: %v", record[1], err)
+            }
+            if this.on_duplicate == REJECT {
+                this.tombstone(key)
+            }
+            this.store(key, item, false)
+        case "tombstone":
+            this.tombstone(key)
+        default:
+            return 0, fmt.Errorf("key %s: unknown operation %q", record[1], record[0])
+        }
+        if this.isFrozen() {
+            return 0, err_frozen
+        }
+    }
+}
+
+/**
+the entries in key order, one per call until ok is false. a lazy list is
+read as it goes, so this is no snapshot unless the list is frozen or
+otherwise left alone meanwhile
+**/
+func (this *LazySkipList[K]) cursor() func() (key K, item int, ok bool) {
+    curr := this.head
+    return func() (K, int, bool) {
+        for curr != this.tail {
+            curr = curr.next[0]
+            if curr != this.tail && curr.isLive() {
+                return curr.key, curr.loadItem(), true
+            }
+        }
+        var zero K
+        return zero, 0, false
+    }
+}
+
+// a key in both snapshots, with different items
+type changedEntry[K any] struct {
+    key K
+    from, to int
+}
+
+// what it takes to get from snapshot a to snapshot b
+type snapshotDiff[K any] struct {
+    added []entry[K]
+    removed []entry[K]
+    changed []changedEntry[K]
+}
+
+func (this snapshotDiff[K]) empty() bool {
+    return len(this.added) == 0 && len(this.removed) == 0 && len(this.changed) == 0
+}
+
+/**
+compares two snapshots by walking both in key order side by side, once
+each. a and b are cursors as cursor() returns them, over two versions of a
+PersistentSkipList, a frozen list, a backup loaded back, or any of these
+against another, all in the order of compare
+**/
+func diffSnapshots[K any](compare func(a, b K) int, a, b func() (K, int, bool)) snapshotDiff[K] {
+    diff := snapshotDiff[K]{}
+    key_a, item_a, ok_a := a()
+    key_b, item_b, ok_b := b()
+    for ok_a || ok_b {
+        c := 0
+        switch {
+        case !ok_a:
+            c = 1
+        case !ok_b:
+            c = -1
+        default:
+            c = compare(key_a, key_b)
+        }
+        switch {
+        case c < 0:
+            diff.removed = append(diff.removed, entry[K]{key: key_a, item: item_a})
+            key_a, item_a, ok_a = a()
+        case c > 0:
+            diff.added = append(diff.added, entry[K]{key: key_b, item: item_b})
+            key_b, item_b, ok_b = b()
+        default:
+            if item_a != item_b {
+                diff.changed = append(diff.changed, changedEntry[K]{key: key_a, from: item_a, to: item_b})
+            }
+            key_a, item_a, ok_a = a()
+            key_b, item_b, ok_b = b()
+        }
+    }
+    return diff
+}
+
+// one line per difference: + and - for added and removed entries, ~ for changed ones
+func writeDiff[K any](w io.Writer, diff snapshotDiff[K]) error {
+    out := bufio.NewWriter(w)
+    for _, e := range diff.removed {
+        fmt.Fprintf(out, "- %v %d\n", e.key, e.item)
+    }
+    for _, e := range diff.added {
+        fmt.Fprintf(out, "+ %v %d\n", e.key, e.item)
+    }
+    for _, e := range diff.changed {
+        fmt.Fprintf(out, "~ %v %d -> %d\n", e.key, e.from, e.to)
+    }
+    return out.Flush()
+}
+
+// a full backup of an int-keyed list, as the -diff mode reads it
+func loadBackup(name string) (LazySkipList[int], error) {
+    list := newLazySkipList(withOnDuplicate(OVERWRITE))
+    f, err := os.Open(name)
+    if err != nil {
+        return list, err
+    }
+    defer f.Close()
+    if _, err := list.applyBackup(f, strconv.Atoi); err != nil {
+        return list, fmt.Errorf("%s: %v", name, err)
+    }
+    return list, nil
+}
+
+/**
+writes sorted key/value pairs as a block-based table in the legacy footer
+format (format_version 0) that both RocksDB and Pebble still read, with a
+full bloom filter over the user keys and the properties IngestExternalFile
+looks for. every key goes in at sequence number 0 as a put, as an
+SstFileWriter file does, and the store assigns the global one on ingestion
+**/
+type sstWriter struct {
+    w io.Writer
+    offset uint64
+    data sstBlock
+    last []byte
+    index sstBlock
+    key_hashes []uint32
+    entries, data_blocks uint64
+    data_size, raw_key_size, raw_value_size uint64
+}
+
+const sst_block_size int = 4096
+const sst_restart_interval int = 16
+const sst_bloom_bits_per_key int = 10
+const sst_legacy_magic uint64 = 0xdb4775248b80fb57
+
+// offset and size of a block, not counting its 5 byte trailer
+type sstHandle struct {
+    offset, size uint64
+}
+
+func (this sstHandle) encode(dst []byte) []byte {
+    dst = binary.AppendUvarint(dst, this.offset)
+    return binary.AppendUvarint(dst, this.size)
+}
+
+// a block of prefix-compressed entries with a restart point every sst_restart_interval
+type sstBlock struct {
+    buf []byte
+    restarts []uint32
+    count int
+    prev []byte
+}
+
+func (this *sstBlock) add(key, value []byte) {
+    shared := 0
+    if this.count % sst_restart_interval == 0 {
+        this.restarts = append(this.restarts, uint32(len(this.buf)))
+    } else {
+        for shared < len(key) && shared < len(this.prev) && key[shared] == this.prev[shared] {
+            shared++
+        }
+    }
+    this.buf = binary.AppendUvarint(this.buf, uint64(shared))
+    this.buf = binary.AppendUvarint(this.buf, uint64(len(key) - shared))
+    this.buf = binary.AppendUvarint(this.buf, uint64(len(value)))
+    this.buf = append(this.buf, key[shared:]...)
+    this.buf = append(this.buf, value...)
+    this.prev = append(this.prev[:0], key...)
+    this.count++
+}
+
+func (this *sstBlock) finish() []byte {
+    if len(this.restarts) == 0 {
+        this.restarts = append(this.restarts, 0)
+    }
+    for _, r := range this.restarts {
+        this.buf = binary.LittleEndian.AppendUint32(this.buf, r)
+    }
+    return binary.LittleEndian.AppendUint32(this.buf, uint32(len(this.restarts)))
+}
+
+func (this *sstBlock) reset() {
+    this.buf, this.restarts, this.count = this.buf[:0], this.restarts[:0], 0
+}
+
+func newSSTWriter(w io.Writer) *sstWriter {
+    return &sstWriter{w: w}
+}
+
+/**
+adds a put of key, which has to sort after the last one bytewise: RocksDB
+and Pebble compare user keys as bytes, and an SST holds each at most once
+**/
+func (this *sstWriter) add(key, value []byte) error {
+    if this.entries > 0 && bytes.Compare(key, this.last) <= 0 {
+        return fmt.Errorf("sst: key %q does not sort after %q", key, this.last)
+    }
+    internal := append(append([]byte(nil), key...), 1, 0, 0, 0, 0, 0, 0, 0)
+    this.data.add(internal, value)
+    this.last = append(this.last[:0], key...)
+    this.key_hashes = append(this.key_hashes, sstBloomHash(key))
+    this.entries++
+    this.raw_key_size += uint64(len(internal))
+    this.raw_value_size += uint64(len(value))
+    if len(this.data.buf) >= sst_block_size {
+        return this.flushData()
+    }
+    return nil
+}
+
+// writes out the data block and indexes it under its last internal key
+func (this *sstWriter) flushData() error {
+    if this.data.count == 0 {
+        return nil
+    }
+    last := append([]byte(nil), this.data.prev...)
+    handle, err := this.writeBlock(this.data.finish())
+    if err != nil {
+        return err
+    }
+    this.data.reset()
+    this.data_blocks++
+    this.data_size += handle.size + 5
+    this.index.add(last, handle.encode(nil))
+    return nil
+}
+
+// writes a block uncompressed, with its trailer: the type byte and a masked crc32c
+func (this *sstWriter) writeBlock(block []byte) (sstHandle, error) {
+    handle := sstHandle{this.offset, uint64(len(block))}
+    crc := crc32.Update(crc32.Checksum(block, sst_crc_table), sst_crc_table, []byte{0})
+    trailer := binary.LittleEndian.AppendUint32([]byte{0}, (crc >> 15 | crc << 17) + 0xa282ead8)
+    if _, err := this.w.Write(block); err != nil {
+        return handle, err
+    }
+    if _, err := this.w.Write(trailer); err != nil {
+        return handle, err
+    }
+    this.offset += uint64(len(block) + len(trailer))
+    return handle, nil
+}
+
+var sst_crc_table = crc32.MakeTable(crc32.Castagnoli)
+
+// the LevelDB hash, sign extension of the tail bytes and all, seeded as bloom filters seed it
+func sstBloomHash(b []byte) uint32 {
+    const m uint32 = 0xc6a4a793
+    h := uint32(0xbc9f1d34) ^ uint32(len(b)) * m
+    for ; len(b) >= 4; b = b[4:] {
+        h += binary.LittleEndian.Uint32(b)
+        h *= m
+        h ^= h >> 16
+    }
+    switch len(b) {
+    case 3:
+        h += uint32(int8(b[2])) << 16
+        fallthrough
+    case 2:
+        h += uint32(int8(b[1])) << 8
+        fallthrough
+    case 1:
+        h += uint32(int8(b[0]))
+        h *= m
+        h ^= h >> 24
+    }
+    return h
+}
+
+/**
+the legacy full filter: the bits are split into 64 byte cache lines, an
+odd number of them, and each key sets all its probes within one line.
+it ends with the probe count and the line count
+**/
+func sstBloomFilter(hashes []uint32) []byte {
+    const line_bits uint32 = 64 * 8
+    probes := sst_bloom_bits_per_key * 69 / 100
+    lines := (uint32(len(hashes) * sst_bloom_bits_per_key) + line_bits - 1) / line_bits
+    if lines % 2 == 0 {
+        lines++
+    }
+    filter := make([]byte, lines * line_bits / 8, lines * line_bits / 8 + 5)
+    for _, h := range hashes {
+        delta := h >> 17 | h << 15
+        base := (h % lines) * line_bits
+        for i := 0; i < probes; i++ {
+            bit := base + h % line_bits
+            filter[bit / 8] |= 1 << (bit % 8)
+            h += delta
+        }
+    }
+    filter = append(filter, byte(probes))
+    return binary.LittleEndian.AppendUint32(filter, lines)
+}
+
+/**
+writes the filter, index, properties and metaindex blocks and the footer.
+the writer is done with after this
+**/
+func (this *sstWriter) finish() error {
+    if err := this.flushData(); err != nil {
+        return err
+    }
+    filter, err := this.writeBlock(sstBloomFilter(this.key_hashes))
+    if err != nil {
+        return err
+    }
+    index, err := this.writeBlock(this.index.finish())
+    if err != nil {
+        return err
+    }
+    // in name order, as a block has to be
+    props := sstBlock{}
+    num := func(v uint64) []byte { return binary.AppendUvarint(nil, v) }
+    props.add([]byte("rocksdb.comparator"), []byte("leveldb.BytewiseComparator"))
+    props.add([]byte("rocksdb.data.size"), num(this.data_size))
+    props.add([]byte("rocksdb.external_sst_file.global_seqno"), binary.LittleEndian.AppendUint64(nil, 0))
+    props.add([]byte("rocksdb.external_sst_file.version"), binary.LittleEndian.AppendUint32(nil, 2))
+    props.add([]byte("rocksdb.filter.policy"), []byte("rocksdb.BuiltinBloomFilter"))
+    props.add([]byte("rocksdb.filter.size"), num(filter.size))
+    props.add([]byte("rocksdb.index.size"), num(index.size))
+    props.add([]byte("rocksdb.num.data.blocks"), num(this.data_blocks))
+    props.add([]byte("rocksdb.num.entries"), num(this.entries))
+    props.add([]byte("rocksdb.raw.key.size"), num(this.raw_key_size))
+    props.add([]byte("rocksdb.raw.value.size"), num(this.raw_value_size))
+    properties, err := this.writeBlock(props.finish())
+    if err != nil {
+        return err
+    }
+    meta := sstBlock{}
+    meta.add([]byte("fullfilter.rocksdb.BuiltinBloomFilter"), filter.encode(nil))
+    meta.add([]byte("rocksdb.properties"), properties.encode(nil))
+    metaindex, err := this.writeBlock(meta.finish())
+    if err != nil {
+        return err
+    }
+    footer := index.encode(metaindex.encode(nil))
+    footer = append(footer, make([]byte, 40 - len(footer))...)
+    footer = binary.LittleEndian.AppendUint64(footer, sst_legacy_magic)
+    _, err = this.w.Write(footer)
+    return err
+}
+
+/**
+writes the live entries into an SST that IngestExternalFile takes, returning
+how many went in. encode turns a key into bytes that sort as the list does;
+items are written as 8 byte big-endian values. a KEEP_BOTH list with a key
+twice fails, as a store holds a key once
+**/
+func (this *LazySkipList[K]) exportSST(w io.Writer, encode func(key K) []byte) (uint64, error) {
+    out := newSSTWriter(w)
+    next := this.cursor()
+    for key, item, ok := next(); ok; key, item, ok = next() {
+        if err := out.add(encode(key), binary.BigEndian.AppendUint64(nil, uint64(item))); err != nil {
+            return out.entries, err
+        }
+    }
+    return out.entries, out.finish()
+}
+
+// a sorted set member, ordered as ZRANGE orders them: by score, then member bytes
+type zsetEntry struct {
+    score float64
+    member string
+}
+
+func compareZset(a, b zsetEntry) int {
+    if c := compareFloat(a.score, b.score); c != 0 {
+        return c
+    }
+    return strings.Compare(a.member, b.member)
+}
+
+func newZsetList(opts ...option) LazySkipList[zsetEntry] {
+    return newListFunc(compareZset, opts...)
+}
+
+// the value types of an RDB dump, as rdb.h numbers them
+const (
+    RDB_STRING = 0
+    RDB_LIST = 1
+    RDB_SET = 2
+    RDB_ZSET = 3
+    RDB_HASH = 4
+    RDB_ZSET_2 = 5
+    RDB_HASH_ZIPMAP = 9
+    RDB_LIST_ZIPLIST = 10
+    RDB_SET_INTSET = 11
+    RDB_ZSET_ZIPLIST = 12
+    RDB_HASH_ZIPLIST = 13
+    RDB_LIST_QUICKLIST = 14
+    RDB_HASH_LISTPACK = 16
+    RDB_ZSET_LISTPACK = 17
+    RDB_LIST_QUICKLIST_2 = 18
+    RDB_SET_LISTPACK = 20
+)
+
+type rdbReader struct {
+    r *bufio.Reader
+}
+
+func (this rdbReader) bytes(n uint64) ([]byte, error) {
+    b := make([]byte, n)
+    _, err := io.ReadFull(this.r, b)
+    return b, err
+}
+
+/**
+a length, or with special set the encoding of a string stored as an
+integer or LZF-compressed
+**/
+func (this rdbReader) length() (n uint64, special bool, err error) {
+    b, err := this.r.ReadByte()
+    if err != nil {
+        return 0, false, err
+    }
+    switch b >> 6 {
+    case 0:
+        return uint64(b & 0x3f), false, nil
+    case 1:
+        next, err := this.r.ReadByte()
+        return uint64(b & 0x3f) << 8 | uint64(next), false, err
+    case 3:
+        return uint64(b & 0x3f), true, nil
+    }
+    switch b {
+    case 0x80:
+        raw, err := this.bytes(4)
+        if err != nil {
+            return 0, false, err
+        }
+        return uint64(binary.BigEndian.Uint32(raw)), false, nil
+    case 0x81:
+        raw, err := this.bytes(8)
+        if err != nil {
+            return 0, false, err
+        }
+        return binary.BigEndian.Uint64(raw), false, nil
+    }
+    return 0, false, fmt.Errorf("rdb: bad length byte %#x", b)
+}
+
+func (this rdbReader) plainLength() (uint64, error) {
+    n, special, err := this.length()
+    if err == nil && special {
+        err = fmt.Errorf("rdb: encoded string where a length goes")
+    }
+    return n, err
+}
+
+func (this rdbReader) str() ([]byte, error) {
+    n, special, err := this.length()
+    if err != nil || !special {
+        if err != nil {
+            return nil, err
+        }
+        return this.bytes(n)
+    }
+    switch n {
+    case 0, 1, 2:
+        raw, err := this.bytes(1 << n)
+        if err != nil {
+            return nil, err
+        }
+        var v int64
+        switch n {
+        case 0:
+            v = int64(int8(raw[0]))
+        case 1:
+            v = int64(int16(binary.LittleEndian.Uint16(raw)))
+        case 2:
+            v = int64(int32(binary.LittleEndian.Uint32(raw)))
+        }
+        return strconv.AppendInt(nil, v, 10), nil
+    case 3:
+        compressed, err := this.plainLength()
+        if err != nil {
+            return nil, err
+        }
+        size, err := this.plainLength()
+        if err != nil {
+            return nil, err
+        }
+        in, err := this.bytes(compressed)
+        if err != nil {
+            return nil, err
+        }
+        return lzfDecompress(in, size)
+    }
+    return nil, fmt.Errorf("rdb: unknown string encoding %d", n)
+}
+
+// scores of RDB_ZSET, as text with three lengths kept for NaN and the infinities
+func (this rdbReader) textScore() (float64, error) {
+    n, err := this.r.ReadByte()
+    if err != nil {
+        return 0, err
+    }
+    switch n {
+    case 253:
+        return math.NaN(), nil
+    case 254:
+        return math.Inf(1), nil
+    case 255:
+        return math.Inf(-1), nil
+    }
+    raw, err := this.bytes(uint64(n))
+    if err != nil {
+        return 0, err
+    }
+    return strconv.ParseFloat(string(raw), 64)
+}
+
+// the LZF format Redis compresses strings with: literal runs and back references
+func lzfDecompress(in []byte, size uint64) ([]byte, error) {
+    out := make([]byte, 0, size)
+    for i := 0; i < len(in); {
+        ctrl := int(in[i])
+        i++
+        if ctrl < 32 {
+            if i + ctrl + 1 > len(in) {
+                return nil, fmt.Errorf("rdb: lzf literal past the end")
+            }
+            out = append(out, in[i:i + ctrl + 1]...)
+            i += ctrl + 1
+            continue
+        }
+        n := ctrl >> 5
+        if n == 7 {
+            if i == len(in) {
+                return nil, fmt.Errorf("rdb: lzf reference past the end")
+            }
+            n += int(in[i])
+            i++
+        }
+        if i == len(in) {
+            return nil, fmt.Errorf("rdb: lzf reference past the end")
+        }
+        ref := len(out) - (ctrl & 0x1f) << 8 - int(in[i]) - 1
+        i++
+        if ref < 0 {
+            return nil, fmt.Errorf("rdb: lzf reference before the start")
+        }
+        // byte by byte: a reference may overlap what it is copying out
+        for j := 0; j < n + 2; j++ {
+            out = append(out, out[ref + j])
+        }
+    }
+    if uint64(len(out)) != size {
+        return nil, fmt.Errorf("rdb: lzf gave %d bytes, want %d", len(out), size)
+    }
+    return out, nil
+}
+
+// the entries of a ziplist, integers formatted as text
+func ziplistEntries(zl []byte) ([][]byte, error) {
+    entries := [][]byte{}
+    if len(zl) < 11 {
+        return nil, fmt.Errorf("rdb: short ziplist")
+    }
+    for i := 10; ; {
+        if i >= len(zl) {
+            return nil, fmt.Errorf("rdb: ziplist without an end")
+        }
+        if zl[i] == 0xff {
+            return entries, nil
+        }
+        if zl[i] == 0xfe {
+            i += 5
+        } else {
+            i++
+        }
+        if i >= len(zl) {
+            return nil, fmt.Errorf("rdb: ziplist entry past the end")
+        }
+        enc := zl[i]
+        var n, head int
+        var v int64
+        integer := true
+        switch {
+        case enc >> 6 == 0:
+            n, head, integer = int(enc & 0x3f), 1, false
+        case enc >> 6 == 1 && i + 1 < len(zl):
+            n, head, integer = int(enc & 0x3f) << 8 | int(zl[i + 1]), 2, false
+        case enc == 0x80 && i + 4 < len(zl):
+            n, head, integer = int(binary.BigEndian.Uint32(zl[i + 1:])), 5, false
+        case enc == 0xc0:
+            n, head = 2, 1
+        case enc == 0xd0:
+            n, head = 4, 1
+        case enc == 0xe0:
+            n, head = 8, 1
+        case enc == 0xf0:
+            n, head = 3, 1
+        case enc == 0xfe:
+            n, head = 1, 1
+        case enc >= 0xf1 && enc <= 0xfd:
+            n, head, v = 0, 1, int64(enc & 0x0f) - 1
+        default:
+            return nil, fmt.Errorf("rdb: bad ziplist encoding %#x", enc)
+        }
+        if i + head + n > len(zl) {
+            return nil, fmt.Errorf("rdb: ziplist entry past the end")
+        }
+        data := zl[i + head:i + head + n]
+        i += head + n
+        if !integer {
+            entries = append(entries, data)
+            continue
+        }
+        switch enc {
+        case 0xc0:
+            v = int64(int16(binary.LittleEndian.Uint16(data)))
+        case 0xd0:
+            v = int64(int32(binary.LittleEndian.Uint32(data)))
+        case 0xe0:
+            v = int64(binary.LittleEndian.Uint64(data))
+        case 0xf0:
+            v = int64(int32(uint32(data[0]) << 8 | uint32(data[1]) << 16 | uint32(data[2]) << 24)) >> 8
+        case 0xfe:
+            v = int64(int8(data[0]))
+        }
+        entries = append(entries, strconv.AppendInt(nil, v, 10))
+    }
+}
+
+// the entries of a listpack, integers formatted as text
+func listpackEntries(lp []byte) ([][]byte, error) {
+    entries := [][]byte{}
+    if len(lp) < 7 {
+        return nil, fmt.Errorf("rdb: short listpack")
+    }
+    for i := 6; ; {
+        if i >= len(lp) {
+            return nil, fmt.Errorf("rdb: listpack without an end")
+        }
+        enc := lp[i]
+        if enc == 0xff {
+            return entries, nil
+        }
+        var n, head int
+        var v int64
+        integer := true
+        switch {
+        case enc >> 7 == 0:
+            n, head, v = 0, 1, int64(enc)
+        case enc >> 6 == 2:
+            n, head, integer = int(enc & 0x3f), 1, false
+        case enc >> 5 == 6 && i + 1 < len(lp):
+            n, head, v = 0, 2, int64(int(enc & 0x1f) << 8 | int(lp[i + 1]))
+            if v >= 1 << 12 {
+                v -= 1 << 13
+            }
+        case enc >> 4 == 14 && i + 1 < len(lp):
+            n, head, integer = int(enc & 0x0f) << 8 | int(lp[i + 1]), 2, false
+        case enc == 0xf0 && i + 4 < len(lp):
+            n, head, integer = int(binary.LittleEndian.Uint32(lp[i + 1:])), 5, false
+        case enc >= 0xf1 && enc <= 0xf4:
+            n, head = []int{2, 3, 4, 8}[enc - 0xf1], 1
+        default:
+            return nil, fmt.Errorf("rdb: bad listpack encoding %#x", enc)
+        }
+        if i + head + n > len(lp) {
+            return nil, fmt.Errorf("rdb: listpack entry past the end")
+        }
+        data := lp[i + head:i + head + n]
+        // the back length after each entry takes 7 bits a byte
+        size := head + n
+        i += size + 1
+        for size > 127 {
+            size >>= 7
+            i++
+        }
+        if !integer {
+            entries = append(entries, data)
+            continue
+        }
+        switch n {
+        case 2:
+            v = int64(int16(binary.LittleEndian.Uint16(data)))
+        case 3:
+            v = int64(int32(uint32(data[0]) << 8 | uint32(data[1]) << 16 | uint32(data[2]) << 24)) >> 8
+        case 4:
+            v = int64(int32(binary.LittleEndian.Uint32(data)))
+        case 8:
+            v = int64(binary.LittleEndian.Uint64(data))
+        }
+        entries = append(entries, strconv.AppendInt(nil, v, 10))
+    }
+}
+
+// member, score pairs as ziplists and listpacks hold them
+func zsetPairs(list LazySkipList[zsetEntry], entries [][]byte) error {
+    if len(entries) % 2 != 0 {
+        return fmt.Errorf("rdb: zset with a member and no score")
+    }
+    for i := 0; i < len(entries); i += 2 {
+        score, err := strconv.ParseFloat(string(entries[i + 1]), 64)
+        if err != nil {
+            return fmt.Errorf("rdb: score: %v", err)
+        }
+        list.put(zsetEntry{score, string(entries[i])}, 0)
+    }
+    return nil
+}
+
+/**
+reads the sorted sets out of an RDB dump, from BGSAVE or redis-cli --rdb,
+into one list per key, with 0 for items. keys of other types are read past;
+streams, modules and types newer than RDB version 12 are an error, as they
+can't be, and so is a key in two databases. the trailing checksum is not
+checked
+**/
+func importRDB(r io.Reader, opts ...option) (map[string]LazySkipList[zsetEntry], error) {
+    in := rdbReader{bufio.NewReader(r)}
+    header, err := in.bytes(9)
+    if err != nil {
+        return nil, err
+    }
+    if string(header[:5]) != "REDIS" {
+        return nil, fmt.Errorf("rdb: not an RDB dump")
+    }
+    if version, err := strconv.Atoi(string(header[5:])); err != nil || version > 12 {
+        return nil, fmt.Errorf("rdb: unsupported version %q", header[5:])
+    }
+    sets := map[string]LazySkipList[zsetEntry]{}
+    for {
+        kind, err := in.r.ReadByte()
+        if err != nil {
+            return nil, err
+        }
+        switch kind {
+        case 0xff:
+            return sets, nil
+        case 0xfa:
+            // an aux field, a name and a value
+            if _, err = in.str(); err == nil {
+                _, err = in.str()
+            }
+        case 0xfb:
+            if _, err = in.plainLength(); err == nil {
+                _, err = in.plainLength()
+            }
+        case 0xfe, 0xf8:
+            _, err = in.plainLength()
+        case 0xfd:
+            _, err = in.bytes(4)
+        case 0xfc:
+            _, err = in.bytes(8)
+        case 0xf9:
+            _, err = in.r.ReadByte()
+        case 0xf5:
+            _, err = in.str()
+        default:
+            err = in.value(kind, sets, opts)
+        }
+        if err != nil {
+            return nil, err
+        }
+    }
+}
+
+// a key and its value, a sorted set kept and anything else read past
+func (this rdbReader) value(kind byte, sets map[string]LazySkipList[zsetEntry], opts []option) error {
+    name, err := this.str()
+    if err != nil {
+        return err
+    }
+    key := string(name)
+    switch kind {
+    case RDB_ZSET, RDB_ZSET_2, RDB_ZSET_ZIPLIST, RDB_ZSET_LISTPACK:
+        if _, ok := sets[key]; ok {
+            return fmt.Errorf("rdb: zset %q twice", key)
+        }
+        list := newZsetList(opts...)
+        sets[key] = list
+        if kind == RDB_ZSET_ZIPLIST || kind == RDB_ZSET_LISTPACK {
+            blob, err := this.str()
+            if err != nil {
+                return err
+            }
+            var entries [][]byte
+            if kind == RDB_ZSET_ZIPLIST {
+                entries, err = ziplistEntries(blob)
+            } else {
+                entries, err = listpackEntries(blob)
+            }
+            if err != nil {
+                return fmt.Errorf("%v in zset %q", err, key)
+            }
+            return zsetPairs(list, entries)
+        }
+        n, err := this.plainLength()
+        for ; err == nil && n > 0; n-- {
+            var member []byte
+            var score float64
+            if member, err = this.str(); err != nil {
+                break
+            }
+            if kind == RDB_ZSET {
+                score, err = this.textScore()
+            } else {
+                var raw []byte
+                raw, err = this.bytes(8)
+                if err == nil {
+                    score = math.Float64frombits(binary.LittleEndian.Uint64(raw))
+                }
+            }
+            list.put(zsetEntry{score, string(member)}, 0)
+        }
+        return err
+    case RDB_STRING, RDB_HASH_ZIPMAP, RDB_LIST_ZIPLIST, RDB_SET_INTSET, RDB_HASH_ZIPLIST, RDB_HASH_LISTPACK, RDB_SET_LISTPACK:
+        _, err = this.str()
+        return err
+    case RDB_LIST, RDB_SET, RDB_HASH, RDB_LIST_QUICKLIST, RDB_LIST_QUICKLIST_2:
+        n, err := this.plainLength()
+        for ; err == nil && n > 0; n-- {
+            switch kind {
+            case RDB_HASH:
+                if _, err = this.str(); err == nil {
+                    _, err = this.str()
+                }
+            case RDB_LIST_QUICKLIST_2:
+                // each node says whether it is plain or a listpack first
+                if _, err = this.plainLength(); err == nil {
+                    _, err = this.str()
+                }
+            default:
+                _, err = this.str()
+            }
+        }
+        return err
+    }
+    return fmt.Errorf("rdb: key %q has type %d, which can't be read past", key, kind)
+}
+
+/**
+the live node at rank, counted from 0. with a jump table the rank is as
+of the table's last rebuild: the entry whose span holds it is found by
+binary search and only that span is walked, nil if the span has shrunk
+past the rank since. without a table it walks level 0, O(n)
+**/
+func (this *LazySkipList[K]) atRank(rank int) *Node[K] {
+    curr, end := this.head.next[0], this.tail
+    if this.jump != nil {
+        table := this.jump.table.Load()
+        i := sort.Search(len(table.offsets), func(i int) bool {
+            return table.offsets[i] > rank
+        }) - 1
+        if i >= 0 {
+            curr = table.nodes[i]
+            rank -= table.offsets[i]
+        }
+        if i + 1 < len(table.nodes) {
+            end = table.nodes[i + 1]
+        }
+    }
+    for ; curr != this.tail && curr != end; curr = curr.next[0] {
+        if curr.isLive() {
+            if rank == 0 {
+                return curr
+            }
+            rank--
+        }
+    }
+    return nil
+}
+
+// the number of ranks atRank() knows of
+func (this *LazySkipList[K]) rankedSize() int {
+    if this.jump != nil {
+        return this.jump.table.Load().total
+    }
+    return this.size()
+}
+
+/**
+a uniformly random live node, nil if there is none. with a jump table,
+keys added since its last rebuild are a little under-sampled until the
+next one, see atRank()
+**/
+func (this *LazySkipList[K]) randomNode() *Node[K] {
+    for try := 0; try < 16; try++ {
+        n := this.rankedSize()
+        if n == 0 {
+            return nil
+        }
+        if node := this.atRank(rand.Intn(n)); node != nil {
+            return node
+        }
+    }
+    return nil
+}
+
+/**
+the key at rank ceil(q * n) of the n keys, q in [0, 1], so quantile(0.99)
+of a list of latencies is their 99th percentile. exact on a list without
+a jump table once writes stop. with one the ranks are as of its last
+rebuild, which lags by up to JUMP_MIN_CHANGES or size() / 8 writes
+**/
+func (this *LazySkipList[K]) quantile(q float64) (K, bool) {
+    var zero K
+    for try := 0; try < 16; try++ {
+        n := this.rankedSize()
+        if n == 0 {
+            return zero, false
+        }
+        rank := min(max(int(math.Ceil(q * float64(n))), 1), n)
+        if node := this.atRank(rank - 1); node != nil {
+            return node.key, true
+        }
+    }
+    return zero, false
+}
+
+/**
+a random key drawn with probability proportional to its item, for lists
+whose items are weights, e.g. lottery scheduling. items below 1 are never
+drawn. like randomNode(), the jump table's span weights are as old as the
+table, so weights changed since its last rebuild count as they were; the
+span is walked with the current ones. without a table it is one pass
+over level 0. false if no key has a positive weight
+**/
+func (this *LazySkipList[K]) weightedRandom() (K, int, bool) {
+    var zero K
+    if this.jump == nil {
+        // weighted reservoir of one: keep each node with its share of the weight so far
+        var pick *Node[K]
+        seen := int64(0)
+        for curr := this.head.next[0]; curr != this.tail; curr = curr.next[0] {
+            if w := int64(curr.loadItem()); w > 0 && curr.isLive() {
+                seen += w
+                if rand.Int63n(seen) < w {
+                    pick = curr
+                }
+            }
+        }
+        if pick == nil {
+            return zero, 0, false
+        }
+        return pick.key, pick.loadItem(), true
+    }
+    table := this.jump.table.Load()
+    for try := 0; try < 16 && table.total_weight > 0; try++ {
+        r := rand.Int63n(table.total_weight)
+        i := sort.Search(len(table.weights), func(i int) bool {
+            return table.weights[i] > r
+        }) - 1
+        curr, end := this.head.next[0], this.tail
+        if i >= 0 {
+            curr = table.nodes[i]
+            r -= table.weights[i]
+        }
+        if i + 1 < len(table.nodes) {
+            end = table.nodes[i + 1]
+        }
+        for ; curr != this.tail && curr != end; curr = curr.next[0] {
+            if item := curr.loadItem(); item > 0 && curr.isLive() {
+                if r < int64(item) {
+                    return curr.key, item, true
+                }
+                r -= int64(item)
+            }
+        }
+    }
+    return zero, 0, false
+}
+
+// a random key, see randomNode(); false if the list is empty
+func (this *LazySkipList[K]) randomKey() (K, bool) {
+    var zero K
+    node := this.randomNode()
+    if node == nil {
+        return zero, false
+    }
+    return node.key, true
+}
+
+/**
+up to n distinct random keys in no particular order, see randomNode().
+gives up after 4n draws, so a list with fewer than n keys returns fewer
+**/
+func (this *LazySkipList[K]) randomSample(n int) []K {
+    seen := map[*Node[K]]bool{}
+    sample := []K{}
+    for draw := 0; draw < 4 * n + 16 && len(sample) < n; draw++ {
+        node := this.randomNode()
+        if node != nil && !seen[node] {
+            seen[node] = true
+            sample = append(sample, node.key)
+        }
+    }
+    return sample
+}
+
+/**
+puts a batch sorted by key in one forward pass: each put() starts its
+search from the predecessors of the one before, so the batch walks the
+list about once instead of descending from head for every entry. locking
+is that of put(), only around each entry's own splice. returns how many
+entries were inserted rather than rejected or overwritten. an unsorted
+batch is still put correctly, only without the speedup
+**/
+func (this *LazySkipList[K]) insertSortedBatch(entries []entry[K]) int {
+    inserted := 0
+    var hint []*Node[K]
+    for _, e := range entries {
+        if this.limiter != nil {
+            this.limiter.take()
+        }
+        var result putResult
+        result, hint = this.storeFrom(e.key, e.item, false, false, hint)
+        if result == PUT_INSERTED || result == PUT_DUPLICATED {
+            inserted++
+        }
+    }
+    return inserted
+}
+
+// what ingest() did with the records it read
+type ingestStats struct {
+    accepted int
+    // repeated within the input, or already in the list
+    duplicates int
+}
+
+/**
+loads newline-delimited records from r, skipping blank lines. records are
+parsed into a key and an item, gathered into batches of batch_size, and
+each batch is sorted so that its inserts walk the list in key order. a key
+seen earlier in the input or already present is counted as a duplicate
+and never put, whatever the list's duplicate policy. stops at the first
+record parse fails on, naming its line
+**/
+func (this *LazySkipList[K]) ingest(r io.Reader, parse func(record string) (K, int, error), batch_size int) (ingestStats, error) {
+    type record struct {
+        key K
+        item int
+    }
+    stats := ingestStats{}
+    batch := make([]record, 0, batch_size)
+    flush := func() error {
+        // stable, so the first of several equal keys is the one kept
+        sort.SliceStable(batch, func(i, j int) bool {
+            return this.compare(batch[i].key, batch[j].key) < 0
+        })
+        for i, rec := range batch {
+            if i > 0 && this.compare(batch[i - 1].key, rec.key) == 0 || this.contains(rec.key) {
+                stats.duplicates++
+                continue
+            }
+            switch this.put(rec.key, rec.item) {
+            case PUT_INSERTED:
+                stats.accepted++
+            case PUT_FROZEN:
+                return err_frozen
+            case PUT_OVER_CAPACITY:
+                return err_over_capacity
+            default:
+                // another writer added the key since contains()
+                stats.duplicates++
+            }
+        }
+        batch = batch[:0]
+        return nil
+    }
+    scanner := bufio.NewScanner(r)
+    for line := 1; scanner.Scan(); line++ {
+        text := strings.TrimSpace(scanner.Text())
+        if text == "" {
+            continue
+        }
+        key, item, err := parse(text)
+        if err != nil {
+            return stats, fmt.Errorf("line %d: %v", line, err)
+        }
+        if batch = append(batch, record{key, item}); len(batch) >= batch_size {
+            if err := flush(); err != nil {
+                return stats, err
+            }
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        return stats, err
+    }
+    return stats, flush()
+}
+
+// "key" or "key item" with integer fields, the item defaulting to the key
+func parseIntRecord(record string) (int, int, error) {
+    fields := strings.Fields(record)
+    if len(fields) > 2 {
+        return 0, 0, fmt.Errorf("%d fields in %q", len(fields), record)
+    }
+    key, err := strconv.Atoi(fields[0])
+    if err != nil {
+        return 0, 0, err
+    }
+    item := key
+    if len(fields) == 2 {
+        if item, err = strconv.Atoi(fields[1]); err != nil {
+            return 0, 0, err
+        }
+    }
+    return key, item, nil
+}
+
+// a key and its item, for building a list in bulk
+type entry[K any] struct {
+    key K
+    item int
+}
+
+/**
+builds a list out of unsorted entries: they are sorted once, duplicates
+settled by the list's policy (REJECT keeps the first of equal keys,
+OVERWRITE the last, KEEP_BOTH all of them in input order), and the sorted
+run is cut into one key range per worker. each worker gives its nodes
+their heights and links them among themselves concurrently, then the
+ranges are stitched together level by level. nobody can see the list
+until it is returned, so no node is locked
+**/
+func buildParallel[K any](compare func(a, b K) int, entries []entry[K], workers int, opts ...option) LazySkipList[K] {
+    list := newListFunc(compare, opts...)
+    sorted := make([]entry[K], len(entries))
+    copy(sorted, entries)
+    sort.SliceStable(sorted, func(i, j int) bool {
+        return compare(sorted[i].key, sorted[j].key) < 0
+    })
+    unique := sorted[:0]
+    for _, e := range sorted {
+        switch {
+        case len(unique) == 0 || list.on_duplicate == KEEP_BOTH || compare(unique[len(unique) - 1].key, e.key) != 0:
+            unique = append(unique, e)
+        case list.on_duplicate == OVERWRITE:
+            unique[len(unique) - 1] = e
+        }
+    }
+    workers = max(min(workers, len(unique)), 1)
+    // the first and last node of each range on every level, nil where a range has none
+    firsts := make([][]*Node[K], workers)
+    lasts := make([][]*Node[K], workers)
+    var wg sync.WaitGroup
+    for w := 0; w < workers; w++ {
+        wg.Add(1)
+        go func(w int) {
+            defer wg.Done()
+            lo, hi := w * len(unique) / workers, (w + 1) * len(unique) / workers
+            first := make([]*Node[K], list.max_level)
+            last := make([]*Node[K], list.max_level)
+            for i := lo; i < hi; i++ {
+                top_level := list.randomHeight()
+                node := list.newNode(unique[i].key, unique[i].item, top_level)
+                node.base_level = top_level
+                node.fully_linked = true
+                if list.on_duplicate == KEEP_BOTH {
+                    node.seq = uint64(i + 1)
+                }
+                list.grow(top_level)
+                for l := 0; l < top_level; l++ {
+                    if last[l] == nil {
+                        first[l] = node
+                    } else {
+                        last[l].next[l] = node
+                    }
+                    last[l] = node
+                }
+            }
+            firsts[w], lasts[w] = first, last
+        }(w)
+    }
+    wg.Wait()
+    for l := 0; l < list.max_level; l++ {
+        pred := list.head
+        for w := 0; w < workers; w++ {
+            if firsts[w][l] != nil {
+                pred.next[l] = firsts[w][l]
+                pred = lasts[w][l]
+            }
+        }
+        pred.next[l] = list.tail
+    }
+    list.seq = uint64(len(unique))
+    list.count.add(int64(len(unique)))
+    if list.bloom != nil {
+        list.rebuildBloom()
+    }
+    if list.jump != nil {
+        list.jump.rebuild(&list)
+    }
+    return list
+}
+
+/**
+a uniform sample of up to capacity keys out of every key observed, kept
+with Vitter's algorithm R: the i-th key replaces a random slot with
+probability capacity / i. feed it the keys of successful add() calls to
+see representative keys of a list too big to scan
+**/
+type reservoir[K any] struct {
+    lock sync.Mutex
+    keys []K
+    capacity int
+    seen int64
+}
+
+func newReservoir[K any](capacity int) *reservoir[K] {
+    return &reservoir[K]{keys: make([]K, 0, capacity), capacity: capacity}
+}
+
+func (this *reservoir[K]) observe(key K) {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    this.seen++
+    if len(this.keys) < this.capacity {
+        this.keys = append(this.keys, key)
+    } else if i := rand.Int63n(this.seen); i < int64(this.capacity) {
+        this.keys[i] = key
+    }
+}
+
+// a copy of the current sample and the number of keys observed
+func (this *reservoir[K]) sample() ([]K, int64) {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    return append([]K(nil), this.keys...), this.seen
+}
+
+// a filter is never sized for fewer keys
+const BLOOM_MIN_KEYS int = 1024
+
+type bloomFilter struct {
+    words []uint64
+    probes int
+    // the number of keys it was sized for
+    capacity int64
+    // successful remove() calls since it was built
+    removed int64
+}
+
+func newBloomFilter(capacity, bits_per_key int) *bloomFilter {
+    return &bloomFilter{
+        words: make([]uint64, (capacity * bits_per_key + 63) / 64),
+        probes: min(max(int(math.Round(float64(bits_per_key) * math.Ln2)), 1), 16),
+        capacity: int64(capacity)}
+}
+
+// probe i is at h1 + i * h2, see Kirsch and Mitzenmacher
+func (this *bloomFilter) insert(h uint64) {
+    n := uint64(len(this.words)) * 64
+    h2 := h >> 32 | h << 32 | 1
+    for i := 0; i < this.probes; i++ {
+        bit := h % n
+        atomic.OrUint64(&this.words[bit / 64], 1 << (bit % 64))
+        h += h2
+    }
+}
+
+func (this *bloomFilter) mayContain(h uint64) bool {
+    n := uint64(len(this.words)) * 64
+    h2 := h >> 32 | h << 32 | 1
+    for i := 0; i < this.probes; i++ {
+        bit := h % n
+        if atomic.LoadUint64(&this.words[bit / 64]) & (1 << (bit % 64)) == 0 {
+            return false
+        }
+        h += h2
+    }
+    return true
+}
+
+/**
+current is read without locking. adders hold lock for reading from the
+moment they set their bits until their node is linked, and write to
+building as well while a rebuild is under way
+**/
+type bloomState[K any] struct {
+    hash func(K) uint64
+    bits_per_key int
+    current atomic.Pointer[bloomFilter]
+    lock sync.RWMutex
+    building *bloomFilter
+    rebuilding int32
+}
+
+func (this *bloomState[K]) insert(key K) {
+    this.insertHash(this.hash(key))
+}
+
+// insert() with the hash taken beforehand, outside any lock
+func (this *bloomState[K]) insertHash(h uint64) {
+    this.current.Load().insert(h)
+    if this.building != nil {
+        this.building.insert(h)
+    }
+}
+
+func (this *bloomState[K]) mayContain(key K) bool {
+    return this.current.Load().mayContain(this.hash(key))
+}
+
+/**
+builds a filter sized for twice the current size from level 0 and swaps it
+in. once building is published every new key reaches it, and every key
+linked before that is found by the scan, so the new filter has no false
+negatives. one rebuild at a time, the others skip it
+**/
+func (this *LazySkipList[K]) rebuildBloom() {
+    bloom := this.bloom
+    if !atomic.CompareAndSwapInt32(&bloom.rebuilding, 0, 1) {
+        return
+    }
+    defer atomic.StoreInt32(&bloom.rebuilding, 0)
+    filter := newBloomFilter(max(2 * this.size(), BLOOM_MIN_KEYS), bloom.bits_per_key)
+    bloom.lock.Lock()
+    bloom.building = filter
+    bloom.lock.Unlock()
+    // a panicking hash abandons the new filter, the current one stays
+    defer func() {
+        bloom.lock.Lock()
+        bloom.building = nil
+        bloom.lock.Unlock()
+    }()
+    for curr := this.head.next[0]; curr != this.tail; curr = curr.next[0] {
+        if !curr.marked {
+            filter.insert(bloom.hash(curr.key))
+        }
+    }
+    bloom.lock.Lock()
+    bloom.current.Store(filter)
+    bloom.lock.Unlock()
+}
+
+// the table is rebuilt after this many adds and removes, or size() / 8 if more
+const JUMP_MIN_CHANGES int64 = 1024
+
+/**
+the nodes linked at the table's level when it was built, and their keys in
+a separate array so the binary search touches contiguous memory. each
+node's offset counts the live keys before it, so its span runs to the
+next node's offset, or to total for the last one. weights does the same
+for the sum of the items, see weightedRandom()
+**/
+type jumpTable[K any] struct {
+    keys []K
+    nodes []*Node[K]
+    offsets []int
+    total int
+    weights []int64
+    total_weight int64
+}
+
+type jumpState[K any] struct {
+    level int
+    table atomic.Pointer[jumpTable[K]]
+    // adds and removes since the table was built
+    changes int64
+    rebuilding int32
+}
+
+/**
+the last node of the table before key that is still linked at the table's
+level, nil to start from head. a node unmarked when we look at it is as
+good a start as head was at that moment. tables go stale, so a removed
+node only costs a step back
+**/
+func (this *jumpState[K]) start(list *LazySkipList[K], key K) *Node[K] {
+    table := this.table.Load()
+    i := sort.Search(len(table.keys), func(i int) bool {
+        return list.compare(table.keys[i], key) >= 0
+    })
+    for i--; i >= 0; i-- {
+        node := table.nodes[i]
+        if !node.marked && node.top_level > this.level {
+            return node
+        }
+    }
+    return nil
+}
+
+func (this *jumpState[K]) changed(list *LazySkipList[K]) {
+    if changes := atomic.AddInt64(&this.changes, 1); changes > JUMP_MIN_CHANGES && changes > int64(list.size()) / 8 {
+        this.rebuild(list)
+    }
+}
+
+/**
+one rebuild at a time, the others skip it. walks all of level 0, which
+comes to about 8 nodes per add or remove since the last rebuild
+**/
+func (this *jumpState[K]) rebuild(list *LazySkipList[K]) {
+    if !atomic.CompareAndSwapInt32(&this.rebuilding, 0, 1) {
+        return
+    }
+    defer atomic.StoreInt32(&this.rebuilding, 0)
+    atomic.StoreInt64(&this.changes, 0)
+    table := &jumpTable[K]{}
+    // level 0, for the spans randomNode() weighs table entries by
+    for curr := list.head.next[0]; curr != list.tail; curr = curr.next[0] {
+        if !curr.fully_linked || curr.marked || curr.isHidden() {
+            continue
+        }
+        if curr.top_level > this.level {
+            table.keys = append(table.keys, curr.key)
+            table.nodes = append(table.nodes, curr)
+            table.offsets = append(table.offsets, table.total)
+            table.weights = append(table.weights, table.total_weight)
+        }
+        if !curr.isTombstone() {
+            table.total++
+            table.total_weight += int64(max(curr.loadItem(), 0))
+        }
+    }
+    this.table.Store(table)
+}
+
+/**
+print each level as a row of keys aligned on the level-0 order,
+marked (logically deleted) nodes are suffixed with * and tombstones with ~
+**/
+func (this *LazySkipList[K]) dumpLevels(w io.Writer, max_nodes int) {
+    nodes := []*Node[K]{}
+    for curr := this.head.next[0]; curr != this.tail && len(nodes) < max_nodes; curr = curr.next[0] {
+        nodes = append(nodes, curr)
+    }
+    width := 1
+    top_level := 0
+    labels := make([]string, len(nodes))
+    for i, node := range nodes {
+        labels[i] = fmt.Sprint(node.key)
+        if node.marked {
+            labels[i] += "*"
+        }
+        if node.isTombstone() {
+            labels[i] += "~"
+        }
+        if len(labels[i]) > width {
+            width = len(labels[i])
+        }
+        if node.top_level > top_level {
+            top_level = node.top_level
+        }
+    }
+    for l := top_level - 1; l >= 0; l-- {
+        linked := make(map[*Node[K]]bool)
+        for curr := this.head.next[l]; curr != this.tail && len(linked) < len(nodes); curr = curr.next[l] {
+            linked[curr] = true
+        }
+        row := fmt.Sprintf("L%-2d head", l)
+        for i, node := range nodes {
+            if linked[node] {
+                row += fmt.Sprintf(" %*s", width, labels[i])
+            } else {
+                row += " " + strings.Repeat("-", width)
+            }
+        }
+        fmt.Fprintln(w, row + " tail")
+    }
+    if len(nodes) > 0 && len(nodes) == max_nodes && nodes[len(nodes) - 1].next[0] != this.tail {
+        fmt.Fprintln(w, "... truncated after", max_nodes, "nodes")
+    }
+}
+
+/**
+structural invariants that hold whenever no operation is in flight: every
+level is sorted, every level is a sub-list of the level below, and level 0
+holds exactly size() unmarked, fully linked nodes besides tombstones
+**/
+func (this *LazySkipList[K]) checkInvariants() error {
+    below := map[*Node[K]]bool{}
+    tombstones := 0
+    for l := 0; l < this.max_level; l++ {
+        level := map[*Node[K]]bool{}
+        prev := this.head
+        for curr := this.head.next[l]; curr != this.tail; curr = curr.next[l] {
+            if prev != this.head && !this.before(prev, curr.key, curr.seq) {
+                return fmt.Errorf("level %d: key %v follows %v", l, curr.key, prev.key)
+            }
+            if curr.top_level <= l {
+                return fmt.Errorf("level %d: node %v has top level %d", l, curr.key, curr.top_level)
+            }
+            if curr.marked || !curr.fully_linked {
+                return fmt.Errorf("level %d: node %v still linked with marked=%v fully_linked=%v", l, curr.key, curr.marked, curr.fully_linked)
+            }
+            if l > 0 && !below[curr] {
+                return fmt.Errorf("level %d: node %v missing from level %d", l, curr.key, l - 1)
+            }
+            level[curr] = true
+            if l == 0 && curr.isTombstone() {
+                tombstones++
+            }
+            prev = curr
+        }
+        if l == 0 && len(level) - tombstones != this.size() {
+            return fmt.Errorf("level 0 holds %d nodes and %d tombstones, size() is %d", len(level), tombstones, this.size())
+        }
+        below = level
+    }
+    return nil
+}
+
+/**
+num_threads goroutines run a random mix of add(), remove(), contains() and
+ascend() over [0, key_range). every check_every the workers are paused so
+that checkInvariants() runs on a quiescent list and size() can be compared
+with the net number of successful add() and remove() calls
+**/
+func stress(list *LazySkipList[int], num_threads, key_range int, duration, check_every time.Duration) (int64, error) {
+    var pause sync.RWMutex
+    var stop int32
+    var ops int64
+    var wg sync.WaitGroup
+    net := make([]int, num_threads)
+    errs := make(chan error, num_threads)
+    for i := 0; i < num_threads; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            rng := rand.New(rand.NewSource(time.Now().UnixNano() + int64(i)))
+            for atomic.LoadInt32(&stop) == 0 {
+                pause.RLock()
+                if list.promote_every > 0 && rng.Intn(10) == 0 {
+                    list.maintain()
+                }
+                done := 0
+                // a failed check stops the batch, the checker waits on pause
+                for ; done < 100 && atomic.LoadInt32(&stop) == 0; done++ {
+                    key := rng.Intn(key_range)
+                    switch rng.Intn(4) {
+                    case 0:
+                        if list.add(key) {
+                            net[i]++
+                        }
+                    case 1:
+                        if list.remove(key) {
+                            net[i]--
+                        }
+                    case 2:
+                        list.contains(key)
+                    case 3:
+                        prev := key - 1
+                        list.ascend(key, key + 16, func(k, item int) bool {
+                            if k < prev || (k == prev && list.on_duplicate != KEEP_BOTH) || k >= key + 16 {
+                                // the first error is the one reported, the rest may be its echoes
+                                select {
+                                case errs <- fmt.Errorf("ascend(%d, %d) returned %d after %d", key, key + 16, k, prev):
+                                default:
+                                }
+                                atomic.StoreInt32(&stop, 1)
+                                return false
+                            }
+                            prev = k
+                            return true
+                        })
+                    }
+                }
+                pause.RUnlock()
+                atomic.AddInt64(&ops, int64(done))
+            }
+        }(i)
+    }
+    var err error
+    deadline := time.Now().Add(duration)
+    for err == nil && atomic.LoadInt32(&stop) == 0 && time.Now().Before(deadline) {
+        time.Sleep(check_every)
+        pause.Lock()
+        expected := 0
+        for _, n := range net {
+            expected += n
+        }
+        if err = list.checkInvariants(); err == nil && expected != list.size() {
+            err = fmt.Errorf("size() is %d, successful add() minus remove() is %d", list.size(), expected)
+        }
+        pause.Unlock()
+    }
+    atomic.StoreInt32(&stop, 1)
+    wg.Wait()
+    select {
+    case e := <-errs:
+        if err == nil {
+            err = e
+        }
+    default:
+    }
+    return atomic.LoadInt64(&ops), err
+}
+
+/**
+a deterministic 1-2-3 skiplist (Munro, Papadakis and Sedgewick) for callers
+that need worst-case rather than expected O(log n). every level is a list
+of cells; a cell's down pointer starts its gap, the run of cells one level
+below up to the one with the same key, and every gap but the header's holds
+1 to 3 cells besides that one. add() splits gaps of 3 and remove() widens
+gaps of 1 on the way down, so both finish in a single top-down pass. keys
+at the upper levels are copies, the last cell of every level is infinite.
+one lock guards the whole list
+**/
+type DetNode[K any] struct {
+    key K
+    inf bool
+    right *DetNode[K]
+    down *DetNode[K]
+}
+
+type DeterministicSkipList[K any] struct {
+    lock sync.RWMutex
+    head *DetNode[K]
+    bottom *DetNode[K]
+    tail *DetNode[K]
+    compare func(a, b K) int
+    count int
+}
+
+func newDeterministicSkipList[K any](compare func(a, b K) int) *DeterministicSkipList[K] {
+    list := DeterministicSkipList[K]{compare: compare}
+    list.bottom = &DetNode[K]{}
+    list.bottom.right = list.bottom
+    list.bottom.down = list.bottom
+    list.tail = &DetNode[K]{inf: true}
+    list.tail.right = list.tail
+    list.head = &DetNode[K]{inf: true, right: list.tail, down: list.bottom}
+    return &list
+}
+
+func (this *DeterministicSkipList[K]) less(node *DetNode[K], key K) bool {
+    return !node.inf && this.compare(node.key, key) < 0
+}
+
+func (this *DeterministicSkipList[K]) nodeLess(a, b *DetNode[K]) bool {
+    return !a.inf && (b.inf || this.compare(a.key, b.key) < 0)
+}
+
+func (this *DeterministicSkipList[K]) hasKey(node *DetNode[K], key K) bool {
+    return !node.inf && this.compare(node.key, key) == 0
+}
+
+// number of cells in node's gap, not counting the one that closes it
+func (this *DeterministicSkipList[K]) gapSize(node *DetNode[K]) int {
+    n := 0
+    for curr := node.down; this.nodeLess(curr, node); curr = curr.right {
+        n++
+    }
+    return n
+}
+
+func (this *DeterministicSkipList[K]) size() int {
+    this.lock.RLock()
+    defer this.lock.RUnlock()
+    return this.count
+}
+
+func (this *DeterministicSkipList[K]) contains(x K) bool {
+    this.lock.RLock()
+    defer this.lock.RUnlock()
+    curr := this.head
+    for {
+        for this.less(curr, x) {
+            curr = curr.right
+        }
+        if curr.down == this.bottom || this.hasKey(curr, x) {
+            return this.hasKey(curr, x)
+        }
+        curr = curr.down
+    }
+}
+
+func (this *DeterministicSkipList[K]) add(x K) bool {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    added := false
+    curr := this.head
+    for {
+        for this.less(curr, x) {
+            curr = curr.right
+        }
+        if curr.down == this.bottom {
+            if !this.hasKey(curr, x) {
+                // x goes in front of curr: curr takes x and a new cell takes curr's old key
+                curr.right = &DetNode[K]{key: curr.key, inf: curr.inf, right: curr.right, down: this.bottom}
+                curr.key, curr.inf = x, false
+                added = true
+            }
+            break
+        }
+        if d := curr.down; this.nodeLess(d.right.right, curr) {
+            // a gap of 3, raise the middle cell
+            curr.right = &DetNode[K]{key: curr.key, inf: curr.inf, right: curr.right, down: d.right.right}
+            curr.key, curr.inf = d.right.key, false
+        } else {
+            curr = curr.down
+        }
+    }
+    // splits on the way down happen even when x is already there
+    if this.head.right != this.tail {
+        this.head = &DetNode[K]{inf: true, right: this.tail, down: this.head}
+    }
+    if added {
+        this.count++
+    }
+    return added
+}
+
+func (this *DeterministicSkipList[K]) remove(x K) bool {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    var parent, prev *DetNode[K]
+    // the cells above the bottom level that carry x
+    copies := []*DetNode[K]{}
+    curr := this.head
+    for curr.down != this.bottom {
+        if parent != nil && this.gapSize(curr) == 1 {
+            if this.nodeLess(curr, parent) {
+                // not the last gap under parent, use the next one
+                next := curr.right
+                if this.gapSize(next) == 1 {
+                    curr.key, curr.inf, curr.right = next.key, next.inf, next.right
+                } else {
+                    first := next.down
+                    curr.key, curr.inf = first.key, false
+                    next.down = first.right
+                }
+            } else if this.gapSize(prev) == 1 {
+                prev.key, prev.inf, prev.right = curr.key, curr.inf, curr.right
+                curr = prev
+            } else {
+                // lower prev's closing cell into curr's gap and raise the one before it
+                last := prev.down
+                for last.right.right != curr.down {
+                    last = last.right
+                }
+                prev.key = last.key
+                curr.down = last.right
+            }
+        }
+        if this.hasKey(curr, x) {
+            copies = append(copies, curr)
+        }
+        parent, prev = curr, nil
+        curr = curr.down
+        for this.less(curr, x) {
+            prev = curr
+            curr = curr.right
+        }
+    }
+    found := this.hasKey(curr, x)
+    if found {
+        if prev == nil {
+            // the cell before curr closes another gap and is out of reach, so
+            // curr takes over its successor, which is in the same gap
+            next := curr.right
+            curr.key, curr.inf, curr.right = next.key, next.inf, next.right
+        } else {
+            prev.right = curr.right
+        }
+        for _, cell := range copies {
+            cell.key = prev.key
+        }
+        this.count--
+    }
+    // merges may have left levels with nothing but their infinite cell
+    for this.head.down != this.bottom && this.head.down.right == this.tail {
+        this.head = this.head.down
+    }
+    return found
+}
+
+/**
+every level is sorted and ends in an infinite cell, consecutive gaps meet,
+every gap below the header holds 1 to 3 cells and the bottom level holds
+size() keys
+**/
+func (this *DeterministicSkipList[K]) checkInvariants() error {
+    this.lock.RLock()
+    defer this.lock.RUnlock()
+    level := this.head
+    for depth := 0; ; depth++ {
+        var expected_down *DetNode[K]
+        n := 0
+        for curr := level; curr != this.tail; curr = curr.right {
+            if curr.right == this.tail && !curr.inf {
+                return fmt.Errorf("level %d ends in %v, not an infinite cell", depth, curr.key)
+            }
+            if curr.right != this.tail && !this.nodeLess(curr, curr.right) {
+                return fmt.Errorf("level %d: %v is followed by %v", depth, curr.key, curr.right.key)
+            }
+            n++
+            if curr.down == this.bottom {
+                continue
+            }
+            if expected_down != nil && curr.down != expected_down {
+                return fmt.Errorf("level %d: the gap of %v does not start after the previous one", depth, curr.key)
+            }
+            closing := curr.down
+            for this.nodeLess(closing, curr) {
+                closing = closing.right
+            }
+            if closing.inf != curr.inf || (!curr.inf && !this.hasKey(closing, curr.key)) {
+                return fmt.Errorf("level %d: the gap of %v is not closed by a copy of it", depth, curr.key)
+            }
+            if gap := this.gapSize(curr); curr != this.head && (gap < 1 || gap > 3) {
+                return fmt.Errorf("level %d: the gap of %v holds %d cells", depth, curr.key, gap)
+            }
+            expected_down = closing.right
+        }
+        if level.down == this.bottom {
+            if n - 1 != this.count {
+                return fmt.Errorf("bottom level holds %d keys, size() is %d", n - 1, this.count)
+            }
+            return nil
+        }
+        level = level.down
+    }
+}
+
+/**
+a skiplist biased towards skewed reads: every hit counts against the node,
+and a node with h hits is raised one level per hit until it stands
+bits.Len(h) levels tall, so hot keys of a Zipfian workload end up near the
+top of the search path. every decay_every lookups all counts are halved
+and nodes taller than their count warrants are lowered again, but never
+below the random height they were added with. contains() changes the
+structure, so one mutex guards the whole list
+**/
+type BiasedNode[K any] struct {
+    key K
+    hits uint32
+    base_level int
+    next []*BiasedNode[K]
+}
+
+type BiasedSkipList[K any] struct {
+    lock sync.Mutex
+    head *BiasedNode[K]
+    compare func(a, b K) int
+    count int
+    lookups int
+    listOptions
+}
+
+// lookups between two decays of the biased list's hit counts, defaults to 1 << 16
+func withDecay(every int) option {
+    return func(list *listOptions) {
+        list.decay_every = every
+    }
+}
+
+func newBiasedSkipList[K any](compare func(a, b K) int, opts ...option) *BiasedSkipList[K] {
+    list := BiasedSkipList[K]{
+        compare: compare,
+        listOptions: listOptions{
+            max_level: MAX_LEVEL,
+            prob: Prob,
+            decay_every: 1 << 16}}
+    for _, opt := range opts {
+        opt(&list.listOptions)
+    }
+    list.head = &BiasedNode[K]{next: make([]*BiasedNode[K], list.max_level)}
+    return &list
+}
+
+// the height a node has earned with its hits
+func (this *BiasedSkipList[K]) earned(node *BiasedNode[K]) int {
+    return min(max(node.base_level, bits.Len32(node.hits)), this.max_level)
+}
+
+func (this *BiasedSkipList[K]) find(key K) (*BiasedNode[K], []*BiasedNode[K]) {
+    preds := make([]*BiasedNode[K], this.max_level)
+    pred := this.head
+    for l := this.max_level - 1; l >= 0; l-- {
+        for pred.next[l] != nil && this.compare(pred.next[l].key, key) < 0 {
+            pred = pred.next[l]
+        }
+        preds[l] = pred
+    }
+    if found := preds[0].next[0]; found != nil && this.compare(found.key, key) == 0 {
+        return found, preds
+    }
+    return nil, preds
+}
+
+func (this *BiasedSkipList[K]) size() int {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    return this.count
+}
+
+func (this *BiasedSkipList[K]) contains(x K) bool {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    node, preds := this.find(x)
+    if node != nil {
+        if node.hits < math.MaxUint32 {
+            node.hits++
+        }
+        if level := len(node.next); level < this.earned(node) {
+            node.next = append(node.next, preds[level].next[level])
+            preds[level].next[level] = node
+        }
+    }
+    if this.lookups++; this.lookups >= this.decay_every {
+        this.decay()
+    }
+    return node != nil
+}
+
+func (this *BiasedSkipList[K]) add(x K) bool {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    node, preds := this.find(x)
+    if node != nil {
+        return false
+    }
+    top_level := level_source(this.max_level, this.prob)
+    node = &BiasedNode[K]{key: x, base_level: top_level, next: make([]*BiasedNode[K], top_level)}
+    for l := 0; l < top_level; l++ {
+        node.next[l] = preds[l].next[l]
+        preds[l].next[l] = node
+    }
+    this.count++
+    return true
+}
+
+func (this *BiasedSkipList[K]) remove(x K) bool {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    node, preds := this.find(x)
+    if node == nil {
+        return false
+    }
+    for l := range node.next {
+        preds[l].next[l] = node.next[l]
+    }
+    this.count--
+    return true
+}
+
+// sorted levels, each a sub-list of the one below, no node below its base height
+func (this *BiasedSkipList[K]) checkInvariants() error {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    below := map[*BiasedNode[K]]bool{}
+    for l := 0; l < this.max_level; l++ {
+        level := map[*BiasedNode[K]]bool{}
+        var prev *BiasedNode[K]
+        for curr := this.head.next[l]; curr != nil; curr = curr.next[l] {
+            if prev != nil && this.compare(prev.key, curr.key) >= 0 {
+                return fmt.Errorf("level %d: key %v follows %v", l, curr.key, prev.key)
+            }
+            if len(curr.next) <= l || len(curr.next) < curr.base_level {
+                return fmt.Errorf("level %d: node %v has height %d and base height %d", l, curr.key, len(curr.next), curr.base_level)
+            }
+            if l > 0 && !below[curr] {
+                return fmt.Errorf("level %d: node %v missing from level %d", l, curr.key, l - 1)
+            }
+            level[curr] = true
+            prev = curr
+        }
+        tall := 0
+        for node := range below {
+            if len(node.next) > l {
+                tall++
+            }
+        }
+        if l == 0 && len(level) != this.count {
+            return fmt.Errorf("level 0 holds %d nodes, size() is %d", len(level), this.count)
+        }
+        if l > 0 && len(level) != tall {
+            return fmt.Errorf("level %d holds %d nodes, %d nodes reach it", l, len(level), tall)
+        }
+        below = level
+    }
+    return nil
+}
+
+// halve every hit count and lower the nodes that no longer earn their height
+func (this *BiasedSkipList[K]) decay() {
+    this.lookups = 0
+    for curr := this.head.next[0]; curr != nil; curr = curr.next[0] {
+        curr.hits /= 2
+    }
+    // top-down, so a node is cut off one level at a time from its top
+    for l := this.max_level - 1; l > 0; l-- {
+        pred := this.head
+        for curr := pred.next[l]; curr != nil; curr = pred.next[l] {
+            if l == len(curr.next) - 1 && l >= this.earned(curr) {
+                pred.next[l] = curr.next[l]
+                curr.next = curr.next[:l]
+                continue
+            }
+            pred = curr
+        }
+    }
+}
+
+/**
+a skip graph: every node draws a membership vector whose first
+partition_bits bits are its partition, and at level i the nodes whose
+vectors share their first i bits form a doubly linked list in key order.
+level 0 holds everything, level partition_bits holds exactly one partition
+and the levels above make each partition a skip list of its own, so a
+search can start from any node and a partition can be scanned on its own.
+nodes stop at the first level where they have no company, but always reach
+partition_bits, and grow a level when a newcomer joins them there. one lock guards the graph
+**/
+type GraphNode[K any] struct {
+    key K
+    partition uint64
+    membership uint64
+    next []*GraphNode[K]
+    prev []*GraphNode[K]
+}
+
+type SkipGraph[K any] struct {
+    lock sync.RWMutex
+    compare func(a, b K) int
+    partition_bits int
+    // any node, where searches start
+    root *GraphNode[K]
+    // any node of each partition
+    entries map[uint64]*GraphNode[K]
+    count int
+}
+
+func newSkipGraph[K any](compare func(a, b K) int, partition_bits int) *SkipGraph[K] {
+    return &SkipGraph[K]{
+        compare: compare,
+        partition_bits: partition_bits,
+        entries: make(map[uint64]*GraphNode[K])}
+}
+
+// the nodes share the list at level
+func sameList[K any](a, b *GraphNode[K], level int) bool {
+    return level == 0 || a.membership >> (64 - level) == b.membership >> (64 - level)
+}
+
+/**
+the last node before key and the first node at or after it in the list at
+level that passes through start, either may be nil
+**/
+func (this *SkipGraph[K]) seek(start *GraphNode[K], key K, level int) (*GraphNode[K], *GraphNode[K]) {
+    curr := start
+    if this.compare(curr.key, key) < 0 {
+        for l := len(curr.next) - 1; l >= level; l-- {
+            for curr.next[l] != nil && this.compare(curr.next[l].key, key) < 0 {
+                curr = curr.next[l]
+            }
+        }
+        return curr, curr.next[level]
+    }
+    for l := len(curr.prev) - 1; l >= level; l-- {
+        for curr.prev[l] != nil && this.compare(curr.prev[l].key, key) >= 0 {
+            curr = curr.prev[l]
+        }
+    }
+    return curr.prev[level], curr
+}
+
+func (this *SkipGraph[K]) size() int {
+    this.lock.RLock()
+    defer this.lock.RUnlock()
+    return this.count
+}
+
+func (this *SkipGraph[K]) contains(x K) bool {
+    this.lock.RLock()
+    defer this.lock.RUnlock()
+    if this.root == nil {
+        return false
+    }
+    _, succ := this.seek(this.root, x, 0)
+    return succ != nil && this.compare(succ.key, x) == 0
+}
+
+func (this *SkipGraph[K]) add(x K, partition uint64) bool {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    node := &GraphNode[K]{key: x, partition: partition, membership: rand.Uint64()}
+    if this.partition_bits > 0 {
+        node.membership = partition << (64 - this.partition_bits) | node.membership >> this.partition_bits
+    }
+    var pred, succ *GraphNode[K]
+    if this.root != nil {
+        pred, succ = this.seek(this.root, x, 0)
+        if succ != nil && this.compare(succ.key, x) == 0 {
+            return false
+        }
+    }
+    for level := 0; level < 64; level++ {
+        // the nearest nodes on either side that share this level's list
+        for pred != nil && !sameList(pred, node, level) {
+            pred = pred.prev[level - 1]
+        }
+        for succ != nil && !sameList(succ, node, level) {
+            succ = succ.next[level - 1]
+        }
+        if pred == nil && succ == nil && level > this.partition_bits {
+            break
+        }
+        node.prev = append(node.prev, pred)
+        node.next = append(node.next, succ)
+        // a neighbour that had this list to itself has no link here yet
+        if pred != nil && len(pred.next) == level {
+            pred.prev = append(pred.prev, nil)
+            pred.next = append(pred.next, nil)
+        }
+        if succ != nil && len(succ.next) == level {
+            succ.prev = append(succ.prev, nil)
+            succ.next = append(succ.next, nil)
+        }
+        if pred != nil {
+            pred.next[level] = node
+        }
+        if succ != nil {
+            succ.prev[level] = node
+        }
+    }
+    if this.root == nil {
+        this.root = node
+    }
+    if this.entries[partition] == nil {
+        this.entries[partition] = node
+    }
+    this.count++
+    return true
+}
+
+func (this *SkipGraph[K]) remove(x K) bool {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    if this.root == nil {
+        return false
+    }
+    _, node := this.seek(this.root, x, 0)
+    if node == nil || this.compare(node.key, x) != 0 {
+        return false
+    }
+    for level := range node.next {
+        if node.prev[level] != nil {
+            node.prev[level].next[level] = node.next[level]
+        }
+        if node.next[level] != nil {
+            node.next[level].prev[level] = node.prev[level]
+        }
+    }
+    if this.root == node {
+        this.root = node.next[0]
+        if this.root == nil {
+            this.root = node.prev[0]
+        }
+    }
+    if this.entries[node.partition] == node {
+        level := this.partition_bits
+        if node.next[level] != nil {
+            this.entries[node.partition] = node.next[level]
+        } else if node.prev[level] != nil {
+            this.entries[node.partition] = node.prev[level]
+        } else {
+            delete(this.entries, node.partition)
+        }
+    }
+    this.count--
+    return true
+}
+
+// calls fn in key order for every key in [lo, hi) until fn returns false
+func (this *SkipGraph[K]) ascend(lo, hi K, fn func(key K, partition uint64) bool) {
+    this.lock.RLock()
+    defer this.lock.RUnlock()
+    if this.root != nil {
+        this.scan(this.root, 0, lo, hi, fn)
+    }
+}
+
+// like ascend(), but only over one partition
+func (this *SkipGraph[K]) ascendPartition(partition uint64, lo, hi K, fn func(key K, partition uint64) bool) {
+    this.lock.RLock()
+    defer this.lock.RUnlock()
+    if entry := this.entries[partition]; entry != nil {
+        this.scan(entry, this.partition_bits, lo, hi, fn)
+    }
+}
+
+func (this *SkipGraph[K]) scan(start *GraphNode[K], level int, lo, hi K, fn func(key K, partition uint64) bool) {
+    _, curr := this.seek(start, lo, level)
+    for ; curr != nil && this.compare(curr.key, hi) < 0; curr = curr.next[level] {
+        if !fn(curr.key, curr.partition) {
+            return
+        }
+    }
+}
+
+/**
+level 0 is sorted and doubly linked, and each node's neighbours at every
+level are the nearest nodes on level 0 that share that level's list
+**/
+func (this *SkipGraph[K]) checkInvariants() error {
+    this.lock.RLock()
+    defer this.lock.RUnlock()
+    nodes := []*GraphNode[K]{}
+    if this.root != nil {
+        first := this.root
+        for first.prev[0] != nil {
+            first = first.prev[0]
+        }
+        for curr := first; curr != nil; curr = curr.next[0] {
+            if len(nodes) > 0 && this.compare(nodes[len(nodes) - 1].key, curr.key) >= 0 {
+                return fmt.Errorf("key %v follows %v", curr.key, nodes[len(nodes) - 1].key)
+            }
+            nodes = append(nodes, curr)
+        }
+    }
+    if len(nodes) != this.count {
+        return fmt.Errorf("level 0 holds %d nodes, size() is %d", len(nodes), this.count)
+    }
+    for i, node := range nodes {
+        if len(node.next) <= this.partition_bits {
+            return fmt.Errorf("node %v stops at level %d, below its partition", node.key, len(node.next) - 1)
+        }
+        for level := range node.next {
+            var want_prev, want_next *GraphNode[K]
+            for j := i - 1; j >= 0 && want_prev == nil; j-- {
+                if sameList(nodes[j], node, level) {
+                    want_prev = nodes[j]
+                }
+            }
+            for j := i + 1; j < len(nodes) && want_next == nil; j++ {
+                if sameList(nodes[j], node, level) {
+                    want_next = nodes[j]
+                }
+            }
+            if node.prev[level] != want_prev || node.next[level] != want_next {
+                return fmt.Errorf("node %v has the wrong neighbours at level %d", node.key, level)
+            }
+        }
+    }
+    for partition, entry := range this.entries {
+        if entry.partition != partition {
+            return fmt.Errorf("entry of partition %d is node %v of partition %d", partition, entry.key, entry.partition)
+        }
+    }
+    return nil
+}
+
+/**
+a 2D point index on the ordered list: points on a 2^32 x 2^32 grid are
+keyed by their z-order (Morton) code, which interleaves the bits of x and y
+so that points close on the grid are mostly close in the list. queryRect()
+covers the rectangle with aligned quadrants, each one a contiguous run of
+codes, and scans those runs
+**/
+type pointIndex struct {
+    list LazySkipList[uint64]
+}
+
+func newPointIndex(opts ...option) *pointIndex {
+    return &pointIndex{list: newOrderedList[uint64](opts...)}
+}
+
+// spreads the bits of v over the even bits of the result
+func spreadBits(v uint32) uint64 {
+    z := uint64(v)
+    z = (z | z << 16) & 0x0000ffff0000ffff
+    z = (z | z << 8) & 0x00ff00ff00ff00ff
+    z = (z | z << 4) & 0x0f0f0f0f0f0f0f0f
+    z = (z | z << 2) & 0x3333333333333333
+    z = (z | z << 1) & 0x5555555555555555
+    return z
+}
+
+func compactBits(z uint64) uint32 {
+    z &= 0x5555555555555555
+    z = (z | z >> 1) & 0x3333333333333333
+    z = (z | z >> 2) & 0x0f0f0f0f0f0f0f0f
+    z = (z | z >> 4) & 0x00ff00ff00ff00ff
+    z = (z | z >> 8) & 0x0000ffff0000ffff
+    z = (z | z >> 16) & 0x00000000ffffffff
+    return uint32(z)
+}
+
+func mortonCode(x, y uint32) uint64 {
+    return spreadBits(x) | spreadBits(y) << 1
+}
+
+func mortonPoint(z uint64) (uint32, uint32) {
+    return compactBits(z), compactBits(z >> 1)
+}
+
+func (this *pointIndex) put(x, y uint32, item int) putResult {
+    return this.list.put(mortonCode(x, y), item)
+}
+
+func (this *pointIndex) get(x, y uint32) (int, bool) {
+    return this.list.get(mortonCode(x, y))
+}
+
+func (this *pointIndex) remove(x, y uint32) bool {
+    return this.list.remove(mortonCode(x, y))
+}
+
+func (this *pointIndex) size() int {
+    return this.list.size()
+}
+
+/**
+calls fn for every point with min_x <= x <= max_x and min_y <= y <= max_y,
+in z-order, until fn returns false
+**/
+func (this *pointIndex) queryRect(min_x, min_y, max_x, max_y uint32, fn func(x, y uint32, item int) bool) {
+    if min_x > max_x || min_y > max_y {
+        return
+    }
+    for _, r := range zRanges(min_x, min_y, max_x, max_y) {
+        done := false
+        this.list.ascend(r[0], r[1], func(z uint64, item int) bool {
+            if x, y := mortonPoint(z); x >= min_x && x <= max_x && y >= min_y && y <= max_y {
+                done = !fn(x, y, item)
+            }
+            return !done
+        })
+        // ascend() stops short of its upper bound
+        if !done {
+            if item, ok := this.list.get(r[1]); ok {
+                if x, y := mortonPoint(r[1]); x >= min_x && x <= max_x && y >= min_y && y <= max_y {
+                    done = !fn(x, y, item)
+                }
+            }
+        }
+        if done {
+            return
+        }
+    }
+}
+
+/**
+the runs of z codes [lo, hi] that cover the rectangle, in order. quadrants
+inside the rectangle are exact; those crossing its edge are split until
+they are about a sixteenth of its longer side, then scanned whole, so a
+query costs a few dozen runs at most and the caller filters the points
+that fall outside
+**/
+func zRanges(min_x, min_y, max_x, max_y uint32) [][2]uint64 {
+    side := max(max_x - min_x, max_y - min_y)
+    stop_level := max(bits.Len32(side) - 4, 0)
+    ranges := [][2]uint64{}
+    var visit func(z uint64, level int)
+    visit = func(z uint64, level int) {
+        x0, y0 := mortonPoint(z)
+        x1 := uint64(x0) + (1 << level) - 1
+        y1 := uint64(y0) + (1 << level) - 1
+        if x1 < uint64(min_x) || uint64(x0) > uint64(max_x) || y1 < uint64(min_y) || uint64(y0) > uint64(max_y) {
+            return
+        }
+        inside := x0 >= min_x && x1 <= uint64(max_x) && y0 >= min_y && y1 <= uint64(max_y)
+        if inside || level <= stop_level {
+            hi := z + (1 << (2 * level)) - 1
+            if level == 32 {
+                hi = math.MaxUint64
+            }
+            if n := len(ranges); n > 0 && ranges[n - 1][1] + 1 == z {
+                ranges[n - 1][1] = hi
+            } else {
+                ranges = append(ranges, [2]uint64{z, hi})
+            }
+            return
+        }
+        for quadrant := uint64(0); quadrant < 4; quadrant++ {
+            visit(z + quadrant << (2 * (level - 1)), level - 1)
+        }
+    }
+    visit(0, 32)
+    return ranges
+}
+
+/**
+a list built once from sorted keys and never changed, so reads need no
+locks, flags or atomics. towers are not random: the i-th node (from 1)
+is as tall as the number of times 2 divides i, plus one, which halves
+every level exactly and bounds a search at one step forward per level
+**/
+type ImmutableNode[K any] struct {
+    key K
+    item int
+    next []*ImmutableNode[K]
+}
+
+type ImmutableSkipList[K any] struct {
+    head *ImmutableNode[K]
+    compare func(a, b K) int
+    count int
+}
+
+/**
+keys must be strictly increasing under compare. items holds the item of
+each key and may be nil for all zeros
+**/
+func newImmutableSkipList[K any](compare func(a, b K) int, keys []K, items []int) (*ImmutableSkipList[K], error) {
+    if items != nil && len(items) != len(keys) {
+        return nil, fmt.Errorf("%d items for %d keys", len(items), len(keys))
+    }
+    levels := bits.Len(uint(len(keys))) + 1
+    list := &ImmutableSkipList[K]{
+        head: &ImmutableNode[K]{next: make([]*ImmutableNode[K], levels)},
+        compare: compare,
+        count: len(keys)}
+    last := make([]*ImmutableNode[K], levels)
+    for l := range last {
+        last[l] = list.head
+    }
+    for i, key := range keys {
+        if i > 0 && compare(keys[i - 1], key) >= 0 {
+            return nil, fmt.Errorf("key %v at %d does not sort after %v", key, i, keys[i - 1])
+        }
+        node := &ImmutableNode[K]{key: key, next: make([]*ImmutableNode[K], bits.TrailingZeros(uint(i + 1)) + 1)}
+        if items != nil {
+            node.item = items[i]
+        }
+        for l := range node.next {
+            last[l].next[l] = node
+            last[l] = node
+        }
+    }
+    return list, nil
+}
+
+// the last node before key, head if there is none
+func (this *ImmutableSkipList[K]) find(key K) *ImmutableNode[K] {
+    pred := this.head
+    for l := len(this.head.next) - 1; l >= 0; l-- {
+        for pred.next[l] != nil && this.compare(pred.next[l].key, key) < 0 {
+            pred = pred.next[l]
+        }
+    }
+    return pred
+}
+
+func (this *ImmutableSkipList[K]) size() int {
+    return this.count
+}
+
+func (this *ImmutableSkipList[K]) get(key K) (int, bool) {
+    node := this.find(key).next[0]
+    if node == nil || this.compare(node.key, key) != 0 {
+        return 0, false
+    }
+    return node.item, true
+}
+
+func (this *ImmutableSkipList[K]) contains(x K) bool {
+    _, ok := this.get(x)
+    return ok
+}
+
+// calls fn in key order for every key in [lo, hi) until fn returns false
+func (this *ImmutableSkipList[K]) ascend(lo, hi K, fn func(key K, item int) bool) {
+    for curr := this.find(lo).next[0]; curr != nil && this.compare(curr.key, hi) < 0; curr = curr.next[0] {
+        if !fn(curr.key, curr.item) {
+            return
+        }
+    }
+}
+
+// a lazy list with the same entries, for when the table has to change after all
+func (this *ImmutableSkipList[K]) toMutable(opts ...option) LazySkipList[K] {
+    list := newListFunc(this.compare, opts...)
+    for curr := this.head.next[0]; curr != nil; curr = curr.next[0] {
+        list.put(curr.key, curr.item)
+    }
+    return list
+}
+
+/**
+a partially persistent list: every put() and remove() makes a new
+version, and a persistentVersion keeps reading the list as it was when it
+was made, for as long as it is held, with no locks. nothing is copied:
+each next pointer keeps its history, newest first, and a reader follows
+the newest link that is not younger than its version. one writer at a
+time; histories are never trimmed, so a list that is overwritten forever
+grows forever
+**/
+type linkRecord[K any] struct {
+    version uint64
+    // nil past the last node
+    node *PersistentNode[K]
+    older *linkRecord[K]
+}
+
+type PersistentNode[K any] struct {
+    key K
+    item int
+    next []atomic.Pointer[linkRecord[K]]
+}
+
+type PersistentSkipList[K any] struct {
+    head *PersistentNode[K]
+    compare func(a, b K) int
+    // serializes writers
+    lock sync.Mutex
+    latest atomic.Pointer[persistentVersion[K]]
+    listOptions
+}
+
+// the list as of one put() or remove()
+type persistentVersion[K any] struct {
+    list *PersistentSkipList[K]
+    version uint64
+    count int
+}
+
+func newPersistentSkipList[K any](compare func(a, b K) int, opts ...option) *PersistentSkipList[K] {
+    list := &PersistentSkipList[K]{
+        compare: compare,
+        listOptions: listOptions{
+            max_level: MAX_LEVEL,
+            prob: Prob}}
+    for _, opt := range opts {
+        opt(&list.listOptions)
+    }
+    list.head = &PersistentNode[K]{next: make([]atomic.Pointer[linkRecord[K]], list.max_level)}
+    list.latest.Store(&persistentVersion[K]{list: list})
+    return list
+}
+
+// the successor of node at level as of version
+func (this *PersistentNode[K]) at(level int, version uint64) *PersistentNode[K] {
+    link := this.next[level].Load()
+    for link != nil && link.version > version {
+        link = link.older
+    }
+    if link == nil {
+        return nil
+    }
+    return link.node
+}
+
+func (this *PersistentNode[K]) link(level int, version uint64, node *PersistentNode[K]) {
+    this.next[level].Store(&linkRecord[K]{version: version, node: node, older: this.next[level].Load()})
+}
+
+// the newest version, made by the last put() or remove() to return
+func (this *PersistentSkipList[K]) current() persistentVersion[K] {
+    return *this.latest.Load()
+}
+
+// preds and succs at every level as of version, succs[0] may hold key
+func (this *PersistentSkipList[K]) find(key K, version uint64) ([]*PersistentNode[K], []*PersistentNode[K]) {
+    preds := make([]*PersistentNode[K], this.max_level)
+    succs := make([]*PersistentNode[K], this.max_level)
+    pred := this.head
+    for l := this.max_level - 1; l >= 0; l-- {
+        curr := pred.at(l, version)
+        for curr != nil && this.compare(curr.key, key) < 0 {
+            pred = curr
+            curr = pred.at(l, version)
+        }
+        preds[l] = pred
+        succs[l] = curr
+    }
+    return preds, succs
+}
+
+/**
+a version where key holds item, replacing the node of an existing key.
+versions made before stay as they were
+**/
+func (this *PersistentSkipList[K]) put(key K, item int) persistentVersion[K] {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    prev := this.latest.Load()
+    version := prev.version + 1
+    count := prev.count + 1
+    preds, succs := this.find(key, prev.version)
+    old := succs[0]
+    old_levels := 0
+    if old != nil && this.compare(old.key, key) == 0 {
+        old_levels = len(old.next)
+        for l := 0; l < old_levels; l++ {
+            succs[l] = old.at(l, prev.version)
+        }
+        count--
+    }
+    new_node := &PersistentNode[K]{key: key, item: item, next: make([]atomic.Pointer[linkRecord[K]], level_source(this.max_level, this.prob))}
+    for l := range new_node.next {
+        new_node.link(l, version, succs[l])
+    }
+    for l := 0; l < max(len(new_node.next), old_levels); l++ {
+        if l < len(new_node.next) {
+            preds[l].link(l, version, new_node)
+        } else {
+            preds[l].link(l, version, succs[l])
+        }
+    }
+    next := &persistentVersion[K]{list: this, version: version, count: count}
+    this.latest.Store(next)
+    return *next
+}
+
+// a version without key, and whether key was there to remove
+func (this *PersistentSkipList[K]) remove(key K) (persistentVersion[K], bool) {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    prev := this.latest.Load()
+    preds, succs := this.find(key, prev.version)
+    old := succs[0]
+    if old == nil || this.compare(old.key, key) != 0 {
+        return *prev, false
+    }
+    version := prev.version + 1
+    for l := range old.next {
+        preds[l].link(l, version, old.at(l, prev.version))
+    }
+    next := &persistentVersion[K]{list: this, version: version, count: prev.count - 1}
+    this.latest.Store(next)
+    return *next, true
+}
+
+func (this persistentVersion[K]) size() int {
+    return this.count
+}
+
+func (this persistentVersion[K]) get(key K) (int, bool) {
+    _, succs := this.list.find(key, this.version)
+    if succs[0] == nil || this.list.compare(succs[0].key, key) != 0 {
+        return 0, false
+    }
+    return succs[0].item, true
+}
+
+func (this persistentVersion[K]) contains(x K) bool {
+    _, ok := this.get(x)
+    return ok
+}
+
+// calls fn in key order for every key in [lo, hi) until fn returns false
+func (this persistentVersion[K]) ascend(lo, hi K, fn func(key K, item int) bool) {
+    _, succs := this.list.find(lo, this.version)
+    for curr := succs[0]; curr != nil && this.list.compare(curr.key, hi) < 0; curr = curr.at(0, this.version) {
+        if !fn(curr.key, curr.item) {
+            return
+        }
+    }
+}
+
+/**
+resumeScan() on a version: the scan goes on in the version it started in,
+so a checkpoint from another version is an error. a rebuilt list numbers
+its versions anew, and a caller that knows it rebuilt the same one may
+set cp.Version to this one's
+**/
+func (this persistentVersion[K]) resumeScan(cp *scanCheckpoint[K], fn func(key K, item int) bool) error {
+    if cp.Started && cp.Version != this.version {
+        return fmt.Errorf("checkpoint is of version %d, this is version %d", cp.Version, this.version)
+    }
+    cp.Version = this.version
+    if cp.Done {
+        return nil
+    }
+    curr := this.list.head.at(0, this.version)
+    if cp.Started {
+        _, succs := this.list.find(cp.Last, this.version)
+        curr = succs[0]
+        for curr != nil && this.list.compare(curr.key, cp.Last) == 0 {
+            curr = curr.at(0, this.version)
+        }
+    }
+    for ; curr != nil; curr = curr.at(0, this.version) {
+        cp.Last, cp.Started = curr.key, true
+        if !fn(curr.key, curr.item) {
+            return nil
+        }
+    }
+    cp.Done = true
+    return nil
+}
+
+// cursor() on a version, which is a snapshot
+func (this persistentVersion[K]) cursor() func() (key K, item int, ok bool) {
+    curr := this.list.head
+    return func() (K, int, bool) {
+        if curr != nil {
+            curr = curr.at(0, this.version)
+        }
+        if curr == nil {
+            var zero K
+            return zero, 0, false
+        }
+        return curr.key, curr.item, true
+    }
+}
+
+/**
+write combining for a lazy list under heavy write contention: add(),
+put() and remove() queue their operation and wait, while a few committer
+goroutines take whatever has queued up, sort it by key and apply it in
+that order. consecutive operations then walk mostly the same towers, which
+are still in cache, and fewer goroutines fight over the same predecessor
+locks. reads go straight to the list
+**/
+type groupOp[K any] struct {
+    key K
+    item int
+    op uint8
+    result putResult
+    removed bool
+    // what the operation panicked with, raised again in the submitter
+    panicked interface{}
+    done chan struct{}
+}
+
+type groupCommitter[K any] struct {
+    list *LazySkipList[K]
+    queue chan *groupOp[K]
+    max_batch int
+    committers sync.WaitGroup
+}
+
+func newGroupCommitter[K any](list *LazySkipList[K], num_committers, max_batch int) *groupCommitter[K] {
+    group := &groupCommitter[K]{
+        list: list,
+        queue: make(chan *groupOp[K], num_committers * max_batch),
+        max_batch: max_batch}
+    for i := 0; i < num_committers; i++ {
+        group.committers.Add(1)
+        go group.commit()
+    }
+    return group
+}
+
+func (this *groupCommitter[K]) commit() {
+    defer this.committers.Done()
+    batch := []*groupOp[K]{}
+    for op := range this.queue {
+        batch = append(batch[:0], op)
+    drain:
+        for len(batch) < this.max_batch {
+            select {
+            case op, ok := <-this.queue:
+                if !ok {
+                    break drain
+                }
+                batch = append(batch, op)
+            default:
+                break drain
+            }
+        }
+        for _, op := range this.sorted(batch) {
+            this.apply(op)
+        }
+    }
+}
+
+// the batch in key order, stable so one key's operations keep their queue
+// order. in queue order if compare panics, the operations then meet it again
+func (this *groupCommitter[K]) sorted(batch []*groupOp[K]) (ordered []*groupOp[K]) {
+    defer func() {
+        if recover() != nil {
+            ordered = batch
+        }
+    }()
+    ordered = append([]*groupOp[K]{}, batch...)
+    sort.SliceStable(ordered, func(i, j int) bool {
+        return this.list.compare(ordered[i].key, ordered[j].key) < 0
+    })
+    return ordered
+}
+
+// a panic would end the committer with the batch still waiting, it goes to the submitter instead
+func (this *groupCommitter[K]) apply(op *groupOp[K]) {
+    defer close(op.done)
+    defer func() {
+        op.panicked = recover()
+    }()
+    if op.op == OP_REMOVE {
+        op.removed = this.list.remove(op.key)
+    } else {
+        op.result = this.list.put(op.key, op.item)
+    }
+}
+
+func (this *groupCommitter[K]) submit(op *groupOp[K]) *groupOp[K] {
+    op.done = make(chan struct{})
+    this.queue <- op
+    <-op.done
+    if op.panicked != nil {
+        panic(op.panicked)
+    }
+    return op
+}
+
+func (this *groupCommitter[K]) put(key K, item int) putResult {
+    return this.submit(&groupOp[K]{key: key, item: item, op: OP_ADD}).result
+}
+
+func (this *groupCommitter[K]) add(x K) bool {
+    return this.put(x, 0).added()
+}
+
+func (this *groupCommitter[K]) remove(x K) bool {
+    return this.submit(&groupOp[K]{key: x, op: OP_REMOVE}).removed
+}
+
+func (this *groupCommitter[K]) contains(x K) bool {
+    return this.list.contains(x)
+}
+
+// stops the committers once the queue is drained, no writes may follow
+func (this *groupCommitter[K]) close() {
+    close(this.queue)
+    this.committers.Wait()
+}
+
+/**
+flat combining for writes: a writer pushes its request on a shared stack
+and whoever holds the combiner lock applies every request it finds there,
+its own among them, while the others wait for theirs to be marked done.
+the list then sees one writer at a time, so its locks are never
+contended, at the price of writers taking turns. reads go straight to
+the list
+**/
+type combiningRequest[K any] struct {
+    key K
+    item int
+    op uint8
+    result putResult
+    removed bool
+    // what the operation panicked with, raised again in its owner
+    panicked interface{}
+    done int32
+    next *combiningRequest[K]
+}
+
+// a combiner takes at most this many batches before handing over
+const COMBINING_PASSES int = 4
+
+type FlatCombiningList[K any] struct {
+    list LazySkipList[K]
+    pending atomic.Pointer[combiningRequest[K]]
+    combiner sync.Mutex
+    // pairs completed by eliminate()
+    eliminated int64
+}
+
+/**
+pairs each pending put(key) with a pending remove(key) and completes both
+without touching the list. the two are concurrent, so they may take
+effect in either order: a put and then a remove when the key is absent,
+a remove and then a put of the item it already has when it is present.
+the combiner is the only writer, so what it reads is exact. pairs go
+first, and whatever is left is applied as usual. not for KEEP_BOTH,
+where the re-added entry would move behind its duplicates
+**/
+func (this *FlatCombiningList[K]) eliminate(requests []*combiningRequest[K]) {
+    if this.list.on_duplicate == KEEP_BOTH || this.list.isFrozen() {
+        return
+    }
+    // a panicking compare ends the pairing, the requests still pending
+    // are applied one by one and the panic goes to whichever meets it
+    defer func() {
+        recover()
+    }()
+    sort.SliceStable(requests, func(i, j int) bool {
+        return this.list.compare(requests[i].key, requests[j].key) < 0
+    })
+    for start := 0; start < len(requests); {
+        end := start + 1
+        for end < len(requests) && this.list.compare(requests[start].key, requests[end].key) == 0 {
+            end++
+        }
+        item, found := this.list.lookup(requests[start].key)
+        if found == DELETED {
+            // a put and remove applied would leave the key ABSENT, not its tombstone
+            start = end
+            continue
+        }
+        present := found == FOUND
+        puts, removes := []*combiningRequest[K]{}, []*combiningRequest[K]{}
+        for _, request := range requests[start:end] {
+            if request.op == OP_REMOVE {
+                removes = append(removes, request)
+            } else if !present || request.item == item {
+                puts = append(puts, request)
+            }
+        }
+        for i := 0; i < len(puts) && i < len(removes); i++ {
+            puts[i].result = PUT_INSERTED
+            removes[i].removed = true
+            atomic.StoreInt32(&puts[i].done, 1)
+            atomic.StoreInt32(&removes[i].done, 1)
+            this.eliminated++
+        }
+        start = end
+    }
+}
+
+func newFlatCombiningList[K any](compare func(a, b K) int, opts ...option) *FlatCombiningList[K] {
+    return &FlatCombiningList[K]{list: newListFunc(compare, opts...)}
+}
+
+// newFlatCombiningList() with newList()'s checks on the options
+func newCheckedFlatCombiningList[K any](compare func(a, b K) int, opts ...option) (*FlatCombiningList[K], error) {
+    list, err := newList[K](append(append([]option{}, opts...), withCompare(compare))...)
+    if err != nil {
+        return nil, err
+    }
+    return &FlatCombiningList[K]{list: list}, nil
+}
+
+func (this *FlatCombiningList[K]) submit(request *combiningRequest[K]) *combiningRequest[K] {
+    for {
+        request.next = this.pending.Load()
+        if this.pending.CompareAndSwap(request.next, request) {
+            break
+        }
+    }
+    for atomic.LoadInt32(&request.done) == 0 {
+        if !this.combiner.TryLock() {
+            runtime.Gosched()
+            continue
+        }
+        this.combine()
+    }
+    if request.panicked != nil {
+        panic(request.panicked)
+    }
+    return request
+}
+
+// applies what is pending, with the combiner lock held
+func (this *FlatCombiningList[K]) combine() {
+    defer this.combiner.Unlock()
+    for pass := 0; pass < COMBINING_PASSES; pass++ {
+        batch := this.pending.Swap(nil)
+        if batch == nil {
+            break
+        }
+        // the owner may return as soon as done is set, so next is read first
+        requests := []*combiningRequest[K]{}
+        for ; batch != nil; batch = batch.next {
+            requests = append(requests, batch)
+        }
+        if this.list.eliminate {
+            this.eliminate(requests)
+        }
+        for _, request := range requests {
+            if atomic.LoadInt32(&request.done) == 1 {
+                continue
+            }
+            this.apply(request)
+        }
+    }
+}
+
+// a panic is handed to the request's owner, the combiner goes on with the rest
+func (this *FlatCombiningList[K]) apply(request *combiningRequest[K]) {
+    defer atomic.StoreInt32(&request.done, 1)
+    defer func() {
+        request.panicked = recover()
+    }()
+    if request.op == OP_REMOVE {
+        request.removed = this.list.remove(request.key)
+    } else {
+        request.result = this.list.put(request.key, request.item)
+    }
+}
+
+func (this *FlatCombiningList[K]) put(key K, item int) putResult {
+    return this.submit(&combiningRequest[K]{key: key, item: item, op: OP_ADD}).result
+}
+
+func (this *FlatCombiningList[K]) add(x K) bool {
+    return this.put(x, 0).added()
+}
+
+func (this *FlatCombiningList[K]) remove(x K) bool {
+    return this.submit(&combiningRequest[K]{key: x, op: OP_REMOVE}).removed
+}
+
+func (this *FlatCombiningList[K]) contains(x K) bool {
+    return this.list.contains(x)
+}
+
+func (this *FlatCombiningList[K]) get(key K) (int, bool) {
+    return this.list.get(key)
+}
+
+func (this *FlatCombiningList[K]) size() int {
+    return this.list.size()
+}
+
+/**
+the core operations, for concerns that wrap a list instead of living in
+it: a wrapper takes the sortedMap it decorates and is one itself, so
+wrappers stack in any order, the outermost seeing each call first.
+*LazySkipList and *FlatCombiningList are sortedMaps
+**/
+type sortedMap[K any] interface {
+    get(key K) (int, bool)
+    put(key K, item int) putResult
+    remove(key K) bool
+    contains(key K) bool
+    size() int
+}
+
+// calls and the time spent in them, of one operation
+type opMetrics struct {
+    calls int64
+    nanos int64
+}
+
+func (this *opMetrics) record(start time.Time) {
+    atomic.AddInt64(&this.calls, 1)
+    atomic.AddInt64(&this.nanos, int64(time.Since(start)))
+}
+
+func (this *opMetrics) mean() time.Duration {
+    calls := atomic.LoadInt64(&this.calls)
+    if calls == 0 {
+        return 0
+    }
+    return time.Duration(atomic.LoadInt64(&this.nanos) / calls)
+}
+
+// counts every call and times it, get() hits are counted apart
+type metricsMap[K any] struct {
+    inner sortedMap[K]
+    gets, puts, removes, lookups opMetrics
+    hits int64
+}
+
+func withMetrics[K any](inner sortedMap[K]) *metricsMap[K] {
+    return &metricsMap[K]{inner: inner}
+}
+
+func (this *metricsMap[K]) get(key K) (int, bool) {
+    defer this.gets.record(time.Now())
+    item, ok := this.inner.get(key)
+    if ok {
+        atomic.AddInt64(&this.hits, 1)
+    }
+    return item, ok
+}
+
+func (this *metricsMap[K]) put(key K, item int) putResult {
+    defer this.puts.record(time.Now())
+    return this.inner.put(key, item)
+}
+
+func (this *metricsMap[K]) remove(key K) bool {
+    defer this.removes.record(time.Now())
+    return this.inner.remove(key)
+}
+
+func (this *metricsMap[K]) contains(key K) bool {
+    defer this.lookups.record(time.Now())
+    return this.inner.contains(key)
+}
+
+func (this *metricsMap[K]) size() int {
+    return this.inner.size()
+}
+
+// one line per write, and per read too if reads is set. lines never interleave
+type loggingMap[K any] struct {
+    inner sortedMap[K]
+    w io.Writer
+    reads bool
+    lock sync.Mutex
+}
+
+func withLogging[K any](inner sortedMap[K], w io.Writer, reads bool) *loggingMap[K] {
+    return &loggingMap[K]{inner: inner, w: w, reads: reads}
+}
+
+func (this *loggingMap[K]) log(format string, args ...interface{}) {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    fmt.Fprintf(this.w, format + "\n", args...)
+}
+
+func (this *loggingMap[K]) get(key K) (int, bool) {
+    item, ok := this.inner.get(key)
+    if this.reads {
+        this.log("get %v: %d, %v", key, item, ok)
+    }
+    return item, ok
+}
+
+func (this *loggingMap[K]) put(key K, item int) putResult {
+    result := this.inner.put(key, item)
+    this.log("put %v %d: %v", key, item, result)
+    return result
+}
+
+func (this *loggingMap[K]) remove(key K) bool {
+    removed := this.inner.remove(key)
+    this.log("remove %v: %v", key, removed)
+    return removed
+}
+
+func (this *loggingMap[K]) contains(key K) bool {
+    found := this.inner.contains(key)
+    if this.reads {
+        this.log("contains %v: %v", key, found)
+    }
+    return found
+}
+
+func (this *loggingMap[K]) size() int {
+    return this.inner.size()
+}
+
+/**
+rejects a put() that check() returns an error for before it reaches the
+list, and keeps the last such error for the caller to look at. other
+operations pass straight through
+**/
+type validatingMap[K any] struct {
+    inner sortedMap[K]
+    check func(key K, item int) error
+    rejected int64
+    last atomic.Pointer[error]
+}
+
+func withValidation[K any](inner sortedMap[K], check func(key K, item int) error) *validatingMap[K] {
+    return &validatingMap[K]{inner: inner, check: check}
+}
+
+func (this *validatingMap[K]) put(key K, item int) putResult {
+    if err := this.check(key, item); err != nil {
+        atomic.AddInt64(&this.rejected, 1)
+        this.last.Store(&err)
+        return PUT_REJECTED
+    }
+    return this.inner.put(key, item)
+}
+
+// the error of the latest rejected put(), nil if there was none
+func (this *validatingMap[K]) err() error {
+    if err := this.last.Load(); err != nil {
+        return *err
+    }
+    return nil
+}
+
+func (this *validatingMap[K]) get(key K) (int, bool) {
+    return this.inner.get(key)
+}
+
+func (this *validatingMap[K]) remove(key K) bool {
+    return this.inner.remove(key)
+}
+
+func (this *validatingMap[K]) contains(key K) bool {
+    return this.inner.contains(key)
+}
+
+func (this *validatingMap[K]) size() int {
+    return this.inner.size()
+}
+
+/**
+implementations by name, so a program can pick one from its configuration:
+openMap[K]("lazy", opts...). the built-in ones work for every key type;
+others register a constructor for the key types they support, each a
+func(opts ...option) (sortedMap[K], error), and may share a name across
+key types
+**/
+var map_registry = struct {
+    lock sync.Mutex
+    factories map[string][]interface{}
+}{factories: map[string][]interface{}{}}
+
+var builtin_maps = []string{"elimination", "flatcombining", "lazy"}
+
+func registerMap[K any](name string, factory func(opts ...option) (sortedMap[K], error)) error {
+    for _, builtin := range builtin_maps {
+        if name == builtin {
+            return fmt.Errorf("%q is built in", name)
+        }
+    }
+    map_registry.lock.Lock()
+    defer map_registry.lock.Unlock()
+    for _, registered := range map_registry.factories[name] {
+        if _, ok := registered.(func(opts ...option) (sortedMap[K], error)); ok {
+            return fmt.Errorf("%q is already registered for %T keys", name, *new(K))
+        }
+    }
+    map_registry.factories[name] = append(map_registry.factories[name], factory)
+    return nil
+}
+
+// the built-in names and every registered one, sorted
+func mapNames() []string {
+    map_registry.lock.Lock()
+    defer map_registry.lock.Unlock()
+    names := append([]string{}, builtin_maps...)
+    for name := range map_registry.factories {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// a new map of the named implementation, with newList()'s checks on the options
+func openMap[K any](name string, opts ...option) (sortedMap[K], error) {
+    switch name {
+    case "lazy":
+        list, err := newList[K](opts...)
+        if err != nil {
+            return nil, err
+        }
+        return &list, nil
+    case "flatcombining", "elimination":
+        if name == "elimination" {
+            opts = append(opts, withElimination())
+        }
+        list, err := newList[K](opts...)
+        if err != nil {
+            return nil, err
+        }
+        return &FlatCombiningList[K]{list: list}, nil
+    }
+    map_registry.lock.Lock()
+    registered := map_registry.factories[name]
+    map_registry.lock.Unlock()
+    if len(registered) == 0 {
+        return nil, fmt.Errorf("no implementation named %q, there are %s", name, strings.Join(mapNames(), ", "))
+    }
+    for _, factory := range registered {
+        if factory, ok := factory.(func(opts ...option) (sortedMap[K], error)); ok {
+            return factory(opts...)
+        }
+    }
+    return nil, fmt.Errorf("%q does not support %T keys", name, *new(K))
+}
+
+/**
+the methods of sync.Map on a lazy list, so code written against sync.Map
+gets ordered keys, and Range() in key order, by changing the type. values
+sit beside the items and are read and written under the node lock; Range()
+calls f with no lock held. unlike sync.Map the zero value is not ready,
+use newSyncMap()
+**/
+type SyncMap[K any] struct {
+    list LazySkipList[K]
+}
+
+// nil until the entry's first value is in, the entry does not exist till then
+type syncValue struct {
+    v interface{}
+}
+
+func newSyncMap[K cmp.Ordered](opts ...option) *SyncMap[K] {
+    return &SyncMap[K]{list: newOrderedList[K](opts...)}
+}
+
+// newSyncMap() with newList()'s checks on the options
+func newCheckedSyncMap[K cmp.Ordered](opts ...option) (*SyncMap[K], error) {
+    list, err := newCheckedOrderedList[K](opts...)
+    if err != nil {
+        return nil, err
+    }
+    return &SyncMap[K]{list: list}, nil
+}
+
+/**
+the key's node, locked, nil if there is none. created first if create is
+set, with no values yet: the facades that keep theirs in values treat such
+a node as absent. a creation the list refuses, frozen or under
+withBackpressure(), is err_frozen or err_over_capacity with a nil node
+**/
+func (this *LazySkipList[K]) lockEntry(key K, create bool) (*Node[K], error) {
+    for {
+        node := this.firstLive(key)
+        if node == nil || node.isTombstone() {
+            if !create {
+                return nil, nil
+            }
+            if this.high_water > 0 && !this.admit() {
+                return nil, err_over_capacity
+            }
+            if result, _ := this.storeFrom(key, 0, false, true, nil); result == PUT_FROZEN {
+                return nil, err_frozen
+            }
+            continue
+        }
+        this.lockNode(node)
+        if node.marked {
+            this.unlockNode(node)
+            continue
+        }
+        return node, nil
+    }
+}
+
+func (this *SyncMap[K]) Load(key K) (value interface{}, ok bool) {
+    node, _ := this.list.lockEntry(key, false)
+    if node == nil {
+        return nil, false
+    }
+    box, _ := node.values.(*syncValue)
+    this.list.unlockNode(node)
+    if box == nil {
+        return nil, false
+    }
+    return box.v, true
+}
+
+/**
+Store(), Swap() and LoadOrStore() have sync.Map's signatures, which leave
+no room for an error, so a new key the list refuses, frozen or under
+withBackpressure(), panics with err_frozen or err_over_capacity. trySwap()
+returns it instead
+**/
+func (this *SyncMap[K]) Store(key K, value interface{}) {
+    this.Swap(key, value)
+}
+
+func (this *SyncMap[K]) Swap(key K, value interface{}) (previous interface{}, loaded bool) {
+    previous, loaded, err := this.trySwap(key, value)
+    if err != nil {
+        panic(err)
+    }
+    return previous, loaded
+}
+
+func (this *SyncMap[K]) trySwap(key K, value interface{}) (previous interface{}, loaded bool, err error) {
+    node, err := this.list.lockEntry(key, true)
+    if err != nil {
+        return nil, false, err
+    }
+    box, _ := node.values.(*syncValue)
+    node.values = &syncValue{v: value}
+    this.list.unlockNode(node)
+    if box == nil {
+        return nil, false, nil
+    }
+    return box.v, true, nil
+}
+
+func (this *SyncMap[K]) LoadOrStore(key K, value interface{}) (actual interface{}, loaded bool) {
+    node, err := this.list.lockEntry(key, true)
+    if err != nil {
+        panic(err)
+    }
+    defer this.list.unlockNode(node)
+    if box, _ := node.values.(*syncValue); box != nil {
+        return box.v, true
+    }
+    node.values = &syncValue{v: value}
+    return value, false
+}
+
+// like sync.Map, panics if old and the value are of the same uncomparable type
+func (this *SyncMap[K]) CompareAndSwap(key K, old, new interface{}) bool {
+    node, _ := this.list.lockEntry(key, false)
+    if node == nil {
+        return false
+    }
+    defer this.list.unlockNode(node)
+    if box, _ := node.values.(*syncValue); box == nil || box.v != old {
+        return false
+    }
+    node.values = &syncValue{v: new}
+    return true
+}
+
+// removed in the step that reads the value, under the victim's lock
+func (this *SyncMap[K]) LoadAndDelete(key K) (value interface{}, loaded bool) {
+    loaded = this.list.unlink(key, false, func(victim *Node[K]) bool {
+        box, _ := victim.values.(*syncValue)
+        if box == nil {
+            return false
+        }
+        value = box.v
+        return true
+    })
+    if !loaded {
+        return nil, false
+    }
+    return value, true
+}
+
+func (this *SyncMap[K]) Delete(key K) {
+    this.LoadAndDelete(key)
+}
+
+func (this *SyncMap[K]) CompareAndDelete(key K, old interface{}) bool {
+    return this.list.unlink(key, false, func(victim *Node[K]) bool {
+        box, _ := victim.values.(*syncValue)
+        return box != nil && box.v == old
+    })
+}
+
+/**
+calls f on every entry in key order until it returns false. like
+sync.Map's, it is no snapshot: each value is the one the key held when
+Range() reached it
+**/
+func (this *SyncMap[K]) Range(f func(key K, value interface{}) bool) {
+    list := &this.list
+    for curr := list.head.next[0]; curr != list.tail; curr = curr.next[0] {
+        if !curr.isLive() {
+            continue
+        }
+        list.lockNode(curr)
+        box, _ := curr.values.(*syncValue)
+        marked := curr.marked
+        list.unlockNode(curr)
+        if box != nil && !marked && !f(curr.key, box.v) {
+            return
+        }
+    }
+}
+
+// the last live node at or before key, strictly before unless inclusive, nil if there is none
+func (this *LazySkipList[K]) floor(key K, inclusive bool) *Node[K] {
+    for {
+        pred := this.head
+        for l := this.max_level - 1; l >= 0; l-- {
+            for curr := pred.next[l]; curr != this.tail; curr = pred.next[l] {
+                if c := this.compare(curr.key, key); c > 0 || c == 0 && !inclusive {
+                    break
+                }
+                pred = curr
+            }
+        }
+        if pred == this.head || pred.isLive() {
+            if pred == this.head {
+                return nil
+            }
+            return pred
+        }
+        // removed or hidden, look before it
+        key, inclusive = pred.key, false
+    }
+}
+
+/**
+the methods of google/btree's BTreeG that programs use the most, over a
+lazy list, so code that has one behind an interface can try the other. as
+in a btree an item is its own key: neither less than the other means the
+same entry, and ReplaceOrInsert() keeps the newer. items are read and
+replaced under the node lock, the iterators are called with none held
+**/
+type BTree[T any] struct {
+    list LazySkipList[T]
+}
+
+func newBTree[T any](less func(a, b T) bool, opts ...option) *BTree[T] {
+    return &BTree[T]{list: newListFunc(lessCompare(less), opts...)}
+}
+
+// newBTree() with newList()'s checks on the options
+func newCheckedBTree[T any](less func(a, b T) bool, opts ...option) (*BTree[T], error) {
+    list, err := newList[T](append(append([]option{}, opts...), withCompare(lessCompare(less)))...)
+    if err != nil {
+        return nil, err
+    }
+    return &BTree[T]{list: list}, nil
+}
+
+// the three-way compare of a btree less function
+func lessCompare[T any](less func(a, b T) bool) func(a, b T) int {
+    return func(a, b T) int {
+        switch {
+        case less(a, b):
+            return -1
+        case less(b, a):
+            return 1
+        }
+        return 0
+    }
+}
+
+// the entry's item, nil while a new entry has none yet
+func (this *BTree[T]) itemOf(node *Node[T]) *T {
+    this.list.lockNode(node)
+    defer this.list.unlockNode(node)
+    if node.marked {
+        return nil
+    }
+    item, _ := node.values.(*T)
+    return item
+}
+
+/**
+the item replaced, if there was one. panics with err_frozen or
+err_over_capacity if the list refuses a new entry, as BTreeG's signature
+has no room for an error; tryReplaceOrInsert() returns it instead
+**/
+func (this *BTree[T]) ReplaceOrInsert(item T) (T, bool) {
+    old, replaced, err := this.tryReplaceOrInsert(item)
+    if err != nil {
+        panic(err)
+    }
+    return old, replaced
+}
+
+func (this *BTree[T]) tryReplaceOrInsert(item T) (T, bool, error) {
+    var zero T
+    node, err := this.list.lockEntry(item, true)
+    if err != nil {
+        return zero, false, err
+    }
+    old, _ := node.values.(*T)
+    node.values = &item
+    this.list.unlockNode(node)
+    if old == nil {
+        return zero, false, nil
+    }
+    return *old, true, nil
+}
+
+func (this *BTree[T]) Get(key T) (T, bool) {
+    var zero T
+    node, _ := this.list.lockEntry(key, false)
+    if node == nil {
+        return zero, false
+    }
+    item, _ := node.values.(*T)
+    this.list.unlockNode(node)
+    if item == nil {
+        return zero, false
+    }
+    return *item, true
+}
+
+func (this *BTree[T]) Has(key T) bool {
+    _, ok := this.Get(key)
+    return ok
+}
+
+// the item removed, if there was one
+func (this *BTree[T]) Delete(key T) (T, bool) {
+    var removed *T
+    if !this.list.unlink(key, false, func(victim *Node[T]) bool {
+        removed, _ = victim.values.(*T)
+        return removed != nil
+    }) {
+        var zero T
+        return zero, false
+    }
+    return *removed, true
+}
+
+func (this *BTree[T]) Len() int {
+    return this.list.size()
+}
+
+// the items with greaterOrEqual <= item < lessThan, in order, until iterator returns false
+func (this *BTree[T]) AscendRange(greaterOrEqual, lessThan T, iterator func(item T) bool) {
+    list := &this.list
+    for curr := list.descend(greaterOrEqual); curr != list.tail && list.compare(curr.key, lessThan) < 0; curr = curr.next[0] {
+        if !curr.isLive() {
+            continue
+        }
+        if item := this.itemOf(curr); item != nil && !iterator(*item) {
+            return
+        }
+    }
+}
+
+/**
+the items <= pivot from the largest down, until iterator returns false.
+the list links forward only, so each step is a search from head for the
+entry before the last one, O(log n) apiece
+**/
+func (this *BTree[T]) DescendLessOrEqual(pivot T, iterator func(item T) bool) {
+    for node := this.list.floor(pivot, true); node != nil; node = this.list.floor(node.key, false) {
+        if item := this.itemOf(node); item != nil && !iterator(*item) {
+            return
+        }
+    }
+}
+
+/**
+an augmented skip list stores two summaries on every tower link: the number
+of nodes the link skips over, and a summary of their entries maintained by an
+augmentation. a range query combines whole links wherever they fit inside
+the range, O(log n) links instead of one per key. a link into nil covers
+every node to the end of the list. updates repair the links on the search
+path only, and one mutex guards the whole list
+**/
+type augmentation[K, S any] interface {
+    // the summary of no entries
+    zero() S
+    // fold one entry into a summary, wherever it falls in the link
+    onInsert(summary S, key K, item int) S
+    // take one entry out of a summary, false if the summary can't be taken
+    // apart and has to be recombined from the links below
+    onRemove(summary S, key K, item int) (S, bool)
+    // the summary of two adjacent links, a before b
+    combine(a, b S) S
+}
+
+// an associative operation over items with an identity, invert is nil
+// unless an item can be taken back out of a combined value
+type monoid struct {
+    identity int
+    combine func(a, b int) int
+    invert func(total, item int) int
+}
+
+var sum_aggregate = monoid{0, func(a, b int) int { return a + b }, func(total, item int) int { return total - item }}
+var min_aggregate = monoid{math.MaxInt, func(a, b int) int { return min(a, b) }, nil}
+var max_aggregate = monoid{math.MinInt, func(a, b int) int { return max(a, b) }, nil}
+
+type monoidAugmentation[K any] struct {
+    monoid
+}
+
+// an augmentation that aggregates items with the monoid
+func aggregateBy[K any](aggregate monoid) augmentation[K, int] {
+    return monoidAugmentation[K]{aggregate}
+}
+
+func (this monoidAugmentation[K]) zero() int {
+    return this.identity
+}
+
+func (this monoidAugmentation[K]) onInsert(summary int, key K, item int) int {
+    return this.monoid.combine(summary, item)
+}
+
+func (this monoidAugmentation[K]) onRemove(summary int, key K, item int) (int, bool) {
+    if this.invert == nil {
+        return summary, false
+    }
+    return this.invert(summary, item), true
+}
+
+func (this monoidAugmentation[K]) combine(a, b int) int {
+    return this.monoid.combine(a, b)
+}
+
+type AugNode[K, S any] struct {
+    key K
+    item int
+    next []*AugNode[K, S]
+    // nodes in (this node, next[l]] and the summary of their entries
+    span []int
+    agg []S
+}
+
+type AugmentedSkipList[K, S any] struct {
+    lock sync.Mutex
+    head *AugNode[K, S]
+    compare func(a, b K) int
+    augment augmentation[K, S]
+    count int
+    listOptions
+}
+
+func newAugmentedSkipList[K, S any](compare func(a, b K) int, augment augmentation[K, S], opts ...option) *AugmentedSkipList[K, S] {
+    list := AugmentedSkipList[K, S]{
+        compare: compare,
+        augment: augment,
+        listOptions: listOptions{
+            max_level: MAX_LEVEL,
+            prob: Prob}}
+    for _, opt := range opts {
+        opt(&list.listOptions)
+    }
+    var zero K
+    list.head = list.newNode(zero, 0, list.max_level)
+    return &list
+}
+
+func (this *AugmentedSkipList[K, S]) newNode(key K, item, height int) *AugNode[K, S] {
+    node := &AugNode[K, S]{
+        key: key,
+        item: item,
+        next: make([]*AugNode[K, S], height),
+        span: make([]int, height),
+        agg: make([]S, height)}
+    for l := range node.agg {
+        node.agg[l] = this.augment.zero()
+    }
+    return node
+}
+
+// preds on every level and their ranks, the head being rank 0
+func (this *AugmentedSkipList[K, S]) find(key K) (*AugNode[K, S], []*AugNode[K, S], []int) {
+    preds := make([]*AugNode[K, S], this.max_level)
+    ranks := make([]int, this.max_level)
+    pred := this.head
+    rank := 0
+    for l := this.max_level - 1; l >= 0; l-- {
+        for pred.next[l] != nil && this.compare(pred.next[l].key, key) < 0 {
+            rank += pred.span[l]
+            pred = pred.next[l]
+        }
+        preds[l] = pred
+        ranks[l] = rank
+    }
+    if found := preds[0].next[0]; found != nil && this.compare(found.key, key) == 0 {
+        return found, preds, ranks
+    }
+    return nil, preds, ranks
+}
+
+// recompute the summary of one link from the links below it
+func (this *AugmentedSkipList[K, S]) repair(node *AugNode[K, S], l int) {
+    agg := this.augment.zero()
+    if l == 0 {
+        if next := node.next[0]; next != nil {
+            agg = this.augment.onInsert(agg, next.key, next.item)
+        }
+    } else {
+        for curr := node; curr != node.next[l]; curr = curr.next[l - 1] {
+            agg = this.augment.combine(agg, curr.agg[l - 1])
+        }
+    }
+    node.agg[l] = agg
+}
+
+func (this *AugmentedSkipList[K, S]) size() int {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    return this.count
+}
+
+func (this *AugmentedSkipList[K, S]) get(key K) (int, bool) {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    node, _, _ := this.find(key)
+    if node == nil {
+        return 0, false
+    }
+    return node.item, true
+}
+
+func (this *AugmentedSkipList[K, S]) contains(x K) bool {
+    _, ok := this.get(x)
+    return ok
+}
+
+// inserts the key or replaces its item, true if the key is new
+func (this *AugmentedSkipList[K, S]) put(key K, item int) bool {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    node, preds, ranks := this.find(key)
+    if node != nil {
+        // bottom-up, each link is rebuilt from links already repaired
+        node.item = item
+        for l := 0; l < this.max_level; l++ {
+            this.repair(preds[l], l)
+        }
+        return false
+    }
+    node = this.newNode(key, item, level_source(this.max_level, this.prob))
+    rank := ranks[0] + 1
+    for l := 0; l < this.max_level; l++ {
+        if l < len(node.next) {
+            node.next[l] = preds[l].next[l]
+            preds[l].next[l] = node
+            node.span[l] = preds[l].span[l] - (rank - ranks[l]) + 1
+            preds[l].span[l] = rank - ranks[l]
+            this.repair(node, l)
+            this.repair(preds[l], l)
+        } else {
+            // links above the new node just gain one entry
+            preds[l].span[l]++
+            preds[l].agg[l] = this.augment.onInsert(preds[l].agg[l], key, item)
+        }
+    }
+    this.count++
+    return true
+}
+
+func (this *AugmentedSkipList[K, S]) add(x K) bool {
+    return this.put(x, 0)
+}
+
+func (this *AugmentedSkipList[K, S]) remove(x K) bool {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    node, preds, _ := this.find(x)
+    if node == nil {
+        return false
+    }
+    for l := 0; l < this.max_level; l++ {
+        if l < len(node.next) {
+            preds[l].next[l] = node.next[l]
+            preds[l].span[l] += node.span[l] - 1
+            this.repair(preds[l], l)
+            continue
+        }
+        preds[l].span[l]--
+        if agg, ok := this.augment.onRemove(preds[l].agg[l], node.key, node.item); ok {
+            preds[l].agg[l] = agg
+        } else {
+            this.repair(preds[l], l)
+        }
+    }
+    this.count--
+    return true
+}
+
+// the summary and the number of entries with lo <= key < hi
+func (this *AugmentedSkipList[K, S]) summarize(lo, hi K) (S, int) {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    agg := this.augment.zero()
+    count := 0
+    curr := this.head
+    for l := this.max_level - 1; l >= 0; l-- {
+        for curr.next[l] != nil && this.compare(curr.next[l].key, lo) < 0 {
+            curr = curr.next[l]
+        }
+    }
+    // everything past curr is >= lo, so take the longest link still below hi
+    for {
+        l := len(curr.next) - 1
+        for l >= 0 && (curr.next[l] == nil || this.compare(curr.next[l].key, hi) >= 0) {
+            l--
+        }
+        if l < 0 {
+            return agg, count
+        }
+        agg = this.augment.combine(agg, curr.agg[l])
+        count += curr.span[l]
+        curr = curr.next[l]
+    }
+}
+
+func (this *AugmentedSkipList[K, S]) aggregateRange(lo, hi K) S {
+    agg, _ := this.summarize(lo, hi)
+    return agg
+}
+
+func (this *AugmentedSkipList[K, S]) countRange(lo, hi K) int {
+    _, count := this.summarize(lo, hi)
+    return count
+}
+
+// the node at 0-based rank, found through the link spans in O(log n), nil past the end
+func (this *AugmentedSkipList[K, S]) seekRank(rank int) *AugNode[K, S] {
+    if rank < 0 || rank >= this.count {
+        return nil
+    }
+    curr := this.head
+    rank++
+    for l := this.max_level - 1; l >= 0; l-- {
+        for curr.next[l] != nil && curr.span[l] <= rank {
+            rank -= curr.span[l]
+            curr = curr.next[l]
+        }
+    }
+    return curr
+}
+
+// entries page_size * n up to the next page, in order, without walking the pages before
+func (this *AugmentedSkipList[K, S]) page(n, page_size int, fn func(key K, item int) bool) {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    curr := this.seekRank(n * page_size)
+    for i := 0; curr != nil && i < page_size; i, curr = i + 1, curr.next[0] {
+        if !fn(curr.key, curr.item) {
+            return
+        }
+    }
+}
+
+func (this *AugmentedSkipList[K, S]) pages(page_size int) int {
+    return (this.size() + page_size - 1) / page_size
+}
+
+// the number of keys below key
+func (this *AugmentedSkipList[K, S]) rank(key K) int {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    _, _, ranks := this.find(key)
+    return ranks[0]
+}
+
+/**
+counts keys by bucket: counts[0] below buckets[0], counts[i] in
+[buckets[i-1], buckets[i]) and the last one from the last boundary up.
+boundaries must be sorted, and each costs one O(log n) rank lookup under
+a single hold of the lock, so the counts add up to size()
+**/
+func (this *AugmentedSkipList[K, S]) histogram(buckets []K) []int {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    counts := make([]int, len(buckets) + 1)
+    below := 0
+    for i, boundary := range buckets {
+        _, _, ranks := this.find(boundary)
+        counts[i] = ranks[0] - below
+        below = ranks[0]
+    }
+    counts[len(buckets)] = this.count - below
+    return counts
+}
+
+func (this *AugmentedSkipList[K, S]) ascend(fn func(key K, item int) bool) {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    for curr := this.head.next[0]; curr != nil; curr = curr.next[0] {
+        if !fn(curr.key, curr.item) {
+            return
+        }
+    }
+}
+
+// sorted levels, and every link's span and summary match the nodes it skips,
+// summaries compared with equal since S needn't be comparable
+func (this *AugmentedSkipList[K, S]) checkInvariants(equal func(a, b S) bool) error {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    for l := 0; l < this.max_level; l++ {
+        for curr := this.head; curr != nil; curr = curr.next[l] {
+            if next := curr.next[l]; next != nil && curr != this.head && this.compare(curr.key, next.key) >= 0 {
+                return fmt.Errorf("level %d: key %v follows %v", l, next.key, curr.key)
+            }
+            span := 0
+            agg := this.augment.zero()
+            for skipped := curr.next[0]; ; skipped = skipped.next[0] {
+                if skipped == nil {
+                    if curr.next[l] != nil {
+                        return fmt.Errorf("level %d: node %v missing from level 0", l, curr.next[l].key)
+                    }
+                    break
+                }
+                span++
+                agg = this.augment.combine(agg, this.augment.onInsert(this.augment.zero(), skipped.key, skipped.item))
+                if skipped == curr.next[l] {
+                    break
+                }
+            }
+            if span != curr.span[l] || !equal(agg, curr.agg[l]) {
+                return fmt.Errorf("level %d: link from %v spans %d with summary %v, want %d and %v", l, curr.key, curr.span[l], curr.agg[l], span, agg)
+            }
+        }
+    }
+    if this.head.span[this.max_level - 1] != this.count {
+        return fmt.Errorf("top level spans %d nodes, size() is %d", this.head.span[this.max_level - 1], this.count)
+    }
+    return nil
+}
+
+func (this *LazySkipList[K]) lockNode(node *Node[K]) {
+    if lock_tracking {
+        tracker.acquire(node, this.label(node), func(prev interface{}) bool {
+            return this.sortsBefore(node, prev.(*Node[K]))
+        })
+    }
+    if chaos != nil {
+        // waiting for a lock is an interleaving point too
+        for !this.tryLockNode(node) {
+            chaos("lock:busy")
+        }
+        return
+    }
+    if this.locker != nil {
+        this.locker.lock(node)
+        return
+    }
+    node.lock.Lock()
+}
+
+func (this *LazySkipList[K]) tryLockNode(node *Node[K]) bool {
+    if this.locker != nil {
+        return this.locker.tryLock(node)
+    }
+    return node.lock.TryLock()
+}
+
+func (this *LazySkipList[K]) unlockNode(node *Node[K]) {
+    if lock_tracking {
+        tracker.release(node, this.label(node))
+    }
+    if this.locker != nil {
+        this.locker.unlock(node)
+        return
+    }
+    node.lock.Unlock()
+}
+
+// whether anyone holds the node's lock, for assertions
+func (this *LazySkipList[K]) isLocked(node *Node[K]) bool {
+    if this.tryLockNode(node) {
+        if this.locker != nil {
+            this.locker.unlock(node)
+        } else {
+            node.lock.Unlock()
+        }
+        return false
+    }
+    return true
+}
+
+// release in the reverse of acquisition order
+func (this *LazySkipList[K]) unlockAll(locked []*Node[K]) {
+    for i := len(locked) - 1; i >= 0; i-- {
+        this.unlockNode(locked[i])
+    }
+}
+
+// a sorts strictly before b in list order, head first and tail last
+func (this *LazySkipList[K]) sortsBefore(a, b *Node[K]) bool {
+    if a == b || a == this.tail || b == this.head {
+        return false
+    }
+    if b == this.tail {
+        return true
+    }
+    return this.before(a, b.key, b.seq)
+}
+
+// set with -locktrack, records per-goroutine lock order
+var lock_tracking = false
+var tracker = lockTracker{held: make(map[uint64][]heldLock)}
+
+type heldLock struct {
+    node interface{}
+    label string
+    stack string
+}
+
+/**
+every writer locks its nodes bottom-up: the victim first (remove only), then
+the predecessors from level 0 upwards, which is strictly decreasing key order.
+since keys totally order the nodes, any cycle in the waits-for graph needs
+some goroutine to lock out of that order, so checking each acquisition
+against the goroutine's most recent lock catches every potential deadlock
+**/
+type lockTracker struct {
+    mu sync.Mutex
+    held map[uint64][]heldLock
+}
+
+// before reports whether node sorts before a node locked earlier
+func (this *lockTracker) acquire(node interface{}, label string, before func(prev interface{}) bool) {
+    id := goroutineID()
+    stack := string(debugStack())
+    this.mu.Lock()
+    defer this.mu.Unlock()
+    held := this.held[id]
+    for _, h := range held {
+        if h.node == node {
+            this.report(id, "relocking node " + label + " already held", h, stack)
+        }
+    }
+    if len(held) > 0 && !before(held[len(held) - 1].node) {
+        this.report(id, fmt.Sprintf("locking %s after %s breaks bottom-up order", label, held[len(held) - 1].label), held[len(held) - 1], stack)
+    }
+    this.held[id] = append(held, heldLock{node: node, label: label, stack: stack})
+}
+
+func (this *lockTracker) release(node interface{}, label string) {
+    id := goroutineID()
+    this.mu.Lock()
+    defer this.mu.Unlock()
+    held := this.held[id]
+    for i := len(held) - 1; i >= 0; i-- {
+        if held[i].node == node {
+            held = append(held[:i], held[i + 1:]...)
+            if len(held) == 0 {
+                delete(this.held, id)
+            } else {
+                this.held[id] = held
+            }
+            return
+        }
+    }
+    this.report(id, "unlocking node " + label + " not held", heldLock{}, string(debugStack()))
+}
+
+func (this *lockTracker) report(id uint64, msg string, prev heldLock, stack string) {
+    text := fmt.Sprintf("lock order violation in goroutine %d: %s\n\ncurrent stack:\n%s", id, msg, stack)
+    if prev.node != nil {
+        text += fmt.Sprintf("\nnode %s was locked at:\n%s", prev.label, prev.stack)
+    }
+    panic(text)
+}
+
+func debugStack() []byte {
+    buf := make([]byte, 4096)
+    return buf[:runtime.Stack(buf, false)]
+}
+
+func goroutineID() uint64 {
+    buf := make([]byte, 64)
+    buf = bytes.TrimPrefix(buf[:runtime.Stack(buf, false)], []byte("goroutine "))
+    id, _ := strconv.ParseUint(string(buf[:bytes.IndexByte(buf, ' ')]), 10, 64)
+    return id
+}
+
+func assert(cond bool, format string, args ...interface{}) {
+    if !cond {
+        panic(fmt.Sprintf("lazyskiplist: " + format, args...))
+    }
+}
+
+func (this *LazySkipList[K]) checkSplice(key K, seq uint64, preds, succs []*Node[K], top_level int) {
+    for level := 0; level <= top_level - 1; level++ {
+        pred, succ := preds[level], succs[level]
+        assert(this.isLocked(pred), "add(%v): pred %s not locked at level %d", key, this.label(pred), level)
+        assert(!pred.marked, "add(%v): pred %s marked at level %d", key, this.label(pred), level)
+        // a remover may mark succ after validation, but it keeps succ locked until succ is unlinked
+        assert(!succ.marked || this.isLocked(succ), "add(%v): succ %s marked and abandoned at level %d", key, this.label(succ), level)
+        assert(level < pred.top_level, "add(%v): pred %s not linked at level %d", key, this.label(pred), level)
+        assert(pred.next[level] == succ, "add(%v): pred %s no longer points to succ %s at level %d", key, this.label(pred), this.label(succ), level)
+        assert(this.before(pred, key, seq) && !this.before(succ, key, seq + 1), "add(%v): out of order between %s and %s at level %d", key, this.label(pred), this.label(succ), level)
+    }
+}
+
+func (this *LazySkipList[K]) checkUnlink(victim *Node[K], preds []*Node[K], top_level int) {
+    assert(victim.marked, "remove(%v): victim not marked before unlink", victim.key)
+    assert(this.isLocked(victim), "remove(%v): victim not locked", victim.key)
+    assert(victim.fully_linked, "remove(%v): victim not fully linked", victim.key)
+    for level := 0; level <= top_level - 1; level++ {
+        pred := preds[level]
+        assert(this.isLocked(pred), "remove(%v): pred %s not locked at level %d", victim.key, this.label(pred), level)
+        assert(!pred.marked, "remove(%v): pred %s marked at level %d", victim.key, this.label(pred), level)
+        assert(pred.next[level] == victim, "remove(%v): pred %s does not point to victim at level %d", victim.key, this.label(pred), level)
+    }
+}
+
+const (
+    OP_CONTAINS uint8 = iota
+    OP_ADD
+    OP_REMOVE
+    OP_GET
+)
+
+var op_names = []string{"contains", "add", "remove", "get"}
+
+type benchConfig struct {
+    workload
+    format string
+    latency bool
+    prefill int
+    warmup int
+    options []option
+}
+
+/**
+one result per line in -format json, shared with the ports in other
+languages: lang and impl name the implementation (e.g. go/lazy,
+java/sequential), n is the total number of operations over all threads,
+prefill and warmup_ops the list size and untimed operations before timing
+**/
+type benchResult struct {
+    Lang string `json:"lang"`
+    Impl string `json:"impl"`
+    Op string `json:"op"`
+    Threads int `json:"threads"`
+    Procs int `json:"gomaxprocs"`
+    N int `json:"n"`
+    Prefill int `json:"prefill,omitempty"`
+    Warmup int `json:"warmup_ops,omitempty"`
+    Seconds float64 `json:"seconds"`
+    OpsPerSec float64 `json:"ops_per_sec"`
+    P50 int64 `json:"p50_ns,omitempty"`
+    P90 int64 `json:"p90_ns,omitempty"`
+    P99 int64 `json:"p99_ns,omitempty"`
+    P999 int64 `json:"p999_ns,omitempty"`
+    AllocsPerOp float64 `json:"allocs_per_op"`
+    BytesPerOp float64 `json:"bytes_per_op"`
+    GCCycles uint32 `json:"gc_cycles"`
+    GCPause int64 `json:"gc_pause_ns"`
+}
+
+/**
+log-linear latency histogram in the style of HdrHistogram: values below
+SUB_BUCKETS nanoseconds are exact, above that every power of two is split
+into SUB_BUCKETS / 2 buckets, bounding the relative error to under 2%
+**/
+const SUB_BUCKET_BITS int = 7
+const SUB_BUCKETS int = 1 << SUB_BUCKET_BITS
+const HISTOGRAM_BUCKETS int = SUB_BUCKETS + (64 - SUB_BUCKET_BITS) * SUB_BUCKETS / 2
+
+type latencyHistogram struct {
+    counts [HISTOGRAM_BUCKETS]uint64
+    total uint64
+}
+
+func bucketIndex(v uint64) int {
+    if v < uint64(SUB_BUCKETS) {
+        return int(v)
+    }
+    shift := bits.Len64(v) - SUB_BUCKET_BITS
+    return SUB_BUCKETS + (shift - 1) * SUB_BUCKETS / 2 + int(v >> uint(shift)) - SUB_BUCKETS / 2
+}
+
+// highest value that falls into bucket i
+func bucketLimit(i int) uint64 {
+    if i < SUB_BUCKETS {
+        return uint64(i)
+    }
+    shift := (i - SUB_BUCKETS) / (SUB_BUCKETS / 2) + 1
+    sub := uint64((i - SUB_BUCKETS) % (SUB_BUCKETS / 2) + SUB_BUCKETS / 2)
+    return (sub + 1) << uint(shift) - 1
+}
+
+func (this *latencyHistogram) record(d time.Duration) {
+    if d < 0 {
+        d = 0
+    }
+    this.counts[bucketIndex(uint64(d))]++
+    this.total++
+}
+
+func (this *latencyHistogram) merge(other *latencyHistogram) {
+    for i := range other.counts {
+        this.counts[i] += other.counts[i]
+    }
+    this.total += other.total
+}
+
+func (this *latencyHistogram) percentile(p float64) time.Duration {
+    if this.total == 0 {
+        return 0
+    }
+    rank := uint64(math.Ceil(p / 100 * float64(this.total)))
+    if rank == 0 {
+        rank = 1
+    }
+    seen := uint64(0)
+    for i, count := range this.counts {
+        seen += count
+        if seen >= rank {
+            return time.Duration(bucketLimit(i))
+        }
+    }
+    return time.Duration(bucketLimit(HISTOGRAM_BUCKETS - 1))
+}
+
+// histogram is nil unless per-operation latencies are wanted
+// each goroutine carries impl and op pprof labels for the operation it is running
+func (this *LazySkipList[K]) runOps(keys [][]K, ops [][]uint8, histogram *latencyHistogram) float64 {
+    var wg sync.WaitGroup
+    var mu sync.Mutex
+    labels := make([]context.Context, len(op_names))
+    for op, name := range op_names {
+        labels[op] = pprof.WithLabels(context.Background(), pprof.Labels("impl", "go-lazy", "op", name))
+    }
+    start := time.Now()
+    for i := range keys {
+        wg.Add(1)
+        go func(keys []K, ops []uint8) {
+            defer wg.Done()
+            defer pprof.SetGoroutineLabels(context.Background())
+            var local *latencyHistogram
+            if histogram != nil {
+                local = new(latencyHistogram)
+            }
+            for j, key := range keys {
+                if j == 0 || ops[j] != ops[j - 1] {
+                    pprof.SetGoroutineLabels(labels[ops[j]])
+                }
+                var op_start time.Time
+                if local != nil {
+                    op_start = time.Now()
+                }
+                switch ops[j] {
+                case OP_CONTAINS:
+                    this.contains(key)
+                case OP_ADD:
+                    this.add(key)
+                case OP_REMOVE:
+                    this.remove(key)
+                }
+                if local != nil {
+                    local.record(time.Since(op_start))
+                }
+            }
+            if local != nil {
+                mu.Lock()
+                histogram.merge(local)
+                mu.Unlock()
+            }
+        }(keys[i], ops[i])
+    }
+    wg.Wait()
+    return time.Since(start).Seconds()
+}
+
+// how a workload draws its keys from [0, key_range)
+type keyDistribution int
+
+const (
+    DIST_UNIFORM keyDistribution = iota
+    // key k drawn in proportion to (1 + k)^-zipf_s, so 0 is the hottest
+    DIST_ZIPFIAN
+    // each stream counts up from its own offset, wrapping at key_range
+    DIST_SEQUENTIAL
+)
+
+var dist_names = []string{"uniform", "zipf", "seq"}
+
+func parseDistribution(name string) (keyDistribution, error) {
+    for i, dist := range dist_names {
+        if name == dist {
+            return keyDistribution(i), nil
+        }
+    }
+    return 0, fmt.Errorf("unknown key distribution %q, want one of %s", name, strings.Join(dist_names, ", "))
+}
+
+// the Zipfian exponent when a workload leaves zipf_s at 0
+const ZIPF_S float64 = 1.1
+
+/**
+the operations a benchmark or a load test runs: num_threads streams of n
+keys and ops, one per goroutine, each from a generator of its own, so the
+goroutines share no lock while drawing and a seed gives the same streams
+every time. read, insert and remove are percentages of contains(), add()
+and remove(); left at 0, every op is the one ops() is asked for
+**/
+type workload struct {
+    num_threads int
+    n int
+    key_range int
+    dist keyDistribution
+    zipf_s float64
+    read int
+    insert int
+    remove int
+    // 0 seeds from the clock
+    seed int64
+}
+
+// the generator of stream i, salt telling the keys of a stream from its ops
+func (this workload) stream(i int, salt int64) *rand.Rand {
+    seed := this.seed
+    if seed == 0 {
+        seed = time.Now().UnixNano()
+    }
+    return rand.New(rand.NewSource(seed + int64(i) * 2 + salt))
+}
+
+// stream i's keys, drawn one at a time
+func (this workload) keyStream(i int) func() int {
+    rng := this.stream(i, 0)
+    switch this.dist {
+    case DIST_ZIPFIAN:
+        s := this.zipf_s
+        if s == 0 {
+            s = ZIPF_S
+        }
+        zipf := rand.NewZipf(rng, s, 1, uint64(this.key_range - 1))
+        return func() int {
+            return int(zipf.Uint64())
+        }
+    case DIST_SEQUENTIAL:
+        next := i * this.n
+        return func() int {
+            key := next % this.key_range
+            next++
+            return key
+        }
+    }
+    return func() int {
+        return rng.Intn(this.key_range)
+    }
+}
+
+// stream i's ops, op throughout if the mix is not set
+func (this workload) opStream(i int, op uint8) func() uint8 {
+    if this.read + this.insert + this.remove == 0 {
+        return func() uint8 {
+            return op
+        }
+    }
+    rng := this.stream(i, 1)
+    return func() uint8 {
+        switch p := rng.Intn(100); {
+        case p < this.read:
+            return OP_CONTAINS
+        case p < this.read + this.insert:
+            return OP_ADD
+        }
+        return OP_REMOVE
+    }
+}
+
+/**
+stream i one operation at a time, the same ones keys() and ops() hold, for
+a load test that runs for as long as it likes rather than n operations
+**/
+func (this workload) generator(i int, op uint8) func() (int, uint8) {
+    keys, ops := this.keyStream(i), this.opStream(i, op)
+    return func() (int, uint8) {
+        return keys(), ops()
+    }
+}
+
+/**
+without read/insert/delete ratios the harness times add(), contains() and
+remove() as three separate phases over the same keys, otherwise it runs a
+single mixed phase
+**/
+func (this workload) keys() [][]int {
+    keys := make([][]int, this.num_threads)
+    for i := range keys {
+        next := this.keyStream(i)
+        keys[i] = make([]int, this.n)
+        for j := range keys[i] {
+            keys[i][j] = next()
+        }
+    }
+    return keys
+}
+
+// the configured mix of operations, or only op if the mix is not set
+func (this workload) ops(op uint8) [][]uint8 {
+    ops := make([][]uint8, this.num_threads)
+    for i := range ops {
+        next := this.opStream(i, op)
+        ops[i] = make([]uint8, this.n)
+        for j := range ops[i] {
+            ops[i][j] = next()
+        }
+    }
+    return ops
+}
+
+/**
+fills the list to config.prefill keys and runs config.warmup untimed
+operations per goroutine, of the mix or contains() when phased, so the
+timed phases see a steady-state list instead of one growing from empty
+**/
+func runBenchmark(config benchConfig) []benchResult {
+    list := newLazySkipList(config.options...)
+    for list.size() < config.prefill {
+        list.add(rand.Intn(config.key_range))
+    }
+    if config.warmup > 0 {
+        warmup := config
+        warmup.n = config.warmup
+        if config.seed != 0 {
+            // past every stream of the timed run, which it would replay otherwise
+            warmup.seed = config.seed + int64(2 * config.num_threads)
+        }
+        list.runOps(warmup.keys(), warmup.ops(OP_CONTAINS), nil)
+    }
+    keys := config.keys()
+    phases := [][]uint8{{OP_ADD}, {OP_CONTAINS}, {OP_REMOVE}}
+    mixed := config.read + config.insert + config.remove > 0
+    if mixed {
+        phases = [][]uint8{{OP_CONTAINS}}
+    }
+    results := []benchResult{}
+    for _, phase := range phases {
+        ops := config.ops(phase[0])
+        op := "mixed"
+        if !mixed {
+            op = op_names[phase[0]]
+        }
+        var histogram *latencyHistogram
+        if config.latency {
+            histogram = new(latencyHistogram)
+        }
+        var before, after runtime.MemStats
+        runtime.ReadMemStats(&before)
+        seconds := list.runOps(keys, ops, histogram)
+        runtime.ReadMemStats(&after)
+        total := config.n * config.num_threads
+        result := benchResult{
+            Lang: "go",
+            Impl: "lazy",
+            Op: op,
+            Threads: config.num_threads,
+            Procs: runtime.GOMAXPROCS(0),
+            N: total,
+            Prefill: config.prefill,
+            Warmup: config.warmup * config.num_threads,
+            Seconds: seconds,
+            OpsPerSec: float64(total) / seconds,
+            AllocsPerOp: float64(after.Mallocs - before.Mallocs) / float64(total),
+            BytesPerOp: float64(after.TotalAlloc - before.TotalAlloc) / float64(total),
+            GCCycles: after.NumGC - before.NumGC,
+            GCPause: int64(after.PauseTotalNs - before.PauseTotalNs)}
+        if histogram != nil {
+            result.P50 = int64(histogram.percentile(50))
+            result.P90 = int64(histogram.percentile(90))
+            result.P99 = int64(histogram.percentile(99))
+            result.P999 = int64(histogram.percentile(99.9))
+        }
+        results = append(results, result)
+    }
+    return results
+}
+
+func writeResults(w io.Writer, format string, results []benchResult) error {
+    switch format {
+    case "json":
+        encoder := json.NewEncoder(w)
+        for _, result := range results {
+            if err := encoder.Encode(result); err != nil {
+                return err
+            }
+        }
+    case "csv":
+        writer := csv.NewWriter(w)
+        writer.Write([]string{"lang", "impl", "op", "threads", "gomaxprocs", "n", "seconds", "ops_per_sec", "p50_ns", "p90_ns", "p99_ns", "p999_ns",
+            "allocs_per_op", "bytes_per_op", "gc_cycles", "gc_pause_ns"})
+        for _, result := range results {
+            writer.Write([]string{
+                result.Lang,
+                result.Impl,
+                result.Op,
+                strconv.Itoa(result.Threads),
+                strconv.Itoa(result.Procs),
+                strconv.Itoa(result.N),
+                strconv.FormatFloat(result.Seconds, 'f', -1, 64),
+                strconv.FormatFloat(result.OpsPerSec, 'f', -1, 64),
+                strconv.FormatInt(result.P50, 10),
+                strconv.FormatInt(result.P90, 10),
+                strconv.FormatInt(result.P99, 10),
+                strconv.FormatInt(result.P999, 10),
+                strconv.FormatFloat(result.AllocsPerOp, 'f', 2, 64),
+                strconv.FormatFloat(result.BytesPerOp, 'f', 1, 64),
+                strconv.FormatUint(uint64(result.GCCycles), 10),
+                strconv.FormatInt(result.GCPause, 10)})
+        }
+        writer.Flush()
+        return writer.Error()
+    case "text":
+        for _, result := range results {
+            fmt.Fprintf(w, "Go concurrent %s() %d nodes with %d threads, time: %v s\n", result.Op, result.N, result.Threads, result.Seconds)
+            if result.P50 != 0 {
+                fmt.Fprintln(w, "    latency p50:", time.Duration(result.P50), "p90:", time.Duration(result.P90),
+                    "p99:", time.Duration(result.P99), "p99.9:", time.Duration(result.P999))
+            }
+            fmt.Fprintf(w, "    %.2f allocs/op, %.1f B/op, %d GC cycles, %v GC pause\n",
+                result.AllocsPerOp, result.BytesPerOp, result.GCCycles, time.Duration(result.GCPause))
+        }
+    default:
+        return fmt.Errorf("unknown format %q", format)
+    }
+    return nil
+}
+
+type tuneResult struct {
+    prob float32
+    max_level int
+    ops_per_sec float64
+}
+
+/**
+runs the configured mix against lists prefilled to size keys for a grid of
+probabilities and level counts around log_1/p(size), fastest first
+**/
+func tuneLevels(config benchConfig, size int) []tuneResult {
+    config.key_range = 2 * size
+    if config.read + config.insert + config.remove == 0 {
+        config.read, config.insert, config.remove = 80, 10, 10
+    }
+    keys := config.keys()
+    ops := config.ops(OP_CONTAINS)
+    results := []tuneResult{}
+    for _, prob := range []float32{0.5, 0.37, 0.25, 0.125} {
+        // a single key fits in no levels, and a list has at least one
+        fit := max(int(math.Ceil(math.Log(float64(size)) / math.Log(1 / float64(prob)))), 1)
+        levels := []int{fit, fit + 2}
+        if fit + 2 < MAX_LEVEL {
+            levels = append(levels, MAX_LEVEL)
+        }
+        for _, max_level := range levels {
+            list := newLazySkipList(withProbability(prob), withMaxLevel(max_level))
+            for list.size() < size {
+                list.add(rand.Intn(config.key_range))
+            }
+            seconds := list.runOps(keys, ops, nil)
+            results = append(results, tuneResult{
+                prob: prob,
+                max_level: max_level,
+                ops_per_sec: float64(config.n * config.num_threads) / seconds})
+        }
+    }
+    sort.Slice(results, func(i, j int) bool { return results[i].ops_per_sec > results[j].ops_per_sec })
+    return results
+}
+
+// the free-form lines printed by the Go, Java and C# harnesses
+var legacy_result = regexp.MustCompile(`^(\w+) (concurrent|sequential) (\w+)\(\) (\d+) nodes(?: with (\d+) threads)?, time: ([\d.]+) s`)
+var legacy_cs_result = regexp.MustCompile(`^(\w+)\(\):(\d+) nodes, time: ([\d.]+) s`)
+
+/**
+reads results in the JSON schema, or the older free-form lines, from r.
+C# lines do not name their language or implementation, so name is used
+**/
+func readResults(r io.Reader, name string) ([]benchResult, error) {
+    results := []benchResult{}
+    scanner := bufio.NewScanner(r)
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        var result benchResult
+        if strings.HasPrefix(line, "{") {
+            if err := json.Unmarshal([]byte(line), &result); err != nil {
+                return nil, err
+            }
+        } else if m := legacy_result.FindStringSubmatch(line); m != nil {
+            result = benchResult{Lang: strings.ToLower(m[1]), Impl: "lazy", Op: m[3]}
+            if m[2] == "sequential" {
+                result.Impl, result.Threads = "sequential", 1
+            }
+            result.N, _ = strconv.Atoi(m[4])
+            if m[5] != "" {
+                result.Threads, _ = strconv.Atoi(m[5])
+            }
+            result.Seconds, _ = strconv.ParseFloat(m[6], 64)
+        } else if m := legacy_cs_result.FindStringSubmatch(line); m != nil {
+            result = benchResult{Lang: "cs", Impl: name, Op: strings.ToLower(m[1])}
+            result.N, _ = strconv.Atoi(m[2])
+            result.Seconds, _ = strconv.ParseFloat(m[3], 64)
+        } else {
+            continue
+        }
+        if result.OpsPerSec == 0 && result.Seconds > 0 {
+            result.OpsPerSec = float64(result.N) / result.Seconds
+        }
+        results = append(results, result)
+    }
+    return results, scanner.Err()
+}
+
+// one row per (op, threads, n) with the ops/sec of every implementation side by side
+func writeMerged(w io.Writer, format string, results []benchResult) error {
+    columns, rows := []string{}, []string{}
+    cells := map[string]map[string]float64{}
+    seen := map[string]bool{}
+    for _, result := range results {
+        column := result.Lang + "/" + result.Impl
+        row := fmt.Sprintf("%s,%d,%d", result.Op, result.Threads, result.N)
+        if cells[row] == nil {
+            cells[row] = map[string]float64{}
+            rows = append(rows, row)
+        }
+        if !seen[column] {
+            seen[column] = true
+            columns = append(columns, column)
+        }
+        cells[row][column] = result.OpsPerSec
+    }
+    missing := "-"
+    if format == "csv" {
+        missing = ""
+    }
+    records := [][]string{append([]string{"op", "threads", "n"}, columns...)}
+    for _, row := range rows {
+        record := strings.Split(row, ",")
+        for _, column := range columns {
+            if ops, ok := cells[row][column]; ok {
+                record = append(record, strconv.FormatFloat(ops, 'f', 0, 64))
+            } else {
+                record = append(record, missing)
+            }
+        }
+        records = append(records, record)
+    }
+    if format == "csv" {
+        writer := csv.NewWriter(w)
+        writer.WriteAll(records)
+        return writer.Error()
+    }
+    table := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+    for _, record := range records {
+        fmt.Fprintln(table, strings.Join(record, "\t") + "\t")
+    }
+    return table.Flush()
+}
+
+// runs the benchmark with GOMAXPROCS and the goroutine count at 1, 2, 4, ... up to NumCPU
+func sweepProcs(config benchConfig) []benchResult {
+    defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+    results := []benchResult{}
+    for procs := 1; ; procs *= 2 {
+        if procs > runtime.NumCPU() {
+            procs = runtime.NumCPU()
+        }
+        runtime.GOMAXPROCS(procs)
+        config.num_threads = procs
+        results = append(results, runBenchmark(config)...)
+        if procs == runtime.NumCPU() {
+            return results
+        }
+    }
 }
 
-type Node struct {
-    key int
-    item int
-    top_level int
-    next []*Node
-    marked bool
-    fully_linked bool
-    lock sync.RWMutex
+// throughput and speedup over GOMAXPROCS=1 per operation, with an ASCII speedup chart
+func writeScaling(w io.Writer, results []benchResult) {
+    const BAR_WIDTH = 50
+    results = append([]benchResult{}, results...)
+    sort.SliceStable(results, func(i, j int) bool { return results[i].Op < results[j].Op })
+    base := map[string]float64{}
+    max_speedup := 1.0
+    for _, result := range results {
+        if result.Procs == 1 {
+            base[result.Op] = result.OpsPerSec
+        }
+    }
+    for _, result := range results {
+        if speedup := result.OpsPerSec / base[result.Op]; speedup > max_speedup {
+            max_speedup = speedup
+        }
+    }
+    fmt.Fprintf(w, "%-10s %10s %14s %8s\n", "op", "gomaxprocs", "ops/sec", "speedup")
+    for _, result := range results {
+        fmt.Fprintf(w, "%-10s %10d %14.0f %8.2f\n", result.Op, result.Procs, result.OpsPerSec, result.OpsPerSec / base[result.Op])
+    }
+    fmt.Fprintln(w)
+    for _, result := range results {
+        speedup := result.OpsPerSec / base[result.Op]
+        bar := strings.Repeat("#", int(speedup / max_speedup * BAR_WIDTH + 0.5))
+        fmt.Fprintf(w, "%-10s %3d | %-*s %.2fx\n", result.Op, result.Procs, BAR_WIDTH, bar, speedup)
+    }
 }
 
-func newNode(key, item, height int) *Node {
-    new_node := Node{
-        key: key, 
-        item: item,
-        top_level: height,
-        marked: false,
-        fully_linked: false,
-        next: make([]*Node, height)}
-    return &new_node
+/**
+an experimental lazy skip list for lists big enough that the garbage
+collector's mark phase shows: nodes live in fixed-size chunks of plain
+values and link to each other by index, so no chunk holds a pointer and the
+collector never walks a node, whatever the number of entries. the protocol
+is the lazy list's, with spin locks in the nodes.
+
+the safety contract, as nothing is managed for the caller:
+- keys are numbers, the only keys that keep a chunk pointer-free
+- a removed node's slot is never reused, since a reader may still be on
+  it and nothing tracks when the last one leaves; the memory comes back
+  only when the whole list is unreachable. for heavy churn, build a new
+  list from ascend() now and then and drop the old one
+- node and tower slots are 32-bit indexes, so at most 2^32 - 4 nodes
+  are ever added, removed ones included, and their towers take at most
+  2^32 - ARENA_CHUNK next indexes, padding at the chunk ends included.
+  at the default p towers average 2 levels, so the towers run out first,
+  after about 2^31 adds. add() panics beyond that, and the slots are not
+  handed out again
+**/
+type ArenaSkipList[K arenaKey] struct {
+    // grow takes a new chunk; readers load the directories without it
+    grow sync.Mutex
+    nodes atomic.Pointer[[]*[ARENA_CHUNK]arenaNode[K]]
+    towers atomic.Pointer[[]*[ARENA_CHUNK]uint32]
+    used_nodes uint32
+    used_towers uint32
+    count int64
+    listOptions
 }
 
-type LazySkipList struct {
-    head  *Node
-    tail *Node
-    level int
+// the key types a node can hold without a pointer
+type arenaKey interface {
+    ~int | ~int8 | ~int16 | ~int32 | ~int64 | ~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr | ~float32 | ~float64
 }
 
-func newLazySkipList() LazySkipList {
-    newList := LazySkipList{
-        head: newNode(-999, -999, MAX_LEVEL), 
-        tail: newNode(9999999999, 9999999999, MAX_LEVEL),
-        level: 1}
-    
-    for i := 0; i < MAX_LEVEL; i++ {
-        newList.head.next[i] = newList.tail
+const ARENA_CHUNK_BITS = 12
+const ARENA_CHUNK = 1 << ARENA_CHUNK_BITS
+
+// index 0 is no node, head and tail come next
+const ARENA_HEAD uint32 = 1
+const ARENA_TAIL uint32 = 2
+
+// index math.MaxUint32 stays unused, so used_nodes never wraps
+const ARENA_MAX_NODES uint32 = math.MaxUint32
+// whole chunks, so reserve() rounding an end up does not wrap
+const ARENA_MAX_TOWERS uint32 = math.MaxUint32 &^ (ARENA_CHUNK - 1)
+
+type arenaNode[K arenaKey] struct {
+    key K
+    item int64
+    // where the node's next indexes start in the tower chunks
+    tower uint32
+    top_level int32
+    lock int32
+    marked int32
+    fully_linked int32
+}
+
+// checks the options as newList() does
+func newArenaSkipList[K arenaKey](opts ...option) (*ArenaSkipList[K], error) {
+    list := &ArenaSkipList[K]{
+        listOptions: listOptions{
+            max_level: MAX_LEVEL,
+            prob: Prob}}
+    for _, opt := range opts {
+        opt(&list.listOptions)
+    }
+    if err := list.validate(); err != nil {
+        return nil, err
+    }
+    list.nodes.Store(&[]*[ARENA_CHUNK]arenaNode[K]{})
+    list.towers.Store(&[]*[ARENA_CHUNK]uint32{})
+    var zero K
+    list.newNode(zero, 0, 0)
+    head, _ := list.newNode(zero, 0, list.max_level)
+    tail, _ := list.newNode(zero, 0, list.max_level)
+    for l := 0; l < list.max_level; l++ {
+        list.setNext(head, l, tail)
+    }
+    return list, nil
+}
+
+func (this *ArenaSkipList[K]) node(i uint32) *arenaNode[K] {
+    return &(*this.nodes.Load())[i >> ARENA_CHUNK_BITS][i & (ARENA_CHUNK - 1)]
+}
+
+func (this *ArenaSkipList[K]) link(i uint32, level int) *uint32 {
+    t := this.node(i).tower + uint32(level)
+    return &(*this.towers.Load())[t >> ARENA_CHUNK_BITS][t & (ARENA_CHUNK - 1)]
+}
+
+func (this *ArenaSkipList[K]) next(i uint32, level int) uint32 {
+    return atomic.LoadUint32(this.link(i, level))
+}
+
+func (this *ArenaSkipList[K]) setNext(i uint32, level int, next uint32) {
+    atomic.StoreUint32(this.link(i, level), next)
+}
+
+/**
+takes height tower slots, within one chunk, and the next node slot, adding
+chunks as the slots run past them. false once either runs out, without
+moving the counters past their limits
+**/
+func (this *ArenaSkipList[K]) newNode(key K, item, height int) (uint32, bool) {
+    var tower uint32
+    for {
+        used := atomic.LoadUint32(&this.used_towers)
+        tower = used
+        if (tower & (ARENA_CHUNK - 1)) + uint32(height) > ARENA_CHUNK {
+            tower = (tower | (ARENA_CHUNK - 1)) + 1
+        }
+        if uint64(tower) + uint64(height) > uint64(ARENA_MAX_TOWERS) {
+            return 0, false
+        }
+        if atomic.CompareAndSwapUint32(&this.used_towers, used, tower + uint32(height)) {
+            break
+        }
+    }
+    var i uint32
+    for {
+        i = atomic.LoadUint32(&this.used_nodes)
+        if i == ARENA_MAX_NODES {
+            return 0, false
+        }
+        if atomic.CompareAndSwapUint32(&this.used_nodes, i, i + 1) {
+            break
+        }
+    }
+    this.reserve(i, tower + uint32(height))
+    node := this.node(i)
+    node.key, node.item, node.tower, node.top_level = key, int64(item), tower, int32(height)
+    return i, true
+}
+
+// makes sure the chunks for node slot i and tower slots up to end exist
+func (this *ArenaSkipList[K]) reserve(i, end uint32) {
+    nodes, towers := *this.nodes.Load(), *this.towers.Load()
+    if int(i >> ARENA_CHUNK_BITS) < len(nodes) && int((end + ARENA_CHUNK - 1) >> ARENA_CHUNK_BITS) <= len(towers) {
+        return
+    }
+    this.grow.Lock()
+    defer this.grow.Unlock()
+    // copied, a reader may hold the old directory
+    nodes = append([]*[ARENA_CHUNK]arenaNode[K](nil), *this.nodes.Load()...)
+    for int(i >> ARENA_CHUNK_BITS) >= len(nodes) {
+        nodes = append(nodes, new([ARENA_CHUNK]arenaNode[K]))
+    }
+    this.nodes.Store(&nodes)
+    towers = append([]*[ARENA_CHUNK]uint32(nil), *this.towers.Load()...)
+    for int((end + ARENA_CHUNK - 1) >> ARENA_CHUNK_BITS) > len(towers) {
+        towers = append(towers, new([ARENA_CHUNK]uint32))
+    }
+    this.towers.Store(&towers)
+}
+
+func (this *ArenaSkipList[K]) lockNode(i uint32) {
+    for node := this.node(i); !atomic.CompareAndSwapInt32(&node.lock, 0, 1); {
+        runtime.Gosched()
     }
-    
-    return newList
 }
 
-func (this *LazySkipList) find(key int) (int, []*Node, []*Node) {
+func (this *ArenaSkipList[K]) unlockNode(i uint32) {
+    atomic.StoreInt32(&this.node(i).lock, 0)
+}
+
+func (this *ArenaSkipList[K]) before(i uint32, key K) bool {
+    return i == ARENA_HEAD || (i != ARENA_TAIL && this.node(i).key < key)
+}
+
+func (this *ArenaSkipList[K]) find(key K, preds, succs []uint32) int {
     layer_found := -1
-    preds := make([]*Node, MAX_LEVEL + 1)
-    succs := make([]*Node, MAX_LEVEL + 1)
-    pred := this.head
-    
-    for l := MAX_LEVEL - 1; l >= 0; l-- {
-        curr := pred.next[l]
-        for key > curr.key {
+    pred := ARENA_HEAD
+    for l := this.max_level - 1; l >= 0; l-- {
+        curr := this.next(pred, l)
+        for this.before(curr, key) {
             pred = curr
-            curr = pred.next[l]
+            curr = this.next(pred, l)
         }
-        if layer_found == -1 && key == curr.key {
+        if layer_found == -1 && curr != ARENA_TAIL && this.node(curr).key == key {
             layer_found = l
         }
         preds[l] = pred
         succs[l] = curr
     }
-    return layer_found, preds, succs
-}
-
-func (this *LazySkipList) contains(x int) bool {
-    layer_found := -1
-    layer_found, _, _ = this.find(x)
-    return layer_found != -1
+    return layer_found
 }
 
-func (this *LazySkipList) add(x int) bool {
-    preds := make([]*Node, MAX_LEVEL)
-    succs := make([]*Node, MAX_LEVEL)
+// false if the key is present, whatever its item
+func (this *ArenaSkipList[K]) add(key K, item int) bool {
+    preds := make([]uint32, this.max_level)
+    succs := make([]uint32, this.max_level)
     for {
-        layer_found := -1
-        layer_found, preds, succs = this.find(x)
-        if layer_found != -1 {
-            node_found := succs[layer_found]
-            if !node_found.marked {
-                for !node_found.fully_linked {}
+        if layer_found := this.find(key, preds, succs); layer_found != -1 {
+            found := this.node(succs[layer_found])
+            if atomic.LoadInt32(&found.marked) == 0 {
+                for atomic.LoadInt32(&found.fully_linked) == 0 {
+                    runtime.Gosched()
+                }
                 return false
             }
             continue
         }
-        highest_locked := -1
-        top_level := randomLevel()
-        var pred, succ, prev_pred *Node
+        top_level := level_source(this.max_level, this.prob)
+        locked := []uint32{}
         valid := true
-        for level := 0; valid && (level <= top_level - 1); level++ {
-            pred = preds[level]
-            succ = succs[level]
-            if pred != prev_pred {
-                pred.lock.RLock()
-                highest_locked = level
-                prev_pred = pred
+        for l := 0; valid && l < top_level; l++ {
+            pred, succ := preds[l], succs[l]
+            if len(locked) == 0 || locked[len(locked) - 1] != pred {
+                this.lockNode(pred)
+                locked = append(locked, pred)
             }
-            
-            valid = !pred.marked && !succ.marked && pred.next[level] == succ
+            valid = atomic.LoadInt32(&this.node(pred).marked) == 0 && atomic.LoadInt32(&this.node(succ).marked) == 0 && this.next(pred, l) == succ
         }
         if !valid {
-            for level := 0; level <= highest_locked - 1; level++ {
-                if isLocked(&preds[level].lock) {
-                    preds[level].lock.RUnlock()
-                }
+            for _, i := range locked {
+                this.unlockNode(i)
             }
             continue
         }
-        new_node := newNode(x, x, top_level)
-        for level := 0; level <= top_level - 1; level++ {
-            new_node.next[level] = succs[level]
-        }  
-        for level := 0; level <= top_level - 1; level++ {
-            preds[level].next[level] = new_node
-        }
-        new_node.fully_linked = true
-        for level := 0; level <= highest_locked - 1; level++ {
-            if isLocked(&preds[level].lock) {
-                preds[level].lock.RUnlock()
+        new_node, ok := this.newNode(key, item, top_level)
+        if !ok {
+            for _, i := range locked {
+                this.unlockNode(i)
             }
+            panic("arena list is out of node or tower indexes")
+        }
+        for l := 0; l < top_level; l++ {
+            this.setNext(new_node, l, succs[l])
+        }
+        for l := 0; l < top_level; l++ {
+            this.setNext(preds[l], l, new_node)
+        }
+        atomic.StoreInt32(&this.node(new_node).fully_linked, 1)
+        atomic.AddInt64(&this.count, 1)
+        for _, i := range locked {
+            this.unlockNode(i)
         }
         return true
     }
 }
 
-func (this *LazySkipList) remove(x int) bool {
-    var victim *Node
-    is_marked := false
-    top_level := -1
-    preds := make([]*Node, MAX_LEVEL)
-    succs := make([]*Node, MAX_LEVEL)
+func (this *ArenaSkipList[K]) remove(key K) bool {
+    preds := make([]uint32, this.max_level)
+    succs := make([]uint32, this.max_level)
+    victim, is_marked, top_level := uint32(0), false, 0
     for {
-        layer_found := -1
-        layer_found, preds, succs = this.find(x)
-        if layer_found != -1 {
+        layer_found := this.find(key, preds, succs)
+        if !is_marked {
+            if layer_found == -1 {
+                return false
+            }
             victim = succs[layer_found]
+            node := this.node(victim)
+            if atomic.LoadInt32(&node.fully_linked) == 0 || int(node.top_level) - 1 != layer_found || atomic.LoadInt32(&node.marked) == 1 {
+                return false
+            }
+            this.lockNode(victim)
+            if atomic.LoadInt32(&node.marked) == 1 {
+                this.unlockNode(victim)
+                return false
+            }
+            atomic.StoreInt32(&node.marked, 1)
+            is_marked, top_level = true, int(node.top_level)
+            atomic.AddInt64(&this.count, -1)
         }
-        if is_marked == true || (layer_found != -1 && victim.fully_linked && victim.top_level == layer_found && !victim.marked) {
-            if !is_marked {
-                top_level = victim.top_level
-                victim.lock.RLock()
-                if (victim.marked) {
-                    victim.lock.RUnlock()
-                    return false
-                }
-                victim.marked = true
-                is_marked = true
+        locked := []uint32{}
+        valid := true
+        for l := 0; valid && l < top_level; l++ {
+            pred := preds[l]
+            if len(locked) == 0 || locked[len(locked) - 1] != pred {
+                this.lockNode(pred)
+                locked = append(locked, pred)
             }
-            highest_locked := -1
-            var pred, succ, prev_pred *Node
-            valid := true
-            for level := 0; valid && (level <= top_level - 1); level++ {
-                pred = preds[level]
-                succ = succs[level]
-                if pred != prev_pred {
-                    pred.lock.RLock()
-                    highest_locked = level
-                    prev_pred = pred
-                }
-                valid = !pred.marked && pred.next[level] == succ
+            valid = atomic.LoadInt32(&this.node(pred).marked) == 0 && this.next(pred, l) == victim
+        }
+        if valid {
+            for l := top_level - 1; l >= 0; l-- {
+                this.setNext(preds[l], l, this.next(victim, l))
             }
-            if !valid {
-                for level := 0; level <= highest_locked - 1; level++ {
-                    if isLocked(&preds[level].lock) {
-                        preds[level].lock.RUnlock()
-                    }
+        }
+        for _, i := range locked {
+            this.unlockNode(i)
+        }
+        if valid {
+            this.unlockNode(victim)
+            return true
+        }
+    }
+}
+
+func (this *ArenaSkipList[K]) get(key K) (int, bool) {
+    preds := make([]uint32, this.max_level)
+    succs := make([]uint32, this.max_level)
+    layer_found := this.find(key, preds, succs)
+    if layer_found == -1 {
+        return 0, false
+    }
+    node := this.node(succs[layer_found])
+    if atomic.LoadInt32(&node.fully_linked) == 0 || atomic.LoadInt32(&node.marked) == 1 {
+        return 0, false
+    }
+    return int(node.item), true
+}
+
+func (this *ArenaSkipList[K]) contains(key K) bool {
+    _, ok := this.get(key)
+    return ok
+}
+
+func (this *ArenaSkipList[K]) size() int {
+    return int(atomic.LoadInt64(&this.count))
+}
+
+// calls fn in key order for every present key until fn returns false
+func (this *ArenaSkipList[K]) ascend(fn func(key K, item int) bool) {
+    for curr := this.next(ARENA_HEAD, 0); curr != ARENA_TAIL; curr = this.next(curr, 0) {
+        node := this.node(curr)
+        if atomic.LoadInt32(&node.fully_linked) == 1 && atomic.LoadInt32(&node.marked) == 0 && !fn(node.key, int(node.item)) {
+            return
+        }
+    }
+}
+
+/**
+the lazy list with every link and flag a reader looks at behind an atomic:
+contains(), get() and ascend() take no lock and are race-free under the Go
+memory model, while add() and remove() lock and validate as LazySkipList's
+do. LazySkipList's reads take no lock either, but over plain pointers,
+which the race detector reports; this is the list for code that runs
+under -race or must not lean on that. keys are ordered types and a
+present key is kept, as under REJECT
+**/
+type HybridSkipList[K cmp.Ordered] struct {
+    head *hybridNode[K]
+    tail *hybridNode[K]
+    count int64
+    listOptions
+}
+
+type hybridNode[K cmp.Ordered] struct {
+    key K
+    // written before the node is linked and never again
+    item int
+    next []atomic.Pointer[hybridNode[K]]
+    marked atomic.Bool
+    fully_linked atomic.Bool
+    lock sync.Mutex
+}
+
+func newHybridNode[K cmp.Ordered](key K, item, height int) *hybridNode[K] {
+    return &hybridNode[K]{key: key, item: item, next: make([]atomic.Pointer[hybridNode[K]], height)}
+}
+
+// checks the options as newList() does
+func newHybridSkipList[K cmp.Ordered](opts ...option) (*HybridSkipList[K], error) {
+    list := &HybridSkipList[K]{
+        listOptions: listOptions{
+            max_level: MAX_LEVEL,
+            prob: Prob}}
+    for _, opt := range opts {
+        opt(&list.listOptions)
+    }
+    if err := list.validate(); err != nil {
+        return nil, err
+    }
+    var zero K
+    list.head = newHybridNode(zero, 0, list.max_level)
+    list.tail = newHybridNode(zero, 0, list.max_level)
+    for l := 0; l < list.max_level; l++ {
+        list.head.next[l].Store(list.tail)
+    }
+    return list, nil
+}
+
+func (this *HybridSkipList[K]) before(node *hybridNode[K], key K) bool {
+    return node == this.head || (node != this.tail && node.key < key)
+}
+
+func (this *HybridSkipList[K]) find(key K, preds, succs []*hybridNode[K]) int {
+    layer_found := -1
+    pred := this.head
+    for l := this.max_level - 1; l >= 0; l-- {
+        curr := pred.next[l].Load()
+        for this.before(curr, key) {
+            pred = curr
+            curr = pred.next[l].Load()
+        }
+        if layer_found == -1 && curr != this.tail && curr.key == key {
+            layer_found = l
+        }
+        preds[l] = pred
+        succs[l] = curr
+    }
+    return layer_found
+}
+
+func unlockHybrid[K cmp.Ordered](locked []*hybridNode[K]) {
+    for _, node := range locked {
+        node.lock.Unlock()
+    }
+}
+
+// false if the key is present, whatever its item
+func (this *HybridSkipList[K]) add(key K, item int) bool {
+    preds := make([]*hybridNode[K], this.max_level)
+    succs := make([]*hybridNode[K], this.max_level)
+    for {
+        if layer_found := this.find(key, preds, succs); layer_found != -1 {
+            found := succs[layer_found]
+            if !found.marked.Load() {
+                for !found.fully_linked.Load() {
+                    runtime.Gosched()
                 }
-                continue
+                return false
             }
-            for level := top_level - 1; level >= 0; level-- {
-                preds[level].next[level] = victim.next[level]
+            continue
+        }
+        top_level := level_source(this.max_level, this.prob)
+        locked := []*hybridNode[K]{}
+        valid := true
+        for l := 0; valid && l < top_level; l++ {
+            pred, succ := preds[l], succs[l]
+            if len(locked) == 0 || locked[len(locked) - 1] != pred {
+                pred.lock.Lock()
+                locked = append(locked, pred)
+            }
+            valid = !pred.marked.Load() && !succ.marked.Load() && pred.next[l].Load() == succ
+        }
+        if !valid {
+            unlockHybrid(locked)
+            continue
+        }
+        new_node := newHybridNode(key, item, top_level)
+        for l := 0; l < top_level; l++ {
+            new_node.next[l].Store(succs[l])
+        }
+        for l := 0; l < top_level; l++ {
+            preds[l].next[l].Store(new_node)
+        }
+        new_node.fully_linked.Store(true)
+        atomic.AddInt64(&this.count, 1)
+        unlockHybrid(locked)
+        return true
+    }
+}
+
+func (this *HybridSkipList[K]) remove(key K) bool {
+    preds := make([]*hybridNode[K], this.max_level)
+    succs := make([]*hybridNode[K], this.max_level)
+    var victim *hybridNode[K]
+    for {
+        layer_found := this.find(key, preds, succs)
+        if victim == nil {
+            if layer_found == -1 {
+                return false
             }
-            if isLocked(&victim.lock) {
-                victim.lock.RUnlock()
+            candidate := succs[layer_found]
+            if !candidate.fully_linked.Load() || len(candidate.next) - 1 != layer_found || candidate.marked.Load() {
+                return false
             }
-            for level := 0; level <= highest_locked - 1; level++ {
-                if isLocked(&preds[level].lock) {
-                    preds[level].lock.RUnlock()
-                }
+            candidate.lock.Lock()
+            if candidate.marked.Load() {
+                candidate.lock.Unlock()
+                return false
+            }
+            candidate.marked.Store(true)
+            victim = candidate
+            atomic.AddInt64(&this.count, -1)
+        }
+        locked := []*hybridNode[K]{}
+        valid := true
+        for l := 0; valid && l < len(victim.next); l++ {
+            pred := preds[l]
+            if len(locked) == 0 || locked[len(locked) - 1] != pred {
+                pred.lock.Lock()
+                locked = append(locked, pred)
+            }
+            valid = !pred.marked.Load() && pred.next[l].Load() == victim
+        }
+        if valid {
+            // readers already on the victim go on through its links
+            for l := len(victim.next) - 1; l >= 0; l-- {
+                preds[l].next[l].Store(victim.next[l].Load())
             }
+        }
+        unlockHybrid(locked)
+        if valid {
+            victim.lock.Unlock()
             return true
-        } else {
-            return false
         }
     }
 }
 
-func isLocked(l *sync.RWMutex) bool {
-    state := reflect.ValueOf(l).Elem().FieldByName("readerCount").Int()
-    return state > 0
+// the first node at or after key on level 0, without recording preds
+func (this *HybridSkipList[K]) descend(key K) *hybridNode[K] {
+    pred := this.head
+    var curr *hybridNode[K]
+    for l := this.max_level - 1; l >= 0; l-- {
+        curr = pred.next[l].Load()
+        for this.before(curr, key) {
+            pred = curr
+            curr = pred.next[l].Load()
+        }
+    }
+    return curr
 }
 
-var a, c, r chan bool
-
-func testAdd(list *LazySkipList, nodes []int) {
-    for i := range nodes {
-        list.add(i)
+func (this *HybridSkipList[K]) get(key K) (int, bool) {
+    node := this.descend(key)
+    if node == this.tail || node.key != key || !node.fully_linked.Load() || node.marked.Load() {
+        return 0, false
     }
-    a<-true
+    return node.item, true
 }
 
-func testContains(list *LazySkipList, nodes []int) {
-//     defer wg.Done()
-    for i := range nodes {
-        list.contains(i)
-    }
-    c<-true
+func (this *HybridSkipList[K]) contains(key K) bool {
+    _, ok := this.get(key)
+    return ok
+}
+
+func (this *HybridSkipList[K]) size() int {
+    return int(atomic.LoadInt64(&this.count))
 }
 
-func testRemove(list *LazySkipList, nodes []int) {
-//     defer wg.Done()
-    for i := range nodes {
-        list.remove(i)
+// calls fn in key order for every present key in [lo, hi) until fn returns false
+func (this *HybridSkipList[K]) ascend(lo, hi K, fn func(key K, item int) bool) {
+    for curr := this.descend(lo); curr != this.tail && curr.key < hi; curr = curr.next[0].Load() {
+        if curr.fully_linked.Load() && !curr.marked.Load() && !fn(curr.key, curr.item) {
+            return
+        }
     }
-    r<-true
 }
 
 /**
 testing
 **/
 func main() {
-    a = make(chan bool)
-    c = make(chan bool)
-    r = make(chan bool)
-    list := newLazySkipList()
-    num_threads := 100
-    n := 130000
-    nodes := make([][]int, num_threads)
-    rand.Seed(time.Now().UnixNano())
-    for i := 0; i < num_threads; i++ {
-        nodes[i] = make([]int, n)
+    var config benchConfig
+    flag.BoolVar(&debug, "debug", false, "assert locking protocol invariants on every add() and remove()")
+    flag.BoolVar(&lock_tracking, "locktrack", false, "track lock acquisition order per goroutine and panic on violations")
+    flag.IntVar(&config.num_threads, "threads", 100, "number of goroutines")
+    flag.IntVar(&config.n, "n", 130000, "operations per goroutine")
+    flag.IntVar(&config.key_range, "keys", 0, "keys are drawn from [0, keys), defaults to threads * n")
+    flag.IntVar(&config.read, "read", 0, "percentage of contains() in a mixed run")
+    flag.IntVar(&config.insert, "insert", 0, "percentage of add() in a mixed run")
+    flag.IntVar(&config.remove, "delete", 0, "percentage of remove() in a mixed run")
+    dist := flag.String("dist", "uniform", "key distribution: uniform, zipf or seq")
+    flag.Float64Var(&config.zipf_s, "zipf", ZIPF_S, "exponent of -dist zipf, above 1")
+    flag.Int64Var(&config.seed, "seed", 0, "seed of the per-goroutine key and op streams, 0 for the clock")
+    chaos_mode := flag.Bool("chaos", false, "inject random yields and sleeps at the critical interleaving points")
+    pprof_addr := flag.String("pprof", "", "serve net/http/pprof on this address, e.g. localhost:6060")
+    cpu_profile := flag.String("cpuprofile", "", "write a CPU profile to this file")
+    sweep := flag.Bool("sweep", false, "sweep GOMAXPROCS and goroutines from 1 to NumCPU and report the speedup")
+    prob := flag.Float64("p", float64(Prob), "probability of a node reaching the next level")
+    max_level := flag.Int("maxlevel", MAX_LEVEL, "number of levels")
+    bloom := flag.Int("bloom", 0, "keep a Bloom filter with this many bits per key")
+    jump := flag.Int("jump", 0, "keep a jump table of the nodes linked at this level")
+    tune := flag.Int("tune", 0, "benchmark (p, maxlevel) combinations for a list of this size and report the best")
+    merge := flag.Bool("merge", false, "merge the result files given as arguments into one ops/sec table")
+    stress_for := flag.Duration("stress", 0, "run the invariant-checking stress test for this long instead of benchmarking")
+    diff_mode := flag.Bool("diff", false, "compare the two full backups given as arguments, print what changed and exit 1 if anything did")
+    flag.IntVar(&config.prefill, "prefill", 0, "fill the list to this many keys before measuring")
+    flag.IntVar(&config.warmup, "warmup", 0, "untimed operations per goroutine before measuring")
+    flag.BoolVar(&config.latency, "latency", false, "record per-operation latencies and report percentiles")
+    flag.StringVar(&config.format, "format", "text", "output format: text, json or csv")
+    flag.Parse()
+    if *chaos_mode {
+        chaos = chaosDelay
     }
-    for i := 0; i < num_threads; i++ {
-        for j := 0; j < n; j++ {
-            nodes[i][j] = rand.Intn(n * num_threads)
+    if *diff_mode {
+        if flag.NArg() != 2 {
+            fmt.Fprintln(os.Stderr, "-diff takes two backup files")
+            os.Exit(2)
+        }
+        a, err := loadBackup(flag.Arg(0))
+        if err == nil {
+            var b LazySkipList[int]
+            if b, err = loadBackup(flag.Arg(1)); err == nil {
+                diff := diffSnapshots(a.compare, a.cursor(), b.cursor())
+                err = writeDiff(os.Stdout, diff)
+                if err == nil && !diff.empty() {
+                    os.Exit(1)
+                }
+            }
         }
+        if err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(2)
+        }
+        return
     }
-    
-    start := time.Now()
-    for i := 0; i < num_threads; i++ {
-        go testAdd(&list, nodes[i])
+    if *merge {
+        results := []benchResult{}
+        for _, name := range flag.Args() {
+            f, err := os.Open(name)
+            if err != nil {
+                fmt.Fprintln(os.Stderr, err)
+                os.Exit(1)
+            }
+            file_results, err := readResults(f, strings.TrimSuffix(filepath.Base(name), filepath.Ext(name)))
+            f.Close()
+            if err != nil {
+                fmt.Fprintln(os.Stderr, name + ":", err)
+                os.Exit(1)
+            }
+            results = append(results, file_results...)
+        }
+        if err := writeMerged(os.Stdout, config.format, results); err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(1)
+        }
+        return
     }
-    for i := 0; i < num_threads; i++ {
-        <-a
+    if *pprof_addr != "" {
+        go func() {
+            fmt.Fprintln(os.Stderr, http.ListenAndServe(*pprof_addr, nil))
+        }()
     }
-    elapsed := time.Since(start)
-    fmt.Println("Go concurrent add()", n * num_threads, "nodes, time:",  elapsed.Seconds(), "s")
-    
-    start = time.Now()
-    for i := 0; i < num_threads; i++ {
-        go testContains(&list, nodes[i])
+    if *cpu_profile != "" {
+        f, err := os.Create(*cpu_profile)
+        if err == nil {
+            err = pprof.StartCPUProfile(f)
+        }
+        if err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(1)
+        }
+        defer pprof.StopCPUProfile()
     }
-    for i := 0; i < num_threads; i++ {
-        <-c
+    if *stress_for > 0 {
+        if config.key_range <= 0 {
+            config.key_range = 1024
+        }
+        list := newLazySkipList()
+        ops, err := stress(&list, config.num_threads, config.key_range, *stress_for, 100 * time.Millisecond)
+        if err != nil {
+            fmt.Fprintln(os.Stderr, "stress:", err)
+            list.dumpLevels(os.Stderr, 64)
+            os.Exit(1)
+        }
+        fmt.Println("stress:", ops, "operations, final size", list.size())
+        return
     }
-    elapsed = time.Since(start)
-    fmt.Println("Go concurrent contains()", n * num_threads, "nodes, time:",  elapsed.Seconds(), "s")
-    
-    start = time.Now()
-    for i := 0; i < num_threads; i++ {
-        go testRemove(&list, nodes[i])
+    if config.key_range <= 0 {
+        config.key_range = config.n * config.num_threads
     }
-    for i := 0; i < num_threads; i++ {
-        <-r
+    if config.prefill > config.key_range {
+        fmt.Fprintln(os.Stderr, "cannot prefill more keys than the key range holds")
+        os.Exit(2)
     }
-    elapsed = time.Since(start)
-    fmt.Println("Go concurrent remove()", n * num_threads, "nodes, time:",  elapsed.Seconds(), "s")
-}
+    if sum := config.read + config.insert + config.remove; sum != 0 && sum != 100 {
+        fmt.Fprintln(os.Stderr, "read, insert and delete percentages must add up to 100")
+        os.Exit(2)
+    }
+    dist_kind, err := parseDistribution(*dist)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(2)
+    }
+    if dist_kind == DIST_ZIPFIAN && config.zipf_s <= 1 {
+        fmt.Fprintln(os.Stderr, "the -zipf exponent must be above 1")
+        os.Exit(2)
+    }
+    config.dist = dist_kind
+    rand.Seed(time.Now().UnixNano())
+    config.options = []option{withProbability(float32(*prob)), withMaxLevel(*max_level)}
+    if *bloom > 0 {
+        config.options = append(config.options, withBloomFilter(*bloom, comparableHash[int]()))
+    }
+    if *jump > 0 {
+        config.options = append(config.options, withJumpTable(*jump))
+    }
+    // runBenchmark() and the rest build their lists unchecked
+    if _, err := newList[int](config.options...); err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(2)
+    }
+    if *tune != 0 && *tune < 2 {
+        fmt.Fprintln(os.Stderr, "-tune takes a list size of at least 2")
+        os.Exit(2)
+    }
+    if *tune > 0 {
+        results := tuneLevels(config, *tune)
+        fmt.Printf("%6s %9s %14s\n", "p", "maxlevel", "ops/sec")
+        for _, result := range results {
+            fmt.Printf("%6.3f %9d %14.0f\n", result.prob, result.max_level, result.ops_per_sec)
+        }
+        fmt.Printf("best: newLazySkipList(withProbability(%g), withMaxLevel(%d)), or -p %g -maxlevel %d\n",
+            results[0].prob, results[0].max_level, results[0].prob, results[0].max_level)
+        return
+    }
+    if *sweep {
+        results := sweepProcs(config)
+        if config.format == "text" {
+            writeScaling(os.Stdout, results)
+            return
+        }
+        if err := writeResults(os.Stdout, config.format, results); err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(1)
+        }
+        return
+    }
+    if err := writeResults(os.Stdout, config.format, runBenchmark(config)); err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+}
\ No newline at end of file
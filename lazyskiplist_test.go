@@ -0,0 +1,4548 @@
+package main
+import "testing"
+import "math/rand"
+import "fmt"
+import "sync"
+import "time"
+import "math"
+import "sync/atomic"
+import "strings"
+import "sort"
+import "reflect"
+import "testing/quick"
+import "net/netip"
+import "math/big"
+import "crypto/sha256"
+import "bytes"
+import "cmp"
+import "errors"
+import "context"
+import "encoding/json"
+import "strconv"
+import "io"
+import "encoding/binary"
+import "hash/crc32"
+
+/**
+go test lazyskiplist.go lazyskiplist_test.go
+go test -run NONE -bench . -benchmem lazyskiplist.go lazyskiplist_test.go
+go test -run NONE -fuzz FuzzLazySkipList lazyskiplist.go lazyskiplist_test.go
+**/
+
+const BENCH_KEYS int = 1 << 16
+
+// the benchmarks' op mixes, each goroutine drawing stream i of its workload
+var mixes = []struct {
+    name string
+    workload
+}{
+    {"read-90", workload{key_range: BENCH_KEYS, read: 90, insert: 5, remove: 5, seed: 1}},
+    {"mixed-50", workload{key_range: BENCH_KEYS, read: 50, insert: 25, remove: 25, seed: 1}},
+    {"write-90", workload{key_range: BENCH_KEYS, read: 10, insert: 45, remove: 45, seed: 1}}}
+
+func TestStress(t *testing.T) {
+    debug = true
+    defer func() { debug = false }()
+    duration := 2 * time.Second
+    if testing.Short() {
+        duration = 200 * time.Millisecond
+    }
+    list := newLazySkipList()
+    ops, err := stress(&list, 16, 512, duration, 20 * time.Millisecond)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Log(ops, "operations, final size", list.size())
+}
+
+func TestStressReportsOnce(t *testing.T) {
+    list := newLazySkipList()
+    for key := 8; key < 24; key++ {
+        list.add(key)
+    }
+    // a duplicate past the keys the workers write, so every ascend() fails
+    list.firstLive(9).key = 8
+    done := make(chan error)
+    go func() {
+        _, err := stress(&list, 16, 8, 5 * time.Second, 20 * time.Millisecond)
+        done <- err
+    }()
+    select {
+    case err := <-done:
+        if err == nil {
+            t.Fatal("stress() missed the duplicate")
+        }
+    case <-time.After(10 * time.Second):
+        t.Fatal("stress() hung after a failed check")
+    }
+}
+
+func TestDuplicatePolicy(t *testing.T) {
+    tests := []struct {
+        policy duplicatePolicy
+        second putResult
+        size int
+        item int
+    }{
+        {REJECT, PUT_REJECTED, 1, 10},
+        {OVERWRITE, PUT_OVERWRITTEN, 1, 20},
+        {KEEP_BOTH, PUT_DUPLICATED, 2, 10},
+    }
+    for _, test := range tests {
+        list := newLazySkipList(withOnDuplicate(test.policy))
+        list.put(5, 50)
+        list.put(9, 90)
+        if result := list.put(7, 10); result != PUT_INSERTED {
+            t.Fatalf("policy %d: first put(7) returned %d", test.policy, result)
+        }
+        if result := list.put(7, 20); result != test.second {
+            t.Fatalf("policy %d: second put(7) returned %d, want %d", test.policy, result, test.second)
+        }
+        if list.size() != test.size + 2 {
+            t.Fatalf("policy %d: size %d, want %d", test.policy, list.size(), test.size + 2)
+        }
+        if item, ok := list.get(7); !ok || item != test.item {
+            t.Fatalf("policy %d: get(7) = %d, %v, want %d", test.policy, item, ok, test.item)
+        }
+        if err := list.checkInvariants(); err != nil {
+            t.Fatalf("policy %d: %v", test.policy, err)
+        }
+        for i := 0; i < test.size; i++ {
+            if !list.remove(7) {
+                t.Fatalf("policy %d: remove(7) #%d failed", test.policy, i + 1)
+            }
+        }
+        if list.remove(7) || list.contains(7) {
+            t.Fatalf("policy %d: 7 still present after %d removes", test.policy, test.size)
+        }
+    }
+}
+
+func TestClear(t *testing.T) {
+    for _, policy := range []duplicatePolicy{REJECT, KEEP_BOTH} {
+        list := newLazySkipList(withOnDuplicate(policy))
+        for i := 0; i < 2000; i++ {
+            list.add(i % 1000)
+        }
+        list.tombstone(5000)
+        var wg sync.WaitGroup
+        stop := int32(0)
+        for i := 0; i < 4; i++ {
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                for atomic.LoadInt32(&stop) == 0 {
+                    prev := -1
+                    list.ascend(0, 1000, func(key int, item int) bool {
+                        if key < prev {
+                            t.Errorf("ascend() returned %d after %d", key, prev)
+                        }
+                        prev = key
+                        return true
+                    })
+                    list.contains(rand.Intn(1000))
+                }
+            }()
+        }
+        want := list.size() + 1
+        if removed := list.clear(); removed != want {
+            t.Errorf("clear() removed %d entries, want %d", removed, want)
+        }
+        atomic.StoreInt32(&stop, 1)
+        wg.Wait()
+        if _, result := list.lookup(5000); result != ABSENT || list.size() != 0 || list.head.next[0] != list.tail {
+            t.Fatalf("list not empty after clear(): size %d, lookup(5000) = %v", list.size(), result)
+        }
+        if err := list.checkInvariants(); err != nil {
+            t.Fatal(err)
+        }
+    }
+}
+
+func TestFreeze(t *testing.T) {
+    list := newLazySkipList(withPromotion(1))
+    var wg sync.WaitGroup
+    for i := 0; i < 8; i++ {
+        wg.Add(1)
+        go func(seed int64) {
+            defer wg.Done()
+            rng := rand.New(rand.NewSource(seed))
+            for !list.isFrozen() {
+                key := rng.Intn(256)
+                switch rng.Intn(3) {
+                case 0:
+                    list.add(key)
+                case 1:
+                    list.remove(key)
+                default:
+                    list.contains(key)
+                }
+            }
+        }(int64(i))
+    }
+    time.Sleep(20 * time.Millisecond)
+    list.freeze()
+    // whatever the writers do from here on must not show
+    var before strings.Builder
+    list.dumpLevels(&before, 256)
+    size := list.size()
+    wg.Wait()
+    for key := 0; key < 256; key++ {
+        present := list.contains(key)
+        if list.add(key) || list.remove(key) || list.tombstone(key) {
+            t.Fatalf("write to key %d succeeded after freeze()", key)
+        }
+        if result := list.put(key, 1); result != PUT_FROZEN {
+            t.Fatalf("put(%d) = %v after freeze(), want PUT_FROZEN", key, result)
+        }
+        if list.contains(key) != present {
+            t.Fatalf("contains(%d) changed after freeze()", key)
+        }
+    }
+    var after strings.Builder
+    list.dumpLevels(&after, 256)
+    if before.String() != after.String() || list.size() != size {
+        t.Fatalf("list changed after freeze():\n%s\nbecame\n%s", before.String(), after.String())
+    }
+    if list.clear() != 0 || list.maintain() != 0 {
+        t.Fatal("clear() or maintain() changed a frozen list")
+    }
+    if err := list.checkInvariants(); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestShardedCounter(t *testing.T) {
+    counter := newShardedCounter()
+    var wg sync.WaitGroup
+    for g := 0; g < 8; g++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for i := 0; i < 10000; i++ {
+                counter.add(1)
+                if i % 2 == 0 {
+                    counter.add(-1)
+                }
+                if counter.sum() < 0 {
+                    t.Error("sum() went negative")
+                    return
+                }
+            }
+        }()
+    }
+    wg.Wait()
+    if got := counter.sum(); got != 8 * 5000 {
+        t.Fatalf("sum() = %d, want %d", got, 8 * 5000)
+    }
+    // approx() serves the last sum until it is SIZE_REFRESH old
+    counter.add(1)
+    if got := counter.approx(); got != 8 * 5000 {
+        t.Fatalf("approx() = %d right after sum(), want the cached %d", got, 8 * 5000)
+    }
+    time.Sleep(2 * SIZE_REFRESH)
+    if got := counter.approx(); got != 8 * 5000 + 1 {
+        t.Fatalf("approx() = %d after SIZE_REFRESH, want %d", got, 8 * 5000 + 1)
+    }
+}
+
+func TestRandomKey(t *testing.T) {
+    for _, opts := range [][]option{nil, {withJumpTable(2)}} {
+        list := newLazySkipList(opts...)
+        if _, ok := list.randomKey(); ok {
+            t.Fatal("randomKey() found a key in an empty list")
+        }
+        for i := 0; i < 64; i++ {
+            list.add(i)
+        }
+        list.tombstone(10)
+        list.remove(20)
+        if list.jump != nil {
+            list.jump.rebuild(&list)
+        }
+        counts := make([]int, 64)
+        for i := 0; i < 62000; i++ {
+            key, ok := list.randomKey()
+            if !ok {
+                t.Fatal("randomKey() found nothing")
+            }
+            counts[key]++
+        }
+        if counts[10] != 0 || counts[20] != 0 {
+            t.Fatalf("randomKey() returned deleted keys %d and %d times", counts[10], counts[20])
+        }
+        // 1000 draws expected per key, five standard deviations either way
+        for key, count := range counts {
+            if key != 10 && key != 20 && (count < 850 || count > 1150) {
+                t.Fatalf("key %d drawn %d times out of 62000: %v", key, count, counts)
+            }
+        }
+        sample := list.randomSample(10)
+        distinct := map[int]bool{}
+        for _, key := range sample {
+            distinct[key] = true
+        }
+        if len(sample) != 10 || len(distinct) != 10 {
+            t.Fatalf("randomSample(10) = %v", sample)
+        }
+        if got := list.randomSample(100); len(got) > 62 {
+            t.Fatalf("randomSample(100) returned %d keys out of 62", len(got))
+        }
+    }
+}
+
+func TestWeightedRandom(t *testing.T) {
+    for _, opts := range [][]option{nil, {withJumpTable(1)}} {
+        list := newLazySkipList(opts...)
+        if _, _, ok := list.weightedRandom(); ok {
+            t.Fatal("weightedRandom() drew from an empty list")
+        }
+        // key i weighs i, 0 and the negative key never come up
+        list.put(-1, -5)
+        for i := 0; i < 16; i++ {
+            list.put(i, i)
+        }
+        if list.jump != nil {
+            list.jump.rebuild(&list)
+        }
+        counts := make([]int, 16)
+        for i := 0; i < 120000; i++ {
+            key, item, ok := list.weightedRandom()
+            if !ok || key < 1 || item != key {
+                t.Fatalf("weightedRandom() = %d, %d, %v", key, item, ok)
+            }
+            counts[key]++
+        }
+        // 1000 draws per unit of weight out of 120 units
+        for key := 1; key < 16; key++ {
+            want := 1000 * key
+            if diff := counts[key] - want; diff * diff > 25 * want {
+                t.Fatalf("key %d drawn %d times, want about %d: %v", key, counts[key], want, counts)
+            }
+        }
+    }
+}
+
+func TestReservoir(t *testing.T) {
+    counts := make([]int, 100)
+    for round := 0; round < 2000; round++ {
+        sample := newReservoir[int](10)
+        for key := 0; key < 100; key++ {
+            sample.observe(key)
+        }
+        keys, seen := sample.sample()
+        if len(keys) != 10 || seen != 100 {
+            t.Fatalf("sample() = %v, %d", keys, seen)
+        }
+        for _, key := range keys {
+            counts[key]++
+        }
+    }
+    // every key is kept in a tenth of the rounds
+    for key, count := range counts {
+        if count < 200 - 70 || count > 200 + 70 {
+            t.Fatalf("key %d kept in %d of 2000 rounds: %v", key, count, counts)
+        }
+    }
+}
+
+func TestQuantile(t *testing.T) {
+    for _, opts := range [][]option{nil, {withJumpTable(2)}} {
+        list := newLazySkipList(opts...)
+        if _, ok := list.quantile(0.5); ok {
+            t.Fatal("quantile() of an empty list")
+        }
+        // 1000 latencies, 1 to 1000, added out of order
+        for _, i := range rand.New(rand.NewSource(1)).Perm(1000) {
+            list.add(i + 1)
+        }
+        if list.jump != nil {
+            list.jump.rebuild(&list)
+        }
+        for _, c := range []struct {
+            q float64
+            want int
+        }{{0, 1}, {0.001, 1}, {0.0015, 2}, {0.5, 500}, {0.99, 990}, {0.999, 999}, {1, 1000}} {
+            if got, _ := list.quantile(c.q); got != c.want {
+                t.Fatalf("quantile(%v) = %d, want %d", c.q, got, c.want)
+            }
+        }
+    }
+}
+
+func TestTombstones(t *testing.T) {
+    for _, policy := range []duplicatePolicy{REJECT, OVERWRITE} {
+        list := newLazySkipList(withOnDuplicate(policy))
+        list.put(1, 10)
+        list.put(2, 20)
+        if !list.tombstone(1) || list.tombstone(1) {
+            t.Fatalf("policy %d: tombstone(1) should delete 1 once", policy)
+        }
+        if list.tombstone(3) {
+            t.Fatalf("policy %d: tombstone(3) deleted an absent key", policy)
+        }
+        for key, want := range map[int]lookupResult{1: DELETED, 2: FOUND, 3: DELETED, 4: ABSENT} {
+            if _, got := list.lookup(key); got != want {
+                t.Fatalf("policy %d: lookup(%d) = %d, want %d", policy, key, got, want)
+            }
+        }
+        if list.contains(1) || list.remove(1) || list.size() != 1 {
+            t.Fatalf("policy %d: tombstoned key still visible, size %d", policy, list.size())
+        }
+        if err := list.checkInvariants(); err != nil {
+            t.Fatalf("policy %d: %v", policy, err)
+        }
+        if result := list.put(1, 11); result != PUT_INSERTED {
+            t.Fatalf("policy %d: put() over a tombstone returned %d", policy, result)
+        }
+        if item, result := list.lookup(1); result != FOUND || item != 11 {
+            t.Fatalf("policy %d: lookup(1) = %d, %d after put()", policy, item, result)
+        }
+        if list.size() != 2 {
+            t.Fatalf("policy %d: size %d, want 2", policy, list.size())
+        }
+        if !list.remove(1) {
+            t.Fatalf("policy %d: remove(1) failed", policy)
+        }
+        if _, result := list.lookup(1); result != ABSENT {
+            t.Fatalf("policy %d: lookup(1) = %d after remove()", policy, result)
+        }
+    }
+}
+
+func TestPromotion(t *testing.T) {
+    list := newLazySkipList(withPromotion(1))
+    for key := 0; key < 1000; key++ {
+        list.add(key)
+    }
+    node := list.firstLive(500)
+    for i := 0; i < MAX_LEVEL; i++ {
+        list.contains(500)
+    }
+    if node.top_level != MAX_LEVEL {
+        t.Fatalf("hot node is %d levels tall, want %d", node.top_level, MAX_LEVEL)
+    }
+    // one level per maintain() once the node goes cold
+    list.maintain()
+    if node.top_level != MAX_LEVEL {
+        t.Fatalf("node lowered to %d while still hot", node.top_level)
+    }
+    for i := 0; i < MAX_LEVEL; i++ {
+        list.maintain()
+    }
+    if node.top_level != node.base_level {
+        t.Fatalf("cold node is %d levels tall, base height %d", node.top_level, node.base_level)
+    }
+    if err := list.checkInvariants(); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestStressPromotion(t *testing.T) {
+    debug = true
+    defer func() { debug = false }()
+    duration := time.Second
+    if testing.Short() {
+        duration = 200 * time.Millisecond
+    }
+    list := newLazySkipList(withPromotion(4))
+    ops, err := stress(&list, 16, 64, duration, 20 * time.Millisecond)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Log(ops, "operations, final size", list.size())
+}
+
+func TestBloomFilter(t *testing.T) {
+    list := newLazySkipList(withBloomFilter(10, comparableHash[int]()))
+    for i := 0; i < 20000; i += 2 {
+        list.add(i)
+    }
+    grown := list.bloom.current.Load()
+    // adds check the size on a sample, so the filter may trail it a little
+    if grown.capacity < 5000 {
+        t.Fatalf("filter sized for %d keys after 10000 adds", grown.capacity)
+    }
+    for i := 0; i < 20000; i++ {
+        if got, want := list.contains(i), i % 2 == 0; got != want {
+            t.Fatalf("contains(%d) = %v, want %v", i, got, want)
+        }
+    }
+    for i := 0; i < 20000; i += 2 {
+        if i % 100 != 0 && !list.remove(i) {
+            t.Fatalf("remove(%d) = false", i)
+        }
+    }
+    if list.bloom.current.Load() == grown {
+        t.Fatal("filter was not rebuilt after removing most keys")
+    }
+    false_positives := 0
+    for i := 0; i < 20000; i++ {
+        if got, want := list.contains(i), i % 100 == 0; got != want {
+            t.Fatalf("contains(%d) = %v, want %v", i, got, want)
+        }
+        // removed keys stay in the filter until the next rebuild
+        if i % 2 == 1 && list.bloom.mayContain(i) {
+            false_positives++
+        }
+    }
+    if false_positives > 10000 / 50 {
+        t.Fatalf("%d false positives out of 10000 keys never added", false_positives)
+    }
+    if err := list.checkInvariants(); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestStressBloom(t *testing.T) {
+    debug = true
+    defer func() { debug = false }()
+    duration := time.Second
+    if testing.Short() {
+        duration = 200 * time.Millisecond
+    }
+    list := newLazySkipList(withBloomFilter(8, comparableHash[int]()))
+    ops, err := stress(&list, 16, 64, duration, 20 * time.Millisecond)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Log(ops, "operations, final size", list.size())
+}
+
+func TestJumpTable(t *testing.T) {
+    list := newLazySkipList(withJumpTable(4))
+    rng := rand.New(rand.NewSource(1))
+    model := map[int]bool{}
+    for i := 0; i < 50000; i++ {
+        key := rng.Intn(100000)
+        list.add(key)
+        model[key] = true
+    }
+    if n := len(list.jump.table.Load().nodes); n < len(model) / 32 {
+        t.Fatalf("jump table holds %d of %d keys", n, len(model))
+    }
+    check := func() {
+        for key := 0; key < 100000; key++ {
+            if list.contains(key) != model[key] {
+                t.Fatalf("contains(%d) = %v", key, !model[key])
+            }
+        }
+        count := 0
+        list.ascend(30000, 40000, func(key int, item int) bool {
+            if !model[key] {
+                t.Fatalf("ascend() returned %d", key)
+            }
+            count++
+            return true
+        })
+        want := 0
+        for key := range model {
+            if key >= 30000 && key < 40000 {
+                want++
+            }
+        }
+        if count != want {
+            t.Fatalf("ascend(30000, 40000) returned %d keys, want %d", count, want)
+        }
+    }
+    check()
+    // the table still points at removed nodes until the next rebuild
+    table := list.jump.table.Load()
+    for key := range model {
+        if key % 2 == 0 {
+            list.remove(key)
+            delete(model, key)
+        }
+    }
+    if list.jump.table.Load() == table {
+        t.Fatal("jump table was not rebuilt after removing half the keys")
+    }
+    list.jump.table.Store(table)
+    check()
+}
+
+func TestStressJumpTable(t *testing.T) {
+    debug = true
+    defer func() { debug = false }()
+    duration := time.Second
+    if testing.Short() {
+        duration = 200 * time.Millisecond
+    }
+    list := newLazySkipList(withJumpTable(1))
+    ops, err := stress(&list, 16, 64, duration, 20 * time.Millisecond)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Log(ops, "operations, final size", list.size())
+}
+
+func TestComparerKeys(t *testing.T) {
+    list := newComparerList[netip.Addr]()
+    for _, addr := range []string{"10.0.0.2", "::1", "10.0.0.10", "192.168.1.1", "10.0.0.1"} {
+        list.add(netip.MustParseAddr(addr))
+    }
+    if list.add(netip.MustParseAddr("10.0.0.10")) {
+        t.Fatal("add() accepted a duplicate address")
+    }
+    got := []string{}
+    list.ascend(netip.MustParseAddr("10.0.0.0"), netip.MustParseAddr("10.0.1.0"), func(addr netip.Addr, item int) bool {
+        got = append(got, addr.String())
+        return true
+    })
+    want := []string{"10.0.0.1", "10.0.0.2", "10.0.0.10"}
+    if !reflect.DeepEqual(got, want) {
+        t.Fatalf("ascend() = %v, want %v", got, want)
+    }
+    if !list.remove(netip.MustParseAddr("::1")) || list.contains(netip.MustParseAddr("::1")) {
+        t.Fatal("remove(::1) failed")
+    }
+    if err := list.checkInvariants(); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestTimeKeys(t *testing.T) {
+    list := newTimeList()
+    now := time.Now()
+    tokyo, err := time.LoadLocation("Asia/Tokyo")
+    if err != nil {
+        tokyo = time.FixedZone("JST", 9 * 60 * 60)
+    }
+    for i := 0; i < 10; i++ {
+        list.add(now.Add(time.Duration(i) * time.Minute))
+    }
+    // the same instants without a monotonic reading, seen from another location
+    if list.add(now.Round(0).In(tokyo).Add(3 * time.Minute)) {
+        t.Fatal("add() accepted the same instant in another location")
+    }
+    if !list.contains(now.In(time.UTC).Round(0)) {
+        t.Fatal("contains() missed a key stripped of its monotonic reading")
+    }
+    count := 0
+    list.ascend(now.In(tokyo).Add(2 * time.Minute), now.In(time.UTC).Add(5 * time.Minute), func(key time.Time, item int) bool {
+        if want := now.Add(time.Duration(2 + count) * time.Minute); !key.Equal(want) {
+            t.Fatalf("ascend() returned %v, want %v", key, want)
+        }
+        count++
+        return true
+    })
+    if count != 3 {
+        t.Fatalf("ascend() returned %d keys, want 3", count)
+    }
+}
+
+// keys at and beyond the old -999 and 9999999999 sentinel values
+func TestUint64Keys(t *testing.T) {
+    keys := []uint64{0, 1, 999, 9999999999, 10000000000, 1 << 63, math.MaxUint64 - 1, math.MaxUint64}
+    list := newOrderedList[uint64]()
+    for i := len(keys) - 1; i >= 0; i-- {
+        if !list.add(keys[i]) {
+            t.Fatalf("add(%d) failed", keys[i])
+        }
+    }
+    got := []uint64{}
+    list.ascend(0, math.MaxUint64, func(key uint64, item int) bool {
+        got = append(got, key)
+        return true
+    })
+    if !reflect.DeepEqual(got, keys[:len(keys) - 1]) {
+        t.Fatalf("ascend(0, MaxUint64) = %v, want %v", got, keys[:len(keys) - 1])
+    }
+    for _, key := range keys {
+        if !list.contains(key) || !list.remove(key) || list.contains(key) {
+            t.Fatalf("contains/remove(%d) failed", key)
+        }
+    }
+    if err := list.checkInvariants(); err != nil {
+        t.Fatal(err)
+    }
+    ints := newLazySkipList()
+    for _, key := range []int{math.MinInt, -999, 9999999999, math.MaxInt} {
+        if !ints.add(key) || ints.add(key) || !ints.contains(key) {
+            t.Fatalf("int key %d collides with a sentinel", key)
+        }
+    }
+}
+
+func TestFloatKeys(t *testing.T) {
+    denormal := math.SmallestNonzeroFloat64
+    want := []float64{math.Inf(-1), -math.MaxFloat64, -1, -denormal, 0, denormal, 2 * denormal, 1, math.MaxFloat64, math.Inf(1), math.NaN()}
+    list := newFloatList()
+    for _, i := range rand.Perm(len(want)) {
+        if !list.add(want[i]) {
+            t.Fatalf("add(%v) failed", want[i])
+        }
+    }
+    for _, key := range []float64{math.Copysign(0, -1), math.NaN(), -math.NaN(), math.Inf(1), denormal} {
+        if list.add(key) {
+            t.Fatalf("add(%v) accepted a duplicate", key)
+        }
+    }
+    got := []float64{}
+    list.ascend(math.Inf(-1), math.NaN(), func(key float64, item int) bool {
+        got = append(got, key)
+        return true
+    })
+    if fmt.Sprint(got) != fmt.Sprint(want[:len(want) - 1]) {
+        t.Fatalf("ascend(-Inf, NaN) = %v, want %v", got, want[:len(want) - 1])
+    }
+    if !list.remove(math.Copysign(0, -1)) || list.contains(0) {
+        t.Fatal("remove(-0) did not remove +0")
+    }
+    if !list.remove(math.NaN()) || list.contains(math.NaN()) {
+        t.Fatal("remove(NaN) failed")
+    }
+    if err := list.checkInvariants(); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestBigIntKeys(t *testing.T) {
+    list := newBigIntList()
+    hashes := []*big.Int{}
+    for i := 0; i < 100; i++ {
+        sum := sha256.Sum256([]byte(fmt.Sprint(i)))
+        hash := new(big.Int).SetBytes(sum[:])
+        hashes = append(hashes, hash)
+        if !list.add(hash) {
+            t.Fatalf("add(%x) failed", hash)
+        }
+    }
+    // equal values behind different pointers are the same key
+    if list.add(new(big.Int).Set(hashes[0])) {
+        t.Fatal("add() accepted a copy of an existing key")
+    }
+    negative := new(big.Int).Neg(hashes[1])
+    if !list.add(negative) {
+        t.Fatal("add() rejected a negative key")
+    }
+    sort.Slice(hashes, func(i, j int) bool { return hashes[i].Cmp(hashes[j]) < 0 })
+    max := new(big.Int).Lsh(big.NewInt(1), 256)
+    got := []*big.Int{}
+    list.ascend(new(big.Int), max, func(key *big.Int, item int) bool {
+        got = append(got, key)
+        return true
+    })
+    if fmt.Sprint(got) != fmt.Sprint(hashes) {
+        t.Fatal("ascend(0, 2^256) is not the sorted hashes")
+    }
+    if err := list.checkInvariants(); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestFoldedKeys(t *testing.T) {
+    list := newFoldedList()
+    for _, key := range []string{"cherry", "Banana", "apple", "banana", "Äpfel", "APPLE", "b"} {
+        list.add(key)
+    }
+    got := []string{}
+    list.ascend("", "\U0010FFFF", func(key string, item int) bool {
+        got = append(got, key)
+        return true
+    })
+    want := []string{"APPLE", "apple", "b", "Banana", "banana", "cherry", "Äpfel"}
+    if !reflect.DeepEqual(got, want) {
+        t.Fatalf("ascend() = %v, want %v", got, want)
+    }
+}
+
+func TestCompositeKeys(t *testing.T) {
+    type row struct {
+        score float64
+        name string
+    }
+    list := newListFunc(orderBy(
+        desc(func(r row) float64 { return r.score }),
+        asc(func(r row) string { return r.name })))
+    rows := []row{{1, "carol"}, {3, "bob"}, {2, "dave"}, {3, "alice"}, {1, "bob"}}
+    for _, r := range rows {
+        list.add(r)
+    }
+    if list.add(row{3, "bob"}) {
+        t.Fatal("add() accepted a duplicate row")
+    }
+    got := []row{}
+    list.ascend(row{3, ""}, row{1, "c"}, func(r row, item int) bool {
+        got = append(got, r)
+        return true
+    })
+    want := []row{{3, "alice"}, {3, "bob"}, {2, "dave"}, {1, "bob"}}
+    if !reflect.DeepEqual(got, want) {
+        t.Fatalf("ascend() = %v, want %v", got, want)
+    }
+}
+
+// (int64 ASC, string DESC, float64 ASC) tuples against their encodings
+func TestKeyCodec(t *testing.T) {
+    type tuple struct {
+        id int64
+        name string
+        score float64
+    }
+    compare := orderBy(
+        asc(func(k tuple) int64 { return k.id }),
+        desc(func(k tuple) string { return k.name }),
+        asc(func(k tuple) float64 { return k.score }))
+    encode := func(k tuple) []byte {
+        return new(keyEncoder).putInt64(k.id, ASCENDING).putString(k.name, DESCENDING).putFloat64(k.score, ASCENDING).bytes()
+    }
+    names := []string{"", "a", "a\x00", "a\x00b", "ab", "b", "\xff", "\x00\x01"}
+    scores := []float64{math.Inf(-1), -1.5, -math.SmallestNonzeroFloat64, 0, math.SmallestNonzeroFloat64, 2, math.Inf(1)}
+    ids := []int64{math.MinInt64, -1, 0, 1, math.MaxInt64}
+    rng := rand.New(rand.NewSource(1))
+    tuples := []tuple{}
+    for i := 0; i < 500; i++ {
+        tuples = append(tuples, tuple{ids[rng.Intn(len(ids))], names[rng.Intn(len(names))], scores[rng.Intn(len(scores))]})
+    }
+    list := newBytesList()
+    for i, a := range tuples {
+        key := encode(a)
+        list.add(key)
+        b := tuples[(i + 1) % len(tuples)]
+        if got, want := bytes.Compare(key, encode(b)), compare(a, b); got != want {
+            t.Fatalf("%v vs %v: encodings compare %d, tuples %d", a, b, got, want)
+        }
+        decoder := keyDecoder{key}
+        id, err_id := decoder.getInt64(ASCENDING)
+        name, err_name := decoder.getString(DESCENDING)
+        score, err_score := decoder.getFloat64(ASCENDING)
+        if err_id != nil || err_name != nil || err_score != nil || len(decoder.buf) != 0 {
+            t.Fatalf("decoding %v: %v %v %v, %d bytes left", a, err_id, err_name, err_score, len(decoder.buf))
+        }
+        if (tuple{id, name, score}) != a {
+            t.Fatalf("decoded %v, want %v", tuple{id, name, score}, a)
+        }
+    }
+    // every tuple with id 0, by prefix
+    lo := new(keyEncoder).putInt64(0, ASCENDING).bytes()
+    hi := new(keyEncoder).putInt64(1, ASCENDING).bytes()
+    prev := []byte(nil)
+    list.ascend(lo, hi, func(key []byte, item int) bool {
+        decoder := keyDecoder{key}
+        if id, _ := decoder.getInt64(ASCENDING); id != 0 {
+            t.Fatalf("prefix scan returned id %d", id)
+        }
+        if prev != nil && bytes.Compare(prev, key) >= 0 {
+            t.Fatal("prefix scan out of order")
+        }
+        prev = key
+        return true
+    })
+    if prev == nil {
+        t.Fatal("prefix scan returned nothing")
+    }
+    if _, err := (&keyDecoder{[]byte{'a', 0}}).getString(ASCENDING); err == nil {
+        t.Fatal("decoded an unterminated string")
+    }
+}
+
+func TestDeterministicSkipList(t *testing.T) {
+    rng := rand.New(rand.NewSource(1))
+    for _, key_range := range []int{4, 64, 1024} {
+        list := newDeterministicSkipList(cmp.Compare[int])
+        model := map[int]bool{}
+        for i := 0; i < 20000; i++ {
+            key := rng.Intn(key_range)
+            switch rng.Intn(3) {
+            case 0:
+                if got, want := list.add(key), !model[key]; got != want {
+                    t.Fatalf("op %d: add(%d) = %v, want %v", i, key, got, want)
+                }
+                model[key] = true
+            case 1:
+                if got, want := list.remove(key), model[key]; got != want {
+                    t.Fatalf("op %d: remove(%d) = %v, want %v", i, key, got, want)
+                }
+                delete(model, key)
+            case 2:
+                if got, want := list.contains(key), model[key]; got != want {
+                    t.Fatalf("op %d: contains(%d) = %v, want %v", i, key, got, want)
+                }
+            }
+            if err := list.checkInvariants(); err != nil {
+                t.Fatalf("op %d on key %d: %v", i, key, err)
+            }
+        }
+        for key := range model {
+            if !list.remove(key) {
+                t.Fatalf("remove(%d) failed while draining", key)
+            }
+        }
+        if err := list.checkInvariants(); err != nil || list.size() != 0 {
+            t.Fatalf("after draining: size %d, %v", list.size(), err)
+        }
+    }
+    // sorted input is the worst case for a randomized list, here every gap holds at least one cell
+    list := newDeterministicSkipList(cmp.Compare[int])
+    for i := 0; i < 1 << 12; i++ {
+        list.add(i)
+    }
+    levels := 0
+    for level := list.head; level != list.bottom; level = level.down {
+        levels++
+    }
+    if levels > 13 {
+        t.Fatalf("%d levels for %d keys", levels, list.size())
+    }
+}
+
+func TestBiasedSkipList(t *testing.T) {
+    list := newBiasedSkipList(cmp.Compare[int], withDecay(5000))
+    model := map[int]bool{}
+    rng := rand.New(rand.NewSource(1))
+    zipf := rand.NewZipf(rng, 1.2, 1, 1023)
+    for i := 0; i < 50000; i++ {
+        key := int(zipf.Uint64())
+        switch rng.Intn(10) {
+        case 0:
+            if got, want := list.add(key), !model[key]; got != want {
+                t.Fatalf("op %d: add(%d) = %v, want %v", i, key, got, want)
+            }
+            model[key] = true
+        case 1:
+            key = rng.Intn(1024)
+            if got, want := list.remove(key), model[key]; got != want {
+                t.Fatalf("op %d: remove(%d) = %v, want %v", i, key, got, want)
+            }
+            delete(model, key)
+        default:
+            if got, want := list.contains(key), model[key]; got != want {
+                t.Fatalf("op %d: contains(%d) = %v, want %v", i, key, got, want)
+            }
+        }
+        if i % 1000 == 0 {
+            if err := list.checkInvariants(); err != nil {
+                t.Fatalf("op %d: %v", i, err)
+            }
+        }
+    }
+    // the hottest key has climbed, and sinks back once it goes cold
+    list.add(0)
+    for i := 0; i < 4000; i++ {
+        list.contains(0)
+    }
+    hot, _ := list.find(0)
+    if len(hot.next) < 10 {
+        t.Fatalf("hot key is %d levels tall", len(hot.next))
+    }
+    for i := 0; i < 20 * 5000; i++ {
+        list.contains(-1)
+    }
+    if len(hot.next) != hot.base_level {
+        t.Fatalf("cold key is %d levels tall, base height %d", len(hot.next), hot.base_level)
+    }
+    if err := list.checkInvariants(); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestSkipGraph(t *testing.T) {
+    graph := newSkipGraph(cmp.Compare[int], 2)
+    model := map[int]uint64{}
+    rng := rand.New(rand.NewSource(1))
+    for i := 0; i < 20000; i++ {
+        key := rng.Intn(512)
+        _, present := model[key]
+        switch rng.Intn(3) {
+        case 0:
+            partition := uint64(key % 4)
+            if got := graph.add(key, partition); got != !present {
+                t.Fatalf("op %d: add(%d) = %v, want %v", i, key, got, !present)
+            }
+            model[key] = partition
+        case 1:
+            if got := graph.remove(key); got != present {
+                t.Fatalf("op %d: remove(%d) = %v, want %v", i, key, got, present)
+            }
+            delete(model, key)
+        default:
+            if got := graph.contains(key); got != present {
+                t.Fatalf("op %d: contains(%d) = %v, want %v", i, key, got, present)
+            }
+        }
+        if i % 500 == 0 {
+            if err := graph.checkInvariants(); err != nil {
+                t.Fatalf("op %d: %v", i, err)
+            }
+        }
+    }
+    if graph.size() != len(model) {
+        t.Fatalf("size() = %d, want %d", graph.size(), len(model))
+    }
+    // a range over the whole graph, then over each partition
+    want := []int{}
+    for key := 100; key < 300; key++ {
+        if _, ok := model[key]; ok {
+            want = append(want, key)
+        }
+    }
+    got := []int{}
+    graph.ascend(100, 300, func(key int, partition uint64) bool {
+        got = append(got, key)
+        return true
+    })
+    if fmt.Sprint(got) != fmt.Sprint(want) {
+        t.Fatalf("ascend(100, 300) = %v, want %v", got, want)
+    }
+    for partition := uint64(0); partition < 4; partition++ {
+        got = got[:0]
+        graph.ascendPartition(partition, 100, 300, func(key int, p uint64) bool {
+            if p != partition {
+                t.Fatalf("partition %d yielded %d from partition %d", partition, key, p)
+            }
+            got = append(got, key)
+            return true
+        })
+        in_partition := []int{}
+        for _, key := range want {
+            if model[key] == partition {
+                in_partition = append(in_partition, key)
+            }
+        }
+        if fmt.Sprint(got) != fmt.Sprint(in_partition) {
+            t.Fatalf("ascendPartition(%d) = %v, want %v", partition, got, in_partition)
+        }
+    }
+}
+
+func TestPointIndex(t *testing.T) {
+    index := newPointIndex()
+    rng := rand.New(rand.NewSource(1))
+    points := map[[2]uint32]int{}
+    for i := 0; i < 5000; i++ {
+        x, y := uint32(rng.Intn(1000)), uint32(rng.Intn(1000))
+        if index.put(x, y, i) == PUT_INSERTED {
+            points[[2]uint32{x, y}] = i
+        }
+    }
+    // the corners of the grid
+    for _, p := range [][2]uint32{{0, 0}, {math.MaxUint32, math.MaxUint32}, {0, math.MaxUint32}} {
+        index.put(p[0], p[1], -1)
+        points[p] = -1
+    }
+    for x := uint32(0); x < 1000; x += 7 {
+        if x, y := mortonPoint(mortonCode(x, 999 - x)); x + y != 999 {
+            t.Fatalf("mortonPoint(mortonCode(%d, %d)) = %d, %d", x, 999 - x, x, y)
+        }
+    }
+    rects := [][4]uint32{{0, 0, math.MaxUint32, math.MaxUint32}, {500, 500, math.MaxUint32, math.MaxUint32}}
+    for i := 0; i < 200; i++ {
+        min_x, min_y := uint32(rng.Intn(1000)), uint32(rng.Intn(1000))
+        rects = append(rects, [4]uint32{min_x, min_y, min_x + uint32(rng.Intn(300)), min_y + uint32(rng.Intn(300))})
+    }
+    for _, r := range rects {
+        want := 0
+        for p := range points {
+            if p[0] >= r[0] && p[0] <= r[2] && p[1] >= r[1] && p[1] <= r[3] {
+                want++
+            }
+        }
+        got := 0
+        index.queryRect(r[0], r[1], r[2], r[3], func(x, y uint32, item int) bool {
+            if item != points[[2]uint32{x, y}] || x < r[0] || x > r[2] || y < r[1] || y > r[3] {
+                t.Fatalf("queryRect(%v) returned (%d, %d) = %d", r, x, y, item)
+            }
+            got++
+            return true
+        })
+        if got != want {
+            t.Fatalf("queryRect(%v) returned %d points, want %d", r, got, want)
+        }
+        if n := len(zRanges(r[0], r[1], r[2], r[3])); n > 256 {
+            t.Fatalf("zRanges(%v) split into %d runs", r, n)
+        }
+    }
+    stopped := 0
+    index.queryRect(0, 0, 999, 999, func(x, y uint32, item int) bool {
+        stopped++
+        return stopped < 10
+    })
+    if stopped != 10 {
+        t.Fatalf("queryRect() went on for %d points after fn returned false", stopped - 10)
+    }
+}
+
+func TestImmutableSkipList(t *testing.T) {
+    keys := []int{}
+    items := []int{}
+    for i := 0; i < 1000; i++ {
+        keys = append(keys, i * 3)
+        items = append(items, -i)
+    }
+    list, err := newImmutableSkipList(cmp.Compare[int], keys, items)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for key := -1; key < 3001; key++ {
+        item, ok := list.get(key)
+        if ok != (key >= 0 && key % 3 == 0 && key < 3000) || ok && item != -key / 3 {
+            t.Fatalf("get(%d) = %d, %v", key, item, ok)
+        }
+    }
+    // exactly half the nodes reach each next level
+    for l := 1; l < len(list.head.next); l++ {
+        below, at := 0, 0
+        for curr := list.head.next[l - 1]; curr != nil; curr = curr.next[l - 1] {
+            below++
+        }
+        for curr := list.head.next[l]; curr != nil; curr = curr.next[l] {
+            at++
+        }
+        if at != below / 2 {
+            t.Fatalf("%d nodes at level %d above %d", at, l, below)
+        }
+    }
+    got := []int{}
+    list.ascend(10, 20, func(key int, item int) bool {
+        got = append(got, key)
+        return true
+    })
+    if fmt.Sprint(got) != "[12 15 18]" {
+        t.Fatalf("ascend(10, 20) = %v", got)
+    }
+    mutable := list.toMutable()
+    mutable.add(1)
+    if mutable.size() != 1001 || list.contains(1) {
+        t.Fatalf("toMutable() has %d keys, the original contains(1) = %v", mutable.size(), list.contains(1))
+    }
+    if item, _ := mutable.get(300); item != -100 {
+        t.Fatalf("toMutable() get(300) = %d, want -100", item)
+    }
+    if _, err := newImmutableSkipList(cmp.Compare[int], []int{1, 3, 3}, nil); err == nil {
+        t.Fatal("newImmutableSkipList() accepted a duplicate key")
+    }
+    empty, _ := newImmutableSkipList(cmp.Compare[int], nil, nil)
+    if empty.contains(0) || empty.size() != 0 {
+        t.Fatal("empty list is not empty")
+    }
+}
+
+func TestPersistentSkipList(t *testing.T) {
+    list := newPersistentSkipList(cmp.Compare[int], withMaxLevel(8))
+    rng := rand.New(rand.NewSource(1))
+    model := map[int]int{}
+    versions := []persistentVersion[int]{list.current()}
+    models := []map[int]int{{}}
+    // a reader holding an old version sees it unchanged while the writer goes on
+    first := list.put(-1, -1)
+    model[-1] = -1
+    var wg sync.WaitGroup
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        for i := 0; i < 1000; i++ {
+            if first.size() != 1 || !first.contains(-1) || first.contains(rand.Intn(256)) {
+                t.Errorf("first version changed")
+                return
+            }
+        }
+    }()
+    for i := 0; i < 3000; i++ {
+        key := rng.Intn(256)
+        if rng.Intn(2) == 0 {
+            versions = append(versions, list.put(key, i))
+            model[key] = i
+        } else {
+            version, ok := list.remove(key)
+            if _, want := model[key]; ok != want {
+                t.Fatalf("op %d: remove(%d) = %v, want %v", i, key, ok, want)
+            }
+            versions = append(versions, version)
+            delete(model, key)
+        }
+        snapshot := map[int]int{}
+        for k, v := range model {
+            snapshot[k] = v
+        }
+        models = append(models, snapshot)
+    }
+    wg.Wait()
+    for i := 0; i < len(versions); i += 37 {
+        version, want := versions[i], models[i]
+        if version.size() != len(want) {
+            t.Fatalf("version %d: size() = %d, want %d", i, version.size(), len(want))
+        }
+        got := map[int]int{}
+        version.ascend(-1, 256, func(key int, item int) bool {
+            got[key] = item
+            return true
+        })
+        if !reflect.DeepEqual(got, want) {
+            t.Fatalf("version %d: ascend() = %v, want %v", i, got, want)
+        }
+        for key := 0; key < 256; key++ {
+            item, ok := version.get(key)
+            if want_item, want_ok := want[key]; ok != want_ok || item != want_item {
+                t.Fatalf("version %d: get(%d) = %d, %v, want %d, %v", i, key, item, ok, want_item, want_ok)
+            }
+        }
+    }
+    if list.current().version != versions[len(versions) - 1].version {
+        t.Fatal("current() is not the last version made")
+    }
+}
+
+func TestGroupCommitter(t *testing.T) {
+    list := newLazySkipList()
+    group := newGroupCommitter(&list, 2, 32)
+    // each goroutine owns the keys congruent to it, so its results are predictable
+    var wg sync.WaitGroup
+    for g := 0; g < 8; g++ {
+        wg.Add(1)
+        go func(g int) {
+            defer wg.Done()
+            present := map[int]bool{}
+            rng := rand.New(rand.NewSource(int64(g)))
+            for i := 0; i < 2000; i++ {
+                key := rng.Intn(64) * 8 + g
+                if rng.Intn(2) == 0 {
+                    if got := group.add(key); got != !present[key] {
+                        t.Errorf("add(%d) = %v, want %v", key, got, !present[key])
+                        return
+                    }
+                    present[key] = true
+                } else {
+                    if got := group.remove(key); got != present[key] {
+                        t.Errorf("remove(%d) = %v, want %v", key, got, present[key])
+                        return
+                    }
+                    delete(present, key)
+                }
+                if got := group.contains(key); got != present[key] {
+                    t.Errorf("contains(%d) = %v after its own write", key, got)
+                    return
+                }
+            }
+        }(g)
+    }
+    wg.Wait()
+    group.close()
+    if err := list.checkInvariants(); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestFlatCombining(t *testing.T) {
+    group := newFlatCombiningList(cmp.Compare[int])
+    // each goroutine owns the keys congruent to it, so its results are predictable
+    var wg sync.WaitGroup
+    for g := 0; g < 8; g++ {
+        wg.Add(1)
+        go func(g int) {
+            defer wg.Done()
+            present := map[int]bool{}
+            rng := rand.New(rand.NewSource(int64(g)))
+            for i := 0; i < 2000; i++ {
+                key := rng.Intn(64) * 8 + g
+                if rng.Intn(2) == 0 {
+                    if got := group.add(key); got != !present[key] {
+                        t.Errorf("add(%d) = %v, want %v", key, got, !present[key])
+                        return
+                    }
+                    present[key] = true
+                } else {
+                    if got := group.remove(key); got != present[key] {
+                        t.Errorf("remove(%d) = %v, want %v", key, got, present[key])
+                        return
+                    }
+                    delete(present, key)
+                }
+                if !group.contains(key) != !present[key] {
+                    t.Errorf("contains(%d) = %v after its own write", key, !present[key])
+                    return
+                }
+            }
+        }(g)
+    }
+    wg.Wait()
+    if err := group.list.checkInvariants(); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestElimination(t *testing.T) {
+    list := newFlatCombiningList(cmp.Compare[int], withElimination())
+    // successful adds and removes of a key alternate, starting with an add
+    added := make([]int64, 8)
+    removed := make([]int64, 8)
+    var wg sync.WaitGroup
+    for g := 0; g < 16; g++ {
+        wg.Add(1)
+        go func(g int) {
+            defer wg.Done()
+            rng := rand.New(rand.NewSource(int64(g)))
+            for i := 0; i < 3000; i++ {
+                key := rng.Intn(8)
+                if g % 2 == 0 {
+                    if list.add(key) {
+                        atomic.AddInt64(&added[key], 1)
+                    }
+                } else if list.remove(key) {
+                    atomic.AddInt64(&removed[key], 1)
+                }
+            }
+        }(g)
+    }
+    wg.Wait()
+    for key := 0; key < 8; key++ {
+        present := int64(0)
+        if list.contains(key) {
+            present = 1
+        }
+        if added[key] - removed[key] != present {
+            t.Fatalf("key %d: %d adds and %d removes succeeded, contains() = %v", key, added[key], removed[key], present == 1)
+        }
+    }
+    if err := list.list.checkInvariants(); err != nil {
+        t.Fatal(err)
+    }
+    // a batch as the combiner would see it
+    list = newFlatCombiningList(cmp.Compare[int], withElimination())
+    list.add(2)
+    list.add(4)
+    requests := []*combiningRequest[int]{
+        {key: 1, op: OP_ADD}, {key: 3, op: OP_REMOVE}, {key: 1, op: OP_REMOVE},
+        {key: 2, op: OP_REMOVE}, {key: 2, op: OP_ADD}, {key: 4, item: 5, op: OP_ADD}, {key: 4, op: OP_REMOVE}}
+    list.eliminate(requests)
+    done := map[int]int{}
+    for _, request := range requests {
+        if request.done == 1 {
+            done[request.key]++
+            if request.op == OP_ADD && request.result != PUT_INSERTED || request.op == OP_REMOVE && !request.removed {
+                t.Fatalf("eliminated request on %d did not succeed", request.key)
+            }
+        }
+    }
+    // 4 is present with another item, replacing it is a write
+    if !reflect.DeepEqual(done, map[int]int{1: 2, 2: 2}) || list.eliminated != 2 {
+        t.Fatalf("eliminate() completed %v", done)
+    }
+    if list.contains(1) || !list.contains(2) {
+        t.Fatal("eliminate() changed the list")
+    }
+    // applied, a put and remove of a tombstoned key would leave it ABSENT
+    list.list.tombstone(6)
+    requests = []*combiningRequest[int]{{key: 6, op: OP_ADD}, {key: 6, op: OP_REMOVE}}
+    list.eliminate(requests)
+    if requests[0].done == 1 || requests[1].done == 1 {
+        t.Fatal("eliminate() paired up requests on a tombstone")
+    }
+}
+
+func TestAugmentedSkipList(t *testing.T) {
+    aggregates := map[string]monoid{"sum": sum_aggregate, "min": min_aggregate, "max": max_aggregate}
+    for name, aggregate := range aggregates {
+        list := newAugmentedSkipList(cmp.Compare[int], aggregateBy[int](aggregate))
+        model := map[int]int{}
+        rng := rand.New(rand.NewSource(1))
+        for i := 0; i < 20000; i++ {
+            key := rng.Intn(2048)
+            switch rng.Intn(3) {
+            case 0:
+                _, found := model[key]
+                item := rng.Intn(1000) - 500
+                if got := list.put(key, item); got == found {
+                    t.Fatalf("%s op %d: put(%d) = %v with key present %v", name, i, key, got, found)
+                }
+                model[key] = item
+            case 1:
+                _, found := model[key]
+                if got := list.remove(key); got != found {
+                    t.Fatalf("%s op %d: remove(%d) = %v, want %v", name, i, key, got, found)
+                }
+                delete(model, key)
+            default:
+                lo := rng.Intn(2048)
+                hi := lo + rng.Intn(512)
+                agg, count := aggregate.identity, 0
+                for key, item := range model {
+                    if key >= lo && key < hi {
+                        agg = aggregate.combine(agg, item)
+                        count++
+                    }
+                }
+                if got := list.aggregateRange(lo, hi); got != agg {
+                    t.Fatalf("%s op %d: aggregateRange(%d, %d) = %d, want %d", name, i, lo, hi, got, agg)
+                }
+                if got := list.countRange(lo, hi); got != count {
+                    t.Fatalf("%s op %d: countRange(%d, %d) = %d, want %d", name, i, lo, hi, got, count)
+                }
+            }
+            if i % 2000 == 0 {
+                if err := list.checkInvariants(equalInts); err != nil {
+                    t.Fatalf("%s op %d: %v", name, i, err)
+                }
+            }
+        }
+        if list.size() != len(model) {
+            t.Fatalf("%s: size() = %d, want %d", name, list.size(), len(model))
+        }
+        if err := list.checkInvariants(equalInts); err != nil {
+            t.Fatalf("%s: %v", name, err)
+        }
+    }
+}
+
+func equalInts(a, b int) bool {
+    return a == b
+}
+
+// counts keys by their residue mod 4, a summary that can be taken apart
+type residueCounts struct{}
+
+func (residueCounts) zero() [4]int {
+    return [4]int{}
+}
+
+func (residueCounts) onInsert(summary [4]int, key int, item int) [4]int {
+    summary[key % 4]++
+    return summary
+}
+
+func (residueCounts) onRemove(summary [4]int, key int, item int) ([4]int, bool) {
+    summary[key % 4]--
+    return summary, true
+}
+
+func (residueCounts) combine(a, b [4]int) [4]int {
+    for i := range a {
+        a[i] += b[i]
+    }
+    return a
+}
+
+func TestAugmentation(t *testing.T) {
+    list := newAugmentedSkipList[int, [4]int](cmp.Compare[int], residueCounts{})
+    model := map[int]bool{}
+    rng := rand.New(rand.NewSource(1))
+    for i := 0; i < 20000; i++ {
+        key := rng.Intn(4096)
+        if rng.Intn(2) == 0 {
+            if got, want := list.add(key), !model[key]; got != want {
+                t.Fatalf("op %d: add(%d) = %v, want %v", i, key, got, want)
+            }
+            model[key] = true
+        } else {
+            if got, want := list.remove(key), model[key]; got != want {
+                t.Fatalf("op %d: remove(%d) = %v, want %v", i, key, got, want)
+            }
+            delete(model, key)
+        }
+        if i % 100 == 0 {
+            lo := rng.Intn(4096)
+            hi := lo + rng.Intn(1024)
+            var want [4]int
+            for key := range model {
+                if key >= lo && key < hi {
+                    want[key % 4]++
+                }
+            }
+            if got := list.aggregateRange(lo, hi); got != want {
+                t.Fatalf("op %d: aggregateRange(%d, %d) = %v, want %v", i, lo, hi, got, want)
+            }
+        }
+    }
+    if err := list.checkInvariants(func(a, b [4]int) bool { return a == b }); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestPage(t *testing.T) {
+    list := newAugmentedSkipList(cmp.Compare[int], aggregateBy[int](sum_aggregate))
+    keys := []int{}
+    for _, key := range rand.New(rand.NewSource(1)).Perm(10000) {
+        if key % 3 != 0 {
+            list.put(key, -key)
+            keys = append(keys, key)
+        }
+    }
+    sort.Ints(keys)
+    page_size := 25
+    if got, want := list.pages(page_size), (len(keys) + page_size - 1) / page_size; got != want {
+        t.Fatalf("pages() = %d, want %d", got, want)
+    }
+    for n := 0; n <= list.pages(page_size); n++ {
+        want := keys[min(n * page_size, len(keys)):min((n + 1) * page_size, len(keys))]
+        got := []int{}
+        list.page(n, page_size, func(key, item int) bool {
+            if item != -key {
+                t.Fatalf("page %d: key %d has item %d", n, key, item)
+            }
+            got = append(got, key)
+            return true
+        })
+        if !reflect.DeepEqual(got, want) {
+            t.Fatalf("page %d = %v, want %v", n, got, want)
+        }
+    }
+}
+
+func TestHistogram(t *testing.T) {
+    list := newAugmentedSkipList(cmp.Compare[int], aggregateBy[int](sum_aggregate))
+    model := []int{}
+    rng := rand.New(rand.NewSource(1))
+    for i := 0; i < 5000; i++ {
+        key := int(rng.NormFloat64() * 1000)
+        if list.add(key) {
+            model = append(model, key)
+        }
+    }
+    buckets := []int{-2000, -1000, -10, 0, 1, 1000, 2000}
+    want := make([]int, len(buckets) + 1)
+    for _, key := range model {
+        want[sort.SearchInts(buckets, key + 1)]++
+    }
+    if got := list.histogram(buckets); !reflect.DeepEqual(got, want) {
+        t.Fatalf("histogram(%v) = %v, want %v", buckets, got, want)
+    }
+    if got := list.histogram(nil); !reflect.DeepEqual(got, []int{len(model)}) {
+        t.Fatalf("histogram(nil) = %v, want [%d]", got, len(model))
+    }
+    sort.Ints(model)
+    for _, key := range []int{-1000, 0, 1} {
+        if got, want := list.rank(key), sort.SearchInts(model, key); got != want {
+            t.Fatalf("rank(%d) = %d, want %d", key, got, want)
+        }
+    }
+}
+
+func TestIngest(t *testing.T) {
+    list := newLazySkipList()
+    list.add(7)
+    input := "3 30\n1\n\n  7\n3 31\n2 20\n9\n1 10\n5 50\n"
+    stats, err := list.ingest(strings.NewReader(input), parseIntRecord, 3)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // 3 and 1 repeat within the input, 7 was already there
+    if stats.accepted != 5 || stats.duplicates != 3 {
+        t.Fatalf("ingest() = %+v, want 5 accepted and 3 duplicates", stats)
+    }
+    for key, want := range map[int]int{1: 1, 2: 20, 3: 30, 5: 50, 7: 0, 9: 9} {
+        if got, ok := list.get(key); !ok || got != want {
+            t.Fatalf("get(%d) = %d, %v, want %d", key, got, ok, want)
+        }
+    }
+    if _, err := list.ingest(strings.NewReader("4\nfour\n"), parseIntRecord, 10); err == nil || !strings.Contains(err.Error(), "line 2") {
+        t.Fatalf("ingest() of a bad record returned %v", err)
+    }
+    list.freeze()
+    if _, err := list.ingest(strings.NewReader("100\n"), parseIntRecord, 10); err == nil {
+        t.Fatalf("ingest() into a frozen list succeeded")
+    }
+    if err := list.checkInvariants(); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestBuildParallel(t *testing.T) {
+    rng := rand.New(rand.NewSource(1))
+    entries := make([]entry[int], 20000)
+    for i := range entries {
+        entries[i] = entry[int]{rng.Intn(5000), i}
+    }
+    for _, policy := range []duplicatePolicy{REJECT, OVERWRITE, KEEP_BOTH} {
+        for _, workers := range []int{1, 3, 8} {
+            list := buildParallel(cmp.Compare[int], entries, workers, withOnDuplicate(policy))
+            if err := list.checkInvariants(); err != nil {
+                t.Fatalf("policy %d, %d workers: %v", policy, workers, err)
+            }
+            model := newListFunc(cmp.Compare[int], withOnDuplicate(policy))
+            for _, e := range entries {
+                model.put(e.key, e.item)
+            }
+            got, want := [][2]int{}, [][2]int{}
+            list.ascend(math.MinInt, math.MaxInt, func(key, item int) bool {
+                got = append(got, [2]int{key, item})
+                return true
+            })
+            model.ascend(math.MinInt, math.MaxInt, func(key, item int) bool {
+                want = append(want, [2]int{key, item})
+                return true
+            })
+            if !reflect.DeepEqual(got, want) || list.size() != model.size() {
+                t.Fatalf("policy %d, %d workers: built list differs from one built by put()", policy, workers)
+            }
+            // still a working list
+            if list.put(-1, 0) != PUT_INSERTED || !list.remove(-1) {
+                t.Fatalf("policy %d, %d workers: put() and remove() failed on the built list", policy, workers)
+            }
+        }
+    }
+    list := buildParallel(cmp.Compare[int], entries, 4, withJumpTable(3), withBloomFilter(10, comparableHash[int]()))
+    for _, e := range entries {
+        if !list.contains(e.key) {
+            t.Fatalf("contains(%d) = false with a jump table and filter", e.key)
+        }
+    }
+    if list := buildParallel(cmp.Compare[int], nil, 4); list.size() != 0 || list.checkInvariants() != nil {
+        t.Fatalf("building from no entries gave size %d", list.size())
+    }
+}
+
+func TestInsertSortedBatch(t *testing.T) {
+    list := newLazySkipList()
+    var wg sync.WaitGroup
+    for g := 0; g < 4; g++ {
+        wg.Add(1)
+        go func(g int) {
+            defer wg.Done()
+            rng := rand.New(rand.NewSource(int64(g)))
+            for b := 0; b < 50; b++ {
+                batch := make([]entry[int], 100)
+                for i := range batch {
+                    batch[i] = entry[int]{rng.Intn(20000), g}
+                }
+                sort.Slice(batch, func(i, j int) bool { return batch[i].key < batch[j].key })
+                list.insertSortedBatch(batch)
+                // removers make some of the hints stale
+                for i := 0; i < 20; i++ {
+                    list.remove(rng.Intn(20000))
+                }
+            }
+        }(g)
+    }
+    wg.Wait()
+    if err := list.checkInvariants(); err != nil {
+        t.Fatal(err)
+    }
+    batch := []entry[int]{}
+    rng := rand.New(rand.NewSource(1))
+    for key := 0; key < 25000; key += 1 + rng.Intn(4) {
+        batch = append(batch, entry[int]{key, key})
+    }
+    want := 0
+    for _, e := range batch {
+        if !list.contains(e.key) {
+            want++
+        }
+    }
+    if got := list.insertSortedBatch(batch); got != want {
+        t.Fatalf("insertSortedBatch() = %d, want %d", got, want)
+    }
+    for _, e := range batch {
+        if !list.contains(e.key) {
+            t.Fatalf("contains(%d) = false after insertSortedBatch()", e.key)
+        }
+    }
+    if err := list.checkInvariants(); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestDrain(t *testing.T) {
+    list := newLazySkipList(withJumpTable(2))
+    for key := 0; key < 100; key++ {
+        list.add(key)
+    }
+    list.remove(50)
+    batch := list.drain()
+    for want := 0; want < 100; want++ {
+        if want == 50 {
+            continue
+        }
+        if key, _, ok := batch.next(); !ok || key != want {
+            t.Fatalf("next() = %d, %v, want %d", key, ok, want)
+        }
+    }
+    if _, _, ok := batch.next(); ok {
+        t.Fatalf("next() past the drained keys")
+    }
+    if list.size() != 0 || list.contains(10) {
+        t.Fatalf("drained list holds %d keys", list.size())
+    }
+    // every add lands in exactly one drained batch or the final list, unless removed
+    const writers, per_writer = 4, 5000
+    removed := make([][]bool, writers)
+    var wg sync.WaitGroup
+    for g := 0; g < writers; g++ {
+        removed[g] = make([]bool, per_writer)
+        wg.Add(1)
+        go func(g int) {
+            defer wg.Done()
+            for i := 0; i < per_writer; i++ {
+                key := i * writers + g
+                if !list.add(key) {
+                    t.Errorf("add(%d) = false", key)
+                }
+                if i % 3 == 0 {
+                    removed[g][i] = list.remove(key)
+                }
+            }
+        }(g)
+    }
+    seen := map[int]int{}
+    done := make(chan struct{})
+    go func() {
+        wg.Wait()
+        close(done)
+    }()
+    for finished := false; !finished; {
+        select {
+        case <-done:
+            finished = true
+        case <-time.After(time.Millisecond):
+        }
+        batch := list.drain()
+        for key, _, ok := batch.next(); ok; key, _, ok = batch.next() {
+            seen[key]++
+        }
+    }
+    list.ascend(math.MinInt, math.MaxInt, func(key, item int) bool {
+        seen[key]++
+        return true
+    })
+    for g := 0; g < writers; g++ {
+        for i := 0; i < per_writer; i++ {
+            key := i * writers + g
+            want := 1
+            if removed[g][i] {
+                want = 0
+            }
+            if seen[key] != want {
+                t.Fatalf("key %d seen %d times, removed %v", key, seen[key], removed[g][i])
+            }
+        }
+    }
+    if err := list.checkInvariants(); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestMoveRange(t *testing.T) {
+    src, dst := newLazySkipList(), newLazySkipList(withJumpTable(1))
+    for key := 0; key < 1000; key++ {
+        src.put(key, key)
+    }
+    dst.put(500, -1)
+    dst.put(510, -1)
+    dst.tombstone(510)
+    if got := src.moveRange(&dst, 400, 600); got != 199 {
+        t.Fatalf("moveRange() = %d, want 199", got)
+    }
+    for key := 0; key < 1000; key++ {
+        item, in_src := src.get(key)
+        _, in_dst := dst.get(key)
+        switch {
+        case key == 510:
+            if !in_src || in_dst {
+                t.Fatalf("key 510 with a tombstone in dst: in src %v, in dst %v", in_src, in_dst)
+            }
+        case key >= 400 && key < 600:
+            if in_src || !in_dst {
+                t.Fatalf("moved key %d: in src %v, in dst %v", key, in_src, in_dst)
+            }
+        default:
+            if !in_src || item != key || in_dst {
+                t.Fatalf("key %d outside the range: in src %v, in dst %v", key, in_src, in_dst)
+            }
+        }
+    }
+    if item, _ := dst.get(500); item != -1 {
+        t.Fatalf("dst's own entry for 500 was replaced by %d", item)
+    }
+    if src.size() != 801 || dst.size() != 199 {
+        t.Fatalf("sizes %d and %d after the move, want 801 and 199", src.size(), dst.size())
+    }
+    for _, list := range []*LazySkipList[int]{&src, &dst} {
+        if err := list.checkInvariants(); err != nil {
+            t.Fatal(err)
+        }
+    }
+    // readers never find a moving key in neither list, nor in both
+    src, dst = newLazySkipList(), newLazySkipList()
+    const n, ranges = 4000, 20
+    for key := 0; key < n; key++ {
+        src.add(key)
+    }
+    var stop int32
+    var wg sync.WaitGroup
+    for g := 0; g < 4; g++ {
+        wg.Add(1)
+        go func(g int) {
+            defer wg.Done()
+            rng := rand.New(rand.NewSource(int64(g)))
+            for atomic.LoadInt32(&stop) == 0 {
+                key := rng.Intn(n)
+                switch g {
+                case 0:
+                    // writes outside the moving keys wait out the pauses
+                    src.add(n + rng.Intn(n))
+                    dst.remove(n + rng.Intn(n))
+                case 1:
+                    if !src.contains(key) && !dst.contains(key) {
+                        t.Errorf("key %d in neither list", key)
+                    }
+                default:
+                    if dst.contains(key) && src.contains(key) {
+                        t.Errorf("key %d in both lists", key)
+                    }
+                }
+            }
+        }(g)
+    }
+    for r := 0; r < ranges; r++ {
+        if got := src.moveRange(&dst, r * n / ranges, (r + 1) * n / ranges); got != n / ranges {
+            t.Errorf("moveRange() moved %d keys, want %d", got, n / ranges)
+        }
+        time.Sleep(time.Millisecond)
+    }
+    atomic.StoreInt32(&stop, 1)
+    wg.Wait()
+    for _, list := range []*LazySkipList[int]{&src, &dst} {
+        if err := list.checkInvariants(); err != nil {
+            t.Fatal(err)
+        }
+    }
+    moved := 0
+    dst.ascend(0, n, func(key, item int) bool {
+        moved++
+        return true
+    })
+    if moved != n {
+        t.Fatalf("dst holds %d of the moved keys, want %d", moved, n)
+    }
+}
+
+func TestSwapValues(t *testing.T) {
+    list := newLazySkipList(withOnDuplicate(OVERWRITE))
+    for key := 0; key < 8; key++ {
+        list.put(key, key * 10)
+    }
+    if !list.swapValues(1, 6) {
+        t.Fatalf("swapValues(1, 6) = false")
+    }
+    if a, b, ok := list.getPair(1, 6); !ok || a != 60 || b != 10 {
+        t.Fatalf("getPair(1, 6) = %d, %d, %v after the swap", a, b, ok)
+    }
+    if list.swapValues(1, 100) || list.swapValues(100, 1) {
+        t.Fatalf("swapValues() with an absent key = true")
+    }
+    // the items stay a permutation, and no pair read catches half a swap
+    var stop int32
+    var wg sync.WaitGroup
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        for atomic.LoadInt32(&stop) == 0 {
+            a, b, ok := list.getPair(2, 3)
+            if !ok || a + b != 50 {
+                t.Errorf("getPair(2, 3) = %d, %d, %v", a, b, ok)
+                return
+            }
+        }
+    }()
+    for g := 0; g < 4; g++ {
+        wg.Add(1)
+        go func(g int) {
+            defer wg.Done()
+            rng := rand.New(rand.NewSource(int64(g)))
+            for i := 0; i < 5000; i++ {
+                if i % 2 == 0 {
+                    list.swapValues(2, 3)
+                } else {
+                    list.swapValues(4 + rng.Intn(4), 4 + rng.Intn(4))
+                }
+            }
+        }(g)
+    }
+    time.Sleep(50 * time.Millisecond)
+    atomic.StoreInt32(&stop, 1)
+    wg.Wait()
+    sum := 0
+    list.ascend(math.MinInt, math.MaxInt, func(key, item int) bool {
+        sum += item
+        return true
+    })
+    if sum != 280 {
+        t.Fatalf("items add up to %d after the swaps, want 280", sum)
+    }
+    list.freeze()
+    if list.swapValues(0, 7) {
+        t.Fatalf("swapValues() on a frozen list = true")
+    }
+}
+
+func TestRename(t *testing.T) {
+    list := newLazySkipList(withOnDuplicate(OVERWRITE))
+    for key := 0; key < 10; key++ {
+        list.put(key, key * 10)
+    }
+    list.tombstone(9)
+    if !list.rename(3, 30) {
+        t.Fatalf("rename(3, 30) = false")
+    }
+    if item, ok := list.get(30); !ok || item != 30 || list.contains(3) {
+        t.Fatalf("after rename(3, 30): get(30) = %d, %v, contains(3) = %v", item, ok, list.contains(3))
+    }
+    for _, test := range [][2]int{{3, 31}, {4, 5}, {4, 9}} {
+        if list.rename(test[0], test[1]) {
+            t.Fatalf("rename(%d, %d) = true", test[0], test[1])
+        }
+    }
+    if list.size() != 9 {
+        t.Fatalf("size() = %d after renames, want 9", list.size())
+    }
+    // a key being renamed back and forth is always found under exactly one name
+    list.put(100, 7)
+    var stop int32
+    var wg sync.WaitGroup
+    for g := 0; g < 3; g++ {
+        wg.Add(1)
+        go func(g int) {
+            defer wg.Done()
+            for atomic.LoadInt32(&stop) == 0 {
+                switch g {
+                case 0:
+                    // renames commit with writes paused, so an unchanged even epoch rules them out
+                    epoch := list.pauseEpoch()
+                    if !list.contains(100) && !list.contains(200) && epoch % 2 == 0 && list.pauseEpoch() == epoch {
+                        t.Errorf("renamed key under neither name")
+                    }
+                case 1:
+                    list.put(50 + rand.Intn(10), 0)
+                    list.remove(50 + rand.Intn(10))
+                default:
+                    item, ok := list.get(100)
+                    if !ok {
+                        item, ok = list.get(200)
+                    }
+                    if ok && item != 7 {
+                        t.Errorf("renamed key has item %d", item)
+                    }
+                }
+            }
+        }(g)
+    }
+    for i := 0; i < 200; i++ {
+        if !list.rename(100, 200) || !list.rename(200, 100) {
+            t.Fatalf("rename %d failed", i)
+        }
+    }
+    atomic.StoreInt32(&stop, 1)
+    wg.Wait()
+    if err := list.checkInvariants(); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestIncrBy(t *testing.T) {
+    for _, policy := range []duplicatePolicy{REJECT, OVERWRITE} {
+        list := newLazySkipList(withOnDuplicate(policy))
+        if item, ok := list.incrBy(1, 5); !ok || item != 5 {
+            t.Fatalf("incrBy(1, 5) on an absent key = %d, %v", item, ok)
+        }
+        if item, _ := list.incrBy(1, -7); item != -2 {
+            t.Fatalf("incrBy(1, -7) = %d, want -2", item)
+        }
+        list.tombstone(1)
+        if item, _ := list.incrBy(1, 3); item != 3 || list.size() != 1 {
+            t.Fatalf("incrBy() on a tombstone = %d with size %d, want 3 and 1", item, list.size())
+        }
+        // racing creators and incrementers never lose an increment
+        var wg sync.WaitGroup
+        for g := 0; g < 8; g++ {
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                for i := 0; i < 1000; i++ {
+                    list.incrBy(i % 10 + 100, 1)
+                }
+            }()
+        }
+        wg.Wait()
+        for key := 100; key < 110; key++ {
+            if item, _ := list.get(key); item != 800 {
+                t.Fatalf("policy %d: key %d counted %d, want 800", policy, key, item)
+            }
+        }
+        list.freeze()
+        if _, ok := list.incrBy(1, 1); ok {
+            t.Fatalf("incrBy() on a frozen list succeeded")
+        }
+        if err := list.checkInvariants(); err != nil {
+            t.Fatal(err)
+        }
+    }
+}
+
+func TestAppendValue(t *testing.T) {
+    list := newOrderedList[string]()
+    var wg sync.WaitGroup
+    for g := 0; g < 8; g++ {
+        wg.Add(1)
+        go func(g int) {
+            defer wg.Done()
+            for i := 0; i < 500; i++ {
+                appendValue(&list, fmt.Sprint("user", i % 5), g * 1000 + i)
+            }
+        }(g)
+    }
+    wg.Wait()
+    for i := 0; i < 5; i++ {
+        values, ok := valuesOf[string, int](&list, fmt.Sprint("user", i))
+        if !ok || len(values) != 800 {
+            t.Fatalf("user%d collected %d values, %v, want 800", i, len(values), ok)
+        }
+        // each collector's values keep their order
+        last := map[int]int{}
+        for _, v := range values {
+            if prev, seen := last[v / 1000]; seen && prev >= v {
+                t.Fatalf("user%d: value %d after %d", i, v, prev)
+            }
+            last[v / 1000] = v
+        }
+    }
+    if list.size() != 5 {
+        t.Fatalf("size() = %d, want 5", list.size())
+    }
+    list.remove("user0")
+    if _, ok := valuesOf[string, int](&list, "user0"); ok {
+        t.Fatalf("valuesOf() a removed key")
+    }
+    appendValue(&list, "user0", 1)
+    if values, _ := valuesOf[string, int](&list, "user0"); len(values) != 1 {
+        t.Fatalf("a re-added key kept %d old values", len(values) - 1)
+    }
+}
+
+func TestCounting(t *testing.T) {
+    list := newLazySkipList()
+    list.inc(1)
+    list.inc(1)
+    if count, ok := list.dec(1); !ok || count != 1 || !list.contains(1) {
+        t.Fatalf("dec() from 2 = %d, %v, contains %v", count, ok, list.contains(1))
+    }
+    if count, ok := list.dec(1); !ok || count != 0 || list.contains(1) {
+        t.Fatalf("dec() from 1 = %d, %v, contains %v", count, ok, list.contains(1))
+    }
+    if _, ok := list.dec(1); ok {
+        t.Fatalf("dec() of an absent key succeeded")
+    }
+    // a key is present for as long as anyone holds a reference to it
+    var wg sync.WaitGroup
+    for g := 0; g < 8; g++ {
+        wg.Add(1)
+        go func(g int) {
+            defer wg.Done()
+            rng := rand.New(rand.NewSource(int64(g)))
+            for i := 0; i < 2000; i++ {
+                key := rng.Intn(4)
+                if count, ok := list.inc(key); !ok || count < 1 {
+                    t.Errorf("inc(%d) = %d, %v", key, count, ok)
+                }
+                if !list.contains(key) {
+                    t.Errorf("key %d missing while referenced", key)
+                }
+                if count, ok := list.dec(key); !ok || count < 0 {
+                    t.Errorf("dec(%d) = %d, %v", key, count, ok)
+                }
+            }
+        }(g)
+    }
+    wg.Wait()
+    if list.size() != 0 {
+        t.Fatalf("%d keys left once every reference was dropped", list.size())
+    }
+    if err := list.checkInvariants(); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestErrors(t *testing.T) {
+    list := newLazySkipList()
+    if err := list.insert(1, 10); err != nil {
+        t.Fatalf("insert(1) = %v", err)
+    }
+    if err := list.insert(1, 11); !errors.Is(err, err_exists) {
+        t.Fatalf("insert() of a present key = %v, want err_exists", err)
+    }
+    if err := list.delete(2); !errors.Is(err, err_not_found) {
+        t.Fatalf("delete() of an absent key = %v, want err_not_found", err)
+    }
+    // a pause that outlasts the deadline
+    list.tryPause()
+    ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+    defer cancel()
+    if err := list.insertContext(ctx, 2, 20); !errors.Is(err, err_timeout) {
+        t.Fatalf("insertContext() during a pause = %v, want err_timeout", err)
+    }
+    list.resume()
+    if err := list.deleteContext(context.Background(), 1); err != nil {
+        t.Fatalf("deleteContext(1) = %v", err)
+    }
+    list.freeze()
+    if err := list.insert(3, 30); !errors.Is(err, err_frozen) {
+        t.Fatalf("insert() into a frozen list = %v, want err_frozen", err)
+    }
+    if err := list.delete(3); !errors.Is(err, err_frozen) {
+        t.Fatalf("delete() from a frozen list = %v, want err_frozen", err)
+    }
+}
+
+func TestCallbackPanics(t *testing.T) {
+    panics := func(fn func()) (panicked bool) {
+        defer func() {
+            panicked = recover() != nil
+        }()
+        fn()
+        return false
+    }
+    // a hash that fails on one key, and a compare that fails on another
+    hash := comparableHash[int]()
+    poisoned := func(key int) uint64 {
+        if key == 13 {
+            panic("hash")
+        }
+        return hash(key)
+    }
+    compare := func(a, b int) int {
+        if a < 0 || b < 0 {
+            panic("compare")
+        }
+        return cmp.Compare(a, b)
+    }
+    list := newLazySkipList(withBloomFilter(10, poisoned))
+    for key := 0; key < 10; key++ {
+        list.add(key)
+    }
+    if !panics(func() { list.add(13) }) || !panics(func() { list.rename(3, 13) }) {
+        t.Fatal("the hash's panic did not reach the caller")
+    }
+    // no lock is left held and no pause in force
+    if !list.add(14) || !list.remove(5) || !list.rename(3, 30) || !list.contains(30) {
+        t.Fatal("the list is unusable after a panicking hash")
+    }
+    if err := list.checkInvariants(); err != nil {
+        t.Fatal(err)
+    }
+    // a move the hash stops halfway is undone in both lists
+    src := newLazySkipList()
+    for key := 0; key < 20; key++ {
+        src.add(key)
+    }
+    dst := newLazySkipList(withBloomFilter(10, poisoned))
+    dst.add(100)
+    if !panics(func() { src.moveRange(&dst, 0, 20) }) {
+        t.Fatal("moveRange() did not panic")
+    }
+    if src.size() != 20 || dst.size() != 1 || dst.contains(0) || !src.contains(0) {
+        t.Fatalf("after an aborted move: sizes %d and %d", src.size(), dst.size())
+    }
+    if src.moveRange(&dst, 0, 10) != 10 || !dst.contains(9) || src.contains(9) {
+        t.Fatal("moveRange() fails after an aborted move")
+    }
+    for _, list := range []*LazySkipList[int]{&src, &dst} {
+        if err := list.checkInvariants(); err != nil {
+            t.Fatal(err)
+        }
+    }
+    // a panicking request reaches its own submitter, the others go through
+    flat := newFlatCombiningList(compare)
+    elim := newFlatCombiningList(compare, withElimination())
+    grouped := newListFunc(compare)
+    group := newGroupCommitter(&grouped, 2, 32)
+    for _, set := range []benchSet{flat, elim, group} {
+        // in an empty list a put() has nothing to compare against
+        set.add(1 << 20)
+        var wg sync.WaitGroup
+        for g := 0; g < 4; g++ {
+            wg.Add(1)
+            go func(g int) {
+                defer wg.Done()
+                for i := 0; i < 500; i++ {
+                    key := i * 4 + g
+                    if g == 0 {
+                        if !panics(func() { set.add(-1) }) {
+                            t.Errorf("add(-1) did not panic")
+                            return
+                        }
+                        continue
+                    }
+                    if !set.add(key) || !set.remove(key) || !set.add(key) {
+                        t.Errorf("key %d: add or remove failed", key)
+                        return
+                    }
+                }
+            }(g)
+        }
+        wg.Wait()
+    }
+    group.close()
+    for _, list := range []*LazySkipList[int]{&flat.list, &elim.list, &grouped} {
+        if err := list.checkInvariants(); err != nil {
+            t.Fatal(err)
+        }
+        if list.size() != 1501 {
+            t.Fatalf("size() = %d, want 1501", list.size())
+        }
+    }
+}
+
+func TestDecorators(t *testing.T) {
+    list := newLazySkipList()
+    var out bytes.Buffer
+    metrics := withMetrics[int](&list)
+    logged := withLogging[int](metrics, &out, false)
+    checked := withValidation[int](logged, func(key, item int) error {
+        if item < 0 {
+            return fmt.Errorf("negative item %d for key %d", item, key)
+        }
+        return nil
+    })
+    var m sortedMap[int] = checked
+    for key := 0; key < 10; key++ {
+        m.put(key, key * 10)
+    }
+    if result := m.put(3, -1); result != PUT_REJECTED || checked.err() == nil || checked.rejected != 1 {
+        t.Fatalf("put(3, -1) = %v, err() = %v", result, checked.err())
+    }
+    m.remove(4)
+    m.get(3)
+    m.get(4)
+    m.contains(5)
+    if item, ok := m.get(3); !ok || item != 30 || m.size() != 9 {
+        t.Fatalf("get(3) = %d, %v, size() = %d", item, ok, m.size())
+    }
+    // the rejected put never got as far as the metrics
+    if metrics.puts.calls != 10 || metrics.removes.calls != 1 || metrics.gets.calls != 3 || metrics.hits != 2 || metrics.lookups.calls != 1 {
+        t.Fatalf("metrics: %d puts, %d removes, %d gets with %d hits, %d lookups", metrics.puts.calls, metrics.removes.calls, metrics.gets.calls, metrics.hits, metrics.lookups.calls)
+    }
+    lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+    if len(lines) != 11 || lines[0] != "put 0 0: inserted" || lines[10] != "remove 4: true" {
+        t.Fatalf("log:\n%s", out.String())
+    }
+    // a FlatCombiningList takes the same wrappers
+    var _ sortedMap[int] = withMetrics[int](newFlatCombiningList(cmp.Compare[int]))
+}
+
+func TestMiddleware(t *testing.T) {
+    shadow := newLazySkipList()
+    audit := []string{}
+    var lock sync.Mutex
+    list := newLazySkipList(withMiddleware[int](
+        func(op uint8, key, item int, next func(key, item int) opResult) opResult {
+            r := next(key, item)
+            lock.Lock()
+            audit = append(audit, fmt.Sprintf("%s(%d)", op_names[op], key))
+            lock.Unlock()
+            return r
+        },
+        // no keys of 100 and up
+        func(op uint8, key, item int, next func(key, item int) opResult) opResult {
+            if op == OP_ADD && key >= 100 {
+                return opResult{result: PUT_REJECTED}
+            }
+            return next(key, item)
+        }), withMiddleware[int](
+        // writes that took effect are repeated on the shadow
+        func(op uint8, key, item int, next func(key, item int) opResult) opResult {
+            r := next(key, item)
+            switch {
+            case op == OP_ADD && r.result != PUT_REJECTED:
+                shadow.put(key, item)
+            case op == OP_REMOVE && r.ok:
+                shadow.remove(key)
+            }
+            return r
+        }))
+    for key := 0; key < 10; key++ {
+        list.put(key, key * 10)
+    }
+    if list.add(100) || list.contains(100) || !list.remove(3) || list.remove(3) {
+        t.Fatal("the rejection rule did not hold")
+    }
+    if item, ok := list.get(4); !ok || item != 40 {
+        t.Fatalf("get(4) = %d, %v", item, ok)
+    }
+    if list.size() != 9 || shadow.size() != 9 || shadow.contains(3) || shadow.contains(100) {
+        t.Fatalf("size() = %d, shadow size() = %d", list.size(), shadow.size())
+    }
+    // the audit log is outermost and sees rejected operations too
+    tail := strings.Join(audit[10:], " ")
+    if len(audit) != 15 || tail != "add(100) contains(100) remove(3) remove(3) get(4)" {
+        t.Fatalf("audit log: %v", audit)
+    }
+    if err := list.checkInvariants(); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestNewList(t *testing.T) {
+    shape := func(list *LazySkipList[string]) []int {
+        heights := []int{}
+        for curr := list.head.next[0]; curr != list.tail; curr = curr.next[0] {
+            heights = append(heights, curr.top_level)
+        }
+        return heights
+    }
+    lists := []LazySkipList[string]{}
+    for i := 0; i < 2; i++ {
+        list, err := newList[string](withSeed(7), withMaxLevel(12), withProbability(0.25), withOnDuplicate(OVERWRITE))
+        if err != nil {
+            t.Fatal(err)
+        }
+        for key := 0; key < 200; key++ {
+            list.put(fmt.Sprint(key), key)
+        }
+        lists = append(lists, list)
+    }
+    if !reflect.DeepEqual(shape(&lists[0]), shape(&lists[1])) {
+        t.Fatal("two lists with the same seed differ in shape")
+    }
+    if list := lists[0]; list.put("5", 50) != PUT_OVERWRITTEN || list.size() != 200 || list.checkInvariants() != nil {
+        t.Fatal("options were not applied")
+    }
+    addrs, err := newList[netip.Addr](withCompare(func(a, b netip.Addr) int { return a.Compare(b) }))
+    if err != nil || !addrs.add(netip.MustParseAddr("10.0.0.1")) {
+        t.Fatalf("newList[netip.Addr]: %v", err)
+    }
+    pass := func(op uint8, key string, item int, next func(key string, item int) opResult) opResult {
+        return next(key, item)
+    }
+    for i, opt := range []option{
+        withProbability(1),
+        withMaxLevel(0),
+        withJumpTable(40),
+        withCompare(cmp.Compare[string]),
+        withBloomFilter(8, comparableHash[string]()),
+        withMiddleware[string](pass),
+    } {
+        if _, err := newList[int](opt); err == nil {
+            t.Fatalf("newList() accepted option %d", i)
+        }
+    }
+    if _, err := newList[netip.Addr](); err == nil {
+        t.Fatal("newList[netip.Addr]() without an order did not fail")
+    }
+    // the checked variants of the other constructors
+    for i, opt := range []option{withProbability(0), withMaxLevel(100)} {
+        _, list_err := newCheckedOrderedList[string](opt)
+        _, map_err := newCheckedSyncMap[string](opt)
+        _, tree_err := newCheckedBTree(func(a, b int) bool { return a < b }, opt)
+        _, combining_err := newCheckedFlatCombiningList(cmp.Compare[int], opt)
+        if list_err == nil || map_err == nil || tree_err == nil || combining_err == nil {
+            t.Fatalf("a checked constructor accepted option %d", i)
+        }
+    }
+    tree, err := newCheckedBTree(func(a, b int) bool { return a < b }, withMaxLevel(8))
+    if err != nil {
+        t.Fatal(err)
+    }
+    tree.ReplaceOrInsert(2)
+    tree.ReplaceOrInsert(1)
+    if item, ok := tree.Get(1); !ok || item != 1 || tree.Len() != 2 {
+        t.Fatalf("checked btree Get(1) = %d, %v", item, ok)
+    }
+}
+
+// a nodeLocker that counts and checks every acquisition on top of the node's mutex
+type protocolLocker struct {
+    mutexLocker[int]
+    held sync.Map
+    acquired int64
+    violations int64
+}
+
+func (this *protocolLocker) lock(node *Node[int]) {
+    this.mutexLocker.lock(node)
+    atomic.AddInt64(&this.acquired, 1)
+    if _, loaded := this.held.LoadOrStore(node, true); loaded {
+        atomic.AddInt64(&this.violations, 1)
+    }
+}
+
+func (this *protocolLocker) tryLock(node *Node[int]) bool {
+    if !this.mutexLocker.tryLock(node) {
+        return false
+    }
+    atomic.AddInt64(&this.acquired, 1)
+    this.held.Store(node, true)
+    return true
+}
+
+func (this *protocolLocker) unlock(node *Node[int]) {
+    if _, loaded := this.held.LoadAndDelete(node); !loaded {
+        atomic.AddInt64(&this.violations, 1)
+    }
+    this.mutexLocker.unlock(node)
+}
+
+func TestLockers(t *testing.T) {
+    duration := 200 * time.Millisecond
+    if testing.Short() {
+        duration = 50 * time.Millisecond
+    }
+    protocol := &protocolLocker{}
+    for _, locker := range []nodeLocker[int]{spinLocker[int]{}, newAdaptiveLocker[int](), protocol} {
+        list := newLazySkipList(withLocker[int](locker))
+        if _, err := stress(&list, 8, 64, duration, 10 * time.Millisecond); err != nil {
+            t.Fatalf("%T: %v", locker, err)
+        }
+        // flushWriters() takes every node lock
+        list.put(1000, 1)
+        if !list.rename(1000, 1001) {
+            t.Fatalf("%T: rename() failed", locker)
+        }
+        if err := list.checkInvariants(); err != nil {
+            t.Fatalf("%T: %v", locker, err)
+        }
+    }
+    held := 0
+    protocol.held.Range(func(_, _ interface{}) bool {
+        held++
+        return true
+    })
+    if protocol.acquired == 0 || protocol.violations != 0 || held != 0 {
+        t.Fatalf("%d acquisitions, %d violations, %d locks still held", protocol.acquired, protocol.violations, held)
+    }
+}
+
+func TestAdaptiveLocker(t *testing.T) {
+    locker := newAdaptiveLocker[int]()
+    node := newNode(1, 0, 1)
+    locker.lock(node)
+    locker.unlock(node)
+    if locker.spinBudget() != 16 {
+        t.Fatalf("uncontended lock() moved the budget to %d", locker.spinBudget())
+    }
+    // held well past the spinning, so the waiter parks and halves the budget
+    for want := 8; want >= int(ADAPTIVE_SPIN_MIN); want /= 2 {
+        locker.lock(node)
+        done := make(chan bool)
+        go func() {
+            locker.lock(node)
+            locker.unlock(node)
+            done <- true
+        }()
+        time.Sleep(20 * time.Millisecond)
+        locker.unlock(node)
+        <-done
+        if locker.spinBudget() != want {
+            t.Fatalf("budget %d after parking, want %d", locker.spinBudget(), want)
+        }
+    }
+}
+
+func TestOpenMap(t *testing.T) {
+    for _, name := range []string{"lazy", "flatcombining", "elimination"} {
+        m, err := openMap[string](name, withMaxLevel(8))
+        if err != nil {
+            t.Fatal(err)
+        }
+        m.put("b", 2)
+        m.put("a", 1)
+        if item, ok := m.get("a"); !ok || item != 1 || m.size() != 2 {
+            t.Fatalf("%s: get(a) = %d, %v, size() = %d", name, item, ok, m.size())
+        }
+    }
+    metered := func(opts ...option) (sortedMap[int], error) {
+        list, err := newList[int](opts...)
+        return withMetrics[int](&list), err
+    }
+    if err := registerMap("metered", metered); err != nil {
+        t.Fatal(err)
+    }
+    defer func() {
+        map_registry.lock.Lock()
+        delete(map_registry.factories, "metered")
+        map_registry.lock.Unlock()
+    }()
+    if registerMap("metered", metered) == nil || registerMap("lazy", metered) == nil {
+        t.Fatal("registered a taken name")
+    }
+    m, err := openMap[int]("metered")
+    if err != nil {
+        t.Fatal(err)
+    }
+    m.put(1, 1)
+    if m.(*metricsMap[int]).puts.calls != 1 {
+        t.Fatal("openMap() did not use the registered constructor")
+    }
+    for _, name := range []string{"metered", "lockfree"} {
+        if _, err := openMap[string](name); err == nil {
+            t.Fatalf("openMap[string](%q) did not fail", name)
+        }
+    }
+    if _, err := openMap[int]("lazy", withProbability(2)); err == nil {
+        t.Fatal("openMap() did not check the options")
+    }
+    if names := mapNames(); !reflect.DeepEqual(names, []string{"elimination", "flatcombining", "lazy", "metered"}) {
+        t.Fatalf("mapNames() = %v", names)
+    }
+}
+
+func TestSyncMap(t *testing.T) {
+    // the same operations on a sync.Map give the same answers
+    m := newSyncMap[int]()
+    var want sync.Map
+    rng := rand.New(rand.NewSource(1))
+    for i := 0; i < 5000; i++ {
+        key, value := rng.Intn(32), rng.Intn(4)
+        var got, expected []interface{}
+        switch rng.Intn(7) {
+        case 0:
+            v, ok := m.Load(key)
+            w, wok := want.Load(key)
+            got, expected = []interface{}{v, ok}, []interface{}{w, wok}
+        case 1:
+            m.Store(key, value)
+            want.Store(key, value)
+        case 2:
+            v, ok := m.LoadOrStore(key, value)
+            w, wok := want.LoadOrStore(key, value)
+            got, expected = []interface{}{v, ok}, []interface{}{w, wok}
+        case 3:
+            v, ok := m.LoadAndDelete(key)
+            w, wok := want.LoadAndDelete(key)
+            got, expected = []interface{}{v, ok}, []interface{}{w, wok}
+        case 4:
+            got, expected = []interface{}{m.CompareAndSwap(key, value, value + 1)}, []interface{}{want.CompareAndSwap(key, value, value + 1)}
+        case 5:
+            got, expected = []interface{}{m.CompareAndDelete(key, value)}, []interface{}{want.CompareAndDelete(key, value)}
+        case 6:
+            v, ok := m.Swap(key, value)
+            w, wok := want.Swap(key, value)
+            got, expected = []interface{}{v, ok}, []interface{}{w, wok}
+        }
+        if !reflect.DeepEqual(got, expected) {
+            t.Fatalf("step %d on key %d: got %v, sync.Map gives %v", i, key, got, expected)
+        }
+    }
+    keys, want_keys := []int{}, []int{}
+    m.Range(func(key int, value interface{}) bool {
+        keys = append(keys, key)
+        return true
+    })
+    want.Range(func(key, value interface{}) bool {
+        want_keys = append(want_keys, key.(int))
+        return true
+    })
+    sort.Ints(want_keys)
+    if !reflect.DeepEqual(keys, want_keys) {
+        t.Fatalf("Range() visits %v, want %v in order", keys, want_keys)
+    }
+    // racing LoadOrStore()s agree on one winner
+    for key := 100; key < 150; key++ {
+        var winners int32
+        var wg sync.WaitGroup
+        for g := 0; g < 4; g++ {
+            wg.Add(1)
+            go func(g int) {
+                defer wg.Done()
+                if actual, loaded := m.LoadOrStore(key, g); !loaded {
+                    atomic.AddInt32(&winners, 1)
+                } else if v, _ := m.Load(key); v != actual {
+                    t.Errorf("key %d: LoadOrStore() saw %v, Load() %v", key, actual, v)
+                }
+            }(g)
+        }
+        wg.Wait()
+        if winners != 1 {
+            t.Fatalf("key %d: %d LoadOrStore()s stored", key, winners)
+        }
+    }
+    // a refused new key is reported instead of retried forever
+    full := newSyncMap[int](withBackpressure(2, 1, OVERFLOW_REJECT, nil))
+    full.Store(1, "a")
+    full.Store(2, "b")
+    if _, _, err := full.trySwap(3, "c"); !errors.Is(err, err_over_capacity) {
+        t.Fatalf("trySwap() over capacity = %v", err)
+    }
+    if previous, loaded, err := full.trySwap(1, "z"); err != nil || !loaded || previous != "a" {
+        t.Fatalf("trySwap() of a present key over capacity = %v, %v, %v", previous, loaded, err)
+    }
+    full.list.freeze()
+    defer func() {
+        if err, _ := recover().(error); !errors.Is(err, err_frozen) {
+            t.Fatalf("Store() on a frozen map panicked with %v", err)
+        }
+    }()
+    full.Store(4, "d")
+    t.Fatal("Store() on a frozen map returned")
+}
+
+func TestBTree(t *testing.T) {
+    type item struct {
+        key int
+        payload string
+    }
+    tree := newBTree(func(a, b item) bool { return a.key < b.key })
+    want := map[int]string{}
+    rng := rand.New(rand.NewSource(1))
+    for i := 0; i < 3000; i++ {
+        key := rng.Intn(64)
+        it := item{key, fmt.Sprint(i)}
+        switch rng.Intn(3) {
+        case 0:
+            old, replaced := tree.ReplaceOrInsert(it)
+            payload, ok := want[key]
+            if replaced != ok || old.payload != payload {
+                t.Fatalf("ReplaceOrInsert(%v) = %v, %v, want %q, %v", it, old, replaced, payload, ok)
+            }
+            want[key] = it.payload
+        case 1:
+            removed, ok := tree.Delete(item{key: key})
+            payload, present := want[key]
+            if ok != present || removed.payload != payload {
+                t.Fatalf("Delete(%d) = %v, %v, want %q, %v", key, removed, ok, payload, present)
+            }
+            delete(want, key)
+        case 2:
+            got, ok := tree.Get(item{key: key})
+            if payload, present := want[key]; ok != present || got.payload != payload {
+                t.Fatalf("Get(%d) = %v, %v, want %q, %v", key, got, ok, payload, present)
+            }
+        }
+    }
+    keys := []int{}
+    for key := range want {
+        keys = append(keys, key)
+    }
+    sort.Ints(keys)
+    if tree.Len() != len(keys) {
+        t.Fatalf("Len() = %d, want %d", tree.Len(), len(keys))
+    }
+    visited := []int{}
+    tree.AscendRange(item{key: 10}, item{key: 40}, func(it item) bool {
+        if it.payload != want[it.key] {
+            t.Fatalf("AscendRange() gives %v, want payload %q", it, want[it.key])
+        }
+        visited = append(visited, it.key)
+        return true
+    })
+    expected := []int{}
+    for _, key := range keys {
+        if key >= 10 && key < 40 {
+            expected = append(expected, key)
+        }
+    }
+    if !reflect.DeepEqual(visited, expected) {
+        t.Fatalf("AscendRange(10, 40) visits %v, want %v", visited, expected)
+    }
+    // from 50 down, stopping after five
+    visited, expected = []int{}, []int{}
+    tree.DescendLessOrEqual(item{key: 50}, func(it item) bool {
+        visited = append(visited, it.key)
+        return len(visited) < 5
+    })
+    for i := len(keys) - 1; i >= 0 && len(expected) < 5; i-- {
+        if keys[i] <= 50 {
+            expected = append(expected, keys[i])
+        }
+    }
+    if !reflect.DeepEqual(visited, expected) {
+        t.Fatalf("DescendLessOrEqual(50) visits %v, want %v", visited, expected)
+    }
+    tree.list.freeze()
+    if _, _, err := tree.tryReplaceOrInsert(item{key: 1000}); !errors.Is(err, err_frozen) {
+        t.Fatalf("tryReplaceOrInsert() on a frozen tree = %v", err)
+    }
+}
+
+func TestResumeScan(t *testing.T) {
+    build := func() LazySkipList[string] {
+        list := newOrderedList[string]()
+        for i := 0; i < 100; i++ {
+            list.put(fmt.Sprintf("k%03d", i), i)
+        }
+        return list
+    }
+    list := build()
+    cp := scanCheckpoint[string]{}
+    seen := 0
+    saved := []byte{}
+    list.resumeScan(&cp, func(key string, item int) bool {
+        seen++
+        if seen % 10 == 0 {
+            saved, _ = json.Marshal(cp)
+        }
+        return seen < 35
+    })
+    // a restart: the list is rebuilt, and changed meanwhile
+    list = build()
+    list.remove("k031")
+    list.put("k030x", -1)
+    var restored scanCheckpoint[string]
+    if err := json.Unmarshal(saved, &restored); err != nil || restored.Last != "k029" {
+        t.Fatalf("restored %+v, %v", restored, err)
+    }
+    keys := []string{}
+    list.resumeScan(&restored, func(key string, item int) bool {
+        keys = append(keys, key)
+        return true
+    })
+    if !restored.Done || len(keys) != 70 || keys[0] != "k030" || keys[1] != "k030x" || keys[2] != "k032" {
+        t.Fatalf("resumed with %d keys from %v, done %v", len(keys), keys[:3], restored.Done)
+    }
+    list.resumeScan(&restored, func(key string, item int) bool {
+        t.Fatal("a finished scan went on")
+        return false
+    })
+    // a version resumes in its own version only
+    plist := newPersistentSkipList(cmp.Compare[int], withMaxLevel(8))
+    for key := 0; key < 20; key++ {
+        plist.put(key, key)
+    }
+    version := plist.current()
+    plist.remove(15)
+    pcp := scanCheckpoint[int]{}
+    version.resumeScan(&pcp, func(key, item int) bool {
+        return key < 9
+    })
+    if err := plist.current().resumeScan(&pcp, func(key, item int) bool { return true }); err == nil {
+        t.Fatal("resumed a checkpoint in another version")
+    }
+    pkeys := []int{}
+    if err := version.resumeScan(&pcp, func(key, item int) bool {
+        pkeys = append(pkeys, key)
+        return true
+    }); err != nil || len(pkeys) != 10 || pkeys[0] != 10 || !pcp.Done {
+        t.Fatalf("resumed %v, %v", pkeys, err)
+    }
+}
+
+func TestBackupSince(t *testing.T) {
+    format := func(key int) string { return fmt.Sprint(key) }
+    parse := func(field string) (int, error) {
+        var key int
+        _, err := fmt.Sscan(field, &key)
+        return key, err
+    }
+    list := newLazySkipList(withChangeTracking(), withOnDuplicate(OVERWRITE))
+    replica := newLazySkipList()
+    same := func() bool {
+        for key := 0; key < 300; key++ {
+            item, result := list.lookup(key)
+            if r_item, r_result := replica.lookup(key); item != r_item || result != r_result {
+                return false
+            }
+        }
+        return true
+    }
+    backup := func(since uint64) (uint64, int) {
+        var buf bytes.Buffer
+        upto, err := list.backupSince(since, &buf, format)
+        if err != nil {
+            t.Fatal(err)
+        }
+        lines := strings.Count(buf.String(), "\n")
+        if got, err := replica.applyBackup(&buf, parse); err != nil || got != upto {
+            t.Fatalf("applyBackup() = %d, %v, want %d", got, err, upto)
+        }
+        return upto, lines - 1
+    }
+    for key := 0; key < 100; key++ {
+        list.put(key, key)
+    }
+    since, entries := backup(0)
+    if entries != 100 || !same() {
+        t.Fatalf("full backup of %d entries", entries)
+    }
+    list.put(5, 500)
+    list.tombstone(7)
+    list.put(200, 1)
+    list.incrBy(9, 1)
+    if since, entries = backup(since); entries != 4 || !same() {
+        t.Fatalf("incremental backup of %d entries, want 4", entries)
+    }
+    // appending to a key's values is a change to it too
+    appendValue(&list, 11, "x")
+    if since, entries = backup(since); entries != 1 || !same() {
+        t.Fatalf("backup after appendValue() of %d entries, want 1", entries)
+    }
+    // backups taken while writes go on miss nothing once the writers stop
+    var stop int32
+    var wg sync.WaitGroup
+    for g := 0; g < 4; g++ {
+        wg.Add(1)
+        go func(g int) {
+            defer wg.Done()
+            rng := rand.New(rand.NewSource(int64(g)))
+            for atomic.LoadInt32(&stop) == 0 {
+                if key := rng.Intn(300); rng.Intn(4) == 0 {
+                    list.tombstone(key)
+                } else {
+                    list.put(key, rng.Intn(1000))
+                }
+            }
+        }(g)
+    }
+    for i := 0; i < 20; i++ {
+        since, _ = backup(since)
+    }
+    atomic.StoreInt32(&stop, 1)
+    wg.Wait()
+    if backup(since); !same() {
+        t.Fatal("the replica differs after the last backup")
+    }
+    if _, err := replica.backupSince(0, &bytes.Buffer{}, format); err == nil {
+        t.Fatal("backupSince() without change tracking")
+    }
+}
+
+func TestDiffSnapshots(t *testing.T) {
+    list := newPersistentSkipList(cmp.Compare[int], withMaxLevel(8))
+    for key := 0; key < 50; key++ {
+        list.put(key, key)
+    }
+    before := list.current()
+    list.remove(3)
+    list.remove(49)
+    list.put(10, 100)
+    list.put(60, 6)
+    list.put(-1, 0)
+    after := list.current()
+    diff := diffSnapshots(cmp.Compare[int], before.cursor(), after.cursor())
+    want := snapshotDiff[int]{
+        added: []entry[int]{{-1, 0}, {60, 6}},
+        removed: []entry[int]{{3, 3}, {49, 49}},
+        changed: []changedEntry[int]{{10, 10, 100}}}
+    if !reflect.DeepEqual(diff, want) {
+        t.Fatalf("diff = %+v, want %+v", diff, want)
+    }
+    if !diffSnapshots(cmp.Compare[int], after.cursor(), after.cursor()).empty() {
+        t.Fatal("a version differs from itself")
+    }
+    // a backup loaded back against the list it came from, as -diff does
+    lazy := newLazySkipList(withChangeTracking())
+    for key := 0; key < 50; key++ {
+        lazy.put(key, key)
+    }
+    lazy.tombstone(20)
+    var buf bytes.Buffer
+    if _, err := lazy.backupSince(0, &buf, func(key int) string { return fmt.Sprint(key) }); err != nil {
+        t.Fatal(err)
+    }
+    restored := newLazySkipList()
+    restored.applyBackup(&buf, strconv.Atoi)
+    diff = diffSnapshots(cmp.Compare[int], restored.cursor(), after.cursor())
+    // 20 was tombstoned in the backup, 3 and 49 removed from the version
+    if len(diff.added) != 3 || diff.added[1].key != 20 || len(diff.removed) != 2 || len(diff.changed) != 1 {
+        t.Fatalf("backup against version: %+v", diff)
+    }
+    var out bytes.Buffer
+    writeDiff(&out, diff)
+    if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 6 || lines[5] != "~ 10 10 -> 100" {
+        t.Fatalf("writeDiff():\n%s", out.String())
+    }
+}
+
+// the entries of the block at handle in an exported SST, after checking its trailer
+func readSSTBlock(t *testing.T, file []byte, handle []byte) [][2][]byte {
+    offset, n := binary.Uvarint(handle)
+    size, _ := binary.Uvarint(handle[n:])
+    block := file[offset:offset + size]
+    crc := crc32.Update(crc32.Checksum(block, sst_crc_table), sst_crc_table, []byte{0})
+    if file[offset + size] != 0 || binary.LittleEndian.Uint32(file[offset + size + 1:]) != (crc >> 15 | crc << 17) + 0xa282ead8 {
+        t.Fatalf("block at %d: bad trailer", offset)
+    }
+    restarts := int(binary.LittleEndian.Uint32(block[len(block) - 4:]))
+    data := block[:len(block) - 4 - 4 * restarts]
+    entries := [][2][]byte{}
+    var key []byte
+    for len(data) > 0 {
+        shared, a := binary.Uvarint(data)
+        unshared, b := binary.Uvarint(data[a:])
+        length, c := binary.Uvarint(data[a + b:])
+        data = data[a + b + c:]
+        key = append(append([]byte(nil), key[:shared]...), data[:unshared]...)
+        entries = append(entries, [2][]byte{key, data[unshared:unshared + length]})
+        data = data[unshared + length:]
+    }
+    return entries
+}
+
+func TestExportSST(t *testing.T) {
+    list := newLazySkipList()
+    for key := -1000; key < 1000; key += 2 {
+        list.put(key, key * 3)
+    }
+    list.remove(0)
+    // flipping the sign bit makes big-endian ints sort as bytes
+    encode := func(key int) []byte { return binary.BigEndian.AppendUint64(nil, uint64(key) ^ 1 << 63) }
+    var buf bytes.Buffer
+    n, err := list.exportSST(&buf, encode)
+    if err != nil || n != 999 {
+        t.Fatalf("exportSST() = %d, %v", n, err)
+    }
+    file := buf.Bytes()
+    footer := file[len(file) - 48:]
+    if binary.LittleEndian.Uint64(footer[40:]) != sst_legacy_magic {
+        t.Fatal("bad magic")
+    }
+    _, a := binary.Uvarint(footer)
+    _, b := binary.Uvarint(footer[a:])
+    metaindex, index := footer[:a + b], footer[a + b:]
+    meta := map[string][]byte{}
+    for _, e := range readSSTBlock(t, file, metaindex) {
+        meta[string(e[0])] = e[1]
+    }
+    props := map[string][]byte{}
+    for _, e := range readSSTBlock(t, file, meta["rocksdb.properties"]) {
+        props[string(e[0])] = e[1]
+    }
+    if entries, _ := binary.Uvarint(props["rocksdb.num.entries"]); entries != 999 {
+        t.Fatalf("rocksdb.num.entries = %d", entries)
+    }
+    if blocks, _ := binary.Uvarint(props["rocksdb.num.data.blocks"]); blocks < 2 {
+        t.Fatalf("rocksdb.num.data.blocks = %d, want a few", blocks)
+    }
+    want := list.cursor()
+    for _, block := range readSSTBlock(t, file, index) {
+        for _, e := range readSSTBlock(t, file, block[1]) {
+            key, item, _ := want()
+            internal := append(encode(key), 1, 0, 0, 0, 0, 0, 0, 0)
+            if !bytes.Equal(e[0], internal) || binary.BigEndian.Uint64(e[1]) != uint64(item) {
+                t.Fatalf("entry %x = %x, want key %d item %d", e[0], e[1], key, item)
+            }
+        }
+    }
+    if _, _, more := want(); more {
+        t.Fatal("entries missing from the data blocks")
+    }
+    // LevelDB's hash vectors, except that RocksDB and Pebble sign extend
+    // tail bytes from 0x80 up where LevelDB now no longer does
+    for in, want := range map[string]uint32{"": 0xbc9f1d34, "\x62": 0xef1345c4, "\xe1\x80\xb9\x32": 0xed21633a, "\xc3\x97": 0x0f2ba540, "\xe2\x99\xa5": 0x530174ee} {
+        if h := sstBloomHash([]byte(in)); h != want {
+            t.Fatalf("sstBloomHash(%q) = %#x, want %#x", in, h, want)
+        }
+    }
+    // every key is in the filter, as a RocksDB reader would probe it
+    offset, c := binary.Uvarint(meta["fullfilter.rocksdb.BuiltinBloomFilter"])
+    size, _ := binary.Uvarint(meta["fullfilter.rocksdb.BuiltinBloomFilter"][c:])
+    bits := file[offset:offset + size]
+    probes, lines := int(bits[len(bits) - 5]), binary.LittleEndian.Uint32(bits[len(bits) - 4:])
+    next := list.cursor()
+    for key, _, ok := next(); ok; key, _, ok = next() {
+        h := sstBloomHash(encode(key))
+        delta := h >> 17 | h << 15
+        base := (h % lines) * 512
+        for i := 0; i < probes; i++ {
+            if bit := base + h % 512; bits[bit / 8] & (1 << (bit % 8)) == 0 {
+                t.Fatalf("filter misses %d", key)
+            }
+            h += delta
+        }
+    }
+    // a key the store would see twice
+    dup := newLazySkipList(withOnDuplicate(KEEP_BOTH))
+    dup.put(1, 1)
+    dup.put(1, 2)
+    if _, err := dup.exportSST(io.Discard, encode); err == nil {
+        t.Fatal("exported a key twice")
+    }
+}
+
+func TestImportRDB(t *testing.T) {
+    str := func(s string) []byte { return append([]byte{byte(len(s))}, s...) }
+    dump := []byte("REDIS0011")
+    dump = append(dump, 0xfa)
+    dump = append(append(dump, str("redis-ver")...), str("7.2.4")...)
+    dump = append(dump, 0xfe, 0, 0xfb, 4, 0)
+    // a string, a hash and a set, all read past
+    dump = append(append(append(dump, RDB_STRING), str("greeting")...), str("hello")...)
+    dump = append(append(append(dump, RDB_HASH), str("h")...), 1)
+    dump = append(append(dump, str("f")...), 0xc0, 42)
+    dump = append(append(append(dump, RDB_SET), str("s")...), 2)
+    dump = append(append(dump, str("x")...), str("y")...)
+    // a zset with binary scores, named by an LZF-compressed string
+    dump = append(dump, 0xfc, 1, 2, 3, 4, 5, 6, 7, 8, RDB_ZSET_2, 0xc3, 6, 9, 2, 'a', 'b', 'c', 0x80, 2)
+    dump = append(dump, 3)
+    for _, e := range []zsetEntry{{2.5, "bob"}, {-1, "alice"}, {math.Inf(1), "carol"}} {
+        dump = append(append(dump, str(e.member)...), binary.LittleEndian.AppendUint64(nil, math.Float64bits(e.score))...)
+    }
+    // the same in a listpack: member, score, and each entry's back length
+    lp := []byte{0, 0, 0, 0, 4, 0}
+    lp = append(lp, 0x80 | 3, 'd', 'a', 'n', 4)
+    lp = append(lp, 0xc0 | 0x1f, 0xfe, 2)
+    lp = append(lp, 0x80 | 3, 'e', 'v', 'e', 4)
+    lp = append(lp, 0x80 | 3, '1', '.', '5', 4)
+    lp = append(lp, 0xff)
+    dump = append(append(append(dump, RDB_ZSET_LISTPACK), str("board")...), str(string(lp))...)
+    // and in a ziplist, with text scores
+    zl := []byte{0, 0, 0, 0, 0, 0, 0, 0, 4, 0}
+    zl = append(zl, 0, 3, 'f', 'a', 'y')
+    zl = append(zl, 5, 0xf1 + 6)
+    zl = append(zl, 2, 2, 'g', 'i')
+    zl = append(zl, 4, 0xfe, 0xf9)
+    zl = append(zl, 0xff)
+    dump = append(append(append(dump, RDB_ZSET_ZIPLIST), str("old")...), str(string(zl))...)
+    dump = append(dump, 0xff, 0, 0, 0, 0, 0, 0, 0, 0)
+    sets, err := importRDB(bytes.NewReader(dump))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(sets) != 3 {
+        t.Fatalf("got %d zsets, want 3", len(sets))
+    }
+    got := map[string][]zsetEntry{}
+    for key, list := range sets {
+        next := list.cursor()
+        for e, _, ok := next(); ok; e, _, ok = next() {
+            got[key] = append(got[key], e)
+        }
+    }
+    want := map[string][]zsetEntry{
+        "abcabcabc": {{-1, "alice"}, {2.5, "bob"}, {math.Inf(1), "carol"}},
+        "board": {{-2, "dan"}, {1.5, "eve"}},
+        "old": {{-7, "gi"}, {6, "fay"}}}
+    if !reflect.DeepEqual(got, want) {
+        t.Fatalf("imported %v, want %v", got, want)
+    }
+    // a module value can't be read past
+    bad := append(append([]byte("REDIS0011"), 7), str("m")...)
+    if _, err := importRDB(bytes.NewReader(bad)); err == nil || !strings.Contains(err.Error(), "type 7") {
+        t.Fatalf("module value: %v", err)
+    }
+    if _, err := importRDB(strings.NewReader("REDIS0099")); err == nil {
+        t.Fatal("read a dump from the future")
+    }
+}
+
+func TestRebuild(t *testing.T) {
+    list := newLazySkipList(withMaxLevel(12), withOnDuplicate(OVERWRITE), withJumpTable(2))
+    for key := 0; key < 1024; key++ {
+        list.put(key, key)
+    }
+    for key := 0; key < 1024; key += 2 {
+        list.remove(key)
+    }
+    list.tombstone(1)
+    if !list.rebuild() {
+        t.Fatal("rebuild() = false")
+    }
+    // 512 entries, tombstone included, halving level by level
+    for l, want := 0, 512; l < 10; l, want = l + 1, want / 2 {
+        n := 0
+        for curr := list.head.next[l]; curr != list.tail; curr = curr.next[l] {
+            n++
+        }
+        if n != want {
+            t.Fatalf("level %d holds %d nodes, want %d", l, n, want)
+        }
+    }
+    if _, result := list.lookup(1); result != DELETED {
+        t.Fatalf("lookup(1) = %v after rebuild()", result)
+    }
+    if item, ok := list.get(1023); !ok || item != 1023 || list.size() != 511 || list.contains(2) {
+        t.Fatalf("get(1023) = %d, %v, size() = %d", item, ok, list.size())
+    }
+    // writes that race a rebuild land in whichever nodes are current
+    const writers, per_writer = 4, 3000
+    var stop int32
+    var wg sync.WaitGroup
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        for atomic.LoadInt32(&stop) == 0 {
+            list.rebuild()
+        }
+    }()
+    var writes sync.WaitGroup
+    for g := 0; g < writers; g++ {
+        writes.Add(1)
+        go func(g int) {
+            defer writes.Done()
+            for i := 0; i < per_writer; i++ {
+                key := 2000 + i * writers + g
+                list.put(key, i)
+                list.put(key, i + 1)
+                if i % 3 == 0 && !list.remove(key) {
+                    t.Errorf("remove(%d) = false", key)
+                }
+            }
+        }(g)
+    }
+    writes.Wait()
+    atomic.StoreInt32(&stop, 1)
+    wg.Wait()
+    for g := 0; g < writers; g++ {
+        for i := 0; i < per_writer; i++ {
+            key := 2000 + i * writers + g
+            item, ok := list.get(key)
+            if ok != (i % 3 != 0) || ok && item != i + 1 {
+                t.Fatalf("get(%d) = %d, %v", key, item, ok)
+            }
+        }
+    }
+    if list.size() != 511 + writers * per_writer * 2 / 3 {
+        t.Fatalf("size() = %d", list.size())
+    }
+    if err := list.checkInvariants(); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestCompactLevels(t *testing.T) {
+    list := newLazySkipList(withSeed(7))
+    for key := 0; key < 20000; key++ {
+        list.add(key)
+    }
+    used := func() int {
+        for l := list.max_level - 1; l > 0; l-- {
+            if list.head.next[l] != list.tail {
+                return l + 1
+            }
+        }
+        return 1
+    }
+    if list.activeLevel() != used() || used() < 10 {
+        t.Fatalf("active level %d, %d in use", list.activeLevel(), used())
+    }
+    for key := 0; key < 20000; key++ {
+        if key % 1000 != 0 {
+            list.remove(key)
+        }
+    }
+    // remove() lowered it as the tall nodes went
+    if list.activeLevel() != used() || used() > 8 {
+        t.Fatalf("active level %d after removes, %d in use", list.activeLevel(), used())
+    }
+    for key := 0; key < 20000; key += 1000 {
+        if !list.contains(key) {
+            t.Fatalf("contains(%d) = false", key)
+        }
+    }
+    // too low a level is only slower
+    atomic.StoreInt32(&list.level, 1)
+    if !list.contains(19000) || list.contains(19001) {
+        t.Fatal("lookup from level 1 went wrong")
+    }
+    if list.compact() != used() {
+        t.Fatalf("compact() = %d, %d in use", list.activeLevel(), used())
+    }
+    list.drain()
+    if list.activeLevel() != 1 {
+        t.Fatalf("active level %d after drain()", list.activeLevel())
+    }
+
+    // compact() racing adds never leaves a linked node above the level
+    var wg sync.WaitGroup
+    stop := int32(0)
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        for atomic.LoadInt32(&stop) == 0 {
+            list.compact()
+        }
+    }()
+    for w := 0; w < 4; w++ {
+        wg.Add(1)
+        go func(w int) {
+            defer wg.Done()
+            for i := 0; i < 5000; i++ {
+                key := w * 5000 + i
+                list.add(key)
+                if i % 2 == 0 {
+                    list.remove(key)
+                }
+            }
+        }(w)
+    }
+    time.Sleep(50 * time.Millisecond)
+    atomic.StoreInt32(&stop, 1)
+    wg.Wait()
+    if list.activeLevel() < used() {
+        t.Fatalf("active level %d under %d in use", list.activeLevel(), used())
+    }
+    for key := 1; key < 20000; key += 2 {
+        if !list.contains(key) {
+            t.Fatalf("contains(%d) = false", key)
+        }
+    }
+}
+
+func TestCompactDeleted(t *testing.T) {
+    list := newLazySkipList(withOnDuplicate(OVERWRITE))
+    for key := 0; key < 100; key++ {
+        list.put(key, key)
+    }
+    for key := 0; key < 100; key += 4 {
+        list.tombstone(key)
+    }
+    list.tombstone(500)
+    list.put(8, 80)
+    if n := list.compactDeleted(); n != 25 {
+        t.Fatalf("compactDeleted() = %d, want 25", n)
+    }
+    if _, result := list.lookup(4); result != ABSENT {
+        t.Fatalf("lookup(4) = %v after compactDeleted()", result)
+    }
+    if item, ok := list.get(8); !ok || item != 80 || list.size() != 76 {
+        t.Fatalf("get(8) = %d, %v, size() = %d", item, ok, list.size())
+    }
+    if list.compactDeleted() != 0 {
+        t.Fatal("a second compactDeleted() found more")
+    }
+    // every 10th tombstone compacts the ones before it
+    auto := newLazySkipList(withTombstoneCompaction(10))
+    for key := 0; key < 25; key++ {
+        auto.add(key)
+        auto.tombstone(key)
+    }
+    tombstones := 0
+    for curr := auto.head.next[0]; curr != auto.tail; curr = curr.next[0] {
+        tombstones++
+    }
+    if tombstones != 5 || auto.size() != 0 {
+        t.Fatalf("%d tombstones left, size() = %d", tombstones, auto.size())
+    }
+}
+
+func TestCapacityHint(t *testing.T) {
+    list := newLazySkipList(withCapacityHint(1000))
+    full := list.memoryUsage().reserve
+    if full <= 0 {
+        t.Fatalf("reserve %d before any add", full)
+    }
+    for key := 0; key < 500; key++ {
+        list.add(key)
+    }
+    usage := list.memoryUsage()
+    if usage.nodes != 500 || usage.reserve <= 0 || usage.reserve >= full || usage.bytes <= 0 {
+        t.Fatalf("after 500 adds: %+v, %d reserved at first", usage, full)
+    }
+    // adds go on past the slab
+    for key := 500; key < 3000; key++ {
+        list.add(key)
+    }
+    if usage := list.memoryUsage(); usage.nodes != 3000 || usage.reserve != 0 {
+        t.Fatalf("after 3000 adds: %+v", usage)
+    }
+    for key := 0; key < 3000; key++ {
+        if !list.contains(key) {
+            t.Fatalf("contains(%d) = false", key)
+        }
+    }
+    if err := list.checkInvariants(); err != nil {
+        t.Fatal(err)
+    }
+    // promoted nodes take max_level pointers from it
+    promoted := newLazySkipList(withCapacityHint(100), withPromotion(1), withMaxLevel(8))
+    for key := 0; key < 100; key++ {
+        promoted.add(key)
+    }
+    for i := 0; i < 20; i++ {
+        promoted.contains(50)
+    }
+    if !promoted.contains(50) || promoted.firstLive(50).top_level != 8 {
+        t.Fatal("node was not promoted to the top")
+    }
+}
+
+func TestArenaSkipList(t *testing.T) {
+    if _, err := newArenaSkipList[int64](withMaxLevel(0)); err == nil {
+        t.Fatal("newArenaSkipList() took a max level of 0")
+    }
+    list, err := newArenaSkipList[int64](withMaxLevel(16))
+    if err != nil {
+        t.Fatal(err)
+    }
+    const writers, per_writer = 4, 6000
+    var wg sync.WaitGroup
+    for g := 0; g < writers; g++ {
+        wg.Add(1)
+        go func(g int) {
+            defer wg.Done()
+            for i := 0; i < per_writer; i++ {
+                key := int64(i * writers + g)
+                if !list.add(key, int(key) * 2) {
+                    t.Errorf("add(%d) = false", key)
+                }
+                if i % 3 == 0 && !list.remove(key) {
+                    t.Errorf("remove(%d) = false", key)
+                }
+            }
+        }(g)
+    }
+    wg.Wait()
+    if list.add(4, 0) || list.remove(0) || list.contains(3) {
+        t.Fatal("add() of a present key or remove() of an absent one went through")
+    }
+    want := int64(0)
+    list.ascend(func(key int64, item int) bool {
+        for (want / writers) % 3 == 0 {
+            want++
+        }
+        if key != want || item != int(key) * 2 {
+            t.Fatalf("ascend() gave %d, %d, want %d", key, item, want)
+        }
+        want++
+        return true
+    })
+    if list.size() != writers * per_writer * 2 / 3 || want != writers * per_writer {
+        t.Fatalf("size() = %d, ascend() ended at %d", list.size(), want)
+    }
+    if item, ok := list.get(19999); !ok || item != 39998 {
+        t.Fatalf("get(19999) = %d, %v", item, ok)
+    }
+    // what keeps the collector out: nothing in a chunk it would have to follow
+    var pointers func(r reflect.Type) bool
+    pointers = func(r reflect.Type) bool {
+        switch r.Kind() {
+        case reflect.Array:
+            return pointers(r.Elem())
+        case reflect.Struct:
+            for i := 0; i < r.NumField(); i++ {
+                if pointers(r.Field(i).Type) {
+                    return true
+                }
+            }
+            return false
+        }
+        return r.Kind() >= reflect.Chan && r.Kind() != reflect.Struct
+    }
+    if pointers(reflect.TypeOf([ARENA_CHUNK]arenaNode[float64]{})) || pointers(reflect.TypeOf([ARENA_CHUNK]uint32{})) {
+        t.Fatal("arena chunks hold pointers")
+    }
+
+    // out of indexes, add() panics and leaves the counters at their limits
+    small, _ := newArenaSkipList[int64](withMaxLevel(1))
+    panics := func(key int64) (panicked bool) {
+        defer func() {
+            panicked = recover() != nil
+        }()
+        small.add(key, 0)
+        return
+    }
+    nodes, towers := small.used_nodes, small.used_towers
+    small.used_towers = ARENA_MAX_TOWERS
+    if !panics(1) || !panics(2) || small.used_towers != ARENA_MAX_TOWERS || small.used_nodes != nodes {
+        t.Fatalf("add() past the towers left %d nodes, %d towers", small.used_nodes, small.used_towers)
+    }
+    small.used_towers, small.used_nodes = towers, ARENA_MAX_NODES
+    if !panics(1) || !panics(2) || small.used_nodes != ARENA_MAX_NODES {
+        t.Fatalf("add() past the nodes left %d nodes", small.used_nodes)
+    }
+    // and unlocks the preds it had locked
+    small.used_towers, small.used_nodes = towers, nodes
+    if panics(1) || !small.contains(1) || small.size() != 1 {
+        t.Fatal("add() after running out failed")
+    }
+}
+
+func TestOpStats(t *testing.T) {
+    list := newLazySkipList(withMaxLevel(1))
+    list.add(10)
+    list.add(20)
+    node10, node20 := list.firstLive(10), list.firstLive(20)
+    // a writer that finds 10 before 20, then has to wait for 10 while 12 goes in
+    list.lockNode(node10)
+    done := make(chan opStats)
+    go func() {
+        _, stats := list.putStats(15, 0)
+        done <- stats
+    }()
+    time.Sleep(20 * time.Millisecond)
+    // the writer may have started late into the sleep, so only most of it is waited for sure
+    node12 := list.newNode(12, 0, 1)
+    node12.next[0] = node20
+    node12.fully_linked = true
+    node10.next[0] = node12
+    list.count.add(1)
+    list.unlockNode(node10)
+    stats := <-done
+    if stats.retries != 1 || stats.levels != 2 || stats.steps != 3 || stats.lock_wait < 10 * time.Millisecond {
+        t.Fatalf("putStats(15) took %+v", stats)
+    }
+    if ok, stats := list.removeStats(12); !ok || stats.retries != 0 || stats.levels != 1 {
+        t.Fatalf("removeStats(12) = %v, %+v", ok, stats)
+    }
+    if ok, _ := list.removeStats(12); ok || list.size() != 3 {
+        t.Fatalf("removeStats(12) twice, size() = %d", list.size())
+    }
+}
+
+func TestSlowOpThreshold(t *testing.T) {
+    var out bytes.Buffer
+    list := newLazySkipList(withMaxLevel(1), withSlowOpThreshold(10 * time.Millisecond, &out))
+    for key := 0; key < 100; key += 2 {
+        list.add(key)
+    }
+    list.remove(50)
+    if out.Len() != 0 {
+        t.Fatalf("fast operations logged:\n%s", out.String())
+    }
+    // a put that waits for the lock of 60, its pred
+    node := list.firstLive(60)
+    list.lockNode(node)
+    done := make(chan bool)
+    go func() {
+        list.put(61, 1)
+        done <- true
+    }()
+    time.Sleep(20 * time.Millisecond)
+    list.unlockNode(node)
+    <-done
+    list.ascend(0, 10, func(key int, item int) bool {
+        time.Sleep(4 * time.Millisecond)
+        return true
+    })
+    lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+    if len(lines) != 2 || !strings.HasPrefix(lines[0], "slow put 61: 0 retries, ") || !strings.HasPrefix(lines[1], "slow ascend [0, 10): 0 retries, ") {
+        t.Fatalf("logged:\n%s", out.String())
+    }
+    // a remove through middleware is timed past it, like a put
+    out.Reset()
+    chained := newLazySkipList(withMaxLevel(1), withSlowOpThreshold(10 * time.Millisecond, &out), withMiddleware[int](
+        func(op uint8, key, item int, next func(key, item int) opResult) opResult {
+            return next(key, item)
+        }))
+    chained.add(18)
+    chained.add(20)
+    pred := chained.firstLive(18)
+    chained.lockNode(pred)
+    go func() {
+        chained.remove(20)
+        done <- true
+    }()
+    time.Sleep(20 * time.Millisecond)
+    chained.unlockNode(pred)
+    <-done
+    if !strings.HasPrefix(out.String(), "slow remove 20: 0 retries, ") {
+        t.Fatalf("chained remove logged:\n%s", out.String())
+    }
+}
+
+func TestAscendContext(t *testing.T) {
+    list := newLazySkipList()
+    for key := 0; key < 10000; key++ {
+        list.add(key)
+    }
+    ctx, cancel := context.WithCancel(context.Background())
+    seen := 0
+    err := list.ascendContext(ctx, 0, 10000, func(key int, item int) bool {
+        if seen++; key == 1000 {
+            cancel()
+        }
+        return true
+    })
+    if !errors.Is(err, err_cancelled) || seen <= 1000 || seen > 1000 + SCAN_CHECK_EVERY {
+        t.Fatalf("cancelled at 1000: err = %v after %d keys", err, seen)
+    }
+    // nothing live to hand fn, the walk over the tombstones still stops
+    for key := 0; key < 10000; key++ {
+        list.tombstone(key)
+    }
+    err = list.ascendContext(ctx, 0, 10000, func(key int, item int) bool {
+        t.Fatalf("fn called for tombstoned %d", key)
+        return true
+    })
+    if !errors.Is(err, err_cancelled) {
+        t.Fatalf("cancelled over tombstones: err = %v", err)
+    }
+    if err := list.ascendContext(context.Background(), 0, 10000, func(key int, item int) bool { return true }); err != nil {
+        t.Fatalf("uncancelled: err = %v", err)
+    }
+}
+
+func TestHelping(t *testing.T) {
+    list := newLazySkipList(withTombstoneCompaction(1 << 20))
+    for key := 0; key < 100; key++ {
+        list.add(key)
+    }
+    for key := 10; key < 90; key++ {
+        list.tombstone(key)
+    }
+    linked := func() int {
+        n := 0
+        for curr := list.head.next[0]; curr != list.tail; curr = curr.next[0] {
+            n++
+        }
+        return n
+    }
+    if _, result := list.lookup(10); result != DELETED {
+        t.Fatalf("lookup(10) = %v, want DELETED before it is purged", result)
+    }
+    if _, result := list.lookup(10); result != ABSENT {
+        t.Fatalf("lookup(10) = %v, want ABSENT once purged", result)
+    }
+    if list.contains(11) || list.firstLive(11) != nil {
+        t.Fatalf("contains(11) left its tombstone")
+    }
+    if n := linked(); n != 98 {
+        t.Fatalf("%d nodes linked after two reads, want 98", n)
+    }
+    keys := []int{}
+    list.ascend(0, 100, func(key int, item int) bool {
+        keys = append(keys, key)
+        return true
+    })
+    if len(keys) != 20 || linked() != 20 || list.size() != 20 {
+        t.Fatalf("after a scan: %d keys, %d linked, size() = %d", len(keys), linked(), list.size())
+    }
+    // without compaction tombstones are for lookup() and stay
+    kept := newLazySkipList()
+    kept.add(1)
+    kept.tombstone(1)
+    kept.lookup(1)
+    if _, result := kept.lookup(1); result != DELETED {
+        t.Fatalf("lookup(1) = %v without compaction, want DELETED", result)
+    }
+}
+
+func TestReadHelping(t *testing.T) {
+    list := newLazySkipList(withTombstoneCompaction(1 << 20))
+    for key := 0; key < 100; key++ {
+        list.add(key)
+        list.tombstone(key)
+    }
+    list.lookup(5)
+    list.contains(6)
+    list.ascend(50, 60, func(key int, item int) bool { return true })
+    if r := list.repairs(); r.helped != 12 || r.compacted != 0 {
+        t.Fatalf("after reads: %+v", r)
+    }
+    if n := list.compactDeleted(); n != 88 || list.repairs().compacted != 88 {
+        t.Fatalf("compactDeleted() = %d, %+v", n, list.repairs())
+    }
+    // reads leave the tombstones to compactDeleted(), which runs on its own
+    quiet := newLazySkipList(withTombstoneCompaction(100), withoutReadHelping())
+    for key := 0; key < 99; key++ {
+        quiet.add(key)
+        quiet.tombstone(key)
+    }
+    quiet.lookup(5)
+    quiet.ascend(0, 100, func(key int, item int) bool { return true })
+    if r := quiet.repairs(); r.helped != 0 || r.compacted != 0 {
+        t.Fatalf("reads helped without read helping: %+v", r)
+    }
+    quiet.tombstone(99)
+    for start := time.Now(); quiet.repairs().compacted != 100; {
+        if time.Since(start) > 5 * time.Second {
+            t.Fatalf("compaction not done in the background: %+v", quiet.repairs())
+        }
+        time.Sleep(time.Millisecond)
+    }
+    if _, err := newList[int](withoutReadHelping()); err == nil {
+        t.Fatal("withoutReadHelping() accepted without compaction")
+    }
+}
+
+func TestBackpressure(t *testing.T) {
+    list := newLazySkipList(withBackpressure(10, 5, OVERFLOW_REJECT, nil))
+    for key := 0; key < 10; key++ {
+        list.add(key)
+    }
+    if result := list.put(10, 0); result != PUT_OVER_CAPACITY || !errors.Is(list.insert(10, 0), err_over_capacity) {
+        t.Fatalf("put(10) at the high-water mark = %v", result)
+    }
+    // deletes are never held back, tombstones included
+    if !list.tombstone(9) {
+        t.Fatal("tombstone(9) turned away")
+    }
+    for key := 0; key < 3; key++ {
+        list.remove(key)
+    }
+    if list.add(10) {
+        t.Fatalf("add(10) let in between the marks, size() = %d", list.size())
+    }
+    // the low-water mark itself lets writers back in
+    list.remove(3)
+    if !list.add(10) || !list.add(11) {
+        t.Fatalf("add() turned away at the low-water mark, size() = %d", list.size())
+    }
+
+    // the wrappers report a turned-away put the same way
+    for key := 12; key < 15; key++ {
+        list.add(key)
+    }
+    group := newGroupCommitter(&list, 1, 4)
+    defer group.close()
+    combining := newFlatCombiningList(cmp.Compare[int], withBackpressure(2, 1, OVERFLOW_REJECT, nil))
+    combining.add(1)
+    combining.add(2)
+    if list.size() != 10 || group.add(100) || combining.add(3) {
+        t.Fatalf("groupCommitter or FlatCombiningList add() went through over capacity")
+    }
+
+    blocking := newLazySkipList(withBackpressure(10, 5, OVERFLOW_BLOCK, nil))
+    for key := 0; key < 10; key++ {
+        blocking.add(key)
+    }
+    done := make(chan putResult)
+    go func() {
+        done <- blocking.put(100, 0)
+    }()
+    time.Sleep(20 * time.Millisecond)
+    select {
+    case result := <-done:
+        t.Fatalf("put(100) over the high-water mark went ahead: %v", result)
+    default:
+    }
+    for key := 0; key < 6; key++ {
+        blocking.remove(key)
+    }
+    if result := <-done; result != PUT_INSERTED {
+        t.Fatalf("blocked put(100) = %v", result)
+    }
+
+    // a low-water mark of 0 waits for the list to drain
+    for _, policy := range []overflowPolicy{OVERFLOW_REJECT, OVERFLOW_BLOCK} {
+        draining := newLazySkipList(withBackpressure(3, 0, policy, nil))
+        for key := 0; key < 3; key++ {
+            draining.add(key)
+        }
+        done := make(chan bool)
+        go func() {
+            done <- draining.add(3)
+        }()
+        if policy == OVERFLOW_REJECT {
+            if <-done {
+                t.Fatal("add(3) over the high-water mark went ahead")
+            }
+        }
+        for key := 0; key < 3; key++ {
+            draining.remove(key)
+        }
+        if policy == OVERFLOW_BLOCK && !<-done || policy == OVERFLOW_REJECT && !draining.add(3) {
+            t.Fatalf("add(3) into the drained list turned away under %v", policy)
+        }
+        if !draining.add(4) || draining.size() != 2 {
+            t.Fatalf("add(4) after draining, size() = %d", draining.size())
+        }
+    }
+
+    var shedding LazySkipList[int]
+    sheds, oldest := 0, 0
+    shedding = newLazySkipList(withBackpressure(10, 5, OVERFLOW_SHED, func(size int) {
+        sheds++
+        for ; size > 4; size-- {
+            shedding.remove(oldest)
+            oldest++
+        }
+    }))
+    for key := 0; key < 20; key++ {
+        if !shedding.add(key) {
+            t.Fatalf("add(%d) turned away while shedding", key)
+        }
+    }
+    if sheds != 2 || shedding.size() != 8 || shedding.contains(11) || !shedding.contains(12) {
+        t.Fatalf("%d sheds, size() = %d", sheds, shedding.size())
+    }
+    for i, config := range [][]option{
+        {withBackpressure(10, 10, OVERFLOW_BLOCK, nil)},
+        {withBackpressure(10, 5, OVERFLOW_SHED, nil)},
+        {withBackpressure(10, 5, OVERFLOW_REJECT, func(int) {})},
+    } {
+        if _, err := newList[int](config...); err == nil {
+            t.Fatalf("bad backpressure config %d accepted", i)
+        }
+    }
+}
+
+func TestWriteLimit(t *testing.T) {
+    list := newLazySkipList(withWriteLimit(200, 10))
+    start := time.Now()
+    for key := 0; key < 10; key++ {
+        list.add(key)
+    }
+    if took := time.Since(start); took > 25 * time.Millisecond {
+        t.Fatalf("the burst of 10 took %v", took)
+    }
+    // 20 more writes over 4 writers, 5ms apart
+    start = time.Now()
+    var wg sync.WaitGroup
+    for w := 0; w < 4; w++ {
+        wg.Add(1)
+        go func(w int) {
+            defer wg.Done()
+            for key := 10 + w; key < 30; key += 4 {
+                list.add(key)
+            }
+        }(w)
+    }
+    wg.Wait()
+    if took := time.Since(start); took < 90 * time.Millisecond {
+        t.Fatalf("20 writes past the burst took %v", took)
+    }
+    // reads take no token
+    start = time.Now()
+    for key := 0; key < 1000; key++ {
+        list.contains(key)
+    }
+    if took := time.Since(start); took > 25 * time.Millisecond || list.size() != 30 {
+        t.Fatalf("1000 reads took %v, size() = %d", took, list.size())
+    }
+    time.Sleep(50 * time.Millisecond)
+    start = time.Now()
+    list.insertSortedBatch([]entry[int]{{30, 0}, {31, 0}, {32, 0}, {33, 0}, {34, 0}, {35, 0}, {36, 0}, {37, 0}, {38, 0}, {39, 0}, {40, 0}, {41, 0}, {42, 0}, {43, 0}, {44, 0}})
+    list.remove(0)
+    if took := time.Since(start); took < 20 * time.Millisecond {
+        t.Fatalf("15 batch entries and a remove() on 10 tokens took %v", took)
+    }
+    if _, err := newList[int](withWriteLimit(10, 0)); err == nil {
+        t.Fatal("write limit with no burst accepted")
+    }
+}
+
+func TestPriorityLanes(t *testing.T) {
+    list := newLazySkipList()
+    for key := 0; key < 1000; key++ {
+        list.add(key)
+    }
+    // a high-priority scan held in flight until release
+    release := make(chan bool)
+    go list.ascendContext(prioritized(context.Background(), PRIORITY_HIGH), 0, 1, func(key int, item int) bool {
+        <-release
+        return true
+    })
+    for atomic.LoadInt32(&list.foreground) == 0 {
+        time.Sleep(time.Millisecond)
+    }
+    ctx, cancel := context.WithTimeout(prioritized(context.Background(), PRIORITY_LOW), 20 * time.Millisecond)
+    defer cancel()
+    if err := list.insertContext(ctx, 5000, 0); !errors.Is(err, err_starved) || list.contains(5000) {
+        t.Fatalf("low-priority insertContext() = %v, want err_starved", err)
+    }
+    if err := list.insertContext(context.Background(), 5001, 0); err != nil {
+        t.Fatalf("insertContext() without a priority = %v", err)
+    }
+    scanned := make(chan int)
+    go func() {
+        n := 0
+        list.ascendContext(prioritized(context.Background(), PRIORITY_LOW), 0, 1000, func(key int, item int) bool {
+            n++
+            return true
+        })
+        scanned <- n
+    }()
+    time.Sleep(20 * time.Millisecond)
+    select {
+    case <-scanned:
+        t.Fatal("low-priority scan ran alongside a high-priority one")
+    default:
+    }
+    close(release)
+    if n := <-scanned; n != 1000 || atomic.LoadInt32(&list.foreground) != 0 {
+        t.Fatalf("low-priority scan saw %d keys", n)
+    }
+}
+
+func TestHybridSkipList(t *testing.T) {
+    if _, err := newHybridSkipList[int](withProbability(1)); err == nil {
+        t.Fatal("newHybridSkipList() took a probability of 1")
+    }
+    list, err := newHybridSkipList[int](withMaxLevel(16))
+    if err != nil {
+        t.Fatal(err)
+    }
+    const writers, per_writer = 4, 3000
+    var wg sync.WaitGroup
+    stop := make(chan bool)
+    // readers alongside the writers, run with -race
+    for r := 0; r < 2; r++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for {
+                select {
+                case <-stop:
+                    return
+                default:
+                }
+                prev := -1
+                list.ascend(0, writers * per_writer, func(key int, item int) bool {
+                    if key <= prev || item != key * 2 {
+                        t.Errorf("ascend() gave %d, %d after %d", key, item, prev)
+                        return false
+                    }
+                    prev = key
+                    return true
+                })
+                if item, ok := list.get(rand.Intn(writers * per_writer)); ok && item % 2 != 0 {
+                    t.Errorf("get() = %d", item)
+                }
+            }
+        }()
+    }
+    var writing sync.WaitGroup
+    for g := 0; g < writers; g++ {
+        writing.Add(1)
+        go func(g int) {
+            defer writing.Done()
+            for i := 0; i < per_writer; i++ {
+                key := i * writers + g
+                if !list.add(key, key * 2) {
+                    t.Errorf("add(%d) = false", key)
+                }
+                if i % 3 == 0 && !list.remove(key) {
+                    t.Errorf("remove(%d) = false", key)
+                }
+            }
+        }(g)
+    }
+    writing.Wait()
+    close(stop)
+    wg.Wait()
+    if list.add(4, 0) || list.remove(0) || list.contains(3) {
+        t.Fatal("add() of a present key or remove() of an absent one went through")
+    }
+    n := 0
+    list.ascend(0, writers * per_writer, func(key int, item int) bool {
+        if (key / writers) % 3 == 0 {
+            t.Fatalf("ascend() gave removed %d", key)
+        }
+        n++
+        return true
+    })
+    if n != writers * per_writer * 2 / 3 || list.size() != n {
+        t.Fatalf("ascend() saw %d keys, size() = %d", n, list.size())
+    }
+    if item, ok := list.get(11999); !ok || item != 23998 {
+        t.Fatalf("get(11999) = %d, %v", item, ok)
+    }
+}
+
+func TestWorkload(t *testing.T) {
+    w := workload{num_threads: 4, n: 10000, key_range: 1000, dist: DIST_ZIPFIAN, read: 80, insert: 10, remove: 10, seed: 42}
+    keys, ops := w.keys(), w.ops(OP_CONTAINS)
+    if !reflect.DeepEqual(keys, w.keys()) || !reflect.DeepEqual(ops, w.ops(OP_CONTAINS)) {
+        t.Fatal("the same seed gave different streams")
+    }
+    if reflect.DeepEqual(keys[0], keys[1]) {
+        t.Fatal("two goroutines got the same stream")
+    }
+    hot, counts := 0, make([]int, len(op_names))
+    for i := range keys {
+        for j, key := range keys[i] {
+            if key < 0 || key >= w.key_range {
+                t.Fatalf("key %d out of range", key)
+            }
+            if key < 10 {
+                hot++
+            }
+            counts[ops[i][j]]++
+        }
+    }
+    // a uniform draw would put 1% in the 10 hottest keys
+    if hot < len(keys) * w.n / 4 {
+        t.Fatalf("%d of %d Zipfian keys among the 10 hottest", hot, len(keys) * w.n)
+    }
+    if counts[OP_CONTAINS] < 31000 || counts[OP_CONTAINS] > 33000 || counts[OP_ADD] < 3500 || counts[OP_REMOVE] < 3500 {
+        t.Fatalf("80/10/10 mix gave %v", counts)
+    }
+    w.dist, w.read, w.insert, w.remove = DIST_SEQUENTIAL, 0, 0, 0
+    keys = w.keys()
+    if keys[0][0] != 0 || keys[0][999] != 999 || keys[0][1000] != 0 || keys[1][0] != 0 || keys[3][5] != 5 {
+        t.Fatalf("sequential streams start %v, %v", keys[0][:3], keys[1][:3])
+    }
+    for _, op := range w.ops(OP_REMOVE)[2] {
+        if op != OP_REMOVE {
+            t.Fatalf("unmixed ops gave %s", op_names[op])
+        }
+    }
+    // the generator hands out the same stream one operation at a time
+    w.dist, w.read, w.insert, w.remove = DIST_ZIPFIAN, 80, 10, 10
+    keys, ops = w.keys(), w.ops(OP_CONTAINS)
+    next := w.generator(2, OP_CONTAINS)
+    for j := 0; j < w.n; j++ {
+        if key, op := next(); key != keys[2][j] || op != ops[2][j] {
+            t.Fatalf("generator(2) gave %d, %s at %d, keys() and ops() %d, %s", key, op_names[op], j, keys[2][j], op_names[ops[2][j]])
+        }
+    }
+    if dist, err := parseDistribution("seq"); err != nil || dist != DIST_SEQUENTIAL {
+        t.Fatalf("parseDistribution(seq) = %v, %v", dist, err)
+    }
+    if _, err := parseDistribution("gaussian"); err == nil {
+        t.Fatal("parseDistribution(gaussian) did not fail")
+    }
+}
+
+func TestStressKeepBoth(t *testing.T) {
+    debug = true
+    defer func() { debug = false }()
+    duration := time.Second
+    if testing.Short() {
+        duration = 200 * time.Millisecond
+    }
+    list := newLazySkipList(withOnDuplicate(KEEP_BOTH))
+    ops, err := stress(&list, 16, 64, duration, 20 * time.Millisecond)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Log(ops, "operations, final size", list.size())
+}
+
+/**
+linearizability checking in the style of porcupine (which needs a module to
+depend on): histories of add(), remove() and contains() are recorded with
+logical call and return times, split per key since linearizability is a
+local property, and each key's history is searched with the Wing & Gong
+algorithm against a sequential set model
+**/
+type operation struct {
+    op uint8
+    key int
+    result bool
+    call int64
+    ret int64
+}
+
+func (this operation) String() string {
+    return fmt.Sprintf("%s(%d)=%v [%d,%d]", op_names[this.op], this.key, this.result, this.call, this.ret)
+}
+
+// model step for a single key, ok is false if the result is impossible in this state
+func step(present bool, op operation) (bool, bool) {
+    switch op.op {
+    case OP_ADD:
+        return true, op.result == !present
+    case OP_REMOVE:
+        return false, op.result == present
+    default:
+        return present, op.result == present
+    }
+}
+
+func linearizable(history []operation, present bool) bool {
+    done := make([]bool, len(history))
+    seen := map[string]bool{}
+    var search func(present bool, remaining int) bool
+    search = func(present bool, remaining int) bool {
+        if remaining == 0 {
+            return true
+        }
+        state := fmt.Sprint(present, done)
+        if seen[state] {
+            return false
+        }
+        seen[state] = true
+        first_ret := int64(math.MaxInt64)
+        for i, op := range history {
+            if !done[i] && op.ret < first_ret {
+                first_ret = op.ret
+            }
+        }
+        for i, op := range history {
+            if done[i] || op.call > first_ret {
+                continue
+            }
+            next, ok := step(present, op)
+            if !ok {
+                continue
+            }
+            done[i] = true
+            if search(next, remaining - 1) {
+                return true
+            }
+            done[i] = false
+        }
+        return false
+    }
+    return search(present, len(history))
+}
+
+func recordHistory(list *LazySkipList[int], num_threads, ops, key_range int, seed int64) []operation {
+    var clock int64
+    var wg sync.WaitGroup
+    start := make(chan bool)
+    histories := make([][]operation, num_threads)
+    for i := 0; i < num_threads; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            <-start
+            rng := rand.New(rand.NewSource(seed + int64(i)))
+            for j := 0; j < ops; j++ {
+                op := operation{op: uint8(rng.Intn(3)), key: rng.Intn(key_range)}
+                op.call = atomic.AddInt64(&clock, 1)
+                switch op.op {
+                case OP_ADD:
+                    op.result = list.add(op.key)
+                case OP_REMOVE:
+                    op.result = list.remove(op.key)
+                default:
+                    op.result = list.contains(op.key)
+                }
+                op.ret = atomic.AddInt64(&clock, 1)
+                histories[i] = append(histories[i], op)
+            }
+        }(i)
+    }
+    close(start)
+    wg.Wait()
+    history := []operation{}
+    for _, h := range histories {
+        history = append(history, h...)
+    }
+    return history
+}
+
+func TestLinearizable(t *testing.T) {
+    const key_range = 16
+    rounds := 100
+    if testing.Short() {
+        rounds = 20
+    }
+    list := newLazySkipList()
+    for round := 0; round < rounds; round++ {
+        present := make([]bool, key_range)
+        for key := range present {
+            present[key] = list.contains(key)
+        }
+        per_key := make([][]operation, key_range)
+        for _, op := range recordHistory(&list, 8, 200, key_range, int64(round) * 100) {
+            per_key[op.key] = append(per_key[op.key], op)
+        }
+        for key, history := range per_key {
+            if !linearizable(history, present[key]) {
+                lines := []string{}
+                for _, op := range history {
+                    lines = append(lines, op.String())
+                }
+                t.Fatalf("round %d: history of key %d (initially present=%v) is not linearizable:\n%s",
+                    round, key, present[key], strings.Join(lines, "\n"))
+            }
+        }
+    }
+}
+
+func TestLinearizableRejectsLostUpdate(t *testing.T) {
+    // two overlapping add(1) calls cannot both succeed
+    history := []operation{
+        {op: OP_ADD, key: 1, result: true, call: 1, ret: 4},
+        {op: OP_ADD, key: 1, result: true, call: 2, ret: 3}}
+    if linearizable(history, false) {
+        t.Fatal("accepted two successful add() of the same key")
+    }
+    history[1].result = false
+    if !linearizable(history, false) {
+        t.Fatal("rejected a linearizable history")
+    }
+}
+
+// same operation encoding as FuzzSkipList in skiplist_test.go
+func FuzzLazySkipList(f *testing.F) {
+    f.Add([]byte{0, 0, 1, 0, 0, 1, 1, 0, 1, 1, 0, 1})
+    f.Add([]byte{0, 0x7f, 0xff, 0, 0x80, 0x00, 2, 0x7f, 0xff, 1, 0x80, 0x00})
+    f.Add([]byte{0, 0xfc, 0x19, 0, 0xfc, 0x18, 1, 0xfc, 0x19, 2, 0xfc, 0x18})
+    f.Fuzz(func(t *testing.T, data []byte) {
+        list := newLazySkipList()
+        model := map[int]bool{}
+        for i := 0; i + 2 < len(data); i += 3 {
+            key := int(int16(uint16(data[i + 1]) << 8 | uint16(data[i + 2])))
+            switch data[i] % 3 {
+            case 0:
+                if got, want := list.add(key), !model[key]; got != want {
+                    t.Fatalf("op %d: add(%d) = %v, want %v", i / 3, key, got, want)
+                }
+                model[key] = true
+            case 1:
+                if got, want := list.remove(key), model[key]; got != want {
+                    t.Fatalf("op %d: remove(%d) = %v, want %v", i / 3, key, got, want)
+                }
+                delete(model, key)
+            case 2:
+                if got, want := list.contains(key), model[key]; got != want {
+                    t.Fatalf("op %d: contains(%d) = %v, want %v", i / 3, key, got, want)
+                }
+            }
+        }
+        if err := list.checkInvariants(); err != nil {
+            t.Fatal(err)
+        }
+        want := []int{}
+        for key := range model {
+            want = append(want, key)
+        }
+        sort.Ints(want)
+        got := []int{}
+        list.ascend(math.MinInt, math.MaxInt, func(key, item int) bool {
+            got = append(got, key)
+            return true
+        })
+        if fmt.Sprint(got) != fmt.Sprint(want) {
+            t.Fatalf("contents %v, want %v", got, want)
+        }
+    })
+}
+
+/**
+property tests with testing/quick: a program is a few logical goroutines,
+each with its own operation sequence, and a schedule choosing which of them
+takes the next step. the program is run on the list and on a map model and
+failing programs are shrunk by dropping operations one at a time
+**/
+type program struct {
+    threads [][]operation
+    schedule []int
+}
+
+func (program) Generate(rng *rand.Rand, size int) reflect.Value {
+    var p program
+    key_range := 1 + rng.Intn(size + 1)
+    p.threads = make([][]operation, 1 + rng.Intn(3))
+    for i := range p.threads {
+        for j := rng.Intn(size + 1); j > 0; j-- {
+            p.threads[i] = append(p.threads[i], operation{op: uint8(rng.Intn(3)), key: rng.Intn(key_range) - key_range / 2})
+        }
+    }
+    for j := rng.Intn(4 * size + 1); j > 0; j-- {
+        p.schedule = append(p.schedule, rng.Intn(len(p.threads)))
+    }
+    return reflect.ValueOf(p)
+}
+
+func (this program) String() string {
+    lines := []string{fmt.Sprint("schedule ", this.schedule)}
+    for i, ops := range this.threads {
+        names := []string{}
+        for _, op := range ops {
+            names = append(names, fmt.Sprintf("%s(%d)", op_names[op.op], op.key))
+        }
+        lines = append(lines, fmt.Sprintf("goroutine %d: %s", i, strings.Join(names, " ")))
+    }
+    return strings.Join(lines, "\n")
+}
+
+// steps the goroutines in schedule order, then round-robin until all are done
+func (this program) run() error {
+    list := newLazySkipList()
+    model := map[int]bool{}
+    pc := make([]int, len(this.threads))
+    exec := func(i int) error {
+        op := this.threads[i][pc[i]]
+        pc[i]++
+        var got, want bool
+        switch op.op {
+        case OP_ADD:
+            got, want = list.add(op.key), !model[op.key]
+            model[op.key] = true
+        case OP_REMOVE:
+            got, want = list.remove(op.key), model[op.key]
+            delete(model, op.key)
+        default:
+            got, want = list.contains(op.key), model[op.key]
+        }
+        if got != want {
+            return fmt.Errorf("goroutine %d: %s(%d) = %v, want %v", i, op_names[op.op], op.key, got, want)
+        }
+        return nil
+    }
+    for _, i := range this.schedule {
+        if pc[i] < len(this.threads[i]) {
+            if err := exec(i); err != nil {
+                return err
+            }
+        }
+    }
+    for remaining := true; remaining; {
+        remaining = false
+        for i := range this.threads {
+            if pc[i] < len(this.threads[i]) {
+                remaining = true
+                if err := exec(i); err != nil {
+                    return err
+                }
+            }
+        }
+    }
+    if err := list.checkInvariants(); err != nil {
+        return err
+    }
+    if list.size() != len(model) {
+        return fmt.Errorf("size() = %d, want %d", list.size(), len(model))
+    }
+    return nil
+}
+
+// returns the smallest failing program found and the error it failed with
+func (this program) shrink(failure error) (program, error) {
+    for shrunk := true; shrunk; {
+        shrunk = false
+        for i := range this.threads {
+            for j := 0; j < len(this.threads[i]); j++ {
+                candidate := program{threads: make([][]operation, len(this.threads)), schedule: this.schedule}
+                copy(candidate.threads, this.threads)
+                candidate.threads[i] = append(append([]operation{}, this.threads[i][:j]...), this.threads[i][j + 1:]...)
+                if err := candidate.run(); err != nil {
+                    this, failure = candidate, err
+                    shrunk = true
+                    j--
+                }
+            }
+        }
+        for j := 0; j < len(this.schedule); j++ {
+            candidate := program{threads: this.threads, schedule: append(append([]int{}, this.schedule[:j]...), this.schedule[j + 1:]...)}
+            if err := candidate.run(); err != nil {
+                this, failure = candidate, err
+                shrunk = true
+                j--
+            }
+        }
+    }
+    return this, failure
+}
+
+func TestModelProperty(t *testing.T) {
+    var failure error
+    err := quick.Check(func(p program) bool {
+        failure = p.run()
+        return failure == nil
+    }, &quick.Config{MaxCount: 2000})
+    if check, ok := err.(*quick.CheckError); ok {
+        minimal, failure := check.In[0].(program).shrink(failure)
+        t.Fatalf("%v\nminimal failing program:\n%v", failure, minimal)
+    } else if err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestChaos(t *testing.T) {
+    chaos = chaosDelay
+    defer func() { chaos = nil }()
+    duration := 2 * time.Second
+    if testing.Short() {
+        duration = 200 * time.Millisecond
+    }
+    list := newLazySkipList()
+    ops, err := stress(&list, 16, 64, duration, 20 * time.Millisecond)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Log(ops, "operations, final size", list.size())
+}
+
+/**
+a cooperative scheduler for exploring interleavings. every goroutine runs
+one operation and parks at each chaos point until the scheduler picks it
+again, so exactly one goroutine runs at a time and a run is fully determined
+by its sequence of choices. explore() enumerates those sequences depth
+first, branching at the first max_depth decisions and switching round-robin
+after that so that retry loops cannot stall a run
+**/
+type coopScheduler struct {
+    mu sync.Mutex
+    ids map[uint64]int
+    resume []chan bool
+    events chan schedEvent
+}
+
+type schedEvent struct {
+    goroutine int
+    done bool
+}
+
+func (this *coopScheduler) yield(point string) {
+    this.mu.Lock()
+    i, ok := this.ids[goroutineID()]
+    this.mu.Unlock()
+    if !ok {
+        return
+    }
+    this.events <- schedEvent{goroutine: i}
+    <-this.resume[i]
+}
+
+/**
+runs ops concurrently on list, following prefix for the first decisions.
+returns the op results, the choice taken at each branching decision and the
+number of runnable goroutines there was to choose from. fails if a resumed
+goroutine neither parks nor finishes, or if the goroutines keep retrying
+without finishing, e.g. when spinning on a broken list
+**/
+func runSchedule(list *LazySkipList[int], ops []func(*LazySkipList[int]) bool, prefix []int, max_depth int) ([]bool, []int, []int, error) {
+    sched := &coopScheduler{ids: map[uint64]int{}, events: make(chan schedEvent)}
+    results := make([]bool, len(ops))
+    var registered sync.WaitGroup
+    // every channel made before any goroutine reads the slice
+    sched.resume = make([]chan bool, len(ops))
+    for i := range sched.resume {
+        sched.resume[i] = make(chan bool)
+    }
+    for i := range ops {
+        registered.Add(1)
+        go func(i int) {
+            sched.mu.Lock()
+            sched.ids[goroutineID()] = i
+            sched.mu.Unlock()
+            registered.Done()
+            <-sched.resume[i]
+            results[i] = ops[i](list)
+            sched.events <- schedEvent{goroutine: i, done: true}
+        }(i)
+    }
+    registered.Wait()
+    chaos = sched.yield
+    defer func() { chaos = nil }()
+    runnable := []int{}
+    for i := range ops {
+        runnable = append(runnable, i)
+    }
+    choices, options := []int{}, []int{}
+    last := -1
+    for steps := 0; len(runnable) > 0; steps++ {
+        if steps == 10000 {
+            return results, choices, options, fmt.Errorf("goroutines %v still running after %d steps", runnable, steps)
+        }
+        pick := 0
+        if d := len(choices); d < max_depth {
+            if d < len(prefix) {
+                pick = prefix[d]
+            }
+            choices = append(choices, pick)
+            options = append(options, len(runnable))
+        } else {
+            for pick < len(runnable) - 1 && runnable[pick] <= last {
+                pick++
+            }
+            if runnable[pick] <= last {
+                pick = 0
+            }
+        }
+        last = runnable[pick]
+        sched.resume[last] <- true
+        select {
+        case event := <-sched.events:
+            if event.done {
+                for j, i := range runnable {
+                    if i == event.goroutine {
+                        runnable = append(runnable[:j], runnable[j + 1:]...)
+                        break
+                    }
+                }
+            }
+        case <-time.After(5 * time.Second):
+            return results, choices, options, fmt.Errorf("goroutine %d stopped yielding", last)
+        }
+    }
+    return results, choices, options, nil
+}
+
+// calls check after every explored schedule, returns the number of schedules
+func explore(t *testing.T, setup func() *LazySkipList[int], ops []func(*LazySkipList[int]) bool,
+        check func(list *LazySkipList[int], results []bool) error, max_depth, max_runs int) int {
+    prefix := []int{}
+    for runs := 1; ; runs++ {
+        list := setup()
+        results, choices, options, err := runSchedule(list, ops, prefix, max_depth)
+        if err != nil {
+            t.Fatalf("schedule %v: %v", choices, err)
+        }
+        if err := check(list, results); err != nil {
+            var dump strings.Builder
+            list.dumpLevels(&dump, 32)
+            t.Fatalf("schedule %v: %v\n%s", choices, err, dump.String())
+        }
+        d := len(choices) - 1
+        for d >= 0 && choices[d] + 1 >= options[d] {
+            d--
+        }
+        if d < 0 || runs == max_runs {
+            return runs
+        }
+        prefix = append(choices[:d:d], choices[d] + 1)
+    }
+}
+
+func listOf(height int, keys ...int) func() *LazySkipList[int] {
+    return func() *LazySkipList[int] {
+        level_source = func(int, float32) int { return height }
+        list := newLazySkipList()
+        for _, key := range keys {
+            list.add(key)
+        }
+        return &list
+    }
+}
+
+func expectContents(want ...int) func(list *LazySkipList[int], results []bool) error {
+    return func(list *LazySkipList[int], results []bool) error {
+        for i, result := range results {
+            if !result {
+                return fmt.Errorf("operation %d failed", i)
+            }
+        }
+        if err := list.checkInvariants(); err != nil {
+            return err
+        }
+        got := []int{}
+        list.ascend(math.MinInt, math.MaxInt, func(key, item int) bool {
+            got = append(got, key)
+            return true
+        })
+        if fmt.Sprint(got) != fmt.Sprint(want) {
+            return fmt.Errorf("contents %v, want %v", got, want)
+        }
+        return nil
+    }
+}
+
+func addOp(key int) func(*LazySkipList[int]) bool {
+    return func(list *LazySkipList[int]) bool { return list.add(key) }
+}
+
+func removeOp(key int) func(*LazySkipList[int]) bool {
+    return func(list *LazySkipList[int]) bool { return list.remove(key) }
+}
+
+func TestInterleavingsRemoveSharedPredecessor(t *testing.T) {
+    defer func() { level_source = randomLevel }()
+    // 10 is the predecessor of 20 on every level
+    runs := explore(t, listOf(2, 10, 20, 30),
+        []func(*LazySkipList[int]) bool{removeOp(10), removeOp(20)},
+        expectContents(30), 12, 5000)
+    t.Log(runs, "schedules")
+}
+
+func TestInterleavingsAddBetweenRemoves(t *testing.T) {
+    defer func() { level_source = randomLevel }()
+    runs := explore(t, listOf(2, 10, 20, 30),
+        []func(*LazySkipList[int]) bool{removeOp(10), addOp(15), removeOp(20)},
+        expectContents(15, 30), 10, 20000)
+    t.Log(runs, "schedules")
+}
+
+func TestInterleavingsAddOverRemovedKey(t *testing.T) {
+    defer func() { level_source = randomLevel }()
+    runs := explore(t, listOf(3, 10, 20),
+        []func(*LazySkipList[int]) bool{removeOp(20), addOp(20), removeOp(10)},
+        func(list *LazySkipList[int], results []bool) error {
+            // add(20) either sees 20 before it is marked or re-adds it afterwards
+            want := []int{}
+            if results[1] {
+                want = append(want, 20)
+            }
+            results = []bool{results[0], true, results[2]}
+            return expectContents(want...)(list, results)
+        }, 10, 20000)
+    t.Log(runs, "schedules")
+}
+
+// the structures compared against the lazy skiplist
+type benchSet interface {
+    add(x int) bool
+    remove(x int) bool
+    contains(x int) bool
+}
+
+type syncMapSet struct {
+    m sync.Map
+}
+
+func (this *syncMapSet) add(x int) bool {
+    _, loaded := this.m.LoadOrStore(x, x)
+    return !loaded
+}
+
+func (this *syncMapSet) remove(x int) bool {
+    _, loaded := this.m.LoadAndDelete(x)
+    return loaded
+}
+
+func (this *syncMapSet) contains(x int) bool {
+    _, ok := this.m.Load(x)
+    return ok
+}
+
+type rwMapSet struct {
+    lock sync.RWMutex
+    m map[int]int
+}
+
+func (this *rwMapSet) add(x int) bool {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    if _, ok := this.m[x]; ok {
+        return false
+    }
+    this.m[x] = x
+    return true
+}
+
+func (this *rwMapSet) remove(x int) bool {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    if _, ok := this.m[x]; !ok {
+        return false
+    }
+    delete(this.m, x)
+    return true
+}
+
+func (this *rwMapSet) contains(x int) bool {
+    this.lock.RLock()
+    defer this.lock.RUnlock()
+    _, ok := this.m[x]
+    return ok
+}
+
+var implementations = []struct {
+    name string
+    build func() benchSet
+}{
+    {"lazyskiplist", func() benchSet { list := newLazySkipList(); return &list }},
+    {"deterministic", func() benchSet { return newDeterministicSkipList(cmp.Compare[int]) }},
+    {"biased", func() benchSet { return newBiasedSkipList(cmp.Compare[int]) }},
+    {"groupcommit", func() benchSet { list := newLazySkipList(); return newGroupCommitter(&list, 2, 64) }},
+    {"flatcombining", func() benchSet { return newFlatCombiningList(cmp.Compare[int]) }},
+    {"elimination", func() benchSet { return newFlatCombiningList(cmp.Compare[int], withElimination()) }},
+    {"syncmap", func() benchSet { return &syncMapSet{} }},
+    {"rwmutexmap", func() benchSet { return &rwMapSet{m: make(map[int]int)} }}}
+
+func prefilled(set benchSet, key_range int) benchSet {
+    for i := 0; i < key_range; i += 2 {
+        set.add(i)
+    }
+    return set
+}
+
+func runMix(set benchSet, mix workload, i int, ops int) {
+    next := mix.generator(i, OP_CONTAINS)
+    for j := 0; j < ops; j++ {
+        switch key, op := next(); op {
+        case OP_CONTAINS:
+            set.contains(key)
+        case OP_ADD:
+            set.add(key)
+        default:
+            set.remove(key)
+        }
+    }
+}
+
+func benchmarkMixes(b *testing.B, build func() benchSet) {
+    for _, mix := range mixes {
+        for _, num_threads := range []int{1, 4, 16, 64} {
+            mix, num_threads := mix, num_threads
+            b.Run(fmt.Sprintf("%s/goroutines-%d", mix.name, num_threads), func(b *testing.B) {
+                set := prefilled(build(), BENCH_KEYS)
+                b.ReportAllocs()
+                b.ResetTimer()
+                var wg sync.WaitGroup
+                for i := 0; i < num_threads; i++ {
+                    ops := b.N / num_threads
+                    if i == 0 {
+                        ops += b.N % num_threads
+                    }
+                    wg.Add(1)
+                    go func(i int, ops int) {
+                        defer wg.Done()
+                        runMix(set, mix.workload, i, ops)
+                    }(i, ops)
+                }
+                wg.Wait()
+            })
+        }
+    }
+}
+
+func BenchmarkLazySkipList(b *testing.B) {
+    benchmarkMixes(b, implementations[0].build)
+}
+
+/**
+same workloads against the standard library alternatives, run with
+go test -run NONE -bench Compare -count 10 lazyskiplist.go lazyskiplist_test.go | benchstat -col /impl -
+**/
+func BenchmarkCompare(b *testing.B) {
+    for _, impl := range implementations {
+        impl := impl
+        b.Run("impl=" + impl.name, func(b *testing.B) {
+            benchmarkMixes(b, impl.build)
+        })
+    }
+}
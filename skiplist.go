@@ -62,11 +62,11 @@ func (this *SkipList) find(key int) (int, []*Node, []*Node) {
     
     for l := MAX_LEVEL - 1; l >= 0; l-- {
         curr := pred.next[l]
-        for key > curr.key {
+        for curr != this.tail && key > curr.key {
             pred = curr
             curr = pred.next[l]
         }
-        if layer_found == -1 && key == curr.key {
+        if layer_found == -1 && curr != this.tail && key == curr.key {
             layer_found = l
         }
         preds[l] = pred
@@ -0,0 +1,86 @@
+package main
+import "testing"
+import "math/rand"
+import "sort"
+import "fmt"
+
+/**
+go test skiplist.go skiplist_test.go
+go test -run NONE -bench . -benchmem skiplist.go skiplist_test.go
+go test -run NONE -fuzz FuzzSkipList skiplist.go skiplist_test.go
+**/
+
+const BENCH_KEYS int = 1 << 16
+
+func prefilledSkipList(key_range int) *SkipList {
+    list := newSkipList()
+    for i := 0; i < key_range; i += 2 {
+        list.add(i)
+    }
+    return &list
+}
+
+func BenchmarkSkipList(b *testing.B) {
+    ops := map[string]func(list *SkipList, key int) bool{
+        "add": (*SkipList).add,
+        "contains": (*SkipList).contains,
+        "remove": (*SkipList).remove}
+    for _, name := range []string{"add", "contains", "remove"} {
+        op := ops[name]
+        b.Run(name, func(b *testing.B) {
+            list := prefilledSkipList(BENCH_KEYS)
+            rng := rand.New(rand.NewSource(1))
+            b.ReportAllocs()
+            b.ResetTimer()
+            for i := 0; i < b.N; i++ {
+                op(list, rng.Intn(BENCH_KEYS))
+            }
+        })
+    }
+}
+
+/**
+every 3 bytes of input are one operation: the first selects add(),
+remove() or contains(), the next two are a signed 16-bit key. results are
+diffed against a map and the final contents against a sorted slice
+**/
+func FuzzSkipList(f *testing.F) {
+    f.Add([]byte{0, 0, 1, 0, 0, 1, 1, 0, 1, 1, 0, 1})
+    f.Add([]byte{0, 0x7f, 0xff, 0, 0x80, 0x00, 2, 0x7f, 0xff, 1, 0x80, 0x00})
+    f.Add([]byte{0, 0xfc, 0x19, 0, 0xfc, 0x18, 1, 0xfc, 0x19, 2, 0xfc, 0x18})
+    f.Fuzz(func(t *testing.T, data []byte) {
+        list := newSkipList()
+        model := map[int]bool{}
+        for i := 0; i + 2 < len(data); i += 3 {
+            key := int(int16(uint16(data[i + 1]) << 8 | uint16(data[i + 2])))
+            switch data[i] % 3 {
+            case 0:
+                if got, want := list.add(key), !model[key]; got != want {
+                    t.Fatalf("op %d: add(%d) = %v, want %v", i / 3, key, got, want)
+                }
+                model[key] = true
+            case 1:
+                if got, want := list.remove(key), model[key]; got != want {
+                    t.Fatalf("op %d: remove(%d) = %v, want %v", i / 3, key, got, want)
+                }
+                delete(model, key)
+            case 2:
+                if got, want := list.contains(key), model[key]; got != want {
+                    t.Fatalf("op %d: contains(%d) = %v, want %v", i / 3, key, got, want)
+                }
+            }
+        }
+        want := []int{}
+        for key := range model {
+            want = append(want, key)
+        }
+        sort.Ints(want)
+        got := []int{}
+        for curr := list.head.next[0]; curr != list.tail; curr = curr.next[0] {
+            got = append(got, curr.key)
+        }
+        if fmt.Sprint(got) != fmt.Sprint(want) {
+            t.Fatalf("contents %v, want %v", got, want)
+        }
+    })
+}